@@ -1,32 +1,69 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 type AttachDisk struct {
-	vmFinder   bwcvm.Finder
-	diskFinder bwcdisk.Finder
+	vmFinder    bwcvm.Finder
+	diskFinder  bwcdisk.Finder
+	lockManager bwcutil.LockManager
+	inventory   bwcinv.Store
+	journal     bwcinv.Journal
+	timeService bwcutil.TimeService
+	apiVersion  int
 }
 
-func NewAttachDisk(vmFinder bwcvm.Finder, diskFinder bwcdisk.Finder) AttachDisk {
+func NewAttachDisk(
+	vmFinder bwcvm.Finder,
+	diskFinder bwcdisk.Finder,
+	lockManager bwcutil.LockManager,
+	inventory bwcinv.Store,
+	journal bwcinv.Journal,
+	timeService bwcutil.TimeService,
+	apiVersion int,
+) AttachDisk {
 	return AttachDisk{
-		vmFinder:   vmFinder,
-		diskFinder: diskFinder,
+		vmFinder:    vmFinder,
+		diskFinder:  diskFinder,
+		lockManager: lockManager,
+		inventory:   inventory,
+		journal:     journal,
+		timeService: timeService,
+		apiVersion:  apiVersion,
 	}
 }
 
-func (a AttachDisk) Run(vmCID VMCID, diskCID DiskCID) (interface{}, error) {
-	vm, found, err := a.vmFinder.Find(string(vmCID))
+// Run returns nothing, or with API version 2 and above, disk hint
+func (a AttachDisk) Run(ctx context.Context, vmCID VMCID, diskCID DiskCID) (interface{}, error) {
+	// Agent env is updated with read-modify-write so concurrent changes to the same VM would be lost
+	lock, err := lockVMWithIntent(ctx, a.lockManager, a.journal, string(vmCID), string(diskCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Locking VM '%s' and disk '%s'", vmCID, diskCID)
+	}
+
+	defer lock.Unlock()
+
+	err = recoverIntent(ctx, a.journal, a.vmFinder, a.diskFinder, a.inventory, string(vmCID))
+	if err != nil {
+		return nil, err
+	}
+
+	vm, found, err := a.vmFinder.Find(ctx, string(vmCID))
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Finding VM '%s'", vmCID)
 	}
 
 	if !found {
-		return nil, bosherr.New("Expected to find VM '%s'", vmCID)
+		return nil, bwcapi.NewVMNotFoundError(string(vmCID))
 	}
 
 	disk, found, err := a.diskFinder.Find(string(diskCID))
@@ -35,13 +72,40 @@ func (a AttachDisk) Run(vmCID VMCID, diskCID DiskCID) (interface{}, error) {
 	}
 
 	if !found {
-		return nil, bosherr.New("Expected to find disk '%s'", diskCID)
+		return nil, bwcapi.NewDiskNotFoundError(string(diskCID))
 	}
 
-	err = vm.AttachDisk(disk)
+	intent := bwcinv.Intent{
+		VMCID:     string(vmCID),
+		Op:        bwcinv.IntentOpAttachDisk,
+		DiskCID:   string(diskCID),
+		StartedAt: a.timeService.Now(),
+	}
+
+	err = a.journal.Begin(intent)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Recording intent to attach disk '%s' to VM '%s'", diskCID, vmCID)
+	}
+
+	// Intent is left unfinished on failure so that next invocation rolls back partial attach
+	diskHint, err := vm.AttachDisk(ctx, disk)
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Attaching disk '%s' to VM '%s'", diskCID, vmCID)
 	}
 
+	err = recordDiskAttachment(a.inventory, string(vmCID), string(diskCID), true)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Recording disk '%s' attachment to VM '%s'", diskCID, vmCID)
+	}
+
+	err = a.journal.Finish(string(vmCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Finishing intent to attach disk '%s' to VM '%s'", diskCID, vmCID)
+	}
+
+	if a.apiVersion >= 2 {
+		return diskHint, nil
+	}
+
 	return nil, nil
 }
@@ -1,27 +1,44 @@
 package action_test
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	fakedisk "github.com/cppforlife/bosh-warden-cpi/disk/fakes"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
 
 var _ = Describe("AttachDisk", func() {
 	var (
-		vmFinder   *fakevm.FakeFinder
-		diskFinder *fakedisk.FakeFinder
-		action     AttachDisk
+		vmFinder    *fakevm.FakeFinder
+		diskFinder  *fakedisk.FakeFinder
+		lockManager *fakeutil.FakeLockManager
+		inventory   *fakeinv.FakeStore
+		journal     *fakeinv.FakeJournal
+		timeService bwcutil.TimeService
+		now         time.Time
+		action      AttachDisk
 	)
 
 	BeforeEach(func() {
 		vmFinder = &fakevm.FakeFinder{}
 		diskFinder = &fakedisk.FakeFinder{}
-		action = NewAttachDisk(vmFinder, diskFinder)
+		lockManager = fakeutil.NewFakeLockManager()
+		inventory = fakeinv.NewFakeStore()
+		journal = fakeinv.NewFakeJournal()
+		now = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
+		timeService = fakeutil.NewFakeTimeService(now)
+		action = NewAttachDisk(vmFinder, diskFinder, lockManager, inventory, journal, timeService, 1)
 	})
 
 	Describe("Run", func() {
@@ -32,12 +49,37 @@ var _ = Describe("AttachDisk", func() {
 			diskFinder.FindFound = true
 			diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
 
-			_, err := action.Run("fake-vm-id", "fake-disk-id")
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(vmFinder.FindID).To(Equal("fake-vm-id"))
 		})
 
+		It("locks VM and disk while running and unlocks them afterwards", func() {
+			vmFinder.FindFound = true
+			vmFinder.FindVM = fakevm.NewFakeVM("fake-vm-id")
+
+			diskFinder.FindFound = true
+			diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
+
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(lockManager.LockKeys).To(Equal([]string{"vm-fake-vm-id", "disk-fake-disk-id"}))
+			Expect(lockManager.LockLock.Locked).To(BeTrue())
+			Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+		})
+
+		It("returns error without finding VM if locking fails", func() {
+			lockManager.LockErr = errors.New("fake-lock-err")
+
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-lock-err"))
+
+			Expect(vmFinder.FindID).To(BeEmpty())
+		})
+
 		Context("when VM is found with given VM cid", func() {
 			var (
 				vm *fakevm.FakeVM
@@ -52,7 +94,7 @@ var _ = Describe("AttachDisk", func() {
 			It("tries to find disk with given disk cid", func() {
 				diskFinder.FindFound = true
 
-				_, err := action.Run("fake-vm-id", "fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(diskFinder.FindID).To(Equal("fake-disk-id"))
@@ -70,16 +112,29 @@ var _ = Describe("AttachDisk", func() {
 				})
 
 				It("does not return error when attaching found disk to found VM succeeds", func() {
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
+					vm.AttachDiskDiskHint = "fake-disk-hint"
+
+					result, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 					Expect(err).ToNot(HaveOccurred())
+					Expect(result).To(BeNil())
 
 					Expect(vm.AttachDiskDisk).To(Equal(disk))
 				})
 
+				It("returns disk hint when using API version 2", func() {
+					action = NewAttachDisk(vmFinder, diskFinder, lockManager, inventory, journal, timeService, 2)
+
+					vm.AttachDiskDiskHint = "fake-disk-hint"
+
+					result, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(result).To(Equal("fake-disk-hint"))
+				})
+
 				It("returns error if attaching disk fails", func() {
 					vm.AttachDiskErr = errors.New("fake-attach-disk-err")
 
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-attach-disk-err"))
 				})
@@ -89,9 +144,8 @@ var _ = Describe("AttachDisk", func() {
 				It("returns error", func() {
 					diskFinder.FindFound = false
 
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
-					Expect(err).To(HaveOccurred())
-					Expect(err.Error()).To(ContainSubstring("Expected to find disk"))
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(Equal(bwcapi.NewDiskNotFoundError("fake-disk-id")))
 				})
 			})
 
@@ -99,7 +153,7 @@ var _ = Describe("AttachDisk", func() {
 				It("returns error", func() {
 					diskFinder.FindErr = errors.New("fake-find-err")
 
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 				})
@@ -110,9 +164,8 @@ var _ = Describe("AttachDisk", func() {
 			It("returns error because disk can only be attached to an existing VM", func() {
 				vmFinder.FindFound = false
 
-				_, err := action.Run("fake-vm-id", "fake-disk-id")
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(ContainSubstring("Expected to find VM"))
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(Equal(bwcapi.NewVMNotFoundError("fake-vm-id")))
 			})
 		})
 
@@ -120,10 +173,186 @@ var _ = Describe("AttachDisk", func() {
 			It("returns error because disk can only be attached to an existing VM", func() {
 				vmFinder.FindErr = errors.New("fake-find-err")
 
-				_, err := action.Run("fake-vm-id", "fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 			})
 		})
+
+		Context("when disk is attached", func() {
+			BeforeEach(func() {
+				vmFinder.FindFound = true
+				vmFinder.FindVM = fakevm.NewFakeVM("fake-vm-id")
+
+				diskFinder.FindFound = true
+				diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
+			})
+
+			It("records attachment in VM and disk records", func() {
+				inventory.VMs["fake-vm-id"] = bwcinv.VMRecord{CID: "fake-vm-id", AgentID: "fake-agent-id"}
+				inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id", SizeMB: 20}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(inventory.VMs["fake-vm-id"]).To(Equal(bwcinv.VMRecord{
+					CID:      "fake-vm-id",
+					AgentID:  "fake-agent-id",
+					DiskCIDs: []string{"fake-disk-id"},
+				}))
+
+				Expect(inventory.Disks["fake-disk-id"]).To(Equal(bwcinv.DiskRecord{
+					CID:    "fake-disk-id",
+					SizeMB: 20,
+					VMCID:  "fake-vm-id",
+				}))
+			})
+
+			It("creates missing records for VM and disk created before inventory existed", func() {
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(inventory.VMs["fake-vm-id"].DiskCIDs).To(Equal([]string{"fake-disk-id"}))
+				Expect(inventory.Disks["fake-disk-id"].VMCID).To(Equal("fake-vm-id"))
+			})
+
+			It("returns error if recording attachment fails", func() {
+				inventory.SaveDiskErr = errors.New("fake-save-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-save-err"))
+			})
+		})
+
+		It("does not record attachment if attaching fails", func() {
+			vm := fakevm.NewFakeVM("fake-vm-id")
+			vm.AttachDiskErr = errors.New("fake-attach-err")
+			vmFinder.FindFound = true
+			vmFinder.FindVM = vm
+
+			diskFinder.FindFound = true
+			diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
+
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+
+			Expect(inventory.VMs).To(BeEmpty())
+			Expect(inventory.Disks).To(BeEmpty())
+		})
+
+		Describe("intent journal", func() {
+			var (
+				vm   *fakevm.FakeVM
+				disk *fakedisk.FakeDisk
+			)
+
+			BeforeEach(func() {
+				vm = fakevm.NewFakeVM("fake-vm-id")
+				vmFinder.FindFound = true
+				vmFinder.FindVM = vm
+
+				disk = fakedisk.NewFakeDisk("fake-disk-id")
+				diskFinder.FindFound = true
+				diskFinder.FindDisk = disk
+			})
+
+			It("records intent before attaching and finishes it afterwards", func() {
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(journal.BegunIntents).To(Equal([]bwcinv.Intent{{
+					VMCID:     "fake-vm-id",
+					Op:        bwcinv.IntentOpAttachDisk,
+					DiskCID:   "fake-disk-id",
+					StartedAt: now,
+				}}))
+
+				Expect(journal.Intents).To(BeEmpty())
+			})
+
+			It("returns error without attaching if recording intent fails", func() {
+				journal.BeginErr = errors.New("fake-begin-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-begin-err"))
+
+				Expect(vm.AttachDiskDisk).To(BeNil())
+			})
+
+			It("leaves intent unfinished if attaching fails so that it is rolled back later", func() {
+				vm.AttachDiskErr = errors.New("fake-attach-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+
+				Expect(journal.Intents).To(HaveKey("fake-vm-id"))
+			})
+
+			It("returns error if finishing intent fails", func() {
+				journal.FinishErr = errors.New("fake-finish-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-finish-err"))
+			})
+
+			Context("when previous attach to the VM did not finish", func() {
+				BeforeEach(func() {
+					journal.Intents["fake-vm-id"] = bwcinv.Intent{
+						VMCID:   "fake-vm-id",
+						Op:      bwcinv.IntentOpAttachDisk,
+						DiskCID: "fake-disk-id",
+					}
+
+					inventory.VMs["fake-vm-id"] = bwcinv.VMRecord{CID: "fake-vm-id", DiskCIDs: []string{"fake-disk-id"}}
+				})
+
+				It("rolls back previous attach before attaching again", func() {
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(vm.DetachDiskDisk).To(Equal(disk))
+					Expect(journal.FinishedCIDs).To(Equal([]string{"fake-vm-id", "fake-vm-id"}))
+
+					Expect(vm.AttachDiskDisk).To(Equal(disk))
+					Expect(inventory.VMs["fake-vm-id"].DiskCIDs).To(Equal([]string{"fake-disk-id"}))
+				})
+
+				It("returns error without attaching if rolling back fails", func() {
+					vm.DetachDiskErr = errors.New("fake-detach-err")
+
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("Recovering unfinished 'attach_disk' operation on VM 'fake-vm-id'"))
+					Expect(err.Error()).To(ContainSubstring("fake-detach-err"))
+
+					Expect(vm.AttachDiskDisk).To(BeNil())
+					Expect(journal.Intents).To(HaveKey("fake-vm-id"))
+				})
+
+				It("only updates records if VM no longer exists", func() {
+					vmFinder.FindFound = false
+
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(Equal(bwcapi.NewVMNotFoundError("fake-vm-id")))
+
+					Expect(vm.DetachDiskDisk).To(BeNil())
+					Expect(inventory.VMs["fake-vm-id"].DiskCIDs).To(BeEmpty())
+					Expect(journal.Intents).To(BeEmpty())
+				})
+			})
+
+			It("returns error if finding unfinished operation fails", func() {
+				journal.FindErr = errors.New("fake-find-intent-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-find-intent-err"))
+
+				Expect(vm.AttachDiskDisk).To(BeNil())
+			})
+		})
 	})
 })
@@ -1,14 +1,14 @@
 package action
 
 import (
-	wrdnclient "github.com/cloudfoundry-incubator/garden/client"
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
-	boshcmd "github.com/cloudfoundry/bosh-agent/platform/commands"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
 	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
 	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
@@ -19,31 +19,60 @@ type concreteFactory struct {
 }
 
 func NewConcreteFactory(
-	wardenClient wrdnclient.Client,
+	wardenClient bwcvm.WardenClient,
 	fs boshsys.FileSystem,
 	cmdRunner boshsys.CmdRunner,
 	uuidGen boshuuid.Generator,
-	compressor boshcmd.Compressor,
+	stemcellExtractor bwcstem.Extractor,
 	sleeper bwcutil.Sleeper,
+	timeService bwcutil.TimeService,
+	requestContext bwcapi.RequestContext,
 	options ConcreteFactoryOptions,
 	logger boshlog.Logger,
 ) concreteFactory {
+	inventory := bwcinv.NewFSStore(options.StateDirOrDefault(), fs, uuidGen, logger)
+	journal := bwcinv.NewFSJournal(options.StateDirOrDefault(), fs, uuidGen, logger)
+
 	stemcellImporter := bwcstem.NewFSImporter(
 		options.StemcellsDir,
+		options.StemcellRootFSDirs,
 		fs,
 		uuidGen,
-		compressor,
+		stemcellExtractor,
+		timeService,
 		logger,
 	)
 
 	stemcellFinder := bwcstem.NewFSFinder(options.StemcellsDir, fs, logger)
 
+	lockManager := bwcutil.NewFileLockManager(
+		options.LocksDirOrDefault(),
+		options.LockTimeoutOrDefault(),
+		sleeper,
+		timeService,
+		fs,
+		logger,
+	)
+
+	stemcellUsageChecker := bwcvm.NewWardenStemcellUsageChecker(wardenClient, logger)
+
+	stemcellDeleter := bwcstem.NewFSDeferredDeleter(
+		options.StemcellsDir,
+		stemcellUsageChecker,
+		lockManager,
+		fs,
+		logger,
+	)
+
 	hostBindMounts := bwcvm.NewFSHostBindMounts(
 		options.HostEphemeralBindMountsDir,
 		options.HostPersistentBindMountsDir,
 		sleeper,
 		fs,
-		cmdRunner,
+		bwcvm.NewMounter(options.Mounter, fs, cmdRunner, logger),
+		bwcvm.NewProcMountTable(fs, logger),
+		bwcvm.NewProcMountUsers(fs, logger),
+		options.UnmountRetry.Policy(),
 		logger,
 	)
 
@@ -64,6 +93,7 @@ func NewConcreteFactory(
 		hostBindMounts,
 		guestBindMounts,
 		options.Agent,
+		requestContext,
 		logger,
 	)
 
@@ -72,6 +102,7 @@ func NewConcreteFactory(
 		agentEnvServiceFactory,
 		hostBindMounts,
 		guestBindMounts,
+		options.FindUntaggedContainers,
 		logger,
 	)
 
@@ -87,23 +118,25 @@ func NewConcreteFactory(
 
 	return concreteFactory{
 		availableActions: map[string]Action{
+			"info": NewInfo(),
+
 			// Stemcell management
-			"create_stemcell": NewCreateStemcell(stemcellImporter),
-			"delete_stemcell": NewDeleteStemcell(stemcellFinder),
+			"create_stemcell": NewCreateStemcell(stemcellImporter, inventory, timeService),
+			"delete_stemcell": NewDeleteStemcell(stemcellFinder, stemcellDeleter, inventory),
 
 			// VM management
-			"create_vm":          NewCreateVM(stemcellFinder, vmCreator),
-			"delete_vm":          NewDeleteVM(vmFinder, hostBindMounts),
+			"create_vm":          NewCreateVM(stemcellFinder, vmCreator, lockManager, inventory, timeService, requestContext.APIVersion),
+			"delete_vm":          NewDeleteVM(vmFinder, diskFinder, hostBindMounts, stemcellDeleter, lockManager, inventory, journal, timeService),
 			"has_vm":             NewHasVM(vmFinder),
-			"reboot_vm":          NewRebootVM(),
-			"set_vm_metadata":    NewSetVMMetadata(),
+			"reboot_vm":          NewRebootVM(vmFinder),
+			"set_vm_metadata":    NewSetVMMetadata(vmFinder),
 			"configure_networks": NewConfigureNetworks(),
 
 			// Disk management
-			"create_disk": NewCreateDisk(diskCreator),
-			"delete_disk": NewDeleteDisk(diskFinder),
-			"attach_disk": NewAttachDisk(vmFinder, diskFinder),
-			"detach_disk": NewDetachDisk(vmFinder, diskFinder),
+			"create_disk": NewCreateDisk(diskCreator, inventory, timeService),
+			"delete_disk": NewDeleteDisk(diskFinder, lockManager, inventory),
+			"attach_disk": NewAttachDisk(vmFinder, diskFinder, lockManager, inventory, journal, timeService, requestContext.APIVersion),
+			"detach_disk": NewDetachDisk(vmFinder, diskFinder, lockManager, inventory, journal, timeService),
 
 			// Not implemented:
 			//   current_vm_id
@@ -1,6 +1,9 @@
 package action
 
 import (
+	"path/filepath"
+	"time"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
@@ -10,18 +13,50 @@ type ConcreteFactoryOptions struct {
 	StemcellsDir string
 	DisksDir     string
 
+	// Optional; directories inside which already unpacked root filesystems
+	// can be used as stemcells via rootfs_dir stemcell cloud property;
+	// none are allowed by default
+	StemcellRootFSDirs []string
+
+	// Optional; directory with records of VMs, disks and stemcells created by the CPI
+	// and intents of operations in progress; should be on persistent storage.
+	// Defaults to a "state" directory next to DisksDir.
+	StateDir string
+
 	HostEphemeralBindMountsDir  string // e.g. /var/vcap/store/ephemeral_disks
 	HostPersistentBindMountsDir string // e.g. /var/vcap/store/persistent_disks
 
 	GuestEphemeralBindMountPath  string // e.g. /var/vcap/data
 	GuestPersistentBindMountsDir string // e.g. /warden-cpi-dev
 
+	// Optional; whether to also find containers created before the CPI tagged them
+	// with VM ID, which requires listing all containers when a tagged one is not found
+	FindUntaggedContainers bool
+
 	Agent bwcvm.AgentOptions
 
 	AgentEnvService string
 	Registry        bwcvm.RegistryOptions
+
+	// Optional; how disks and bind mounts are mounted on the host:
+	// "native" (default) uses mount syscalls and loop device ioctls,
+	// "command" runs mount, umount and losetup
+	Mounter string
+
+	// Optional; how unmounting of busy disks is retried
+	UnmountRetry bwcvm.UnmountRetryOptions
+
+	// Optional; directory shared by CPI processes on the host to lock VMs, disks and stemcells;
+	// must be owned by CPI's user. Defaults to a "locks" directory in StateDir.
+	LocksDir string
+
+	// Optional; how long to wait for another CPI process working on the same VM or disk,
+	// e.g. 10m; defaults to 5m
+	LockTimeout string
 }
 
+const defaultLockTimeout = 5 * time.Minute
+
 func (o ConcreteFactoryOptions) Validate() error {
 	if o.StemcellsDir == "" {
 		return bosherr.New("Must provide non-empty StemcellsDir")
@@ -52,5 +87,54 @@ func (o ConcreteFactoryOptions) Validate() error {
 		return bosherr.WrapError(err, "Validating Agent configuration")
 	}
 
+	err = o.UnmountRetry.Validate()
+	if err != nil {
+		return bosherr.WrapError(err, "Validating UnmountRetry configuration")
+	}
+
+	switch o.Mounter {
+	case "", bwcvm.NativeMounterName, bwcvm.CmdMounterName:
+	default:
+		return bosherr.New("Must provide Mounter '%s' or '%s'", bwcvm.NativeMounterName, bwcvm.CmdMounterName)
+	}
+
+	if o.LockTimeout != "" {
+		timeout, err := time.ParseDuration(o.LockTimeout)
+		if err != nil {
+			return bosherr.WrapError(err, "Parsing LockTimeout")
+		}
+
+		if timeout <= 0 {
+			return bosherr.New("Must provide positive LockTimeout")
+		}
+	}
+
 	return nil
 }
+
+func (o ConcreteFactoryOptions) StateDirOrDefault() string {
+	if o.StateDir == "" {
+		return filepath.Join(filepath.Dir(filepath.Clean(o.DisksDir)), "state")
+	}
+
+	return o.StateDir
+}
+
+func (o ConcreteFactoryOptions) LocksDirOrDefault() string {
+	if o.LocksDir == "" {
+		return filepath.Join(o.StateDirOrDefault(), "locks")
+	}
+
+	return o.LocksDir
+}
+
+func (o ConcreteFactoryOptions) LockTimeoutOrDefault() time.Duration {
+	if o.LockTimeout == "" {
+		return defaultLockTimeout
+	}
+
+	// Timeout is already validated
+	timeout, _ := time.ParseDuration(o.LockTimeout)
+
+	return timeout
+}
@@ -1,6 +1,8 @@
 package action_test
 
 import (
+	"time"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -15,6 +17,7 @@ var _ = Describe("ConcreteFactoryOptions", func() {
 		validOptions = ConcreteFactoryOptions{
 			StemcellsDir: "/tmp/stemcells",
 			DisksDir:     "/tmp/disks",
+			StateDir:     "/tmp/state",
 
 			HostEphemeralBindMountsDir:  "/tmp/host-ephemeral-bind-mounts-dir",
 			HostPersistentBindMountsDir: "/tmp/host-persistent-bind-mounts-dir",
@@ -51,6 +54,13 @@ var _ = Describe("ConcreteFactoryOptions", func() {
 			Expect(err.Error()).To(ContainSubstring("Must provide non-empty StemcellsDir"))
 		})
 
+		It("does not return error if StateDir is empty so that existing configurations keep working", func() {
+			options.StateDir = ""
+
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
 		It("returns error if DisksDir is empty", func() {
 			options.DisksDir = ""
 
@@ -102,5 +112,92 @@ var _ = Describe("ConcreteFactoryOptions", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("Validating Agent configuration"))
 		})
+
+		It("returns error if unmount retry section is not valid", func() {
+			options.UnmountRetry.Backoff = "fake-backoff"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating UnmountRetry configuration"))
+		})
+
+		It("returns error if Mounter is not known", func() {
+			options.Mounter = "fake-mounter"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must provide Mounter 'native' or 'command'"))
+		})
+
+		It("does not return error if Mounter is command", func() {
+			options.Mounter = "command"
+
+			err := options.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if LockTimeout cannot be parsed", func() {
+			options.LockTimeout = "fake-timeout"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing LockTimeout"))
+		})
+
+		It("returns error if LockTimeout is not positive", func() {
+			options.LockTimeout = "0s"
+
+			err := options.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must provide positive LockTimeout"))
+		})
+	})
+
+	Describe("StateDirOrDefault", func() {
+		BeforeEach(func() {
+			options = validOptions
+		})
+
+		It("returns configured directory", func() {
+			options.StateDir = "/fake-state-dir"
+			Expect(options.StateDirOrDefault()).To(Equal("/fake-state-dir"))
+		})
+
+		It("defaults to directory next to disks directory", func() {
+			options.StateDir = ""
+			options.DisksDir = "/fake-store/disks/"
+			Expect(options.StateDirOrDefault()).To(Equal("/fake-store/state"))
+		})
+	})
+
+	Describe("LocksDirOrDefault", func() {
+		BeforeEach(func() {
+			options = validOptions
+		})
+
+		It("returns configured directory", func() {
+			options.LocksDir = "/fake-locks-dir"
+			Expect(options.LocksDirOrDefault()).To(Equal("/fake-locks-dir"))
+		})
+
+		It("defaults to directory in state directory", func() {
+			options.StateDir = "/fake-state-dir"
+			Expect(options.LocksDirOrDefault()).To(Equal("/fake-state-dir/locks"))
+		})
+	})
+
+	Describe("LockTimeoutOrDefault", func() {
+		BeforeEach(func() {
+			options = validOptions
+		})
+
+		It("returns configured timeout", func() {
+			options.LockTimeout = "10m"
+			Expect(options.LockTimeoutOrDefault()).To(Equal(10 * time.Minute))
+		})
+
+		It("defaults to 5 minutes", func() {
+			Expect(options.LockTimeoutOrDefault()).To(Equal(5 * time.Minute))
+		})
 	})
 })
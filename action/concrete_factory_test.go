@@ -1,34 +1,48 @@
 package action_test
 
 import (
+	"time"
+
 	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
-	fakecmd "github.com/cloudfoundry/bosh-agent/platform/commands/fakes"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
 	fakeuuid "github.com/cloudfoundry/bosh-agent/uuid/fakes"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
 	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 var _ = Describe("concreteFactory", func() {
 	var (
-		wardenClient *fakewrdnclient.FakeClient
-		fs           *fakesys.FakeFileSystem
-		cmdRunner    *fakesys.FakeCmdRunner
-		uuidGen      *fakeuuid.FakeGenerator
-		compressor   *fakecmd.FakeCompressor
-		sleeper      bwcutil.Sleeper
-		logger       boshlog.Logger
+		wardenClient      bwcvm.WardenClient
+		fs                *fakesys.FakeFileSystem
+		cmdRunner         *fakesys.FakeCmdRunner
+		uuidGen           *fakeuuid.FakeGenerator
+		stemcellExtractor *fakestem.FakeExtractor
+		sleeper           bwcutil.Sleeper
+		timeService       bwcutil.TimeService
+		logger            boshlog.Logger
+
+		requestContext = bwcapi.RequestContext{
+			DirectorUUID: "fake-director-uuid",
+			RequestID:    "fake-request-id",
+			APIVersion:   2,
+		}
 
 		options = ConcreteFactoryOptions{
 			StemcellsDir: "/tmp/stemcells",
 			DisksDir:     "/tmp/disks",
+			StateDir:     "/tmp/state",
+
+			StemcellRootFSDirs: []string{"/tmp/rootfs-dirs"},
 
 			HostEphemeralBindMountsDir:  "/tmp/host-ephemeral-bind-mounts-dir",
 			HostPersistentBindMountsDir: "/tmp/host-persistent-bind-mounts-dir",
@@ -43,6 +57,9 @@ var _ = Describe("concreteFactory", func() {
 				Host:     "fake-host",
 				Port:     1234,
 			},
+
+			LocksDir:    "/tmp/locks",
+			LockTimeout: "1m",
 		}
 
 		factory Factory
@@ -55,39 +72,52 @@ var _ = Describe("concreteFactory", func() {
 		hostBindMounts  bwcvm.FSHostBindMounts
 		guestBindMounts bwcvm.FSGuestBindMounts
 
-		stemcellFinder bwcstem.Finder
-		vmFinder       bwcvm.Finder
-		diskFinder     bwcdisk.Finder
+		stemcellFinder  bwcstem.Finder
+		stemcellDeleter bwcstem.DeferredDeleter
+		vmFinder        bwcvm.Finder
+		diskFinder      bwcdisk.Finder
+		lockManager     bwcutil.LockManager
+		inventory       bwcinv.Store
+		journal         bwcinv.Journal
 	)
 
 	BeforeEach(func() {
-		wardenClient = fakewrdnclient.New()
 		fs = fakesys.NewFakeFileSystem()
 		cmdRunner = fakesys.NewFakeCmdRunner()
 		uuidGen = &fakeuuid.FakeGenerator{}
-		compressor = fakecmd.NewFakeCompressor()
+		stemcellExtractor = &fakestem.FakeExtractor{}
 		sleeper = bwcutil.RealSleeper{}
+		timeService = bwcutil.RealTimeService{}
 		logger = boshlog.NewLogger(boshlog.LevelNone)
+		wardenClient = bwcvm.NewCancellableWardenClient(fakewrdnclient.New(), logger)
 
 		factory = NewConcreteFactory(
 			wardenClient,
 			fs,
 			cmdRunner,
 			uuidGen,
-			compressor,
+			stemcellExtractor,
 			sleeper,
+			timeService,
+			requestContext,
 			options,
 			logger,
 		)
 	})
 
 	BeforeEach(func() {
+		inventory = bwcinv.NewFSStore("/tmp/state", fs, uuidGen, logger)
+		journal = bwcinv.NewFSJournal("/tmp/state", fs, uuidGen, logger)
+
 		hostBindMounts = bwcvm.NewFSHostBindMounts(
 			"/tmp/host-ephemeral-bind-mounts-dir",
 			"/tmp/host-persistent-bind-mounts-dir",
 			sleeper,
 			fs,
-			cmdRunner,
+			bwcvm.NewMounter(options.Mounter, fs, cmdRunner, logger),
+			bwcvm.NewProcMountTable(fs, logger),
+			bwcvm.NewProcMountUsers(fs, logger),
+			options.UnmountRetry.Policy(),
 			logger,
 		)
 
@@ -102,11 +132,29 @@ var _ = Describe("concreteFactory", func() {
 
 		stemcellFinder = bwcstem.NewFSFinder("/tmp/stemcells", fs, logger)
 
+		lockManager = bwcutil.NewFileLockManager(
+			"/tmp/locks",
+			1*time.Minute,
+			sleeper,
+			timeService,
+			fs,
+			logger,
+		)
+
+		stemcellDeleter = bwcstem.NewFSDeferredDeleter(
+			"/tmp/stemcells",
+			bwcvm.NewWardenStemcellUsageChecker(wardenClient, logger),
+			lockManager,
+			fs,
+			logger,
+		)
+
 		vmFinder = bwcvm.NewWardenFinder(
 			wardenClient,
 			agentEnvServiceFactory,
 			hostBindMounts,
 			guestBindMounts,
+			options.FindUntaggedContainers,
 			logger,
 		)
 
@@ -119,24 +167,32 @@ var _ = Describe("concreteFactory", func() {
 		Expect(action).To(BeNil())
 	})
 
+	It("info", func() {
+		action, err := factory.Create("info")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(action).To(Equal(NewInfo()))
+	})
+
 	It("create_stemcell", func() {
 		stemcellImporter := bwcstem.NewFSImporter(
 			"/tmp/stemcells",
+			options.StemcellRootFSDirs,
 			fs,
 			uuidGen,
-			compressor,
+			stemcellExtractor,
+			timeService,
 			logger,
 		)
 
 		action, err := factory.Create("create_stemcell")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewCreateStemcell(stemcellImporter)))
+		Expect(action).To(Equal(NewCreateStemcell(stemcellImporter, inventory, timeService)))
 	})
 
 	It("delete_stemcell", func() {
 		action, err := factory.Create("delete_stemcell")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewDeleteStemcell(stemcellFinder)))
+		Expect(action).To(Equal(NewDeleteStemcell(stemcellFinder, stemcellDeleter, inventory)))
 	})
 
 	It("create_vm", func() {
@@ -148,18 +204,19 @@ var _ = Describe("concreteFactory", func() {
 			hostBindMounts,
 			guestBindMounts,
 			options.Agent,
+			requestContext,
 			logger,
 		)
 
 		action, err := factory.Create("create_vm")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewCreateVM(stemcellFinder, vmCreator)))
+		Expect(action).To(Equal(NewCreateVM(stemcellFinder, vmCreator, lockManager, inventory, timeService, 2)))
 	})
 
 	It("delete_vm", func() {
 		action, err := factory.Create("delete_vm")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewDeleteVM(vmFinder, hostBindMounts)))
+		Expect(action).To(Equal(NewDeleteVM(vmFinder, diskFinder, hostBindMounts, stemcellDeleter, lockManager, inventory, journal, timeService)))
 	})
 
 	It("has_vm", func() {
@@ -171,13 +228,13 @@ var _ = Describe("concreteFactory", func() {
 	It("reboot_vm", func() {
 		action, err := factory.Create("reboot_vm")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewRebootVM()))
+		Expect(action).To(Equal(NewRebootVM(vmFinder)))
 	})
 
 	It("set_vm_metadata", func() {
 		action, err := factory.Create("set_vm_metadata")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewSetVMMetadata()))
+		Expect(action).To(Equal(NewSetVMMetadata(vmFinder)))
 	})
 
 	It("configure_networks", func() {
@@ -197,25 +254,25 @@ var _ = Describe("concreteFactory", func() {
 
 		action, err := factory.Create("create_disk")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewCreateDisk(diskCreator)))
+		Expect(action).To(Equal(NewCreateDisk(diskCreator, inventory, timeService)))
 	})
 
 	It("delete_disk", func() {
 		action, err := factory.Create("delete_disk")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewDeleteDisk(diskFinder)))
+		Expect(action).To(Equal(NewDeleteDisk(diskFinder, lockManager, inventory)))
 	})
 
 	It("attach_disk", func() {
 		action, err := factory.Create("attach_disk")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewAttachDisk(vmFinder, diskFinder)))
+		Expect(action).To(Equal(NewAttachDisk(vmFinder, diskFinder, lockManager, inventory, journal, timeService, 2)))
 	})
 
 	It("detach_disk", func() {
 		action, err := factory.Create("detach_disk")
 		Expect(err).ToNot(HaveOccurred())
-		Expect(action).To(Equal(NewDetachDisk(vmFinder, diskFinder)))
+		Expect(action).To(Equal(NewDetachDisk(vmFinder, diskFinder, lockManager, inventory, journal, timeService)))
 	})
 
 	It("returns error because CPI machine is not self-aware if action is current_vm_id", func() {
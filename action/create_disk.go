@@ -3,23 +3,53 @@ package action
 import (
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 type CreateDisk struct {
 	diskCreator bwcdisk.Creator
+	inventory   bwcinv.Store
+	timeService bwcutil.TimeService
 }
 
 type DiskCloudProperties map[string]interface{}
 
-func NewCreateDisk(diskCreator bwcdisk.Creator) CreateDisk {
-	return CreateDisk{diskCreator: diskCreator}
+func NewCreateDisk(
+	diskCreator bwcdisk.Creator,
+	inventory bwcinv.Store,
+	timeService bwcutil.TimeService,
+) CreateDisk {
+	return CreateDisk{
+		diskCreator: diskCreator,
+		inventory:   inventory,
+		timeService: timeService,
+	}
 }
 
 func (a CreateDisk) Run(size int, _ DiskCloudProperties, _ VMCID) (DiskCID, error) {
 	disk, err := a.diskCreator.Create(size)
 	if err != nil {
-		return "", bosherr.WrapError(err, "Creating disk of size '%d'", size)
+		return "", bwcapi.WrapError(err, "Creating disk of size '%d'", size)
+	}
+
+	record := bwcinv.DiskRecord{
+		CID:       disk.ID(),
+		SizeMB:    size,
+		CreatedAt: a.timeService.Now().UTC(),
+	}
+
+	err = a.inventory.SaveDisk(record)
+	if err != nil {
+		// Disk that is not recorded would be invisible to admin tooling
+		deleteErr := disk.Delete()
+		if deleteErr != nil {
+			return "", bosherr.WrapError(err, "Recording disk '%s' (deleting disk: %s)", disk.ID(), deleteErr)
+		}
+
+		return "", bosherr.WrapError(err, "Recording disk '%s'", disk.ID())
 	}
 
 	return DiskCID(disk.ID()), nil
@@ -2,23 +2,32 @@ package action_test
 
 import (
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	fakedisk "github.com/cppforlife/bosh-warden-cpi/disk/fakes"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 )
 
 var _ = Describe("CreateDisk", func() {
 	var (
 		diskCreator *fakedisk.FakeCreator
+		inventory   *fakeinv.FakeStore
 		action      CreateDisk
+
+		now = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
 	)
 
 	BeforeEach(func() {
 		diskCreator = &fakedisk.FakeCreator{}
-		action = NewCreateDisk(diskCreator)
+		inventory = fakeinv.NewFakeStore()
+		action = NewCreateDisk(diskCreator, inventory, fakeutil.NewFakeTimeService(now))
 	})
 
 	Describe("Run", func() {
@@ -40,5 +49,41 @@ var _ = Describe("CreateDisk", func() {
 			Expect(err.Error()).To(ContainSubstring("fake-create-err"))
 			Expect(id).To(Equal(DiskCID("")))
 		})
+
+		It("keeps no disk space error so that it is reported to the Director", func() {
+			diskCreator.CreateErr = bwcapi.WrapComplexError(errors.New("fake-create-err"), bwcapi.NoDiskSpaceError{})
+
+			_, err := action.Run(20, DiskCloudProperties{}, VMCID("fake-vm-id"))
+			Expect(err).To(HaveOccurred())
+
+			cloudErr, found := bwcapi.FindCloudError(err)
+			Expect(found).To(BeTrue())
+			Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::NoDiskSpace"))
+		})
+
+		It("records created disk in the inventory", func() {
+			diskCreator.CreateDisk = fakedisk.NewFakeDisk("fake-disk-id")
+
+			_, err := action.Run(20, DiskCloudProperties{}, VMCID("fake-vm-id"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(inventory.Disks).To(Equal(map[string]bwcinv.DiskRecord{
+				"fake-disk-id": {CID: "fake-disk-id", SizeMB: 20, CreatedAt: now},
+			}))
+		})
+
+		It("deletes created disk and returns error if recording disk fails", func() {
+			disk := fakedisk.NewFakeDisk("fake-disk-id")
+			diskCreator.CreateDisk = disk
+
+			inventory.SaveDiskErr = errors.New("fake-save-err")
+
+			id, err := action.Run(20, DiskCloudProperties{}, VMCID("fake-vm-id"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-save-err"))
+			Expect(id).To(Equal(DiskCID("")))
+
+			Expect(disk.DeleteCalled).To(BeTrue())
+		})
 	})
 })
@@ -3,24 +3,97 @@ package action
 import (
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 type CreateStemcell struct {
 	stemcellImporter bwcstem.Importer
+	inventory        bwcinv.Store
+	timeService      bwcutil.TimeService
 }
 
-type CreateStemcellCloudProps struct{}
+type CreateStemcellCloudProps struct {
+	// Checksums of the image (e.g. copied from stemcell.MF); empty ones are not verified
+	SHA1   string `json:"sha1"`
+	SHA256 string `json:"sha256"`
 
-func NewCreateStemcell(stemcellImporter bwcstem.Importer) CreateStemcell {
-	return CreateStemcell{stemcellImporter: stemcellImporter}
+	// Recorded in stemcell metadata (e.g. copied from stemcell.MF)
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	OS      string `json:"os_distro"`
+
+	// Already unpacked root filesystem directory to use instead of the image.
+	// Useful for local development since directory is used by reference without copying.
+	// Directory must be inside one of StemcellRootFSDirs and checksums must not be given.
+	RootFSDir string `json:"rootfs_dir"`
+
+	// Other stemcell.MF properties; declared so that they are not rejected as unknown fields
+	Infrastructure  string `json:"infrastructure"`
+	Hypervisor      string `json:"hypervisor"`
+	Disk            int    `json:"disk"`
+	DiskFormat      string `json:"disk_format"`
+	ContainerFormat string `json:"container_format"`
+	OSType          string `json:"os_type"`
+	Architecture    string `json:"architecture"`
+	RootDeviceName  string `json:"root_device_name"`
+}
+
+func NewCreateStemcell(
+	stemcellImporter bwcstem.Importer,
+	inventory bwcinv.Store,
+	timeService bwcutil.TimeService,
+) CreateStemcell {
+	return CreateStemcell{
+		stemcellImporter: stemcellImporter,
+		inventory:        inventory,
+		timeService:      timeService,
+	}
 }
 
-func (a CreateStemcell) Run(imagePath string, _ CreateStemcellCloudProps) (StemcellCID, error) {
-	stemcell, err := a.stemcellImporter.ImportFromPath(imagePath)
+func (a CreateStemcell) Run(imagePath string, cloudProps CreateStemcellCloudProps) (StemcellCID, error) {
+	var stemcell bwcstem.Stemcell
+	var err error
+
+	if len(cloudProps.RootFSDir) > 0 {
+		stemcell, err = a.stemcellImporter.ImportFromDir(cloudProps.RootFSDir, cloudProps.AsImportOptions())
+		if err != nil {
+			return "", bosherr.WrapError(err, "Importing stemcell from directory '%s'", cloudProps.RootFSDir)
+		}
+	} else {
+		stemcell, err = a.stemcellImporter.ImportFromPath(imagePath, cloudProps.AsImportOptions())
+		if err != nil {
+			return "", bosherr.WrapError(err, "Importing stemcell from '%s'", imagePath)
+		}
+	}
+
+	record := bwcinv.StemcellRecord{
+		CID:       stemcell.ID(),
+		CreatedAt: a.timeService.Now().UTC(),
+	}
+
+	err = a.inventory.SaveStemcell(record)
 	if err != nil {
-		return "", bosherr.WrapError(err, "Importing stemcell from '%s'", imagePath)
+		// Stemcell that is not recorded would be invisible to admin tooling
+		deleteErr := stemcell.Delete()
+		if deleteErr != nil {
+			return "", bosherr.WrapError(err, "Recording stemcell '%s' (deleting stemcell: %s)", stemcell.ID(), deleteErr)
+		}
+
+		return "", bosherr.WrapError(err, "Recording stemcell '%s'", stemcell.ID())
 	}
 
 	return StemcellCID(stemcell.ID()), nil
 }
+
+func (p CreateStemcellCloudProps) AsImportOptions() bwcstem.ImportOptions {
+	return bwcstem.ImportOptions{
+		SHA1:   p.SHA1,
+		SHA256: p.SHA256,
+
+		Name:    p.Name,
+		Version: p.Version,
+		OS:      p.OS,
+	}
+}
@@ -2,23 +2,32 @@ package action_test
 
 import (
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
 	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 )
 
 var _ = Describe("CreateStemcell", func() {
 	var (
 		stemcellImporter *fakestem.FakeImporter
+		inventory        *fakeinv.FakeStore
 		action           CreateStemcell
+
+		now = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
 	)
 
 	BeforeEach(func() {
 		stemcellImporter = &fakestem.FakeImporter{}
-		action = NewCreateStemcell(stemcellImporter)
+		inventory = fakeinv.NewFakeStore()
+		action = NewCreateStemcell(stemcellImporter, inventory, fakeutil.NewFakeTimeService(now))
 	})
 
 	Describe("Run", func() {
@@ -32,6 +41,62 @@ var _ = Describe("CreateStemcell", func() {
 			Expect(stemcellImporter.ImportFromPathImagePath).To(Equal("/fake-image-path"))
 		})
 
+		It("imports stemcell with checksums and metadata from cloud properties", func() {
+			stemcellImporter.ImportFromPathStemcell = fakestem.NewFakeStemcell("fake-stemcell-id")
+
+			cloudProps := CreateStemcellCloudProps{
+				SHA1:   "fake-sha1",
+				SHA256: "fake-sha256",
+
+				Name:    "fake-name",
+				Version: "fake-version",
+				OS:      "fake-os",
+			}
+
+			_, err := action.Run("/fake-image-path", cloudProps)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(stemcellImporter.ImportFromPathOptions).To(Equal(bwcstem.ImportOptions{
+				SHA1:   "fake-sha1",
+				SHA256: "fake-sha256",
+
+				Name:    "fake-name",
+				Version: "fake-version",
+				OS:      "fake-os",
+			}))
+		})
+
+		Context("when root fs directory is provided in cloud properties", func() {
+			var (
+				cloudProps CreateStemcellCloudProps
+			)
+
+			BeforeEach(func() {
+				cloudProps = CreateStemcellCloudProps{RootFSDir: "/fake-rootfs-dir", Name: "fake-name"}
+			})
+
+			It("returns id for stemcell created from root fs directory without using image", func() {
+				stemcellImporter.ImportFromDirStemcell = fakestem.NewFakeStemcell("fake-stemcell-id")
+
+				id, err := action.Run("/fake-image-path", cloudProps)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(id).To(Equal(StemcellCID("fake-stemcell-id")))
+
+				Expect(stemcellImporter.ImportFromDirDirPath).To(Equal("/fake-rootfs-dir"))
+				Expect(stemcellImporter.ImportFromDirOptions).To(Equal(bwcstem.ImportOptions{Name: "fake-name"}))
+				Expect(stemcellImporter.ImportFromPathImagePath).To(BeEmpty())
+			})
+
+			It("returns error if creating stemcell from root fs directory fails", func() {
+				stemcellImporter.ImportFromDirErr = errors.New("fake-import-err")
+
+				id, err := action.Run("/fake-image-path", cloudProps)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-import-err"))
+				Expect(id).To(Equal(StemcellCID("")))
+			})
+		})
+
 		It("returns error if creating stemcell fails", func() {
 			stemcellImporter.ImportFromPathErr = errors.New("fake-add-err")
 
@@ -40,5 +105,48 @@ var _ = Describe("CreateStemcell", func() {
 			Expect(err.Error()).To(ContainSubstring("fake-add-err"))
 			Expect(id).To(Equal(StemcellCID("")))
 		})
+
+		It("records imported stemcell in the inventory", func() {
+			stemcellImporter.ImportFromPathStemcell = fakestem.NewFakeStemcell("fake-stemcell-id")
+
+			cloudProps := CreateStemcellCloudProps{Name: "fake-name", Version: "fake-version", OS: "fake-os"}
+
+			_, err := action.Run("/fake-image-path", cloudProps)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(inventory.Stemcells).To(Equal(map[string]bwcinv.StemcellRecord{
+				"fake-stemcell-id": {
+					CID:       "fake-stemcell-id",
+					CreatedAt: now,
+				},
+			}))
+		})
+
+		It("deletes imported stemcell and returns error if recording stemcell fails", func() {
+			stemcell := fakestem.NewFakeStemcell("fake-stemcell-id")
+			stemcellImporter.ImportFromPathStemcell = stemcell
+
+			inventory.SaveStemcellErr = errors.New("fake-save-err")
+
+			id, err := action.Run("/fake-image-path", CreateStemcellCloudProps{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-save-err"))
+			Expect(id).To(Equal(StemcellCID("")))
+
+			Expect(stemcell.DeleteCalled).To(BeTrue())
+		})
+
+		It("includes deletion error if deleting unrecorded stemcell fails", func() {
+			stemcell := fakestem.NewFakeStemcell("fake-stemcell-id")
+			stemcell.DeleteErr = errors.New("fake-delete-err")
+			stemcellImporter.ImportFromPathStemcell = stemcell
+
+			inventory.SaveStemcellErr = errors.New("fake-save-err")
+
+			_, err := action.Run("/fake-image-path", CreateStemcellCloudProps{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-save-err"))
+			Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
+		})
 	})
 })
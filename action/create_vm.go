@@ -1,46 +1,128 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 type CreateVM struct {
 	stemcellFinder bwcstem.Finder
 	vmCreator      bwcvm.Creator
+	lockManager    bwcutil.LockManager
+	inventory      bwcinv.Store
+	timeService    bwcutil.TimeService
+	apiVersion     int
 }
 
-type VMCloudProperties struct{}
+// VMCloudProperties declares sizes commonly given to vm types so that cloud configs
+// shared with other CPIs are accepted; they are ignored since containers share host's
+// CPUs, memory and disk. Other fields are rejected unless argument checks are lenient.
+type VMCloudProperties struct {
+	CPU  int `json:"cpu"`
+	RAM  int `json:"ram"`
+	Disk int `json:"disk"`
+}
 
 type Environment map[string]interface{}
 
-func NewCreateVM(stemcellFinder bwcstem.Finder, vmCreator bwcvm.Creator) CreateVM {
+func NewCreateVM(
+	stemcellFinder bwcstem.Finder,
+	vmCreator bwcvm.Creator,
+	lockManager bwcutil.LockManager,
+	inventory bwcinv.Store,
+	timeService bwcutil.TimeService,
+	apiVersion int,
+) CreateVM {
 	return CreateVM{
 		stemcellFinder: stemcellFinder,
 		vmCreator:      vmCreator,
+		lockManager:    lockManager,
+		inventory:      inventory,
+		timeService:    timeService,
+		apiVersion:     apiVersion,
 	}
 }
 
-func (a CreateVM) Run(agentID string, stemcellCID StemcellCID, _ VMCloudProperties, networks Networks, _ []DiskCID, env Environment) (VMCID, error) {
+// Run returns VM cid, or with API version 2 and above, VM cid and networks with resolved IPs
+func (a CreateVM) Run(ctx context.Context, agentID string, stemcellCID StemcellCID, _ VMCloudProperties, networks Networks, _ []DiskCID, env Environment) (interface{}, error) {
+	// Stemcell must not be deleted until container created from it is tagged with its cid
+	lock, err := a.lockManager.LockShared(ctx, bwcutil.StemcellLockKey(string(stemcellCID)))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Locking stemcell '%s'", stemcellCID)
+	}
+
+	defer lock.Unlock()
+
 	stemcell, found, err := a.stemcellFinder.Find(string(stemcellCID))
 	if err != nil {
-		return "", bosherr.WrapError(err, "Finding stemcell '%s'", stemcellCID)
+		return nil, bosherr.WrapError(err, "Finding stemcell '%s'", stemcellCID)
 	}
 
 	if !found {
-		return "", bosherr.New("Expected to find stemcell '%s'", stemcellCID)
+		// Retrying would not help since stemcell will not appear by itself
+		err = bosherr.New("Expected to find stemcell '%s'", stemcellCID)
+		return nil, bwcapi.WrapComplexError(err, bwcapi.NewVMCreationFailedError(false))
+	}
+
+	// Recorded before creating VM so that failing to record does not leave VM behind
+	err = stemcell.RecordVMCreation(a.timeService.Now().UTC())
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Recording VM creation from stemcell '%s'", stemcellCID)
 	}
 
 	vmNetworks := networks.AsVMNetworks()
 
 	vmEnv := bwcvm.Environment(env)
 
-	vm, err := a.vmCreator.Create(agentID, stemcell, vmNetworks, vmEnv)
+	vm, resolvedNetworks, err := a.vmCreator.Create(ctx, agentID, stemcell, vmNetworks, vmEnv)
 	if err != nil {
-		return "", bosherr.WrapError(err, "Creating VM with agent ID '%s'", agentID)
+		err = bosherr.WrapError(err, "Creating VM with agent ID '%s'", agentID)
+
+		// Failed VM is cleaned up by the creator so Director can try creating it again
+		return nil, bwcapi.WrapComplexError(err, bwcapi.NewVMCreationFailedError(true))
+	}
+
+	err = a.inventory.SaveVM(a.vmRecord(vm.ID(), agentID, stemcellCID, networks.WithResolvedIPs(resolvedNetworks)))
+	if err != nil {
+		// VM that is not recorded would be invisible to admin tooling
+		deleteErr := vm.Delete(ctx)
+		if deleteErr != nil {
+			err = bosherr.WrapError(err, "Recording VM '%s' (deleting VM: %s)", vm.ID(), deleteErr)
+			return nil, bwcapi.WrapComplexError(err, bwcapi.NewVMCreationFailedError(false))
+		}
+
+		err = bosherr.WrapError(err, "Recording VM '%s'", vm.ID())
+
+		return nil, bwcapi.WrapComplexError(err, bwcapi.NewVMCreationFailedError(true))
+	}
+
+	if a.apiVersion >= 2 {
+		return []interface{}{VMCID(vm.ID()), networks.WithResolvedIPs(resolvedNetworks)}, nil
 	}
 
 	return VMCID(vm.ID()), nil
 }
+
+func (a CreateVM) vmRecord(vmCID, agentID string, stemcellCID StemcellCID, networks Networks) bwcinv.VMRecord {
+	record := bwcinv.VMRecord{
+		CID:         vmCID,
+		AgentID:     agentID,
+		StemcellCID: string(stemcellCID),
+		Networks:    map[string]bwcinv.NetworkRecord{},
+		DiskCIDs:    []string{},
+		CreatedAt:   a.timeService.Now().UTC(),
+	}
+
+	for netName, network := range networks {
+		record.Networks[netName] = bwcinv.NetworkRecord{Type: network.Type, IP: network.IP}
+	}
+
+	return record
+}
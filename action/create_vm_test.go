@@ -1,13 +1,20 @@
 package action_test
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
 	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
@@ -16,13 +23,21 @@ var _ = Describe("CreateVM", func() {
 	var (
 		stemcellFinder *fakestem.FakeFinder
 		vmCreator      *fakevm.FakeCreator
+		lockManager    *fakeutil.FakeLockManager
+		inventory      *fakeinv.FakeStore
 		action         CreateVM
+		timeService    bwcutil.TimeService
+
+		now = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
 	)
 
 	BeforeEach(func() {
 		stemcellFinder = &fakestem.FakeFinder{}
 		vmCreator = &fakevm.FakeCreator{}
-		action = NewCreateVM(stemcellFinder, vmCreator)
+		lockManager = fakeutil.NewFakeLockManager()
+		inventory = fakeinv.NewFakeStore()
+		timeService = fakeutil.NewFakeTimeService(now)
+		action = NewCreateVM(stemcellFinder, vmCreator, lockManager, inventory, timeService, 1)
 	})
 
 	Describe("Run", func() {
@@ -43,15 +58,41 @@ var _ = Describe("CreateVM", func() {
 		})
 
 		It("tries to find stemcell with given stemcell cid", func() {
+			stemcellFinder.FindStemcell = fakestem.NewFakeStemcell("fake-stemcell-id")
 			stemcellFinder.FindFound = true
 			vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
 
-			_, err := action.Run("fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+			_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(stemcellFinder.FindID).To(Equal("fake-stemcell-id"))
 		})
 
+		It("holds shared stemcell lock while creating VM", func() {
+			stemcellFinder.FindStemcell = fakestem.NewFakeStemcell("fake-stemcell-id")
+			stemcellFinder.FindFound = true
+			vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
+
+			_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(lockManager.LockSharedKeys).To(Equal([]string{"stemcell-fake-stemcell-id"}))
+			Expect(lockManager.LockSharedLock.Locked).To(BeTrue())
+			Expect(lockManager.LockSharedLock.Unlocked).To(BeTrue())
+			Expect(lockManager.LockKeys).To(BeEmpty())
+		})
+
+		It("returns error without finding stemcell if locking fails", func() {
+			lockManager.LockSharedErr = errors.New("fake-lock-err")
+
+			_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-lock-err"))
+
+			Expect(stemcellFinder.FindID).To(BeEmpty())
+			Expect(vmCreator.CreateAgentID).To(BeEmpty())
+		})
+
 		Context("when stemcell is found with given stemcell cid", func() {
 			var (
 				stemcell *fakestem.FakeStemcell
@@ -66,7 +107,7 @@ var _ = Describe("CreateVM", func() {
 			It("returns id for created VM", func() {
 				vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
 
-				id, err := action.Run("fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				id, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
 				Expect(err).ToNot(HaveOccurred())
 				Expect(id).To(Equal(VMCID("fake-vm-id")))
 			})
@@ -74,7 +115,7 @@ var _ = Describe("CreateVM", func() {
 			It("creates VM with requested agent ID, stemcell, and networks", func() {
 				vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
 
-				_, err := action.Run("fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(vmCreator.CreateAgentID).To(Equal("fake-agent-id"))
@@ -85,13 +126,118 @@ var _ = Describe("CreateVM", func() {
 				))
 			})
 
+			It("returns id and networks with resolved IPs for created VM when using API version 2", func() {
+				action = NewCreateVM(stemcellFinder, vmCreator, lockManager, inventory, timeService, 2)
+
+				networks = Networks{"fake-net-name": Network{Type: "dynamic", MAC: "fake-mac"}}
+
+				vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
+				vmCreator.CreateVMNetworks = bwcvm.Networks{
+					"fake-net-name": bwcvm.Network{Type: "dynamic", IP: "fake-resolved-ip"},
+				}
+
+				result, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result).To(Equal([]interface{}{
+					VMCID("fake-vm-id"),
+					Networks{"fake-net-name": Network{Type: "dynamic", IP: "fake-resolved-ip", MAC: "fake-mac"}},
+				}))
+			})
+
+			It("records VM creation time in stemcell metadata", func() {
+				vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
+
+				_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(stemcell.RecordVMCreationCreatedAt).To(Equal(now))
+			})
+
+			It("returns error without creating VM if recording VM creation fails", func() {
+				stemcell.RecordVMCreationErr = errors.New("fake-record-err")
+
+				id, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-record-err"))
+				Expect(id).To(BeNil())
+
+				Expect(vmCreator.CreateAgentID).To(BeEmpty())
+			})
+
 			It("returns error if creating VM fails", func() {
 				vmCreator.CreateErr = errors.New("fake-create-err")
 
-				id, err := action.Run("fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				id, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-create-err"))
-				Expect(id).To(Equal(VMCID("")))
+				Expect(id).To(BeNil())
+
+				cloudErr, found := bwcapi.FindCloudError(err)
+				Expect(found).To(BeTrue())
+				Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::VMCreationFailed"))
+
+				retryableErr, found := bwcapi.FindRetryableError(err)
+				Expect(found).To(BeTrue())
+				Expect(retryableErr.CanRetry()).To(BeTrue())
+			})
+
+			It("records created VM with resolved networks in the inventory", func() {
+				networks = Networks{"fake-net-name": Network{Type: "dynamic"}}
+
+				vmCreator.CreateVM = fakevm.NewFakeVM("fake-vm-id")
+				vmCreator.CreateVMNetworks = bwcvm.Networks{
+					"fake-net-name": bwcvm.Network{Type: "dynamic", IP: "fake-resolved-ip"},
+				}
+
+				_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(inventory.VMs).To(Equal(map[string]bwcinv.VMRecord{
+					"fake-vm-id": {
+						CID:         "fake-vm-id",
+						AgentID:     "fake-agent-id",
+						StemcellCID: "fake-stemcell-id",
+						Networks: map[string]bwcinv.NetworkRecord{
+							"fake-net-name": {Type: "dynamic", IP: "fake-resolved-ip"},
+						},
+						DiskCIDs:  []string{},
+						CreatedAt: now,
+					},
+				}))
+			})
+
+			It("deletes created VM and returns retryable error if recording VM fails", func() {
+				vm := fakevm.NewFakeVM("fake-vm-id")
+				vmCreator.CreateVM = vm
+
+				inventory.SaveVMErr = errors.New("fake-save-err")
+
+				id, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-save-err"))
+				Expect(id).To(BeNil())
+
+				Expect(vm.DeleteCalled).To(BeTrue())
+
+				retryableErr, found := bwcapi.FindRetryableError(err)
+				Expect(found).To(BeTrue())
+				Expect(retryableErr.CanRetry()).To(BeTrue())
+			})
+
+			It("returns non-retryable error if deleting unrecorded VM fails", func() {
+				vm := fakevm.NewFakeVM("fake-vm-id")
+				vm.DeleteErr = errors.New("fake-delete-err")
+				vmCreator.CreateVM = vm
+
+				inventory.SaveVMErr = errors.New("fake-save-err")
+
+				_, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
+
+				retryableErr, found := bwcapi.FindRetryableError(err)
+				Expect(found).To(BeTrue())
+				Expect(retryableErr.CanRetry()).To(BeFalse())
 			})
 		})
 
@@ -99,10 +245,18 @@ var _ = Describe("CreateVM", func() {
 			It("returns error because VM cannot be created without a stemcell", func() {
 				stemcellFinder.FindFound = false
 
-				id, err := action.Run("fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				id, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("Expected to find stemcell"))
-				Expect(id).To(Equal(VMCID("")))
+				Expect(id).To(BeNil())
+
+				cloudErr, found := bwcapi.FindCloudError(err)
+				Expect(found).To(BeTrue())
+				Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::VMCreationFailed"))
+
+				retryableErr, found := bwcapi.FindRetryableError(err)
+				Expect(found).To(BeTrue())
+				Expect(retryableErr.CanRetry()).To(BeFalse())
 			})
 		})
 
@@ -110,10 +264,10 @@ var _ = Describe("CreateVM", func() {
 			It("returns error because VM cannot be created without a stemcell", func() {
 				stemcellFinder.FindErr = errors.New("fake-find-err")
 
-				id, err := action.Run("fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
+				id, err := action.Run(context.Background(), "fake-agent-id", stemcellCID, resourcePool, networks, diskLocality, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
-				Expect(id).To(Equal(VMCID("")))
+				Expect(id).To(BeNil())
 			})
 		})
 	})
@@ -1,20 +1,41 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 type DeleteDisk struct {
-	diskFinder bwcdisk.Finder
+	diskFinder  bwcdisk.Finder
+	lockManager bwcutil.LockManager
+	inventory   bwcinv.Store
 }
 
-func NewDeleteDisk(diskFinder bwcdisk.Finder) DeleteDisk {
-	return DeleteDisk{diskFinder: diskFinder}
+func NewDeleteDisk(
+	diskFinder bwcdisk.Finder,
+	lockManager bwcutil.LockManager,
+	inventory bwcinv.Store,
+) DeleteDisk {
+	return DeleteDisk{
+		diskFinder:  diskFinder,
+		lockManager: lockManager,
+		inventory:   inventory,
+	}
 }
 
-func (a DeleteDisk) Run(diskCID DiskCID) (interface{}, error) {
+func (a DeleteDisk) Run(ctx context.Context, diskCID DiskCID) (interface{}, error) {
+	lock, err := a.lockManager.Lock(ctx, bwcutil.DiskLockKey(string(diskCID)))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Locking disk '%s'", diskCID)
+	}
+
+	defer lock.Unlock()
+
 	disk, found, err := a.diskFinder.Find(string(diskCID))
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Finding disk '%s'", diskCID)
@@ -27,5 +48,10 @@ func (a DeleteDisk) Run(diskCID DiskCID) (interface{}, error) {
 		}
 	}
 
+	err = a.inventory.DeleteDisk(string(diskCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Deleting disk '%s' record", diskCID)
+	}
+
 	return nil, nil
 }
@@ -1,6 +1,7 @@
 package action_test
 
 import (
+	"context"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -8,27 +9,53 @@ import (
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
 	fakedisk "github.com/cppforlife/bosh-warden-cpi/disk/fakes"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 )
 
 var _ = Describe("DeleteDisk", func() {
 	var (
-		diskFinder *fakedisk.FakeFinder
-		action     DeleteDisk
+		diskFinder  *fakedisk.FakeFinder
+		lockManager *fakeutil.FakeLockManager
+		inventory   *fakeinv.FakeStore
+		action      DeleteDisk
 	)
 
 	BeforeEach(func() {
 		diskFinder = &fakedisk.FakeFinder{}
-		action = NewDeleteDisk(diskFinder)
+		lockManager = fakeutil.NewFakeLockManager()
+		inventory = fakeinv.NewFakeStore()
+		action = NewDeleteDisk(diskFinder, lockManager, inventory)
 	})
 
 	Describe("Run", func() {
 		It("tries to find disk with given disk cid", func() {
-			_, err := action.Run("fake-disk-id")
+			_, err := action.Run(context.Background(), "fake-disk-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(diskFinder.FindID).To(Equal("fake-disk-id"))
 		})
 
+		It("locks disk while running and unlocks it afterwards", func() {
+			_, err := action.Run(context.Background(), "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(lockManager.LockKeys).To(Equal([]string{"disk-fake-disk-id"}))
+			Expect(lockManager.LockLock.Locked).To(BeTrue())
+			Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+		})
+
+		It("returns error without finding disk if locking fails", func() {
+			lockManager.LockErr = errors.New("fake-lock-err")
+
+			_, err := action.Run(context.Background(), "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-lock-err"))
+
+			Expect(diskFinder.FindID).To(BeEmpty())
+		})
+
 		Context("when disk is found with given disk cid", func() {
 			var (
 				disk *fakedisk.FakeDisk
@@ -41,7 +68,7 @@ var _ = Describe("DeleteDisk", func() {
 			})
 
 			It("deletes disk", func() {
-				_, err := action.Run("fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-disk-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(disk.DeleteCalled).To(BeTrue())
@@ -50,7 +77,7 @@ var _ = Describe("DeleteDisk", func() {
 			It("returns error if deleting disk fails", func() {
 				disk.DeleteErr = errors.New("fake-delete-err")
 
-				_, err := action.Run("fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-disk-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
 			})
@@ -60,7 +87,7 @@ var _ = Describe("DeleteDisk", func() {
 			It("does not return error", func() {
 				diskFinder.FindFound = false
 
-				_, err := action.Run("fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-disk-id")
 				Expect(err).ToNot(HaveOccurred())
 			})
 		})
@@ -69,10 +96,27 @@ var _ = Describe("DeleteDisk", func() {
 			It("does not return error", func() {
 				diskFinder.FindErr = errors.New("fake-find-err")
 
-				_, err := action.Run("fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-disk-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 			})
 		})
+
+		It("deletes disk record even if disk is not found", func() {
+			inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id"}
+
+			_, err := action.Run(context.Background(), "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(inventory.Disks).To(BeEmpty())
+		})
+
+		It("returns error if deleting disk record fails", func() {
+			inventory.DeleteDiskErr = errors.New("fake-delete-err")
+
+			_, err := action.Run(context.Background(), "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
+		})
 	})
 })
@@ -1,31 +1,51 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
 )
 
 type DeleteStemcell struct {
-	stemcellFinder bwcstem.Finder
+	stemcellFinder  bwcstem.Finder
+	stemcellDeleter bwcstem.DeferredDeleter
+	inventory       bwcinv.Store
 }
 
-func NewDeleteStemcell(stemcellFinder bwcstem.Finder) DeleteStemcell {
-	return DeleteStemcell{stemcellFinder: stemcellFinder}
+func NewDeleteStemcell(
+	stemcellFinder bwcstem.Finder,
+	stemcellDeleter bwcstem.DeferredDeleter,
+	inventory bwcinv.Store,
+) DeleteStemcell {
+	return DeleteStemcell{
+		stemcellFinder:  stemcellFinder,
+		stemcellDeleter: stemcellDeleter,
+		inventory:       inventory,
+	}
 }
 
-func (a DeleteStemcell) Run(stemcellCID StemcellCID) (interface{}, error) {
+func (a DeleteStemcell) Run(ctx context.Context, stemcellCID StemcellCID) (interface{}, error) {
 	stemcell, found, err := a.stemcellFinder.Find(string(stemcellCID))
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Finding stemcell '%s'", stemcellCID)
 	}
 
 	if found {
-		err := stemcell.Delete()
+		// Stemcell that is still used by VMs is deleted once those VMs are deleted
+		err := a.stemcellDeleter.Delete(ctx, stemcell)
 		if err != nil {
 			return nil, bosherr.WrapError(err, "Deleting stemcell '%s'", stemcellCID)
 		}
 	}
 
+	// Stemcell pending deletion is no longer usable by Director hence not recorded
+	err = a.inventory.DeleteStemcell(string(stemcellCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Deleting stemcell '%s' record", stemcellCID)
+	}
+
 	return nil, nil
 }
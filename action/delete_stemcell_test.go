@@ -1,29 +1,36 @@
 package action_test
 
 import (
+	"context"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
 	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
 )
 
 var _ = Describe("DeleteStemcell", func() {
 	var (
-		stemcellFinder *fakestem.FakeFinder
-		action         DeleteStemcell
+		stemcellFinder  *fakestem.FakeFinder
+		stemcellDeleter *fakestem.FakeDeferredDeleter
+		inventory       *fakeinv.FakeStore
+		action          DeleteStemcell
 	)
 
 	BeforeEach(func() {
 		stemcellFinder = &fakestem.FakeFinder{}
-		action = NewDeleteStemcell(stemcellFinder)
+		stemcellDeleter = &fakestem.FakeDeferredDeleter{}
+		inventory = fakeinv.NewFakeStore()
+		action = NewDeleteStemcell(stemcellFinder, stemcellDeleter, inventory)
 	})
 
 	Describe("Run", func() {
 		It("tries to find stemcell with given stemcell cid", func() {
-			_, err := action.Run("fake-stemcell-id")
+			_, err := action.Run(context.Background(), "fake-stemcell-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(stemcellFinder.FindID).To(Equal("fake-stemcell-id"))
@@ -40,17 +47,17 @@ var _ = Describe("DeleteStemcell", func() {
 				stemcellFinder.FindFound = true
 			})
 
-			It("deletes stemcell", func() {
-				_, err := action.Run("fake-stemcell-id")
+			It("deletes stemcell (possibly deferring deletion until stemcell is no longer in use)", func() {
+				_, err := action.Run(context.Background(), "fake-stemcell-id")
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(stemcell.DeleteCalled).To(BeTrue())
+				Expect(stemcellDeleter.DeleteStemcell).To(Equal(stemcell))
 			})
 
 			It("returns error if deleting stemcell fails", func() {
-				stemcell.DeleteErr = errors.New("fake-delete-err")
+				stemcellDeleter.DeleteErr = errors.New("fake-delete-err")
 
-				_, err := action.Run("fake-stemcell-id")
+				_, err := action.Run(context.Background(), "fake-stemcell-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
 			})
@@ -60,8 +67,10 @@ var _ = Describe("DeleteStemcell", func() {
 			It("does not return error", func() {
 				stemcellFinder.FindFound = false
 
-				_, err := action.Run("fake-stemcell-id")
+				_, err := action.Run(context.Background(), "fake-stemcell-id")
 				Expect(err).ToNot(HaveOccurred())
+
+				Expect(stemcellDeleter.DeleteStemcell).To(BeNil())
 			})
 		})
 
@@ -69,10 +78,27 @@ var _ = Describe("DeleteStemcell", func() {
 			It("does not return error", func() {
 				stemcellFinder.FindErr = errors.New("fake-find-err")
 
-				_, err := action.Run("fake-stemcell-id")
+				_, err := action.Run(context.Background(), "fake-stemcell-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 			})
 		})
+
+		It("deletes stemcell record even if stemcell is not found", func() {
+			inventory.Stemcells["fake-stemcell-id"] = bwcinv.StemcellRecord{CID: "fake-stemcell-id"}
+
+			_, err := action.Run(context.Background(), "fake-stemcell-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(inventory.Stemcells).To(BeEmpty())
+		})
+
+		It("returns error if deleting stemcell record fails", func() {
+			inventory.DeleteStemcellErr = errors.New("fake-delete-err")
+
+			_, err := action.Run(context.Background(), "fake-stemcell-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
+		})
 	})
 })
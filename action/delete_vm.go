@@ -1,30 +1,101 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 type DeleteVM struct {
-	vmFinder       bwcvm.Finder
-	hostBindMounts bwcvm.HostBindMounts
+	vmFinder        bwcvm.Finder
+	diskFinder      bwcdisk.Finder
+	hostBindMounts  bwcvm.HostBindMounts
+	stemcellDeleter bwcstem.DeferredDeleter
+	lockManager     bwcutil.LockManager
+	inventory       bwcinv.Store
+	journal         bwcinv.Journal
+	timeService     bwcutil.TimeService
 }
 
-func NewDeleteVM(vmFinder bwcvm.Finder, hostBindMounts bwcvm.HostBindMounts) DeleteVM {
-	return DeleteVM{vmFinder: vmFinder, hostBindMounts: hostBindMounts}
+func NewDeleteVM(
+	vmFinder bwcvm.Finder,
+	diskFinder bwcdisk.Finder,
+	hostBindMounts bwcvm.HostBindMounts,
+	stemcellDeleter bwcstem.DeferredDeleter,
+	lockManager bwcutil.LockManager,
+	inventory bwcinv.Store,
+	journal bwcinv.Journal,
+	timeService bwcutil.TimeService,
+) DeleteVM {
+	return DeleteVM{
+		vmFinder:        vmFinder,
+		diskFinder:      diskFinder,
+		hostBindMounts:  hostBindMounts,
+		stemcellDeleter: stemcellDeleter,
+		lockManager:     lockManager,
+		inventory:       inventory,
+		journal:         journal,
+		timeService:     timeService,
+	}
 }
 
-func (a DeleteVM) Run(vmCID VMCID) (interface{}, error) {
-	vm, _, err := a.vmFinder.Find(string(vmCID))
+func (a DeleteVM) Run(ctx context.Context, vmCID VMCID) (interface{}, error) {
+	lock, err := lockVMWithIntent(ctx, a.lockManager, a.journal, string(vmCID), "")
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Locking VM '%s'", vmCID)
+	}
+
+	defer lock.Unlock()
+
+	// Disk attached half way should be detached before VM goes away
+	err = recoverIntent(ctx, a.journal, a.vmFinder, a.diskFinder, a.inventory, string(vmCID))
+	if err != nil {
+		return nil, err
+	}
+
+	vm, _, err := a.vmFinder.Find(ctx, string(vmCID))
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Finding vm '%s'", vmCID)
 	}
 
-	err = vm.Delete()
+	intent := bwcinv.Intent{
+		VMCID:     string(vmCID),
+		Op:        bwcinv.IntentOpDeleteVM,
+		StartedAt: a.timeService.Now(),
+	}
+
+	err = a.journal.Begin(intent)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Recording intent to delete vm '%s'", vmCID)
+	}
+
+	err = vm.Delete(ctx)
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Deleting vm '%s'", vmCID)
 	}
 
+	// Disk records still point to the VM until disks are detached or deleted
+	err = a.inventory.DeleteVM(string(vmCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Deleting vm '%s' record", vmCID)
+	}
+
+	err = a.journal.Finish(string(vmCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Finishing intent to delete vm '%s'", vmCID)
+	}
+
+	// Deleted VM might have been the last one using stemcell marked for deletion
+	err = a.stemcellDeleter.CollectPending(ctx)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Collecting stemcells pending deletion")
+	}
+
 	return nil, nil
 }
@@ -1,7 +1,9 @@
 package action_test
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -9,7 +11,12 @@ import (
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	fakedisk "github.com/cppforlife/bosh-warden-cpi/disk/fakes"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
 	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
@@ -23,6 +30,13 @@ var _ = Describe("DeleteVM", func() {
 		sleeper        bwcutil.Sleeper
 		logger         boshlog.Logger
 		hostBindMounts bwcvm.FSHostBindMounts
+
+		stemcellDeleter *fakestem.FakeDeferredDeleter
+		lockManager     *fakeutil.FakeLockManager
+		inventory       *fakeinv.FakeStore
+		journal         *fakeinv.FakeJournal
+		diskFinder      *fakedisk.FakeFinder
+		now             time.Time
 	)
 
 	BeforeEach(func() {
@@ -37,11 +51,35 @@ var _ = Describe("DeleteVM", func() {
 			"/tmp/host-persistent-bind-mounts-dir",
 			sleeper,
 			fs,
-			cmdRunner,
+			bwcvm.NewCmdMounter(cmdRunner, logger),
+			fakevm.NewFakeMountTable(),
+			fakevm.NewFakeMountUsers(),
+			bwcvm.UnmountRetryOptions{}.Policy(),
 			logger,
 		)
 
-		action = NewDeleteVM(vmFinder, hostBindMounts)
+		stemcellDeleter = &fakestem.FakeDeferredDeleter{}
+
+		lockManager = fakeutil.NewFakeLockManager()
+
+		inventory = fakeinv.NewFakeStore()
+
+		journal = fakeinv.NewFakeJournal()
+
+		diskFinder = &fakedisk.FakeFinder{}
+
+		now = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+		action = NewDeleteVM(
+			vmFinder,
+			diskFinder,
+			hostBindMounts,
+			stemcellDeleter,
+			lockManager,
+			inventory,
+			journal,
+			fakeutil.NewFakeTimeService(now),
+		)
 	})
 
 	Describe("Run", func() {
@@ -55,19 +93,38 @@ var _ = Describe("DeleteVM", func() {
 		})
 
 		It("tries to find vm with given vm cid", func() {
-			_, err := action.Run("fake-vm-id")
+			_, err := action.Run(context.Background(), "fake-vm-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(vmFinder.FindID).To(Equal("fake-vm-id"))
 		})
 
+		It("locks vm while running and unlocks it afterwards", func() {
+			_, err := action.Run(context.Background(), "fake-vm-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(lockManager.LockKeys).To(Equal([]string{"vm-fake-vm-id"}))
+			Expect(lockManager.LockLock.Locked).To(BeTrue())
+			Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+		})
+
+		It("returns error without finding vm if locking fails", func() {
+			lockManager.LockErr = errors.New("fake-lock-err")
+
+			_, err := action.Run(context.Background(), "fake-vm-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-lock-err"))
+
+			Expect(vmFinder.FindID).To(BeEmpty())
+		})
+
 		Context("when vm is found with given vm cid", func() {
 			BeforeEach(func() {
 				vmFinder.FindFound = true
 			})
 
 			It("deletes vm", func() {
-				_, err := action.Run("fake-vm-id")
+				_, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(vm.DeleteCalled).To(BeTrue())
@@ -76,9 +133,26 @@ var _ = Describe("DeleteVM", func() {
 			It("returns error if deleting vm fails", func() {
 				vm.DeleteErr = errors.New("fake-delete-err")
 
-				_, err := action.Run("fake-vm-id")
+				_, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
+
+				Expect(stemcellDeleter.CollectPendingCalled).To(BeFalse())
+			})
+
+			It("collects stemcells pending deletion since vm might have been using one of them", func() {
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(stemcellDeleter.CollectPendingCalled).To(BeTrue())
+			})
+
+			It("returns error if collecting stemcells pending deletion fails", func() {
+				stemcellDeleter.CollectPendingErr = errors.New("fake-collect-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-collect-err"))
 			})
 		})
 
@@ -88,12 +162,12 @@ var _ = Describe("DeleteVM", func() {
 			})
 
 			It("does not return error", func() {
-				_, err := action.Run("fake-vm-id")
+				_, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).ToNot(HaveOccurred())
 			})
 
 			It("still deletes the vm data", func() {
-				_, err := action.Run("fake-vm-id")
+				_, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).ToNot(HaveOccurred())
 				Expect(vm.DeleteCalled).To(BeTrue())
 			})
@@ -103,10 +177,116 @@ var _ = Describe("DeleteVM", func() {
 			It("does not return error", func() {
 				vmFinder.FindErr = errors.New("fake-find-err")
 
-				_, err := action.Run("fake-vm-id")
+				_, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 			})
 		})
+
+		It("deletes VM record after deleting VM", func() {
+			inventory.VMs["fake-vm-id"] = bwcinv.VMRecord{CID: "fake-vm-id"}
+
+			_, err := action.Run(context.Background(), "fake-vm-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(inventory.VMs).To(BeEmpty())
+		})
+
+		It("keeps VM record if deleting VM fails", func() {
+			inventory.VMs["fake-vm-id"] = bwcinv.VMRecord{CID: "fake-vm-id"}
+			vm.DeleteErr = errors.New("fake-delete-err")
+
+			_, err := action.Run(context.Background(), "fake-vm-id")
+			Expect(err).To(HaveOccurred())
+
+			Expect(inventory.VMs).To(HaveKey("fake-vm-id"))
+		})
+
+		It("returns error if deleting VM record fails", func() {
+			inventory.DeleteVMErr = errors.New("fake-delete-record-err")
+
+			_, err := action.Run(context.Background(), "fake-vm-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-delete-record-err"))
+		})
+
+		Describe("intent journal", func() {
+			It("records intent before deleting VM and finishes it after deleting VM record", func() {
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(journal.BegunIntents).To(Equal([]bwcinv.Intent{{
+					VMCID:     "fake-vm-id",
+					Op:        bwcinv.IntentOpDeleteVM,
+					StartedAt: now,
+				}}))
+
+				Expect(journal.Intents).To(BeEmpty())
+			})
+
+			It("returns error without deleting VM if recording intent fails", func() {
+				journal.BeginErr = errors.New("fake-begin-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-begin-err"))
+
+				Expect(vm.DeleteCalled).To(BeFalse())
+			})
+
+			It("leaves intent unfinished if deleting VM fails", func() {
+				vm.DeleteErr = errors.New("fake-delete-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).To(HaveOccurred())
+
+				Expect(journal.Intents).To(HaveKey("fake-vm-id"))
+			})
+
+			It("rolls back unfinished attach before deleting VM", func() {
+				vmFinder.FindFound = true
+
+				disk := fakedisk.NewFakeDisk("fake-disk-id")
+				diskFinder.FindFound = true
+				diskFinder.FindDisk = disk
+
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{
+					VMCID:   "fake-vm-id",
+					Op:      bwcinv.IntentOpAttachDisk,
+					DiskCID: "fake-disk-id",
+				}
+
+				inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id", VMCID: "fake-vm-id"}
+
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(vm.DetachDiskDisk).To(Equal(disk))
+				Expect(inventory.Disks["fake-disk-id"].VMCID).To(BeEmpty())
+				Expect(vm.DeleteCalled).To(BeTrue())
+
+				Expect(lockManager.AllLockKeys).To(Equal([][]string{{"vm-fake-vm-id", "disk-fake-disk-id"}}))
+			})
+
+			It("finishes unfinished delete", func() {
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{VMCID: "fake-vm-id", Op: bwcinv.IntentOpDeleteVM}
+
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(vm.DeleteCalled).To(BeTrue())
+				Expect(journal.FinishedCIDs).To(Equal([]string{"fake-vm-id", "fake-vm-id"}))
+			})
+
+			It("returns error if recovering unknown operation", func() {
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{VMCID: "fake-vm-id", Op: "fake-op"}
+
+				_, err := action.Run(context.Background(), "fake-vm-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Unknown operation 'fake-op'"))
+
+				Expect(vm.DeleteCalled).To(BeFalse())
+			})
+		})
 	})
 })
@@ -1,32 +1,65 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 type DetachDisk struct {
-	vmFinder   bwcvm.Finder
-	diskFinder bwcdisk.Finder
+	vmFinder    bwcvm.Finder
+	diskFinder  bwcdisk.Finder
+	lockManager bwcutil.LockManager
+	inventory   bwcinv.Store
+	journal     bwcinv.Journal
+	timeService bwcutil.TimeService
 }
 
-func NewDetachDisk(vmFinder bwcvm.Finder, diskFinder bwcdisk.Finder) DetachDisk {
+func NewDetachDisk(
+	vmFinder bwcvm.Finder,
+	diskFinder bwcdisk.Finder,
+	lockManager bwcutil.LockManager,
+	inventory bwcinv.Store,
+	journal bwcinv.Journal,
+	timeService bwcutil.TimeService,
+) DetachDisk {
 	return DetachDisk{
-		vmFinder:   vmFinder,
-		diskFinder: diskFinder,
+		vmFinder:    vmFinder,
+		diskFinder:  diskFinder,
+		lockManager: lockManager,
+		inventory:   inventory,
+		journal:     journal,
+		timeService: timeService,
 	}
 }
 
-func (a DetachDisk) Run(vmCID VMCID, diskCID DiskCID) (interface{}, error) {
-	vm, found, err := a.vmFinder.Find(string(vmCID))
+func (a DetachDisk) Run(ctx context.Context, vmCID VMCID, diskCID DiskCID) (interface{}, error) {
+	// Agent env is updated with read-modify-write so concurrent changes to the same VM would be lost
+	lock, err := lockVMWithIntent(ctx, a.lockManager, a.journal, string(vmCID), string(diskCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Locking VM '%s' and disk '%s'", vmCID, diskCID)
+	}
+
+	defer lock.Unlock()
+
+	err = recoverIntent(ctx, a.journal, a.vmFinder, a.diskFinder, a.inventory, string(vmCID))
+	if err != nil {
+		return nil, err
+	}
+
+	vm, found, err := a.vmFinder.Find(ctx, string(vmCID))
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Finding VM '%s'", vmCID)
 	}
 
 	if !found {
-		return nil, bosherr.New("Expected to find VM '%s'", vmCID)
+		return nil, bwcapi.NewVMNotFoundError(string(vmCID))
 	}
 
 	disk, found, err := a.diskFinder.Find(string(diskCID))
@@ -35,13 +68,46 @@ func (a DetachDisk) Run(vmCID VMCID, diskCID DiskCID) (interface{}, error) {
 	}
 
 	if !found {
-		return nil, bosherr.New("Expected to find disk '%s'", diskCID)
+		return nil, bwcapi.NewDiskNotFoundError(string(diskCID))
+	}
+
+	// Disks recorded before the inventory was introduced are detached without the check
+	diskRecord, found, err := a.inventory.FindDisk(string(diskCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Finding disk record '%s'", diskCID)
+	}
+
+	if found && diskRecord.VMCID != string(vmCID) {
+		return nil, bwcapi.NewDiskNotAttachedError(string(vmCID), string(diskCID))
+	}
+
+	intent := bwcinv.Intent{
+		VMCID:     string(vmCID),
+		Op:        bwcinv.IntentOpDetachDisk,
+		DiskCID:   string(diskCID),
+		StartedAt: a.timeService.Now(),
+	}
+
+	err = a.journal.Begin(intent)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Recording intent to detach disk '%s' from VM '%s'", diskCID, vmCID)
 	}
 
-	err = vm.DetachDisk(disk)
+	// Intent is left unfinished on failure so that next invocation finishes partial detach
+	err = vm.DetachDisk(ctx, disk)
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Detaching disk '%s' to VM '%s'", diskCID, vmCID)
 	}
 
+	err = recordDiskAttachment(a.inventory, string(vmCID), string(diskCID), false)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Recording disk '%s' detachment from VM '%s'", diskCID, vmCID)
+	}
+
+	err = a.journal.Finish(string(vmCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Finishing intent to detach disk '%s' from VM '%s'", diskCID, vmCID)
+	}
+
 	return nil, nil
 }
@@ -1,27 +1,41 @@
 package action_test
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	fakedisk "github.com/cppforlife/bosh-warden-cpi/disk/fakes"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
 
 var _ = Describe("DetachDisk", func() {
 	var (
-		vmFinder   *fakevm.FakeFinder
-		diskFinder *fakedisk.FakeFinder
-		action     DetachDisk
+		vmFinder    *fakevm.FakeFinder
+		diskFinder  *fakedisk.FakeFinder
+		lockManager *fakeutil.FakeLockManager
+		inventory   *fakeinv.FakeStore
+		journal     *fakeinv.FakeJournal
+		now         time.Time
+		action      DetachDisk
 	)
 
 	BeforeEach(func() {
 		vmFinder = &fakevm.FakeFinder{}
 		diskFinder = &fakedisk.FakeFinder{}
-		action = NewDetachDisk(vmFinder, diskFinder)
+		lockManager = fakeutil.NewFakeLockManager()
+		inventory = fakeinv.NewFakeStore()
+		journal = fakeinv.NewFakeJournal()
+		now = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
+		action = NewDetachDisk(vmFinder, diskFinder, lockManager, inventory, journal, fakeutil.NewFakeTimeService(now))
 	})
 
 	Describe("Run", func() {
@@ -32,12 +46,37 @@ var _ = Describe("DetachDisk", func() {
 			diskFinder.FindFound = true
 			diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
 
-			_, err := action.Run("fake-vm-id", "fake-disk-id")
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(vmFinder.FindID).To(Equal("fake-vm-id"))
 		})
 
+		It("locks VM and disk while running and unlocks them afterwards", func() {
+			vmFinder.FindFound = true
+			vmFinder.FindVM = fakevm.NewFakeVM("fake-vm-id")
+
+			diskFinder.FindFound = true
+			diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
+
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(lockManager.LockKeys).To(Equal([]string{"vm-fake-vm-id", "disk-fake-disk-id"}))
+			Expect(lockManager.LockLock.Locked).To(BeTrue())
+			Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+		})
+
+		It("returns error without finding VM if locking fails", func() {
+			lockManager.LockErr = errors.New("fake-lock-err")
+
+			_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-lock-err"))
+
+			Expect(vmFinder.FindID).To(BeEmpty())
+		})
+
 		Context("when VM is found with given VM cid", func() {
 			var (
 				vm *fakevm.FakeVM
@@ -52,7 +91,7 @@ var _ = Describe("DetachDisk", func() {
 			It("tries to find disk with given disk cid", func() {
 				diskFinder.FindFound = true
 
-				_, err := action.Run("fake-vm-id", "fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(diskFinder.FindID).To(Equal("fake-disk-id"))
@@ -70,7 +109,7 @@ var _ = Describe("DetachDisk", func() {
 				})
 
 				It("does not return error when detaching found disk from found VM succeeds", func() {
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 					Expect(err).ToNot(HaveOccurred())
 
 					Expect(vm.DetachDiskDisk).To(Equal(disk))
@@ -79,19 +118,54 @@ var _ = Describe("DetachDisk", func() {
 				It("returns error if detaching disk fails", func() {
 					vm.DetachDiskErr = errors.New("fake-detach-disk-err")
 
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-detach-disk-err"))
 				})
+
+				It("returns disk not attached error without detaching if disk is recorded as attached to another VM", func() {
+					inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id", VMCID: "fake-other-vm-id"}
+
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(Equal(bwcapi.NewDiskNotAttachedError("fake-vm-id", "fake-disk-id")))
+
+					Expect(vm.DetachDiskDisk).To(BeNil())
+					Expect(journal.BegunIntents).To(BeEmpty())
+				})
+
+				It("returns disk not attached error if disk is recorded as not attached", func() {
+					inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id"}
+
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(Equal(bwcapi.NewDiskNotAttachedError("fake-vm-id", "fake-disk-id")))
+
+					Expect(vm.DetachDiskDisk).To(BeNil())
+				})
+
+				It("detaches disk that is not recorded in the inventory", func() {
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(vm.DetachDiskDisk).To(Equal(disk))
+				})
+
+				It("returns error if finding disk record fails", func() {
+					inventory.FindDiskErr = errors.New("fake-find-disk-err")
+
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("fake-find-disk-err"))
+
+					Expect(vm.DetachDiskDisk).To(BeNil())
+				})
 			})
 
 			Context("when disk is not found with given cid", func() {
 				It("returns error", func() {
 					diskFinder.FindFound = false
 
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
-					Expect(err).To(HaveOccurred())
-					Expect(err.Error()).To(ContainSubstring("Expected to find disk"))
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+					Expect(err).To(Equal(bwcapi.NewDiskNotFoundError("fake-disk-id")))
 				})
 			})
 
@@ -99,7 +173,7 @@ var _ = Describe("DetachDisk", func() {
 				It("returns error", func() {
 					diskFinder.FindErr = errors.New("fake-find-err")
 
-					_, err := action.Run("fake-vm-id", "fake-disk-id")
+					_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 				})
@@ -110,9 +184,8 @@ var _ = Describe("DetachDisk", func() {
 			It("returns error because disk can only be detached from an existing VM", func() {
 				vmFinder.FindFound = false
 
-				_, err := action.Run("fake-vm-id", "fake-disk-id")
-				Expect(err).To(HaveOccurred())
-				Expect(err.Error()).To(ContainSubstring("Expected to find VM"))
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(Equal(bwcapi.NewVMNotFoundError("fake-vm-id")))
 			})
 		})
 
@@ -120,10 +193,168 @@ var _ = Describe("DetachDisk", func() {
 			It("returns error because disk can only be detached from an existing VM", func() {
 				vmFinder.FindErr = errors.New("fake-find-err")
 
-				_, err := action.Run("fake-vm-id", "fake-disk-id")
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
+			})
+		})
+
+		Context("when disk is detached", func() {
+			BeforeEach(func() {
+				vmFinder.FindFound = true
+				vmFinder.FindVM = fakevm.NewFakeVM("fake-vm-id")
+
+				diskFinder.FindFound = true
+				diskFinder.FindDisk = fakedisk.NewFakeDisk("fake-disk-id")
+			})
+
+			It("removes attachment from VM and disk records", func() {
+				inventory.VMs["fake-vm-id"] = bwcinv.VMRecord{
+					CID:      "fake-vm-id",
+					DiskCIDs: []string{"fake-other-disk-id", "fake-disk-id"},
+				}
+
+				inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id", SizeMB: 20, VMCID: "fake-vm-id"}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(inventory.VMs["fake-vm-id"].DiskCIDs).To(Equal([]string{"fake-other-disk-id"}))
+
+				Expect(inventory.Disks["fake-disk-id"]).To(Equal(bwcinv.DiskRecord{CID: "fake-disk-id", SizeMB: 20}))
+			})
+
+			It("returns error if recording detachment fails", func() {
+				inventory.FindVMErr = errors.New("fake-find-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 			})
 		})
+
+		Describe("intent journal", func() {
+			var (
+				vm   *fakevm.FakeVM
+				disk *fakedisk.FakeDisk
+			)
+
+			BeforeEach(func() {
+				vm = fakevm.NewFakeVM("fake-vm-id")
+				vmFinder.FindFound = true
+				vmFinder.FindVM = vm
+
+				disk = fakedisk.NewFakeDisk("fake-disk-id")
+				diskFinder.FindFound = true
+				diskFinder.FindDisk = disk
+			})
+
+			It("records intent before detaching and finishes it afterwards", func() {
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(journal.BegunIntents).To(Equal([]bwcinv.Intent{{
+					VMCID:     "fake-vm-id",
+					Op:        bwcinv.IntentOpDetachDisk,
+					DiskCID:   "fake-disk-id",
+					StartedAt: now,
+				}}))
+
+				Expect(journal.Intents).To(BeEmpty())
+			})
+
+			It("leaves intent unfinished if detaching fails so that it is finished later", func() {
+				vm.DetachDiskErr = errors.New("fake-detach-err")
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+
+				Expect(journal.Intents).To(HaveKey("fake-vm-id"))
+			})
+
+			It("finishes previous unfinished detach before detaching", func() {
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{
+					VMCID:   "fake-vm-id",
+					Op:      bwcinv.IntentOpDetachDisk,
+					DiskCID: "fake-other-disk-id",
+				}
+
+				inventory.Disks["fake-other-disk-id"] = bwcinv.DiskRecord{CID: "fake-other-disk-id", VMCID: "fake-vm-id"}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(diskFinder.FindID).To(Equal("fake-disk-id"))
+				Expect(inventory.Disks["fake-other-disk-id"].VMCID).To(BeEmpty())
+				Expect(journal.FinishedCIDs).To(Equal([]string{"fake-vm-id", "fake-vm-id"}))
+			})
+
+			It("locks disk of unfinished detach together with VM and disk being detached", func() {
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{
+					VMCID:   "fake-vm-id",
+					Op:      bwcinv.IntentOpDetachDisk,
+					DiskCID: "fake-other-disk-id",
+				}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(lockManager.AllLockKeys).To(Equal([][]string{
+					{"vm-fake-vm-id", "disk-fake-disk-id", "disk-fake-other-disk-id"},
+				}))
+			})
+
+			It("locks again if unfinished detach of another disk was begun before locking", func() {
+				lockManager.LockCallback = func(_ []string) {
+					if len(lockManager.AllLockKeys) == 1 {
+						journal.Intents["fake-vm-id"] = bwcinv.Intent{
+							VMCID:   "fake-vm-id",
+							Op:      bwcinv.IntentOpDetachDisk,
+							DiskCID: "fake-other-disk-id",
+						}
+					}
+				}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(lockManager.AllLockKeys).To(Equal([][]string{
+					{"vm-fake-vm-id", "disk-fake-disk-id"},
+					{"vm-fake-vm-id", "disk-fake-disk-id", "disk-fake-other-disk-id"},
+				}))
+
+				Expect(journal.FinishedCIDs).To(Equal([]string{"fake-vm-id", "fake-vm-id"}))
+			})
+
+			It("does not lock disk of unfinished detach again if it is the disk being detached", func() {
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{
+					VMCID:   "fake-vm-id",
+					Op:      bwcinv.IntentOpDetachDisk,
+					DiskCID: "fake-disk-id",
+				}
+
+				inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{CID: "fake-disk-id", VMCID: "fake-vm-id"}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).To(Equal(bwcapi.NewDiskNotAttachedError("fake-vm-id", "fake-disk-id")))
+
+				Expect(lockManager.AllLockKeys).To(Equal([][]string{{"vm-fake-vm-id", "disk-fake-disk-id"}}))
+			})
+
+			It("keeps record of disk that was attached to another VM before unfinished detach is finished", func() {
+				journal.Intents["fake-vm-id"] = bwcinv.Intent{
+					VMCID:   "fake-vm-id",
+					Op:      bwcinv.IntentOpDetachDisk,
+					DiskCID: "fake-other-disk-id",
+				}
+
+				inventory.Disks["fake-other-disk-id"] = bwcinv.DiskRecord{CID: "fake-other-disk-id", VMCID: "fake-other-vm-id"}
+
+				_, err := action.Run(context.Background(), "fake-vm-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(inventory.Disks["fake-other-disk-id"].VMCID).To(Equal("fake-other-vm-id"))
+			})
+		})
 	})
 })
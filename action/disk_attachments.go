@@ -0,0 +1,53 @@
+package action
+
+import (
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+)
+
+// recordDiskAttachment updates both VM and disk records; caller must hold VM and disk locks.
+// Records are created if missing since VMs and disks might predate the inventory.
+func recordDiskAttachment(inventory bwcinv.Store, vmCID, diskCID string, attached bool) error {
+	vmRecord, found, err := inventory.FindVM(vmCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finding VM record")
+	}
+
+	if !found {
+		vmRecord = bwcinv.VMRecord{CID: vmCID}
+	}
+
+	diskRecord, found, err := inventory.FindDisk(diskCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finding disk record")
+	}
+
+	if !found {
+		diskRecord = bwcinv.DiskRecord{CID: diskCID}
+	}
+
+	if attached {
+		vmRecord = vmRecord.WithDisk(diskCID)
+		diskRecord.VMCID = vmCID
+	} else {
+		vmRecord = vmRecord.WithoutDisk(diskCID)
+
+		// Disk that is already recorded as attached to another VM keeps that record
+		if diskRecord.VMCID == vmCID {
+			diskRecord.VMCID = ""
+		}
+	}
+
+	err = inventory.SaveVM(vmRecord)
+	if err != nil {
+		return bosherr.WrapError(err, "Saving VM record")
+	}
+
+	err = inventory.SaveDisk(diskRecord)
+	if err != nil {
+		return bosherr.WrapError(err, "Saving disk record")
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package action
 
 import (
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
@@ -14,8 +16,8 @@ func NewHasVM(vmFinder bwcvm.Finder) HasVM {
 	return HasVM{vmFinder: vmFinder}
 }
 
-func (a HasVM) Run(vmCID VMCID) (bool, error) {
-	_, found, err := a.vmFinder.Find(string(vmCID))
+func (a HasVM) Run(ctx context.Context, vmCID VMCID) (bool, error) {
+	_, found, err := a.vmFinder.Find(ctx, string(vmCID))
 	if err != nil {
 		return false, bosherr.WrapError(err, "Finding VM '%s'", vmCID)
 	}
@@ -1,6 +1,7 @@
 package action_test
 
 import (
+	"context"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -23,7 +24,7 @@ var _ = Describe("HasVM", func() {
 
 	Describe("Run", func() {
 		It("tries to find VM with given VM CID", func() {
-			_, err := action.Run("fake-vm-id")
+			_, err := action.Run(context.Background(), "fake-vm-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(vmFinder.FindID).To(Equal("fake-vm-id"))
@@ -33,7 +34,7 @@ var _ = Describe("HasVM", func() {
 			It("returns true without error", func() {
 				vmFinder.FindFound = true
 
-				found, err := action.Run("fake-vm-id")
+				found, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).ToNot(HaveOccurred())
 				Expect(found).To(BeTrue())
 			})
@@ -41,7 +42,7 @@ var _ = Describe("HasVM", func() {
 
 		Context("when VM is not found with given CID", func() {
 			It("returns false without error", func() {
-				found, err := action.Run("fake-vm-id")
+				found, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).ToNot(HaveOccurred())
 				Expect(found).To(BeFalse())
 			})
@@ -51,7 +52,7 @@ var _ = Describe("HasVM", func() {
 			It("returns error", func() {
 				vmFinder.FindErr = errors.New("fake-find-err")
 
-				found, err := action.Run("fake-vm-id")
+				found, err := action.Run(context.Background(), "fake-vm-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-find-err"))
 				Expect(found).To(BeFalse())
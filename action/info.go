@@ -0,0 +1,25 @@
+package action
+
+import (
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+)
+
+type Info struct{}
+
+type InfoResult struct {
+	APIVersion      int      `json:"api_version"`
+	StemcellFormats []string `json:"stemcell_formats"`
+}
+
+func NewInfo() Info {
+	return Info{}
+}
+
+func (a Info) Run() (InfoResult, error) {
+	result := InfoResult{
+		APIVersion:      bwcapi.SupportedAPIVersion,
+		StemcellFormats: []string{"warden-tar", "general-tar"},
+	}
+
+	return result, nil
+}
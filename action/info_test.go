@@ -0,0 +1,29 @@
+package action_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/action"
+)
+
+var _ = Describe("Info", func() {
+	var (
+		action Info
+	)
+
+	BeforeEach(func() {
+		action = NewInfo()
+	})
+
+	Describe("Run", func() {
+		It("advertises API version 2 and supported stemcell formats", func() {
+			result, err := action.Run()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result).To(Equal(InfoResult{
+				APIVersion:      2,
+				StemcellFormats: []string{"warden-tar", "general-tar"},
+			}))
+		})
+	})
+})
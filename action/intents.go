@@ -0,0 +1,167 @@
+package action
+
+import (
+	"context"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+
+	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+// lockVMWithIntent locks the VM, diskCID if it is not empty and disk of VM's unfinished
+// operation in a single Lock call so that keys are always locked in sorted order.
+// Unfinished operation is only changed while VM is locked, so it is read again after locking
+// and locking is retried if it now involves a disk that was not locked.
+func lockVMWithIntent(
+	ctx context.Context,
+	lockManager bwcutil.LockManager,
+	journal bwcinv.Journal,
+	vmCID string,
+	diskCID string,
+) (bwcutil.Lock, error) {
+	for {
+		intentDiskCID, err := findIntentDiskCID(journal, vmCID)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := []string{bwcutil.VMLockKey(vmCID)}
+
+		if diskCID != "" {
+			keys = append(keys, bwcutil.DiskLockKey(diskCID))
+		}
+
+		if intentDiskCID != "" && intentDiskCID != diskCID {
+			keys = append(keys, bwcutil.DiskLockKey(intentDiskCID))
+		}
+
+		lock, err := lockManager.Lock(ctx, keys...)
+		if err != nil {
+			return nil, err
+		}
+
+		lockedIntentDiskCID, err := findIntentDiskCID(journal, vmCID)
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+
+		if lockedIntentDiskCID == "" || lockedIntentDiskCID == diskCID || lockedIntentDiskCID == intentDiskCID {
+			return lock, nil
+		}
+
+		lock.Unlock()
+	}
+}
+
+func findIntentDiskCID(journal bwcinv.Journal, vmCID string) (string, error) {
+	intent, found, err := journal.Find(vmCID)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Finding unfinished operation on VM '%s'", vmCID)
+	}
+
+	if !found {
+		return "", nil
+	}
+
+	return intent.DiskCID, nil
+}
+
+// recoverIntent repairs an operation on the VM that was begun but never finished,
+// e.g. because CPI process was killed between mounting a disk and updating agent env;
+// caller must hold locks taken by lockVMWithIntent. Interrupted attach
+// is rolled back since Director did not receive disk hint; interrupted detach and delete
+// are finished since they are idempotent.
+// Mounts left behind for VMs whose containers are gone are removed when VM is deleted.
+func recoverIntent(
+	ctx context.Context,
+	journal bwcinv.Journal,
+	vmFinder bwcvm.Finder,
+	diskFinder bwcdisk.Finder,
+	inventory bwcinv.Store,
+	vmCID string,
+) error {
+	intent, found, err := journal.Find(vmCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finding unfinished operation on VM '%s'", vmCID)
+	}
+
+	if !found {
+		return nil
+	}
+
+	switch intent.Op {
+	case bwcinv.IntentOpAttachDisk, bwcinv.IntentOpDetachDisk:
+		err = recoverDiskDetachment(ctx, vmFinder, diskFinder, inventory, intent)
+
+	case bwcinv.IntentOpDeleteVM:
+		err = recoverVMDeletion(ctx, vmFinder, inventory, intent)
+
+	default:
+		err = bosherr.New("Unknown operation '%s'", intent.Op)
+	}
+
+	if err != nil {
+		return bosherr.WrapError(err, "Recovering unfinished '%s' operation on VM '%s'", intent.Op, vmCID)
+	}
+
+	err = journal.Finish(vmCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finishing recovered operation on VM '%s'", vmCID)
+	}
+
+	return nil
+}
+
+// recoverDiskDetachment leaves disk detached from the VM
+// which both rolls back attach and finishes detach. Disk may have been attached
+// to another VM since the operation was interrupted so caller must hold disk's lock.
+func recoverDiskDetachment(
+	ctx context.Context,
+	vmFinder bwcvm.Finder,
+	diskFinder bwcdisk.Finder,
+	inventory bwcinv.Store,
+	intent bwcinv.Intent,
+) error {
+	vm, vmFound, err := vmFinder.Find(ctx, intent.VMCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finding VM '%s'", intent.VMCID)
+	}
+
+	disk, diskFound, err := diskFinder.Find(intent.DiskCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finding disk '%s'", intent.DiskCID)
+	}
+
+	if vmFound && diskFound {
+		err = vm.DetachDisk(ctx, disk)
+		if err != nil {
+			return bosherr.WrapError(err, "Detaching disk '%s' from VM '%s'", intent.DiskCID, intent.VMCID)
+		}
+	}
+
+	return recordDiskAttachment(inventory, intent.VMCID, intent.DiskCID, false)
+}
+
+func recoverVMDeletion(ctx context.Context, vmFinder bwcvm.Finder, inventory bwcinv.Store, intent bwcinv.Intent) error {
+	vm, _, err := vmFinder.Find(ctx, intent.VMCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Finding VM '%s'", intent.VMCID)
+	}
+
+	// Deleting VM cleans up bind mounts even if container is already gone
+	err = vm.Delete(ctx)
+	if err != nil {
+		return bosherr.WrapError(err, "Deleting VM '%s'", intent.VMCID)
+	}
+
+	err = inventory.DeleteVM(intent.VMCID)
+	if err != nil {
+		return bosherr.WrapError(err, "Deleting VM '%s' record", intent.VMCID)
+	}
+
+	return nil
+}
@@ -41,3 +41,18 @@ func (ns Networks) AsVMNetworks() bwcvm.Networks {
 
 	return networks
 }
+
+// WithResolvedIPs returns copy of networks with IPs taken from VM networks (e.g. assigned for dynamic networks)
+func (ns Networks) WithResolvedIPs(vmNetworks bwcvm.Networks) Networks {
+	networks := Networks{}
+
+	for netName, network := range ns {
+		if vmNetwork, found := vmNetworks[netName]; found {
+			network.IP = vmNetwork.IP
+		}
+
+		networks[netName] = network
+	}
+
+	return networks
+}
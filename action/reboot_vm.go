@@ -1,11 +1,31 @@
 package action
 
-type RebootVM struct{}
+import (
+	"context"
 
-func NewRebootVM() RebootVM {
-	return RebootVM{}
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+type RebootVM struct {
+	vmFinder bwcvm.Finder
+}
+
+func NewRebootVM(vmFinder bwcvm.Finder) RebootVM {
+	return RebootVM{vmFinder: vmFinder}
 }
 
-func (a RebootVM) Run(vmCID VMCID) (interface{}, error) {
+func (a RebootVM) Run(ctx context.Context, vmCID VMCID) (interface{}, error) {
+	_, found, err := a.vmFinder.Find(ctx, string(vmCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Finding VM '%s'", vmCID)
+	}
+
+	if !found {
+		return nil, bwcapi.NewVMNotFoundError(string(vmCID))
+	}
+
 	return nil, nil
 }
@@ -1,14 +1,34 @@
 package action
 
-type SetVMMetadata struct{}
+import (
+	"context"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+type SetVMMetadata struct {
+	vmFinder bwcvm.Finder
+}
 
 type VMMetadata struct{}
 
-func NewSetVMMetadata() SetVMMetadata {
-	return SetVMMetadata{}
+func NewSetVMMetadata(vmFinder bwcvm.Finder) SetVMMetadata {
+	return SetVMMetadata{vmFinder: vmFinder}
 }
 
-func (a SetVMMetadata) Run(vmCID VMCID, metadata VMMetadata) (interface{}, error) {
+func (a SetVMMetadata) Run(ctx context.Context, vmCID VMCID, metadata VMMetadata) (interface{}, error) {
+	_, found, err := a.vmFinder.Find(ctx, string(vmCID))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Finding VM '%s'", vmCID)
+	}
+
+	if !found {
+		return nil, bwcapi.NewVMNotFoundError(string(vmCID))
+	}
+
 	// todo can properties be set on the container
 	return nil, nil
 }
@@ -1,9 +1,49 @@
 package action_test
 
 import (
+	"context"
+	"errors"
+
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
 
 var _ = Describe("SetVMMetadata", func() {
-	XDescribe("Run", func() {})
+	var (
+		vmFinder *fakevm.FakeFinder
+		action   SetVMMetadata
+	)
+
+	BeforeEach(func() {
+		vmFinder = &fakevm.FakeFinder{}
+		action = NewSetVMMetadata(vmFinder)
+	})
+
+	Describe("Run", func() {
+		It("does not return error if VM is found with given VM CID", func() {
+			vmFinder.FindFound = true
+
+			_, err := action.Run(context.Background(), "fake-vm-id", VMMetadata{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(vmFinder.FindID).To(Equal("fake-vm-id"))
+		})
+
+		It("returns VM not found error if VM is not found with given VM CID", func() {
+			_, err := action.Run(context.Background(), "fake-vm-id", VMMetadata{})
+			Expect(err).To(Equal(bwcapi.NewVMNotFoundError("fake-vm-id")))
+		})
+
+		It("returns error if VM finding fails", func() {
+			vmFinder.FindErr = errors.New("fake-find-err")
+
+			_, err := action.Run(context.Background(), "fake-vm-id", VMMetadata{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-find-err"))
+		})
+	})
 })
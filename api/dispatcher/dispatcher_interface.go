@@ -1,7 +1,42 @@
 package dispatcher
 
+import (
+	"context"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+
+	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+)
+
 type Dispatcher interface {
 	// Dispatch interprets request bytes, executes request, captures response and return response bytes.
 	// It panics if built-in errors fail to serialize.
 	Dispatch([]byte) []byte
 }
+
+// RequestScope holds dependencies built for a single request
+type RequestScope struct {
+	ActionFactory bwcaction.Factory
+
+	// Tags every log line with request id
+	// so that concurrently served requests can be told apart
+	Logger boshlog.Logger
+
+	// Done once request times out; actions' dependencies stop waiting at that point.
+	// Cancel must be called once request is finished to release resources.
+	Context context.Context
+	Cancel  context.CancelFunc
+
+	// Captures entries logged by Logger that are returned in the response; optional
+	Log RequestLog
+}
+
+type RequestLog interface {
+	String() string
+}
+
+type RequestScopeBuilder interface {
+	// Method is included so that log entries can be attributed to an action
+	Build(method string, context bwcapi.RequestContext) RequestScope
+}
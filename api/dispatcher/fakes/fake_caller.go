@@ -1,18 +1,28 @@
 package fakes
 
 import (
+	"context"
+
 	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
 )
 
 type FakeCaller struct {
+	CallCtx    context.Context
 	CallAction bwcaction.Action
 	CallArgs   []interface{}
 	CallResult interface{}
 	CallErr    error
+	CallStub   func() (interface{}, error)
 }
 
-func (caller *FakeCaller) Call(action bwcaction.Action, args []interface{}) (interface{}, error) {
+func (caller *FakeCaller) Call(ctx context.Context, action bwcaction.Action, args []interface{}) (interface{}, error) {
+	caller.CallCtx = ctx
 	caller.CallAction = action
 	caller.CallArgs = args
+
+	if caller.CallStub != nil {
+		return caller.CallStub()
+	}
+
 	return caller.CallResult, caller.CallErr
 }
@@ -3,9 +3,15 @@ package fakes
 type FakeDispatcher struct {
 	DispatchReqBytes  []byte
 	DispatchRespBytes []byte
+	DispatchStub      func([]byte) []byte
 }
 
 func (d *FakeDispatcher) Dispatch(reqBytes []byte) []byte {
 	d.DispatchReqBytes = reqBytes
+
+	if d.DispatchStub != nil {
+		return d.DispatchStub(reqBytes)
+	}
+
 	return d.DispatchRespBytes
 }
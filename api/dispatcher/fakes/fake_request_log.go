@@ -0,0 +1,9 @@
+package fakes
+
+type FakeRequestLog struct {
+	StringString string
+}
+
+func (l *FakeRequestLog) String() string {
+	return l.StringString
+}
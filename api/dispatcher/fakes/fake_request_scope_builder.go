@@ -0,0 +1,18 @@
+package fakes
+
+import (
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
+)
+
+type FakeRequestScopeBuilder struct {
+	BuildMethod  string
+	BuildContext bwcapi.RequestContext
+	BuildScope   bwcdisp.RequestScope
+}
+
+func (b *FakeRequestScopeBuilder) Build(method string, context bwcapi.RequestContext) bwcdisp.RequestScope {
+	b.BuildMethod = method
+	b.BuildContext = context
+	return b.BuildScope
+}
@@ -1,12 +1,17 @@
 package dispatcher
 
 import (
+	"context"
 	"encoding/json"
+	"runtime/debug"
+	"time"
 
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 
 	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
 	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 const (
@@ -15,13 +20,19 @@ const (
 	jsonCloudErrorType          = "Bosh::Clouds::CloudError"
 	jsonCpiErrorType            = "Bosh::Clouds::CpiError"
 	jsonNotImplementedErrorType = "Bosh::Clouds::NotImplemented"
+
+	// Time given to a cancelled action to return error describing where it stopped
+	jsonCancelGracePeriod = 5 * time.Second
 )
 
 type Request struct {
 	Method    string        `json:"method"`
 	Arguments []interface{} `json:"arguments"`
 
-	// context key is ignored
+	Context bwcapi.RequestContext `json:"context"`
+
+	// Some Directors send api version next to context instead of inside of it
+	APIVersion int `json:"api_version"`
 }
 
 type Response struct {
@@ -39,34 +50,52 @@ type ResponseError struct {
 }
 
 type JSON struct {
-	actionFactory bwcaction.Factory
-	caller        Caller
-	logger        boshlog.Logger
+	scopeBuilder RequestScopeBuilder
+	caller       Caller
+	logger       boshlog.Logger
+
+	// Set once request scope is built
+	log RequestLog
 }
 
 func NewJSON(
-	actionFactory bwcaction.Factory,
+	scopeBuilder RequestScopeBuilder,
 	caller Caller,
 	logger boshlog.Logger,
 ) JSON {
 	return JSON{
-		actionFactory: actionFactory,
-		caller:        caller,
-		logger:        logger,
+		scopeBuilder: scopeBuilder,
+		caller:       caller,
+		logger:       logger,
 	}
 }
 
 func (c JSON) Dispatch(reqBytes []byte) []byte {
 	var req Request
 
-	c.logger.DebugWithDetails(jsonLogTag, "Request bytes", string(reqBytes))
-
 	err := json.Unmarshal(reqBytes, &req)
 	if err != nil {
+		c.logger.DebugWithDetails(jsonLogTag, "Request bytes", string(reqBytes))
 		return c.buildCpiError("Must provide valid JSON payload")
 	}
 
-	c.logger.DebugWithDetails(jsonLogTag, "Deserialized request", req)
+	if req.Context.APIVersion == 0 {
+		req.Context.APIVersion = req.APIVersion
+	}
+
+	scope := c.scopeBuilder.Build(req.Method, req.Context)
+
+	if scope.Cancel != nil {
+		defer scope.Cancel()
+	}
+
+	// Rest of the request is logged with request id
+	c.logger = scope.Logger
+	c.log = scope.Log
+
+	c.logger.DebugWithDetails(jsonLogTag, "Request bytes", string(reqBytes))
+
+	c.logger.DebugWithDetails(jsonLogTag, "Deserialized request", bwcutil.Redact(req))
 
 	if req.Method == "" {
 		return c.buildCpiError("Must provide method key")
@@ -76,12 +105,12 @@ func (c JSON) Dispatch(reqBytes []byte) []byte {
 		return c.buildCpiError("Must provide arguments key")
 	}
 
-	action, err := c.actionFactory.Create(req.Method)
+	action, err := scope.ActionFactory.Create(req.Method)
 	if err != nil {
 		return c.buildNotImplementedError()
 	}
 
-	result, err := c.caller.Call(action, req.Arguments)
+	result, err := c.call(scope.Context, req.Method, action, req.Arguments)
 	if err != nil {
 		return c.buildCloudError(err)
 	}
@@ -92,6 +121,8 @@ func (c JSON) Dispatch(reqBytes []byte) []byte {
 
 	c.logger.DebugWithDetails(jsonLogTag, "Deserialized response", resp)
 
+	resp.Log = c.responseLog()
+
 	respBytes, err := json.Marshal(resp)
 	if err != nil {
 		return c.buildCpiError("Failed to serialize result")
@@ -102,12 +133,65 @@ func (c JSON) Dispatch(reqBytes []byte) []byte {
 	return respBytes
 }
 
+type jsonCallResult struct {
+	value interface{}
+	err   error
+}
+
+// call stops waiting for action once ctx's deadline passes
+func (c JSON) call(ctx context.Context, method string, action bwcaction.Action, args []interface{}) (interface{}, error) {
+	if ctx == nil {
+		return c.caller.Call(context.Background(), action, args)
+	}
+
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline {
+		return c.caller.Call(ctx, action, args)
+	}
+
+	resultCh := make(chan jsonCallResult, 1)
+
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				c.logger.ErrorWithDetails(jsonLogTag, "Action panicked: %s", r, debug.Stack())
+				resultCh <- jsonCallResult{err: bosherr.New("Action panicked: %s", r)}
+			}
+		}()
+
+		value, err := c.caller.Call(ctx, action, args)
+		resultCh <- jsonCallResult{value: value, err: err}
+	}()
+
+	select {
+	case result := <-resultCh:
+		return result.value, result.err
+	case <-ctx.Done():
+	}
+
+	c.logger.Error(jsonLogTag, "Request timed out; waiting for action to stop")
+
+	// Action's dependencies notice cancellation and return error that includes timed out step
+	select {
+	case result := <-resultCh:
+		if result.err != nil {
+			return nil, bwcapi.NewTimeoutError(method, result.err)
+		}
+
+		// Action finished right as it timed out
+		return result.value, nil
+
+	case <-time.After(jsonCancelGracePeriod):
+		return nil, bwcapi.NewTimeoutError(method, bosherr.New("Action did not stop within %s", jsonCancelGracePeriod))
+	}
+}
+
 func (c JSON) buildCloudError(err error) []byte {
 	respErr := Response{
 		Error: &ResponseError{},
 	}
 
-	if typedErr, ok := err.(bwcapi.CloudError); ok {
+	// Typed errors are usually wrapped with additional context
+	if typedErr, ok := bwcapi.FindCloudError(err); ok {
 		respErr.Error.Type = typedErr.Type()
 	} else {
 		respErr.Error.Type = jsonCloudErrorType
@@ -115,10 +199,12 @@ func (c JSON) buildCloudError(err error) []byte {
 
 	respErr.Error.Message = err.Error()
 
-	if typedErr, ok := err.(bwcapi.RetryableError); ok {
+	if typedErr, ok := bwcapi.FindRetryableError(err); ok {
 		respErr.Error.CanRetry = typedErr.CanRetry()
 	}
 
+	respErr.Log = c.responseLog()
+
 	respErrBytes, err := json.Marshal(respErr)
 	if err != nil {
 		panic(err)
@@ -137,6 +223,8 @@ func (c JSON) buildCpiError(message string) []byte {
 		},
 	}
 
+	respErr.Log = c.responseLog()
+
 	respErrBytes, err := json.Marshal(respErr)
 	if err != nil {
 		panic(err)
@@ -155,6 +243,8 @@ func (c JSON) buildNotImplementedError() []byte {
 		},
 	}
 
+	respErr.Log = c.responseLog()
+
 	respErrBytes, err := json.Marshal(respErr)
 	if err != nil {
 		panic(err)
@@ -164,3 +254,11 @@ func (c JSON) buildNotImplementedError() []byte {
 
 	return respErrBytes
 }
+
+func (c JSON) responseLog() string {
+	if c.log == nil {
+		return ""
+	}
+
+	return c.log.String()
+}
@@ -1,26 +1,53 @@
 package dispatcher
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"reflect"
+	"sort"
+	"strings"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 
 	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 )
 
 type Caller interface {
-	Call(bwcaction.Action, []interface{}) (interface{}, error)
+	// Call passes ctx to action.Run if its first argument is a context.Context
+	Call(context.Context, bwcaction.Action, []interface{}) (interface{}, error)
 }
 
+type JSONCallerStrictness string
+
+const (
+	// Extra positional arguments and unknown fields are ignored
+	JSONCallerLenient JSONCallerStrictness = "lenient"
+
+	// Unknown fields are rejected only in cloud properties
+	// since they are provided by operators and typos silently do nothing
+	JSONCallerStrictCloudProperties JSONCallerStrictness = "cloud_properties"
+
+	// Extra positional arguments and unknown fields in all arguments are rejected
+	JSONCallerStrict JSONCallerStrictness = "strict"
+)
+
+// Argument types with these name suffixes are considered to be cloud properties
+var jsonCallerCloudPropertiesSuffixes = []string{"CloudProperties", "CloudProps"}
+
+var jsonCallerContextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 // JSONCaller unmarshals call arguments with json package and calls action.Run
-type JSONCaller struct{}
+type JSONCaller struct {
+	strictness JSONCallerStrictness
+}
 
-func NewJSONCaller() JSONCaller {
-	return JSONCaller{}
+func NewJSONCaller(strictness JSONCallerStrictness) JSONCaller {
+	return JSONCaller{strictness: strictness}
 }
 
-func (r JSONCaller) Call(action bwcaction.Action, args []interface{}) (value interface{}, err error) {
+func (r JSONCaller) Call(ctx context.Context, action bwcaction.Action, args []interface{}) (value interface{}, err error) {
 	actionValue := reflect.ValueOf(action)
 	runMethodValue := actionValue.MethodByName("Run")
 	if runMethodValue.Kind() != reflect.Func {
@@ -34,12 +61,24 @@ func (r JSONCaller) Call(action bwcaction.Action, args []interface{}) (value int
 		return
 	}
 
-	methodArgs, err := r.extractMethodArgs(runMethodType, args)
+	var methodArgs []reflect.Value
+
+	// Context is not part of the payload hence payload arguments start after it
+	numberOfCtxArgs := 0
+
+	if runMethodType.NumIn() > 0 && runMethodType.In(0) == jsonCallerContextType {
+		methodArgs = append(methodArgs, reflect.ValueOf(&ctx).Elem())
+		numberOfCtxArgs = 1
+	}
+
+	payloadArgs, err := r.extractMethodArgs(runMethodType, numberOfCtxArgs, args)
 	if err != nil {
-		err = bosherr.WrapError(err, "Extracting method arguments from payload")
+		err = bwcapi.WrapError(err, "Extracting method arguments from payload")
 		return
 	}
 
+	methodArgs = append(methodArgs, payloadArgs...)
+
 	values := runMethodValue.Call(methodArgs)
 	return r.extractReturns(values)
 }
@@ -63,8 +102,8 @@ func (r JSONCaller) invalidReturnTypes(methodType reflect.Type) (valid bool) {
 	return
 }
 
-func (r JSONCaller) extractMethodArgs(runMethodType reflect.Type, args []interface{}) (methodArgs []reflect.Value, err error) {
-	numberOfArgs := runMethodType.NumIn()
+func (r JSONCaller) extractMethodArgs(runMethodType reflect.Type, numberOfCtxArgs int, args []interface{}) (methodArgs []reflect.Value, err error) {
+	numberOfArgs := runMethodType.NumIn() - numberOfCtxArgs
 	numberOfReqArgs := numberOfArgs
 
 	if runMethodType.IsVariadic() {
@@ -84,8 +123,12 @@ func (r JSONCaller) extractMethodArgs(runMethodType reflect.Type, args []interfa
 			return
 		}
 
-		argType, typeFound := r.getMethodArgType(runMethodType, i)
+		argType, typeFound := r.getMethodArgType(runMethodType, numberOfCtxArgs+i)
 		if !typeFound {
+			if r.strictness == JSONCallerStrict {
+				err = bwcapi.NewArgumentError(i, "", "", fmt.Sprintf("is not expected, Run accepts %d arguments", numberOfArgs))
+				return
+			}
 			continue
 		}
 
@@ -93,16 +136,171 @@ func (r JSONCaller) extractMethodArgs(runMethodType reflect.Type, args []interfa
 
 		err = json.Unmarshal(rawArgBytes, argValuePtr.Interface())
 		if err != nil {
+			if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+				err = bwcapi.NewArgumentError(i, typeErr.Field, typeErr.Type.String(), fmt.Sprintf("has type %s", typeErr.Value))
+				return
+			}
+
 			err = bosherr.WrapError(err, "Unmarshalling action argument")
 			return
 		}
 
+		if r.rejectsUnknownFields(argType) {
+			fieldPath, expectedType, unknown := r.findUnknownField(argFromPayload, argType, "")
+			if unknown {
+				err = bwcapi.NewArgumentError(i, fieldPath, expectedType.String(), "is not a known field")
+				return
+			}
+		}
+
 		methodArgs = append(methodArgs, reflect.Indirect(argValuePtr))
 	}
 
 	return
 }
 
+func (r JSONCaller) rejectsUnknownFields(argType reflect.Type) bool {
+	switch r.strictness {
+	case JSONCallerStrict:
+		return true
+
+	case JSONCallerStrictCloudProperties:
+		for _, suffix := range jsonCallerCloudPropertiesSuffixes {
+			if strings.HasSuffix(argType.Name(), suffix) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// findUnknownField returns path to the first field in the payload that does not
+// correspond to a field in the argument type, together with type that was expected to have it
+func (r JSONCaller) findUnknownField(val interface{}, t reflect.Type, path string) (string, reflect.Type, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	// Custom unmarshalling decides on its own which fields are allowed
+	if reflect.PtrTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()) {
+		return "", nil, false
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return "", nil, false
+		}
+
+		keys := []string{}
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldPath := r.joinFieldPath(path, key)
+
+			fieldType, found := r.findStructField(t, key)
+			if !found {
+				return fieldPath, t, true
+			}
+
+			fieldPath, expectedType, unknown := r.findUnknownField(obj[key], fieldType, fieldPath)
+			if unknown {
+				return fieldPath, expectedType, true
+			}
+		}
+
+	case reflect.Map:
+		obj, ok := val.(map[string]interface{})
+		if !ok {
+			return "", nil, false
+		}
+
+		keys := []string{}
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			fieldPath, expectedType, unknown := r.findUnknownField(obj[key], t.Elem(), r.joinFieldPath(path, key))
+			if unknown {
+				return fieldPath, expectedType, true
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		items, ok := val.([]interface{})
+		if !ok {
+			return "", nil, false
+		}
+
+		for i, item := range items {
+			fieldPath, expectedType, unknown := r.findUnknownField(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+			if unknown {
+				return fieldPath, expectedType, true
+			}
+		}
+	}
+
+	return "", nil, false
+}
+
+// findStructField matches keys to fields the same way as json package does,
+// i.e. by json tag or field name, case insensitively, including embedded structs
+func (r JSONCaller) findStructField(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name := strings.Split(tag, ",")[0]
+
+		if field.Anonymous && name == "" {
+			embeddedType := field.Type
+			if embeddedType.Kind() == reflect.Ptr {
+				embeddedType = embeddedType.Elem()
+			}
+
+			if embeddedType.Kind() == reflect.Struct {
+				if fieldType, found := r.findStructField(embeddedType, key); found {
+					return fieldType, true
+				}
+				continue
+			}
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		if strings.EqualFold(name, key) {
+			return field.Type, true
+		}
+	}
+
+	return nil, false
+}
+
+func (r JSONCaller) joinFieldPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
 func (r JSONCaller) getMethodArgType(methodType reflect.Type, index int) (argType reflect.Type, found bool) {
 	numberOfArgs := methodType.NumIn()
 
@@ -1,6 +1,7 @@
 package dispatcher_test
 
 import (
+	"context"
 	"errors"
 	"reflect"
 
@@ -55,6 +56,46 @@ func (a *actionWithOptionalRunArgument) Run(subAction string, optionalArgs ...ar
 	return a.Value, a.Err
 }
 
+type nestedArgsType struct {
+	Name string `json:"name"`
+}
+
+type embeddedArgsType struct {
+	Zone string `json:"zone"`
+}
+
+type fakeCloudProperties struct {
+	embeddedArgsType
+
+	MemoryMB int                       `json:"memory_mb"`
+	Nested   nestedArgsType            `json:"nested"`
+	Items    []nestedArgsType          `json:"items"`
+	ByName   map[string]nestedArgsType `json:"by_name"`
+	Ignored  string                    `json:"-"`
+}
+
+type actionWithCloudPropertiesArgument struct {
+	CloudProps fakeCloudProperties
+	ExtraArgs  argsType
+}
+
+func (a *actionWithCloudPropertiesArgument) Run(cloudProps fakeCloudProperties, extraArgs argsType) (interface{}, error) {
+	a.CloudProps = cloudProps
+	a.ExtraArgs = extraArgs
+	return nil, nil
+}
+
+type actionWithContextRunArgument struct {
+	Ctx       context.Context
+	SubAction string
+}
+
+func (a *actionWithContextRunArgument) Run(ctx context.Context, subAction string) (interface{}, error) {
+	a.Ctx = ctx
+	a.SubAction = subAction
+	return nil, nil
+}
+
 type actionWithoutRunMethod struct{}
 
 type actionWithOneRunReturnValue struct{}
@@ -75,7 +116,7 @@ var _ = Describe("JSONCaller", func() {
 	)
 
 	BeforeEach(func() {
-		caller = NewJSONCaller()
+		caller = NewJSONCaller(JSONCallerLenient)
 	})
 
 	Describe("Run", func() {
@@ -92,7 +133,7 @@ var _ = Describe("JSONCaller", func() {
 				456,
 			}
 
-			value, err := caller.Call(action, args)
+			value, err := caller.Call(context.Background(), action, args)
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(Equal("fake-run-error"))
 
@@ -118,7 +159,7 @@ var _ = Describe("JSONCaller", func() {
 
 			action := &actionWithGoodRunMethod{Value: expectedValue, Err: expectedErr}
 
-			_, err := caller.Call(action, args)
+			_, err := caller.Call(context.Background(), action, args)
 			Expect(err).To(HaveOccurred())
 			_, ok := reflect.ValueOf(err).Interface().(bwcapi.NotSupportedError)
 			Expect(ok).To(BeTrue())
@@ -129,7 +170,7 @@ var _ = Describe("JSONCaller", func() {
 
 			action := &actionWithGoodRunMethod{Value: expectedValue}
 
-			_, err := caller.Call(action, []interface{}{"setup"})
+			_, err := caller.Call(context.Background(), action, []interface{}{"setup"})
 			Expect(err).To(HaveOccurred())
 		})
 
@@ -138,7 +179,7 @@ var _ = Describe("JSONCaller", func() {
 
 			action := &actionWithGoodRunMethod{Value: expectedValue}
 
-			_, err := caller.Call(action, []interface{}{
+			_, err := caller.Call(context.Background(), action, []interface{}{
 				123,
 				"setup",
 				map[string]interface{}{"user": "rob", "pwd": "rob123", "id": 12},
@@ -152,7 +193,7 @@ var _ = Describe("JSONCaller", func() {
 
 			action := &actionWithOptionalRunArgument{Value: expectedValue, Err: expectedErr}
 
-			value, err := caller.Call(action, []interface{}{
+			value, err := caller.Call(context.Background(), action, []interface{}{
 				"setup",
 				map[string]interface{}{"user": "rob", "pwd": "rob123", "id": 12},
 				map[string]interface{}{"user": "bob", "pwd": "bob123", "id": 13},
@@ -173,25 +214,208 @@ var _ = Describe("JSONCaller", func() {
 		It("handles optional arguments when not passed in", func() {
 			action := &actionWithOptionalRunArgument{}
 
-			caller.Call(action, []interface{}{"setup"})
+			caller.Call(context.Background(), action, []interface{}{"setup"})
 
 			Expect(action.SubAction).To(Equal("setup"))
 			Expect(action.OptionalArgs).To(Equal([]argsType{}))
 		})
 
+		It("passes context to action if run accepts it as the first argument", func() {
+			type ctxKey struct{}
+			ctx := context.WithValue(context.Background(), ctxKey{}, "fake-value")
+
+			action := &actionWithContextRunArgument{}
+
+			_, err := caller.Call(ctx, action, []interface{}{"setup"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(action.Ctx).To(Equal(ctx))
+			Expect(action.SubAction).To(Equal("setup"))
+		})
+
+		It("does not count context as a payload argument", func() {
+			caller = NewJSONCaller(JSONCallerStrict)
+
+			_, err := caller.Call(context.Background(), &actionWithContextRunArgument{}, []interface{}{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Not enough arguments, expected 1, got 0"))
+
+			_, err = caller.Call(context.Background(), &actionWithContextRunArgument{}, []interface{}{"setup", "extra"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Run accepts 1 arguments"))
+		})
+
 		It("returns error if action does not implement run", func() {
-			_, err := caller.Call(&actionWithoutRunMethod{}, []interface{}{})
+			_, err := caller.Call(context.Background(), &actionWithoutRunMethod{}, []interface{}{})
 			Expect(err).To(HaveOccurred())
 		})
 
 		It("returns error if actions run does not return two values", func() {
-			_, err := caller.Call(&actionWithOneRunReturnValue{}, []interface{}{})
+			_, err := caller.Call(context.Background(), &actionWithOneRunReturnValue{}, []interface{}{})
 			Expect(err).To(HaveOccurred())
 		})
 
 		It("returns error if actions run second return type is not error", func() {
-			_, err := caller.Call(&actionWithSecondReturnValueNotError{}, []interface{}{})
+			_, err := caller.Call(context.Background(), &actionWithSecondReturnValueNotError{}, []interface{}{})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("argument types", func() {
+		It("returns CpiError naming argument, field and expected type when types do not match", func() {
+			action := &actionWithGoodRunMethod{}
+
+			_, err := caller.Call(context.Background(), action, []interface{}{
+				"setup",
+				123,
+				map[string]interface{}{"user": "rob", "pwd": "rob123", "id": "12"},
+				[]interface{}{},
+			})
 			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Argument 2 field 'id' has type string (expected int)"))
+
+			cloudErr, found := bwcapi.FindCloudError(err)
+			Expect(found).To(BeTrue())
+			Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::CpiError"))
+		})
+	})
+
+	Describe("strictness", func() {
+		var (
+			action *actionWithCloudPropertiesArgument
+		)
+
+		BeforeEach(func() {
+			action = &actionWithCloudPropertiesArgument{}
+		})
+
+		cloudPropsArgs := func(cloudProps map[string]interface{}) []interface{} {
+			return []interface{}{
+				cloudProps,
+				map[string]interface{}{"user": "rob", "unknown": "fake-unknown"},
+				"fake-extra-arg",
+			}
+		}
+
+		Context("when lenient", func() {
+			BeforeEach(func() {
+				caller = NewJSONCaller(JSONCallerLenient)
+			})
+
+			It("ignores unknown fields and extra arguments", func() {
+				_, err := caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"memroy_mb": 1024,
+				}))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(action.ExtraArgs).To(Equal(argsType{User: "rob"}))
+			})
+		})
+
+		Context("when strict for cloud properties", func() {
+			BeforeEach(func() {
+				caller = NewJSONCaller(JSONCallerStrictCloudProperties)
+			})
+
+			It("accepts known fields regardless of case, including embedded ones", func() {
+				_, err := caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"MEMORY_MB": 1024,
+					"zone":      "fake-zone",
+					"nested":    map[string]interface{}{"name": "fake-name"},
+					"items":     []interface{}{map[string]interface{}{"name": "fake-name"}},
+					"by_name":   map[string]interface{}{"fake-key": map[string]interface{}{"name": "fake-name"}},
+				}))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(action.CloudProps.MemoryMB).To(Equal(1024))
+				Expect(action.CloudProps.Zone).To(Equal("fake-zone"))
+			})
+
+			It("ignores unknown fields and extra arguments outside of cloud properties", func() {
+				_, err := caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{}))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns CpiError for unknown top level field", func() {
+				_, err := caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"memroy_mb": 1024,
+				}))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(
+					"Argument 0 field 'memroy_mb' is not a known field (expected dispatcher_test.fakeCloudProperties)"))
+
+				cloudErr, found := bwcapi.FindCloudError(err)
+				Expect(found).To(BeTrue())
+				Expect(cloudErr).To(Equal(bwcapi.NewArgumentError(
+					0, "memroy_mb", "dispatcher_test.fakeCloudProperties", "is not a known field")))
+			})
+
+			It("returns CpiError with path to unknown nested fields", func() {
+				_, err := caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"nested": map[string]interface{}{"nmae": "fake-name"},
+				}))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(
+					"Argument 0 field 'nested.nmae' is not a known field (expected dispatcher_test.nestedArgsType)"))
+
+				_, err = caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"items": []interface{}{map[string]interface{}{"name": "fake-name"}, map[string]interface{}{"nmae": "fake-name"}},
+				}))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Argument 0 field 'items[1].nmae' is not a known field"))
+
+				_, err = caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"by_name": map[string]interface{}{"fake-key": map[string]interface{}{"nmae": "fake-name"}},
+				}))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Argument 0 field 'by_name.fake-key.nmae' is not a known field"))
+			})
+
+			It("returns CpiError for fields that are excluded from json", func() {
+				_, err := caller.Call(context.Background(), action, cloudPropsArgs(map[string]interface{}{
+					"Ignored": "fake-ignored",
+				}))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Argument 0 field 'Ignored' is not a known field"))
+			})
+		})
+
+		Context("when strict", func() {
+			BeforeEach(func() {
+				caller = NewJSONCaller(JSONCallerStrict)
+			})
+
+			It("returns CpiError for unknown fields in any argument", func() {
+				_, err := caller.Call(context.Background(), action, []interface{}{
+					map[string]interface{}{},
+					map[string]interface{}{"user": "rob", "unknown": "fake-unknown"},
+				})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(
+					"Argument 1 field 'unknown' is not a known field (expected dispatcher_test.argsType)"))
+			})
+
+			It("returns CpiError for extra positional arguments", func() {
+				_, err := caller.Call(context.Background(), action, []interface{}{
+					map[string]interface{}{},
+					map[string]interface{}{"user": "rob"},
+					"fake-extra-arg",
+				})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Argument 2 is not expected, Run accepts 2 arguments"))
+
+				cloudErr, found := bwcapi.FindCloudError(err)
+				Expect(found).To(BeTrue())
+				Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::CpiError"))
+			})
+
+			It("accepts variadic arguments", func() {
+				_, err := caller.Call(context.Background(), &actionWithOptionalRunArgument{}, []interface{}{
+					"setup",
+					map[string]interface{}{"user": "rob"},
+					map[string]interface{}{"user": "bob"},
+				})
+				Expect(err).ToNot(HaveOccurred())
+			})
 		})
 	})
 })
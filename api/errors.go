@@ -16,6 +16,97 @@ type RetryableError interface {
 	CanRetry() bool
 }
 
+// FindCloudError returns the outermost cloud error in a chain of wrapped errors
+// so that typed errors are reported even after being wrapped with additional context
+func FindCloudError(err error) (CloudError, bool) {
+	found := findError(err, func(err error) bool {
+		_, ok := err.(CloudError)
+		return ok
+	})
+	if found == nil {
+		return nil, false
+	}
+
+	return found.(CloudError), true
+}
+
+// FindRetryableError returns the outermost retryable error in a chain of wrapped errors
+func FindRetryableError(err error) (RetryableError, bool) {
+	found := findError(err, func(err error) bool {
+		_, ok := err.(RetryableError)
+		return ok
+	})
+	if found == nil {
+		return nil, false
+	}
+
+	return found.(RetryableError), true
+}
+
+// findError searches depth first; delegate of a complex error is checked before its cause.
+// Only errors wrapped with WrapError or WrapComplexError (or other errors
+// that implement Unwrap) are searched since bosherr does not expose wrapped errors.
+func findError(err error, matches func(error) bool) error {
+	if err == nil {
+		return nil
+	}
+
+	if matches(err) {
+		return err
+	}
+
+	for _, wrappedErr := range wrappedErrors(err) {
+		found := findError(wrappedErr, matches)
+		if found != nil {
+			return found
+		}
+	}
+
+	return nil
+}
+
+func wrappedErrors(err error) []error {
+	switch unwrapper := err.(type) {
+	case interface{ Unwrap() []error }:
+		return unwrapper.Unwrap()
+	case interface{ Unwrap() error }:
+		return []error{unwrapper.Unwrap()}
+	default:
+		return nil
+	}
+}
+
+// WrapError adds context to err the same way bosherr.WrapError does
+// but keeps err reachable so that typed errors it wraps are still reported
+func WrapError(err error, msg string, args ...interface{}) error {
+	return wrappedError{msg: fmt.Sprintf(msg, args...), err: err}
+}
+
+type wrappedError struct {
+	msg string
+	err error
+}
+
+func (e wrappedError) Error() string { return fmt.Sprintf("%s: %s", e.msg, e.err.Error()) }
+func (e wrappedError) Unwrap() error { return e.err }
+
+// WrapComplexError returns delegate (typically a CloudError) whose message includes cause
+// the same way bosherr.WrapComplexError does but keeps both of them reachable
+func WrapComplexError(cause, delegate error) error {
+	return complexError{delegate: delegate, cause: cause}
+}
+
+type complexError struct {
+	delegate error
+	cause    error
+}
+
+func (e complexError) Error() string {
+	return fmt.Sprintf("%s: %s", e.delegate.Error(), e.cause.Error())
+}
+
+func (e complexError) Unwrap() []error { return []error{e.delegate, e.cause} }
+
 // -
 type NotSupportedError struct{}
 
@@ -35,11 +126,19 @@ func (e vmNotFoundError) Type() string  { return "Bosh::Clouds::VMNotFound" }
 func (e vmNotFoundError) Error() string { return fmt.Sprintf("VM '%s' not found", e.vmID) }
 
 // -
-type VMCreationFailedError struct{}
+type vmCreationFailedError struct {
+	canRetry bool
+}
+
+// NewVMCreationFailedError is expected to be used with WrapComplexError
+// so that the reason is included in the message
+func NewVMCreationFailedError(canRetry bool) vmCreationFailedError {
+	return vmCreationFailedError{canRetry: canRetry}
+}
 
-func (e VMCreationFailedError) Type() string   { return "Bosh::Clouds::VMCreationFailed" }
-func (e VMCreationFailedError) Error() string  { return "VM failed to create" }
-func (e VMCreationFailedError) CanRetry() bool { return false }
+func (e vmCreationFailedError) Type() string   { return "Bosh::Clouds::VMCreationFailed" }
+func (e vmCreationFailedError) Error() string  { return "VM failed to create" }
+func (e vmCreationFailedError) CanRetry() bool { return e.canRetry }
 
 // -
 type NoDiskSpaceError struct{}
@@ -78,3 +177,62 @@ func NewDiskNotFoundError(diskID string) diskNotFoundError {
 func (e diskNotFoundError) Type() string   { return "Bosh::Clouds::DiskNotFound" }
 func (e diskNotFoundError) Error() string  { return fmt.Sprintf("Disk '%s' not found", e.diskID) }
 func (e diskNotFoundError) CanRetry() bool { return false }
+
+// -
+type timeoutError struct {
+	method string
+	err    error
+}
+
+// NewTimeoutError wraps error returned by an action once it was cancelled,
+// which describes the step that did not finish in time
+func NewTimeoutError(method string, err error) timeoutError {
+	return timeoutError{method: method, err: err}
+}
+
+func (e timeoutError) Type() string { return "Bosh::Clouds::CloudError" }
+
+func (e timeoutError) Error() string {
+	return fmt.Sprintf("Timed out running '%s': %s", e.method, e.err.Error())
+}
+
+func (e timeoutError) CanRetry() bool { return true }
+
+// -
+type argumentError struct {
+	index        int
+	fieldPath    string
+	expectedType string
+	reason       string
+}
+
+// NewArgumentError describes invalid argument at a given position in the arguments list;
+// field path and expected type are optional
+func NewArgumentError(index int, fieldPath, expectedType, reason string) argumentError {
+	return argumentError{
+		index:        index,
+		fieldPath:    fieldPath,
+		expectedType: expectedType,
+		reason:       reason,
+	}
+}
+
+func (e argumentError) Type() string { return "Bosh::Clouds::CpiError" }
+
+func (e argumentError) Error() string {
+	msg := fmt.Sprintf("Argument %d", e.index)
+
+	if e.fieldPath != "" {
+		msg += fmt.Sprintf(" field '%s'", e.fieldPath)
+	}
+
+	msg += " " + e.reason
+
+	if e.expectedType != "" {
+		msg += fmt.Sprintf(" (expected %s)", e.expectedType)
+	}
+
+	return msg
+}
+
+func (e argumentError) CanRetry() bool { return false }
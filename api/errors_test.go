@@ -0,0 +1,93 @@
+package api_test
+
+import (
+	"errors"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/api"
+)
+
+var _ = Describe("FindCloudError", func() {
+	It("returns error itself if it is a cloud error", func() {
+		cloudErr, found := FindCloudError(NewVMNotFoundError("fake-vm-id"))
+		Expect(found).To(BeTrue())
+		Expect(cloudErr).To(Equal(NewVMNotFoundError("fake-vm-id")))
+	})
+
+	It("returns cloud error wrapped with WrapError", func() {
+		err := WrapError(WrapError(NewDiskNotFoundError("fake-disk-id"), "fake-inner-context"), "fake-outer-context")
+
+		cloudErr, found := FindCloudError(err)
+		Expect(found).To(BeTrue())
+		Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::DiskNotFound"))
+	})
+
+	It("returns cloud error delegate of WrapComplexError", func() {
+		err := WrapError(WrapComplexError(errors.New("fake-cause"), NewVMCreationFailedError(true)), "fake-context")
+
+		cloudErr, found := FindCloudError(err)
+		Expect(found).To(BeTrue())
+		Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::VMCreationFailed"))
+	})
+
+	It("returns cloud error cause of WrapComplexError", func() {
+		err := WrapComplexError(NewDiskNotFoundError("fake-disk-id"), errors.New("fake-delegate"))
+
+		cloudErr, found := FindCloudError(err)
+		Expect(found).To(BeTrue())
+		Expect(cloudErr.Type()).To(Equal("Bosh::Clouds::DiskNotFound"))
+	})
+
+	It("returns outermost cloud error", func() {
+		err := WrapComplexError(NewDiskNotFoundError("fake-disk-id"), NoDiskSpaceError{})
+
+		cloudErr, found := FindCloudError(err)
+		Expect(found).To(BeTrue())
+		Expect(cloudErr).To(Equal(NoDiskSpaceError{}))
+	})
+
+	It("does not find cloud error hidden by bosherr wrapping", func() {
+		_, found := FindCloudError(bosherr.WrapError(NewDiskNotFoundError("fake-disk-id"), "fake-context"))
+		Expect(found).To(BeFalse())
+	})
+
+	It("does not find cloud error in plain errors", func() {
+		_, found := FindCloudError(errors.New("fake-err"))
+		Expect(found).To(BeFalse())
+
+		_, found = FindCloudError(nil)
+		Expect(found).To(BeFalse())
+	})
+})
+
+var _ = Describe("FindRetryableError", func() {
+	It("returns retryable error wrapped with WrapError and WrapComplexError", func() {
+		err := WrapError(WrapComplexError(errors.New("fake-cause"), NewVMCreationFailedError(true)), "fake-context")
+
+		retryableErr, found := FindRetryableError(err)
+		Expect(found).To(BeTrue())
+		Expect(retryableErr.CanRetry()).To(BeTrue())
+	})
+
+	It("does not find retryable error in plain errors", func() {
+		_, found := FindRetryableError(errors.New("fake-err"))
+		Expect(found).To(BeFalse())
+	})
+})
+
+var _ = Describe("WrapError", func() {
+	It("includes context and wrapped error in message", func() {
+		err := WrapError(errors.New("fake-err"), "fake-context '%s'", "fake-arg")
+		Expect(err.Error()).To(Equal("fake-context 'fake-arg': fake-err"))
+	})
+})
+
+var _ = Describe("WrapComplexError", func() {
+	It("includes delegate and cause in message", func() {
+		err := WrapComplexError(errors.New("fake-cause"), NewVMCreationFailedError(false))
+		Expect(err.Error()).To(Equal("VM failed to create: fake-cause"))
+	})
+})
@@ -0,0 +1,15 @@
+package api
+
+// RequestContext is sent by the Director along with every request
+type RequestContext struct {
+	DirectorUUID string `json:"director_uuid"`
+
+	// Allows to correlate CPI logs with Director task logs
+	RequestID string `json:"request_id"`
+
+	// Zero when Director does not specify it which is equivalent to version 1
+	APIVersion int `json:"api_version"`
+}
+
+// SupportedAPIVersion is the highest CPI API version this CPI implements
+const SupportedAPIVersion = 2
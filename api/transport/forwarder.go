@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+)
+
+const forwarderLogTag = "Forwarder"
+
+// Forwarder is a stdin/stdout shim that forwards a single request to a Server
+// so that Director can keep invoking CPI as an executable.
+type Forwarder struct {
+	in  io.Reader
+	out io.Writer
+
+	network string
+	address string
+
+	logger boshlog.Logger
+}
+
+func NewForwarder(
+	in io.Reader,
+	out io.Writer,
+	network string,
+	address string,
+	logger boshlog.Logger,
+) Forwarder {
+	return Forwarder{
+		in:  in,
+		out: out,
+
+		network: network,
+		address: address,
+
+		logger: logger,
+	}
+}
+
+func (t Forwarder) ServeOnce() error {
+	reqBytes, err := ioutil.ReadAll(t.in)
+	if err != nil {
+		t.logger.Error(forwarderLogTag, "Failed reading from IN: %s", err)
+		return bosherr.WrapError(err, "Reading from IN")
+	}
+
+	respBytes, err := t.forward(reqBytes)
+	if err != nil {
+		t.logger.Error(forwarderLogTag, "Failed forwarding request: %s", err)
+		return bosherr.WrapError(err, "Forwarding request to %s '%s'", t.network, t.address)
+	}
+
+	_, err = t.out.Write(respBytes)
+	if err != nil {
+		t.logger.Error(forwarderLogTag, "Failed writing to OUT: %s", err)
+		return bosherr.WrapError(err, "Writing to OUT")
+	}
+
+	return nil
+}
+
+func (t Forwarder) forward(reqBytes []byte) ([]byte, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			// Always dial configured address since unix socket has no host
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.Dial(t.network, t.address)
+			},
+		},
+	}
+
+	resp, err := client.Post("http://cpi/", "application/json", bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Sending request")
+	}
+
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading response")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, bosherr.New("Received non-200 status code '%d': %s", resp.StatusCode, respBytes)
+	}
+
+	return respBytes, nil
+}
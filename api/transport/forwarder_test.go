@@ -0,0 +1,109 @@
+package transport_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	fakedisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher/fakes"
+	. "github.com/cppforlife/bosh-warden-cpi/api/transport"
+)
+
+var _ = Describe("Forwarder", func() {
+	var (
+		tmpDir     string
+		socketPath string
+		in         *FakeReader // io.Reader
+		out        *FakeWriter // io.Writer
+		logger     boshlog.Logger
+		forwarder  Forwarder
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "forwarder-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		socketPath = filepath.Join(tmpDir, "cpi.sock")
+
+		in = &FakeReader{}
+		out = &FakeWriter{}
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		forwarder = NewForwarder(in, out, "unix", socketPath, logger)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	Describe("ServeOnce", func() {
+		Context("when server is running", func() {
+			var (
+				dispatcher *fakedisp.FakeDispatcher
+				server     Server
+			)
+
+			BeforeEach(func() {
+				dispatcher = &fakedisp.FakeDispatcher{}
+
+				fs := boshsys.NewOsFileSystem(logger)
+				server = NewServer("unix", socketPath, dispatcher, fs, logger)
+
+				go func(server Server) { server.ListenAndServe() }(server)
+
+				Eventually(func() bool {
+					_, listening := server.Addr()
+					return listening
+				}).Should(BeTrue())
+			})
+
+			AfterEach(func() {
+				server.Shutdown()
+			})
+
+			It("forwards request from in to server and writes server's response to out", func() {
+				in.ReadBytes = []byte("fake-bytes-in")
+
+				dispatcher.DispatchRespBytes = []byte("fake-bytes-out")
+
+				err := forwarder.ServeOnce()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(dispatcher.DispatchReqBytes).To(Equal([]byte("fake-bytes-in")))
+
+				Expect(out.WriteBytes).To(Equal([]byte("fake-bytes-out")))
+			})
+
+			It("returns error if writing response to out fails", func() {
+				out.WriteErr = errors.New("fake-write-err")
+
+				err := forwarder.ServeOnce()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+			})
+		})
+
+		It("returns error if reading request from in fails", func() {
+			in.ReadErr = errors.New("fake-read-err")
+
+			err := forwarder.ServeOnce()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-read-err"))
+		})
+
+		It("returns error without writing to out if server is not running", func() {
+			err := forwarder.ServeOnce()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Forwarding request to unix"))
+
+			Expect(out.WriteBytes).To(BeNil())
+		})
+	})
+})
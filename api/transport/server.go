@@ -0,0 +1,200 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+
+	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
+)
+
+const serverLogTag = "Server"
+
+const socketFileMode = os.FileMode(0600)
+
+// Server serves dispatcher over HTTP on a unix socket or a localhost TCP address
+// so that process startup and Garden connection are shared across requests.
+type Server struct {
+	network string
+	address string
+
+	dispatcher bwcdisp.Dispatcher
+	fs         boshsys.FileSystem
+	logger     boshlog.Logger
+
+	httpServer *http.Server
+
+	// Used to give each request its own log tag
+	lastReqNum *uint64
+
+	listenerLock *sync.Mutex
+	listener     *net.Listener
+
+	// Closed once in-flight requests finished after Shutdown
+	shutdownOnce *sync.Once
+	shutdownDone chan struct{}
+}
+
+func NewServer(
+	network string,
+	address string,
+	dispatcher bwcdisp.Dispatcher,
+	fs boshsys.FileSystem,
+	logger boshlog.Logger,
+) Server {
+	s := Server{
+		network: network,
+		address: address,
+
+		dispatcher: dispatcher,
+		fs:         fs,
+		logger:     logger,
+
+		lastReqNum: new(uint64),
+
+		listenerLock: &sync.Mutex{},
+		listener:     new(net.Listener),
+
+		shutdownOnce: &sync.Once{},
+		shutdownDone: make(chan struct{}),
+	}
+
+	s.httpServer = &http.Server{Handler: http.HandlerFunc(s.serveHTTP)}
+
+	return s
+}
+
+// ListenAndServe blocks until serving fails or Shutdown is called
+// and in-flight requests are finished.
+func (s Server) ListenAndServe() error {
+	if s.network == "unix" {
+		err := s.removeStaleSocket()
+		if err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen(s.network, s.address)
+	if err != nil {
+		return bosherr.WrapError(err, "Listening on %s '%s'", s.network, s.address)
+	}
+
+	if s.network == "unix" {
+		// Requests are served with CPI's privileges hence only its user may connect
+		err = s.fs.Chmod(s.address, socketFileMode)
+		if err != nil {
+			listener.Close()
+			return bosherr.WrapError(err, "Changing socket '%s' mode", s.address)
+		}
+	}
+
+	s.listenerLock.Lock()
+	*s.listener = listener
+	s.listenerLock.Unlock()
+
+	s.logger.Info(serverLogTag, "Listening on %s '%s'", s.network, s.address)
+
+	err = s.httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		// Serve returns as soon as Shutdown starts hence wait for it to finish
+		<-s.shutdownDone
+		return nil
+	}
+
+	if err != nil {
+		return bosherr.WrapError(err, "Serving on %s '%s'", s.network, s.address)
+	}
+
+	return nil
+}
+
+// removeStaleSocket removes socket file left behind if previous server was killed
+// but refuses to remove anything else in case address is misconfigured
+func (s Server) removeStaleSocket() error {
+	fileInfo, err := os.Lstat(s.address)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return bosherr.WrapError(err, "Checking stale socket '%s'", s.address)
+	}
+
+	if fileInfo.Mode()&os.ModeSocket == 0 {
+		return bosherr.New("Expected '%s' to be a socket", s.address)
+	}
+
+	err = s.fs.RemoveAll(s.address)
+	if err != nil {
+		return bosherr.WrapError(err, "Removing stale socket '%s'", s.address)
+	}
+
+	return nil
+}
+
+// Shutdown stops accepting new requests and waits for in-flight requests to finish.
+func (s Server) Shutdown() error {
+	s.logger.Info(serverLogTag, "Shutting down")
+
+	err := s.httpServer.Shutdown(context.Background())
+
+	s.shutdownOnce.Do(func() { close(s.shutdownDone) })
+
+	if err != nil {
+		return bosherr.WrapError(err, "Shutting down server")
+	}
+
+	return nil
+}
+
+// Addr returns listening address once server started listening.
+func (s Server) Addr() (net.Addr, bool) {
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+
+	if *s.listener == nil {
+		return nil, false
+	}
+
+	return (*s.listener).Addr(), true
+}
+
+func (s Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	logTag := fmt.Sprintf("%s:%d", serverLogTag, atomic.AddUint64(s.lastReqNum, 1))
+
+	if r.Method != "POST" {
+		s.logger.Error(logTag, "Rejecting request with method '%s'", r.Method)
+		http.Error(w, "Must use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqBytes, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.logger.Error(logTag, "Failed reading request: %s", err)
+		http.Error(w, "Failed reading request", http.StatusBadRequest)
+		return
+	}
+
+	s.logger.Debug(logTag, "Dispatching request")
+
+	respBytes := s.dispatcher.Dispatch(reqBytes)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(respBytes)
+	if err != nil {
+		s.logger.Error(logTag, "Failed writing response: %s", err)
+		return
+	}
+
+	s.logger.Debug(logTag, "Dispatched request")
+}
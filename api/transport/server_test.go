@@ -0,0 +1,253 @@
+package transport_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	fakedisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher/fakes"
+	. "github.com/cppforlife/bosh-warden-cpi/api/transport"
+)
+
+// blockingDispatcher holds requests until released to check concurrent serving
+type blockingDispatcher struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d blockingDispatcher) Dispatch(reqBytes []byte) []byte {
+	d.started <- struct{}{}
+	<-d.release
+	return reqBytes
+}
+
+var _ = Describe("Server", func() {
+	var (
+		tmpDir     string
+		socketPath string
+		dispatcher *fakedisp.FakeDispatcher
+		logger     boshlog.Logger
+		server     Server
+		serveErrs  chan error
+	)
+
+	unixClient := func() *http.Client {
+		return &http.Client{
+			Transport: &http.Transport{
+				Dial: func(_, _ string) (net.Conn, error) {
+					return net.Dial("unix", socketPath)
+				},
+			},
+		}
+	}
+
+	startServer := func() {
+		errs := make(chan error, 1)
+		serveErrs = errs
+
+		go func(server Server) {
+			errs <- server.ListenAndServe()
+		}(server)
+
+		Eventually(func() bool {
+			_, listening := server.Addr()
+			return listening
+		}).Should(BeTrue())
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "server-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		socketPath = filepath.Join(tmpDir, "cpi.sock")
+
+		dispatcher = &fakedisp.FakeDispatcher{}
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		fs := boshsys.NewOsFileSystem(logger)
+		server = NewServer("unix", socketPath, dispatcher, fs, logger)
+	})
+
+	AfterEach(func() {
+		server.Shutdown()
+		os.RemoveAll(tmpDir)
+	})
+
+	It("dispatches POSTed request and responds with dispatcher's response", func() {
+		dispatcher.DispatchRespBytes = []byte("fake-bytes-out")
+
+		startServer()
+
+		resp, err := unixClient().Post("http://cpi/", "application/json", bytes.NewBufferString("fake-bytes-in"))
+		Expect(err).ToNot(HaveOccurred())
+
+		defer resp.Body.Close()
+
+		respBytes, err := ioutil.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(respBytes).To(Equal([]byte("fake-bytes-out")))
+
+		Expect(dispatcher.DispatchReqBytes).To(Equal([]byte("fake-bytes-in")))
+	})
+
+	It("rejects requests that are not POSTs", func() {
+		startServer()
+
+		resp, err := unixClient().Get("http://cpi/")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer resp.Body.Close()
+
+		Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+		Expect(dispatcher.DispatchReqBytes).To(BeNil())
+	})
+
+	It("serves requests concurrently", func() {
+		blockingDisp := blockingDispatcher{
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+
+		fs := boshsys.NewOsFileSystem(logger)
+		server = NewServer("unix", socketPath, blockingDisp, fs, logger)
+
+		startServer()
+
+		wg := &sync.WaitGroup{}
+
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				resp, err := unixClient().Post("http://cpi/", "application/json", bytes.NewBufferString("fake-bytes-in"))
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+			}()
+		}
+
+		// Both requests must be in progress at the same time
+		Eventually(blockingDisp.started).Should(Receive())
+		Eventually(blockingDisp.started).Should(Receive())
+
+		close(blockingDisp.release)
+
+		wg.Wait()
+	})
+
+	It("replaces stale socket file left by previous server", func() {
+		listener, err := net.Listen("unix", socketPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Killed server does not remove its socket
+		listener.(*net.UnixListener).SetUnlinkOnClose(false)
+		listener.Close()
+
+		startServer()
+	})
+
+	It("refuses to replace file at address that is not a socket", func() {
+		err := ioutil.WriteFile(socketPath, []byte("fake-contents"), os.FileMode(0600))
+		Expect(err).ToNot(HaveOccurred())
+
+		err = server.ListenAndServe()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("to be a socket"))
+
+		contents, err := ioutil.ReadFile(socketPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(contents)).To(Equal("fake-contents"))
+	})
+
+	It("makes socket accessible only to its owner", func() {
+		startServer()
+
+		fileInfo, err := os.Stat(socketPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileInfo.Mode().Perm()).To(Equal(os.FileMode(0600)))
+	})
+
+	It("stops serving after shutdown", func() {
+		startServer()
+
+		err := server.Shutdown()
+		Expect(err).ToNot(HaveOccurred())
+
+		Eventually(serveErrs).Should(Receive(BeNil()))
+
+		_, err = unixClient().Post("http://cpi/", "application/json", bytes.NewBufferString("fake-bytes-in"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("waits for in-flight requests to finish before returning after shutdown", func() {
+		blockingDisp := blockingDispatcher{
+			started: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+
+		fs := boshsys.NewOsFileSystem(logger)
+		server = NewServer("unix", socketPath, blockingDisp, fs, logger)
+
+		startServer()
+
+		releaseOnce := &sync.Once{}
+		release := func() { releaseOnce.Do(func() { close(blockingDisp.release) }) }
+
+		// Failing expectations must not leave request (and shutdown) hanging
+		defer release()
+
+		respBodies := make(chan []byte, 1)
+
+		go func() {
+			defer GinkgoRecover()
+
+			resp, err := unixClient().Post("http://cpi/", "application/json", bytes.NewBufferString("fake-bytes-in"))
+			Expect(err).ToNot(HaveOccurred())
+
+			defer resp.Body.Close()
+
+			respBytes, err := ioutil.ReadAll(resp.Body)
+			Expect(err).ToNot(HaveOccurred())
+
+			respBodies <- respBytes
+		}()
+
+		Eventually(blockingDisp.started).Should(Receive())
+
+		shutdownErrs := make(chan error, 1)
+
+		go func() { shutdownErrs <- server.Shutdown() }()
+
+		// Slow request is still in progress
+		Consistently(serveErrs).ShouldNot(Receive())
+		Consistently(shutdownErrs).ShouldNot(Receive())
+
+		release()
+
+		Eventually(respBodies).Should(Receive(Equal([]byte("fake-bytes-in"))))
+		Eventually(shutdownErrs).Should(Receive(BeNil()))
+		Eventually(serveErrs).Should(Receive(BeNil()))
+	})
+
+	It("returns error if listening fails", func() {
+		fs := boshsys.NewOsFileSystem(logger)
+		server = NewServer("unix", filepath.Join(tmpDir, "fake-missing-dir", "cpi.sock"), dispatcher, fs, logger)
+
+		err := server.ListenAndServe()
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Listening on unix"))
+	})
+})
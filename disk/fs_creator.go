@@ -3,11 +3,15 @@ package disk
 import (
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
 	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
+
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 )
 
 const fsCreatorLogTag = "FSCreator"
@@ -49,26 +53,39 @@ func (c FSCreator) Create(size int) (Disk, error) {
 
 	err = c.fs.WriteFile(diskPath, []byte{})
 	if err != nil {
-		return nil, bosherr.WrapError(err, "Creating empty disk")
+		return nil, bwcapi.WrapError(c.classifyErr(err, ""), "Creating empty disk")
 	}
 
 	sizeStr := strconv.Itoa(size) + "MB"
 
-	_, _, _, err = c.cmdRunner.RunCommand("truncate", "-s", sizeStr, diskPath)
+	_, stderr, _, err := c.cmdRunner.RunCommand("truncate", "-s", sizeStr, diskPath)
 	if err != nil {
 		c.cleanUpFile(diskPath)
-		return nil, bosherr.WrapError(err, "Resizing disk to '%s'", sizeStr)
+		return nil, bwcapi.WrapError(c.classifyErr(err, stderr), "Resizing disk to '%s'", sizeStr)
 	}
 
-	_, _, _, err = c.cmdRunner.RunCommand("/sbin/mkfs", "-t", "ext4", "-F", diskPath)
+	_, stderr, _, err = c.cmdRunner.RunCommand("/sbin/mkfs", "-t", "ext4", "-F", diskPath)
 	if err != nil {
 		c.cleanUpFile(diskPath)
-		return nil, bosherr.WrapError(err, "Building disk filesystem '%s'", diskPath)
+		return nil, bwcapi.WrapError(c.classifyErr(err, stderr), "Building disk filesystem '%s'", diskPath)
 	}
 
 	return NewFSDisk(id, diskPath, c.fs, c.logger), nil
 }
 
+// classifyErr marks errors caused by host running out of space
+// so that Director does not retry creating disk of the same size
+func (c FSCreator) classifyErr(err error, stderr string) error {
+	noSpaceMsg := strings.ToLower(syscall.ENOSPC.Error())
+
+	if strings.Contains(strings.ToLower(err.Error()), noSpaceMsg) ||
+		strings.Contains(strings.ToLower(stderr), noSpaceMsg) {
+		return bwcapi.WrapComplexError(err, bwcapi.NoDiskSpaceError{})
+	}
+
+	return err
+}
+
 func (c FSCreator) cleanUpFile(path string) {
 	err := c.fs.RemoveAll(path)
 	if err != nil {
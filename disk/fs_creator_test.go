@@ -2,6 +2,7 @@ package disk_test
 
 import (
 	"errors"
+	"syscall"
 
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
@@ -9,6 +10,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	. "github.com/cppforlife/bosh-warden-cpi/disk"
 )
 
@@ -114,6 +116,34 @@ var _ = Describe("FSCreator", func() {
 							Expect(err).To(HaveOccurred())
 							Expect(err.Error()).To(ContainSubstring("fake-run-err"))
 							Expect(disk).To(BeNil())
+
+							_, found := bwcapi.FindCloudError(err)
+							Expect(found).To(BeFalse())
+						})
+
+						ItDestroysFile("fake-run-err")
+					})
+
+					Context("when turning file into a filesystem fails because host is out of space", func() {
+						BeforeEach(func() {
+							cmdRunner.AddCmdResult(
+								"/sbin/mkfs -t ext4 -F /fake-disks-dir/fake-uuid",
+								fakesys.FakeCmdResult{
+									Stderr: "mkfs: No space left on device while writing out inode tables",
+									Error:  errors.New("fake-run-err"),
+								},
+							)
+						})
+
+						It("returns no disk space error", func() {
+							disk, err := creator.Create(40)
+							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+							Expect(disk).To(BeNil())
+
+							cloudErr, found := bwcapi.FindCloudError(err)
+							Expect(found).To(BeTrue())
+							Expect(cloudErr).To(Equal(bwcapi.NoDiskSpaceError{}))
 						})
 
 						ItDestroysFile("fake-run-err")
@@ -148,6 +178,18 @@ var _ = Describe("FSCreator", func() {
 					Expect(err.Error()).To(ContainSubstring("fake-write-file-err"))
 					Expect(disk).To(BeNil())
 				})
+
+				It("returns no disk space error if host is out of space", func() {
+					fs.WriteToFileError = syscall.ENOSPC
+
+					disk, err := creator.Create(40)
+					Expect(err).To(HaveOccurred())
+					Expect(disk).To(BeNil())
+
+					cloudErr, found := bwcapi.FindCloudError(err)
+					Expect(found).To(BeTrue())
+					Expect(cloudErr).To(Equal(bwcapi.NoDiskSpaceError{}))
+				})
 			})
 		})
 
@@ -0,0 +1,48 @@
+package fakes
+
+import (
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+)
+
+type FakeJournal struct {
+	Intents map[string]bwcinv.Intent
+
+	// Intents in the order they were begun
+	BegunIntents []bwcinv.Intent
+	FinishedCIDs []string
+
+	BeginErr  error
+	FindErr   error
+	FinishErr error
+}
+
+func NewFakeJournal() *FakeJournal {
+	return &FakeJournal{Intents: map[string]bwcinv.Intent{}}
+}
+
+func (j *FakeJournal) Begin(intent bwcinv.Intent) error {
+	if j.BeginErr != nil {
+		return j.BeginErr
+	}
+
+	j.Intents[intent.VMCID] = intent
+	j.BegunIntents = append(j.BegunIntents, intent)
+
+	return nil
+}
+
+func (j *FakeJournal) Find(vmCID string) (bwcinv.Intent, bool, error) {
+	intent, found := j.Intents[vmCID]
+	return intent, found, j.FindErr
+}
+
+func (j *FakeJournal) Finish(vmCID string) error {
+	if j.FinishErr != nil {
+		return j.FinishErr
+	}
+
+	delete(j.Intents, vmCID)
+	j.FinishedCIDs = append(j.FinishedCIDs, vmCID)
+
+	return nil
+}
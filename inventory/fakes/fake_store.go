@@ -0,0 +1,159 @@
+package fakes
+
+import (
+	"sort"
+
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+)
+
+type FakeStore struct {
+	VMs       map[string]bwcinv.VMRecord
+	Disks     map[string]bwcinv.DiskRecord
+	Stemcells map[string]bwcinv.StemcellRecord
+
+	SaveVMErr   error
+	FindVMErr   error
+	DeleteVMErr error
+
+	SaveDiskErr   error
+	FindDiskErr   error
+	DeleteDiskErr error
+
+	SaveStemcellErr   error
+	FindStemcellErr   error
+	DeleteStemcellErr error
+
+	FindAllErr error
+}
+
+func NewFakeStore() *FakeStore {
+	return &FakeStore{
+		VMs:       map[string]bwcinv.VMRecord{},
+		Disks:     map[string]bwcinv.DiskRecord{},
+		Stemcells: map[string]bwcinv.StemcellRecord{},
+	}
+}
+
+func (s *FakeStore) SaveVM(record bwcinv.VMRecord) error {
+	if s.SaveVMErr != nil {
+		return s.SaveVMErr
+	}
+
+	s.VMs[record.CID] = record
+
+	return nil
+}
+
+func (s *FakeStore) FindVM(cid string) (bwcinv.VMRecord, bool, error) {
+	record, found := s.VMs[cid]
+	return record, found, s.FindVMErr
+}
+
+func (s *FakeStore) FindAllVMs() ([]bwcinv.VMRecord, error) {
+	records := []bwcinv.VMRecord{}
+
+	for _, cid := range s.sortedKeys(len(s.VMs), func(keys *[]string) {
+		for cid := range s.VMs {
+			*keys = append(*keys, cid)
+		}
+	}) {
+		records = append(records, s.VMs[cid])
+	}
+
+	return records, s.FindAllErr
+}
+
+func (s *FakeStore) DeleteVM(cid string) error {
+	if s.DeleteVMErr != nil {
+		return s.DeleteVMErr
+	}
+
+	delete(s.VMs, cid)
+
+	return nil
+}
+
+func (s *FakeStore) SaveDisk(record bwcinv.DiskRecord) error {
+	if s.SaveDiskErr != nil {
+		return s.SaveDiskErr
+	}
+
+	s.Disks[record.CID] = record
+
+	return nil
+}
+
+func (s *FakeStore) FindDisk(cid string) (bwcinv.DiskRecord, bool, error) {
+	record, found := s.Disks[cid]
+	return record, found, s.FindDiskErr
+}
+
+func (s *FakeStore) FindAllDisks() ([]bwcinv.DiskRecord, error) {
+	records := []bwcinv.DiskRecord{}
+
+	for _, cid := range s.sortedKeys(len(s.Disks), func(keys *[]string) {
+		for cid := range s.Disks {
+			*keys = append(*keys, cid)
+		}
+	}) {
+		records = append(records, s.Disks[cid])
+	}
+
+	return records, s.FindAllErr
+}
+
+func (s *FakeStore) DeleteDisk(cid string) error {
+	if s.DeleteDiskErr != nil {
+		return s.DeleteDiskErr
+	}
+
+	delete(s.Disks, cid)
+
+	return nil
+}
+
+func (s *FakeStore) SaveStemcell(record bwcinv.StemcellRecord) error {
+	if s.SaveStemcellErr != nil {
+		return s.SaveStemcellErr
+	}
+
+	s.Stemcells[record.CID] = record
+
+	return nil
+}
+
+func (s *FakeStore) FindStemcell(cid string) (bwcinv.StemcellRecord, bool, error) {
+	record, found := s.Stemcells[cid]
+	return record, found, s.FindStemcellErr
+}
+
+func (s *FakeStore) FindAllStemcells() ([]bwcinv.StemcellRecord, error) {
+	records := []bwcinv.StemcellRecord{}
+
+	for _, cid := range s.sortedKeys(len(s.Stemcells), func(keys *[]string) {
+		for cid := range s.Stemcells {
+			*keys = append(*keys, cid)
+		}
+	}) {
+		records = append(records, s.Stemcells[cid])
+	}
+
+	return records, s.FindAllErr
+}
+
+func (s *FakeStore) DeleteStemcell(cid string) error {
+	if s.DeleteStemcellErr != nil {
+		return s.DeleteStemcellErr
+	}
+
+	delete(s.Stemcells, cid)
+
+	return nil
+}
+
+func (s *FakeStore) sortedKeys(size int, collect func(*[]string)) []string {
+	keys := make([]string, 0, size)
+	collect(&keys)
+	sort.Strings(keys)
+	return keys
+}
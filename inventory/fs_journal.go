@@ -0,0 +1,38 @@
+package inventory
+
+import (
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
+)
+
+const fsJournalIntentsDir = "intents"
+
+// FSJournal keeps intents next to inventory records, e.g. <dir>/intents/<vm-cid>.json,
+// and writes them the same way so that an intent is either fully recorded or absent.
+type FSJournal struct {
+	store FSStore
+}
+
+func NewFSJournal(
+	dirPath string,
+	fs boshsys.FileSystem,
+	uuidGen boshuuid.Generator,
+	logger boshlog.Logger,
+) FSJournal {
+	return FSJournal{store: NewFSStore(dirPath, fs, uuidGen, logger)}
+}
+
+func (j FSJournal) Begin(intent Intent) error {
+	return j.store.save(fsJournalIntentsDir, intent.VMCID, intent)
+}
+
+func (j FSJournal) Find(vmCID string) (Intent, bool, error) {
+	var intent Intent
+	found, err := j.store.find(fsJournalIntentsDir, vmCID, &intent)
+	return intent, found, err
+}
+
+func (j FSJournal) Finish(vmCID string) error {
+	return j.store.delete(fsJournalIntentsDir, vmCID)
+}
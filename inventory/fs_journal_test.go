@@ -0,0 +1,103 @@
+package inventory_test
+
+import (
+	"errors"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	fakeuuid "github.com/cloudfoundry/bosh-agent/uuid/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/inventory"
+)
+
+var _ = Describe("FSJournal", func() {
+	var (
+		fs      *fakesys.FakeFileSystem
+		uuidGen *fakeuuid.FakeGenerator
+		journal FSJournal
+	)
+
+	BeforeEach(func() {
+		fs = fakesys.NewFakeFileSystem()
+		uuidGen = &fakeuuid.FakeGenerator{GeneratedUuid: "fake-uuid"}
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+		journal = NewFSJournal("/fake-state-dir", fs, uuidGen, logger)
+	})
+
+	intent := Intent{
+		VMCID:     "fake-vm-cid",
+		Op:        IntentOpAttachDisk,
+		DiskCID:   "fake-disk-cid",
+		StartedAt: time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	Describe("Begin", func() {
+		It("writes intent as JSON through a temporary file", func() {
+			err := journal.Begin(intent)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.RenameOldPaths).To(Equal([]string{"/fake-state-dir/intents/fake-vm-cid.json.fake-uuid.tmp"}))
+			Expect(fs.RenameNewPaths).To(Equal([]string{"/fake-state-dir/intents/fake-vm-cid.json"}))
+
+			contents, err := fs.ReadFileString("/fake-state-dir/intents/fake-vm-cid.json")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{
+				"vm_cid": "fake-vm-cid",
+				"op": "attach_disk",
+				"disk_cid": "fake-disk-cid",
+				"started_at": "2014-01-02T03:04:05Z"
+			}`))
+		})
+
+		It("returns error if writing intent fails", func() {
+			fs.WriteToFileError = errors.New("fake-write-err")
+
+			err := journal.Begin(intent)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+		})
+	})
+
+	Describe("Find", func() {
+		It("returns begun intent", func() {
+			err := journal.Begin(intent)
+			Expect(err).ToNot(HaveOccurred())
+
+			foundIntent, found, err := journal.Find("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(foundIntent).To(Equal(intent))
+		})
+
+		It("returns found as false if there is no intent for the VM", func() {
+			_, found, err := journal.Find("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("Finish", func() {
+		It("removes intent", func() {
+			err := journal.Begin(intent)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = journal.Finish("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, found, err := journal.Find("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		It("returns error if removing intent fails", func() {
+			fs.RemoveAllError = errors.New("fake-remove-err")
+
+			err := journal.Finish("fake-vm-cid")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-remove-err"))
+		})
+	})
+})
@@ -0,0 +1,245 @@
+package inventory
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
+)
+
+const fsStoreLogTag = "FSStore"
+
+const (
+	fsStoreVMsDir       = "vms"
+	fsStoreDisksDir     = "disks"
+	fsStoreStemcellsDir = "stemcells"
+
+	fsStoreRecordSuffix = ".json"
+)
+
+// FSStore keeps one JSON file per object under state directory, e.g. <dir>/vms/<cid>.json.
+// Records are written to a temporary file and renamed into place
+// so that a crash never leaves a partially written record behind.
+type FSStore struct {
+	dirPath string
+
+	fs      boshsys.FileSystem
+	uuidGen boshuuid.Generator
+	logger  boshlog.Logger
+}
+
+func NewFSStore(
+	dirPath string,
+	fs boshsys.FileSystem,
+	uuidGen boshuuid.Generator,
+	logger boshlog.Logger,
+) FSStore {
+	return FSStore{
+		dirPath: dirPath,
+
+		fs:      fs,
+		uuidGen: uuidGen,
+		logger:  logger,
+	}
+}
+
+func (s FSStore) SaveVM(record VMRecord) error {
+	return s.save(fsStoreVMsDir, record.CID, record)
+}
+
+func (s FSStore) FindVM(cid string) (VMRecord, bool, error) {
+	var record VMRecord
+	found, err := s.find(fsStoreVMsDir, cid, &record)
+	return record, found, err
+}
+
+func (s FSStore) FindAllVMs() ([]VMRecord, error) {
+	records := []VMRecord{}
+
+	err := s.findAll(fsStoreVMsDir, func(cid string) (bool, error) {
+		record, found, err := s.FindVM(cid)
+		if found {
+			records = append(records, record)
+		}
+		return found, err
+	})
+
+	return records, err
+}
+
+func (s FSStore) DeleteVM(cid string) error {
+	return s.delete(fsStoreVMsDir, cid)
+}
+
+func (s FSStore) SaveDisk(record DiskRecord) error {
+	return s.save(fsStoreDisksDir, record.CID, record)
+}
+
+func (s FSStore) FindDisk(cid string) (DiskRecord, bool, error) {
+	var record DiskRecord
+	found, err := s.find(fsStoreDisksDir, cid, &record)
+	return record, found, err
+}
+
+func (s FSStore) FindAllDisks() ([]DiskRecord, error) {
+	records := []DiskRecord{}
+
+	err := s.findAll(fsStoreDisksDir, func(cid string) (bool, error) {
+		record, found, err := s.FindDisk(cid)
+		if found {
+			records = append(records, record)
+		}
+		return found, err
+	})
+
+	return records, err
+}
+
+func (s FSStore) DeleteDisk(cid string) error {
+	return s.delete(fsStoreDisksDir, cid)
+}
+
+func (s FSStore) SaveStemcell(record StemcellRecord) error {
+	return s.save(fsStoreStemcellsDir, record.CID, record)
+}
+
+func (s FSStore) FindStemcell(cid string) (StemcellRecord, bool, error) {
+	var record StemcellRecord
+	found, err := s.find(fsStoreStemcellsDir, cid, &record)
+	return record, found, err
+}
+
+func (s FSStore) FindAllStemcells() ([]StemcellRecord, error) {
+	records := []StemcellRecord{}
+
+	err := s.findAll(fsStoreStemcellsDir, func(cid string) (bool, error) {
+		record, found, err := s.FindStemcell(cid)
+		if found {
+			records = append(records, record)
+		}
+		return found, err
+	})
+
+	return records, err
+}
+
+func (s FSStore) DeleteStemcell(cid string) error {
+	return s.delete(fsStoreStemcellsDir, cid)
+}
+
+func (s FSStore) save(kind, cid string, record interface{}) error {
+	if cid == "" {
+		return bosherr.New("Expected non-empty CID for %s record", kind)
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return bosherr.WrapError(err, "Marshalling %s record '%s'", kind, cid)
+	}
+
+	err = s.fs.MkdirAll(filepath.Join(s.dirPath, kind), os.FileMode(0700))
+	if err != nil {
+		return bosherr.WrapError(err, "Creating %s records directory", kind)
+	}
+
+	id, err := s.uuidGen.Generate()
+	if err != nil {
+		return bosherr.WrapError(err, "Generating temporary record name")
+	}
+
+	recordPath := s.recordPath(kind, cid)
+
+	// Temporary file is in the same directory so that rename does not cross filesystems
+	tmpPath := recordPath + "." + id + ".tmp"
+
+	s.logger.Debug(fsStoreLogTag, "Saving %s record '%s'", kind, cid)
+
+	err = s.fs.WriteFile(tmpPath, recordBytes)
+	if err != nil {
+		s.cleanUpFile(tmpPath)
+		return bosherr.WrapError(err, "Writing %s record '%s'", kind, cid)
+	}
+
+	err = s.fs.Rename(tmpPath, recordPath)
+	if err != nil {
+		s.cleanUpFile(tmpPath)
+		return bosherr.WrapError(err, "Renaming %s record '%s'", kind, cid)
+	}
+
+	return nil
+}
+
+func (s FSStore) find(kind, cid string, record interface{}) (bool, error) {
+	recordPath := s.recordPath(kind, cid)
+
+	if !s.fs.FileExists(recordPath) {
+		return false, nil
+	}
+
+	recordBytes, err := s.fs.ReadFile(recordPath)
+	if err != nil {
+		return false, bosherr.WrapError(err, "Reading %s record '%s'", kind, cid)
+	}
+
+	err = json.Unmarshal(recordBytes, record)
+	if err != nil {
+		return false, bosherr.WrapError(err, "Unmarshalling %s record '%s'", kind, cid)
+	}
+
+	return true, nil
+}
+
+func (s FSStore) findAll(kind string, findFunc func(string) (bool, error)) error {
+	paths, err := s.fs.Glob(filepath.Join(s.dirPath, kind, "*"+fsStoreRecordSuffix))
+	if err != nil {
+		return bosherr.WrapError(err, "Listing %s records", kind)
+	}
+
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		cid, err := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), fsStoreRecordSuffix))
+		if err != nil {
+			s.logger.Debug(fsStoreLogTag, "Skipping unexpected file '%s'", path)
+			continue
+		}
+
+		// Record might have been deleted since listing
+		_, err = findFunc(cid)
+		if err != nil {
+			return bosherr.WrapError(err, "Finding %s record '%s'", kind, cid)
+		}
+	}
+
+	return nil
+}
+
+func (s FSStore) delete(kind, cid string) error {
+	s.logger.Debug(fsStoreLogTag, "Deleting %s record '%s'", kind, cid)
+
+	err := s.fs.RemoveAll(s.recordPath(kind, cid))
+	if err != nil {
+		return bosherr.WrapError(err, "Deleting %s record '%s'", kind, cid)
+	}
+
+	return nil
+}
+
+func (s FSStore) recordPath(kind, cid string) string {
+	// CIDs are provided by Director so they are escaped to stay within the directory
+	return filepath.Join(s.dirPath, kind, url.PathEscape(cid)+fsStoreRecordSuffix)
+}
+
+func (s FSStore) cleanUpFile(path string) {
+	err := s.fs.RemoveAll(path)
+	if err != nil {
+		s.logger.Error(fsStoreLogTag, "Failed to clean up temporary record '%s': %s", path, err)
+	}
+}
@@ -0,0 +1,260 @@
+package inventory_test
+
+import (
+	"errors"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	fakeuuid "github.com/cloudfoundry/bosh-agent/uuid/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/inventory"
+)
+
+var _ = Describe("FSStore", func() {
+	var (
+		fs      *fakesys.FakeFileSystem
+		uuidGen *fakeuuid.FakeGenerator
+		store   FSStore
+	)
+
+	BeforeEach(func() {
+		fs = fakesys.NewFakeFileSystem()
+		uuidGen = &fakeuuid.FakeGenerator{GeneratedUuid: "fake-uuid"}
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+		store = NewFSStore("/fake-state-dir", fs, uuidGen, logger)
+	})
+
+	vmRecord := VMRecord{
+		CID:         "fake-vm-cid",
+		AgentID:     "fake-agent-id",
+		StemcellCID: "fake-stemcell-cid",
+		Networks: map[string]NetworkRecord{
+			"fake-net": {Type: "dynamic", IP: "10.0.0.2"},
+		},
+		DiskCIDs:  []string{"fake-disk-cid"},
+		CreatedAt: time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	Describe("SaveVM", func() {
+		It("writes record as JSON through a temporary file", func() {
+			err := store.SaveVM(vmRecord)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.RenameOldPaths).To(Equal([]string{"/fake-state-dir/vms/fake-vm-cid.json.fake-uuid.tmp"}))
+			Expect(fs.RenameNewPaths).To(Equal([]string{"/fake-state-dir/vms/fake-vm-cid.json"}))
+
+			contents, err := fs.ReadFileString("/fake-state-dir/vms/fake-vm-cid.json")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(contents).To(MatchJSON(`{
+				"cid": "fake-vm-cid",
+				"agent_id": "fake-agent-id",
+				"stemcell_cid": "fake-stemcell-cid",
+				"networks": {"fake-net": {"type": "dynamic", "ip": "10.0.0.2"}},
+				"disk_cids": ["fake-disk-cid"],
+				"created_at": "2014-01-02T03:04:05Z"
+			}`))
+
+			Expect(fs.FileExists("/fake-state-dir/vms/fake-vm-cid.json.fake-uuid.tmp")).To(BeFalse())
+		})
+
+		It("escapes CID so that record stays within the directory", func() {
+			err := store.SaveVM(VMRecord{CID: "../fake-vm-cid"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.FileExists("/fake-state-dir/vms/..%2Ffake-vm-cid.json")).To(BeTrue())
+		})
+
+		It("returns error if CID is empty", func() {
+			err := store.SaveVM(VMRecord{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Expected non-empty CID for vms record"))
+		})
+
+		It("returns error and removes temporary file if writing fails", func() {
+			fs.WriteToFileError = errors.New("fake-write-err")
+
+			err := store.SaveVM(vmRecord)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+
+			Expect(fs.FileExists("/fake-state-dir/vms/fake-vm-cid.json")).To(BeFalse())
+		})
+
+		It("returns error and keeps previous record if renaming fails", func() {
+			err := store.SaveVM(VMRecord{CID: "fake-vm-cid", AgentID: "fake-old-agent-id"})
+			Expect(err).ToNot(HaveOccurred())
+
+			fs.RenameError = errors.New("fake-rename-err")
+
+			err = store.SaveVM(vmRecord)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-rename-err"))
+
+			Expect(fs.FileExists("/fake-state-dir/vms/fake-vm-cid.json.fake-uuid.tmp")).To(BeFalse())
+
+			record, found, err := store.FindVM("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(record.AgentID).To(Equal("fake-old-agent-id"))
+		})
+
+		It("returns error if creating directory fails", func() {
+			fs.MkdirAllError = errors.New("fake-mkdir-err")
+
+			err := store.SaveVM(vmRecord)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-mkdir-err"))
+		})
+	})
+
+	Describe("FindVM", func() {
+		It("returns saved record", func() {
+			err := store.SaveVM(vmRecord)
+			Expect(err).ToNot(HaveOccurred())
+
+			record, found, err := store.FindVM("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(record).To(Equal(vmRecord))
+		})
+
+		It("returns found as false if record does not exist", func() {
+			_, found, err := store.FindVM("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		It("returns error if record cannot be unmarshalled", func() {
+			fs.WriteFileString("/fake-state-dir/vms/fake-vm-cid.json", "invalid-json")
+
+			_, _, err := store.FindVM("fake-vm-cid")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Unmarshalling vms record 'fake-vm-cid'"))
+		})
+	})
+
+	Describe("FindAllVMs", func() {
+		It("returns all records sorted by file name", func() {
+			err := store.SaveVM(VMRecord{CID: "fake-vm-cid2"})
+			Expect(err).ToNot(HaveOccurred())
+
+			err = store.SaveVM(VMRecord{CID: "fake-vm-cid1"})
+			Expect(err).ToNot(HaveOccurred())
+
+			fs.SetGlob("/fake-state-dir/vms/*.json", []string{
+				"/fake-state-dir/vms/fake-vm-cid2.json",
+				"/fake-state-dir/vms/fake-vm-cid1.json",
+				"/fake-state-dir/vms/fake-vm-cid3.json", // deleted since listing
+			})
+
+			records, err := store.FindAllVMs()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(Equal([]VMRecord{{CID: "fake-vm-cid1"}, {CID: "fake-vm-cid2"}}))
+		})
+
+		It("returns error if listing fails", func() {
+			fs.GlobErr = errors.New("fake-glob-err")
+
+			_, err := store.FindAllVMs()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-glob-err"))
+		})
+	})
+
+	Describe("DeleteVM", func() {
+		It("removes record", func() {
+			err := store.SaveVM(vmRecord)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = store.DeleteVM("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, found, err := store.FindVM("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+
+		It("does not return error if record does not exist", func() {
+			err := store.DeleteVM("fake-vm-cid")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if removing fails", func() {
+			fs.RemoveAllError = errors.New("fake-remove-err")
+
+			err := store.DeleteVM("fake-vm-cid")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-remove-err"))
+		})
+	})
+
+	Describe("disks", func() {
+		It("saves, finds and deletes records in disks directory", func() {
+			diskRecord := DiskRecord{CID: "fake-disk-cid", SizeMB: 100, VMCID: "fake-vm-cid"}
+
+			err := store.SaveDisk(diskRecord)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fs.FileExists("/fake-state-dir/disks/fake-disk-cid.json")).To(BeTrue())
+
+			record, found, err := store.FindDisk("fake-disk-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(record).To(Equal(diskRecord))
+
+			fs.SetGlob("/fake-state-dir/disks/*.json", []string{"/fake-state-dir/disks/fake-disk-cid.json"})
+
+			records, err := store.FindAllDisks()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(Equal([]DiskRecord{diskRecord}))
+
+			err = store.DeleteDisk("fake-disk-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fs.FileExists("/fake-state-dir/disks/fake-disk-cid.json")).To(BeFalse())
+		})
+	})
+
+	Describe("stemcells", func() {
+		It("saves, finds and deletes records in stemcells directory", func() {
+			stemcellRecord := StemcellRecord{CID: "fake-stemcell-cid"}
+
+			err := store.SaveStemcell(stemcellRecord)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fs.FileExists("/fake-state-dir/stemcells/fake-stemcell-cid.json")).To(BeTrue())
+
+			record, found, err := store.FindStemcell("fake-stemcell-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(record).To(Equal(stemcellRecord))
+
+			fs.SetGlob("/fake-state-dir/stemcells/*.json", []string{"/fake-state-dir/stemcells/fake-stemcell-cid.json"})
+
+			records, err := store.FindAllStemcells()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(records).To(Equal([]StemcellRecord{stemcellRecord}))
+
+			err = store.DeleteStemcell("fake-stemcell-cid")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fs.FileExists("/fake-state-dir/stemcells/fake-stemcell-cid.json")).To(BeFalse())
+		})
+	})
+})
+
+var _ = Describe("VMRecord", func() {
+	It("adds and removes disks without modifying original record", func() {
+		record := VMRecord{CID: "fake-vm-cid", DiskCIDs: []string{"fake-disk-cid1"}}
+
+		withDisk := record.WithDisk("fake-disk-cid2")
+		Expect(withDisk.DiskCIDs).To(Equal([]string{"fake-disk-cid1", "fake-disk-cid2"}))
+		Expect(withDisk.WithDisk("fake-disk-cid2").DiskCIDs).To(Equal([]string{"fake-disk-cid1", "fake-disk-cid2"}))
+		Expect(withDisk.HasDisk("fake-disk-cid2")).To(BeTrue())
+
+		withoutDisk := withDisk.WithoutDisk("fake-disk-cid1")
+		Expect(withoutDisk.DiskCIDs).To(Equal([]string{"fake-disk-cid2"}))
+		Expect(withoutDisk.HasDisk("fake-disk-cid1")).To(BeFalse())
+
+		Expect(record.DiskCIDs).To(Equal([]string{"fake-disk-cid1"}))
+	})
+})
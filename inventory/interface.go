@@ -0,0 +1,99 @@
+package inventory
+
+import (
+	"time"
+)
+
+// Store records VMs, disks and stemcells managed by the CPI on this host
+// so that information about them survives between CPI invocations.
+// Records are written by actions and removed once objects are deleted.
+type Store interface {
+	SaveVM(VMRecord) error
+	FindVM(cid string) (VMRecord, bool, error)
+	FindAllVMs() ([]VMRecord, error)
+	DeleteVM(cid string) error
+
+	SaveDisk(DiskRecord) error
+	FindDisk(cid string) (DiskRecord, bool, error)
+	FindAllDisks() ([]DiskRecord, error)
+	DeleteDisk(cid string) error
+
+	SaveStemcell(StemcellRecord) error
+	FindStemcell(cid string) (StemcellRecord, bool, error)
+	FindAllStemcells() ([]StemcellRecord, error)
+	DeleteStemcell(cid string) error
+}
+
+type VMRecord struct {
+	CID         string `json:"cid"`
+	AgentID     string `json:"agent_id"`
+	StemcellCID string `json:"stemcell_cid"`
+
+	// Keyed by network name; IPs are resolved for dynamic networks
+	Networks map[string]NetworkRecord `json:"networks"`
+
+	// Persistent disks currently attached to the VM
+	DiskCIDs []string `json:"disk_cids"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type NetworkRecord struct {
+	Type string `json:"type"`
+	IP   string `json:"ip"`
+}
+
+type DiskRecord struct {
+	CID    string `json:"cid"`
+	SizeMB int    `json:"size_mb"`
+
+	// Empty when disk is not attached
+	VMCID string `json:"vm_cid"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// StemcellRecord does not duplicate name, version and OS;
+// those are only kept in stemcell's metadata (<id>.metadata.json)
+type StemcellRecord struct {
+	CID string `json:"cid"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HasDisk returns true if disk is recorded as attached to the VM
+func (r VMRecord) HasDisk(diskCID string) bool {
+	for _, cid := range r.DiskCIDs {
+		if cid == diskCID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WithDisk returns copy of the record with disk added to attached disks
+func (r VMRecord) WithDisk(diskCID string) VMRecord {
+	if r.HasDisk(diskCID) {
+		return r
+	}
+
+	r.DiskCIDs = append(append([]string{}, r.DiskCIDs...), diskCID)
+
+	return r
+}
+
+// WithoutDisk returns copy of the record with disk removed from attached disks
+func (r VMRecord) WithoutDisk(diskCID string) VMRecord {
+	diskCIDs := []string{}
+
+	for _, cid := range r.DiskCIDs {
+		if cid != diskCID {
+			diskCIDs = append(diskCIDs, cid)
+		}
+	}
+
+	r.DiskCIDs = diskCIDs
+
+	return r
+}
@@ -0,0 +1,34 @@
+package inventory
+
+import (
+	"time"
+)
+
+// Journal records intent to perform a multi-step operation on a VM before
+// its first step is performed so that an operation interrupted half way
+// (e.g. CPI process was killed) can be detected and repaired by the next
+// CPI invocation for that VM. There is at most one intent per VM since
+// operations on a VM are serialized with VM lock.
+type Journal interface {
+	Begin(Intent) error
+	Find(vmCID string) (Intent, bool, error)
+	Finish(vmCID string) error
+}
+
+type IntentOp string
+
+const (
+	IntentOpAttachDisk IntentOp = "attach_disk"
+	IntentOpDetachDisk IntentOp = "detach_disk"
+	IntentOpDeleteVM   IntentOp = "delete_vm"
+)
+
+type Intent struct {
+	VMCID string   `json:"vm_cid"`
+	Op    IntentOp `json:"op"`
+
+	// Empty for operations that do not involve a disk
+	DiskCID string `json:"disk_cid,omitempty"`
+
+	StartedAt time.Time `json:"started_at"`
+}
@@ -2,16 +2,37 @@ package main
 
 import (
 	"encoding/json"
+	"net"
+	"time"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
 
 	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
 )
 
 type Config struct {
 	Warden WardenConfig
 
+	// Optional; when configured, requests are forwarded to a long-running
+	// server started with `serve` command instead of being executed in process
+	Server ServerConfig
+
+	// Optional; by default text entries are logged to stderr at debug level
+	Logging LoggingConfig
+
+	// Optional; requests run without a deadline by default
+	Timeouts TimeoutsConfig
+
+	// Logs captured while executing a request are returned to the Director
+	ResponseLog ResponseLogConfig
+
+	// Optional; unknown fields in cloud properties are rejected by default
+	// while other arguments are checked leniently
+	Arguments ArgumentsConfig
+
 	Actions bwcaction.ConcreteFactoryOptions
 }
 
@@ -23,6 +44,75 @@ type WardenConfig struct {
 	ConnectAddress string
 }
 
+type ServerConfig struct {
+	// e.g. unix, tcp
+	ListenNetwork string
+
+	// Could be file path to sock file or a localhost address with a port;
+	// sock file is only accessible to CPI's user and existing non-socket file is not replaced
+	ListenAddress string
+}
+
+type LoggingConfig struct {
+	// One of DEBUG, INFO, WARN, ERROR, NONE; defaults to DEBUG
+	Level string
+
+	// Either text or json; json logs one object per line
+	// with timestamp, level, tag, request_id, action and message keys
+	Format string
+
+	// Optional; logs go to stderr when not provided
+	File string
+
+	// File is rotated when it reaches this size; defaults to 10MB
+	MaxFileBytes int64
+
+	// Number of rotated files to keep; defaults to 5
+	MaxFiles int
+}
+
+const (
+	LoggingFormatText = "text"
+	LoggingFormatJSON = "json"
+
+	defaultLoggingMaxFileBytes = 10 * 1024 * 1024
+	defaultLoggingMaxFiles     = 5
+)
+
+type TimeoutsConfig struct {
+	// Applies to methods without their own timeout, e.g. 10m
+	Default string
+
+	// Maps CPI method name to a timeout, e.g. {"create_vm": "5m"}
+	Methods map[string]string
+}
+
+type ResponseLogConfig struct {
+	// One of DEBUG, INFO, WARN, ERROR, NONE; defaults to DEBUG
+	Level string
+
+	// Most recent entries are kept when limit is exceeded; defaults to 1MB
+	MaxBytes int
+}
+
+const defaultResponseLogMaxBytes = 1024 * 1024
+
+type ArgumentsConfig struct {
+	// One of lenient, cloud_properties, strict; defaults to cloud_properties.
+	// lenient ignores unknown fields and extra positional arguments;
+	// cloud_properties rejects unknown fields in cloud properties;
+	// strict also rejects unknown fields in other arguments and extra positional arguments
+	Strictness string
+}
+
+var logLevels = map[string]boshlog.LogLevel{
+	"DEBUG": boshlog.LevelDebug,
+	"INFO":  boshlog.LevelInfo,
+	"WARN":  boshlog.LevelWarn,
+	"ERROR": boshlog.LevelError,
+	"NONE":  boshlog.LevelNone,
+}
+
 func NewConfigFromPath(path string, fs boshsys.FileSystem) (Config, error) {
 	var config Config
 
@@ -50,6 +140,33 @@ func (c Config) Validate() error {
 		return bosherr.WrapError(err, "Validating Warden configuration")
 	}
 
+	if c.Server.Enabled() {
+		err = c.Server.Validate()
+		if err != nil {
+			return bosherr.WrapError(err, "Validating Server configuration")
+		}
+	}
+
+	err = c.Logging.Validate()
+	if err != nil {
+		return bosherr.WrapError(err, "Validating Logging configuration")
+	}
+
+	err = c.Timeouts.Validate()
+	if err != nil {
+		return bosherr.WrapError(err, "Validating Timeouts configuration")
+	}
+
+	err = c.ResponseLog.Validate()
+	if err != nil {
+		return bosherr.WrapError(err, "Validating ResponseLog configuration")
+	}
+
+	err = c.Arguments.Validate()
+	if err != nil {
+		return bosherr.WrapError(err, "Validating Arguments configuration")
+	}
+
 	err = c.Actions.Validate()
 	if err != nil {
 		return bosherr.WrapError(err, "Validating Actions configuration")
@@ -69,3 +186,193 @@ func (c WardenConfig) Validate() error {
 
 	return nil
 }
+
+func (c ServerConfig) Enabled() bool {
+	return c.ListenNetwork != "" || c.ListenAddress != ""
+}
+
+func (c ServerConfig) Validate() error {
+	if c.ListenAddress == "" {
+		return bosherr.New("Must provide non-empty ListenAddress")
+	}
+
+	switch c.ListenNetwork {
+	case "unix":
+		return nil
+
+	case "tcp", "tcp4", "tcp6":
+		// Requests are not authenticated so server must not be reachable from other hosts
+		host, _, err := net.SplitHostPort(c.ListenAddress)
+		if err != nil {
+			return bosherr.WrapError(err, "Parsing ListenAddress")
+		}
+
+		if host != "localhost" {
+			ip := net.ParseIP(host)
+			if ip == nil || !ip.IsLoopback() {
+				return bosherr.New("Must provide localhost ListenAddress")
+			}
+		}
+
+		return nil
+
+	default:
+		return bosherr.New("Must provide ListenNetwork that is either unix or tcp")
+	}
+}
+
+func (c LoggingConfig) Validate() error {
+	err := validateLogLevel(c.Level)
+	if err != nil {
+		return err
+	}
+
+	switch c.Format {
+	case "", LoggingFormatText, LoggingFormatJSON:
+	default:
+		return bosherr.New("Must provide Format that is either text or json")
+	}
+
+	if c.MaxFileBytes < 0 {
+		return bosherr.New("Must provide non-negative MaxFileBytes")
+	}
+
+	if c.MaxFiles < 0 {
+		return bosherr.New("Must provide non-negative MaxFiles")
+	}
+
+	return nil
+}
+
+func (c LoggingConfig) LogLevel() boshlog.LogLevel {
+	return logLevel(c.Level)
+}
+
+func (c LoggingConfig) JSONFormat() bool {
+	return c.Format == LoggingFormatJSON
+}
+
+func (c LoggingConfig) MaxFileBytesOrDefault() int64 {
+	if c.MaxFileBytes == 0 {
+		return defaultLoggingMaxFileBytes
+	}
+
+	return c.MaxFileBytes
+}
+
+func (c LoggingConfig) MaxFilesOrDefault() int {
+	if c.MaxFiles == 0 {
+		return defaultLoggingMaxFiles
+	}
+
+	return c.MaxFiles
+}
+
+func (c TimeoutsConfig) Validate() error {
+	if c.Default != "" {
+		_, err := parseTimeout(c.Default)
+		if err != nil {
+			return bosherr.WrapError(err, "Parsing Default")
+		}
+	}
+
+	for method, timeout := range c.Methods {
+		_, err := parseTimeout(timeout)
+		if err != nil {
+			return bosherr.WrapError(err, "Parsing timeout for method '%s'", method)
+		}
+	}
+
+	return nil
+}
+
+// For returns timeout for a method; zero means that method does not have a deadline
+func (c TimeoutsConfig) For(method string) time.Duration {
+	timeout, found := c.Methods[method]
+	if !found {
+		timeout = c.Default
+	}
+
+	if timeout == "" {
+		return 0
+	}
+
+	// Timeouts are already validated
+	duration, _ := parseTimeout(timeout)
+
+	return duration
+}
+
+func parseTimeout(timeout string) (time.Duration, error) {
+	duration, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, err
+	}
+
+	if duration <= 0 {
+		return 0, bosherr.New("Must provide positive timeout")
+	}
+
+	return duration, nil
+}
+
+func (c ResponseLogConfig) Validate() error {
+	err := validateLogLevel(c.Level)
+	if err != nil {
+		return err
+	}
+
+	if c.MaxBytes < 0 {
+		return bosherr.New("Must provide non-negative MaxBytes")
+	}
+
+	return nil
+}
+
+func (c ResponseLogConfig) LogLevel() boshlog.LogLevel {
+	return logLevel(c.Level)
+}
+
+func (c ResponseLogConfig) MaxBytesOrDefault() int {
+	if c.MaxBytes == 0 {
+		return defaultResponseLogMaxBytes
+	}
+
+	return c.MaxBytes
+}
+
+func (c ArgumentsConfig) Validate() error {
+	switch bwcdisp.JSONCallerStrictness(c.Strictness) {
+	case "", bwcdisp.JSONCallerLenient, bwcdisp.JSONCallerStrictCloudProperties, bwcdisp.JSONCallerStrict:
+		return nil
+
+	default:
+		return bosherr.New("Must provide Strictness that is one of lenient, cloud_properties or strict")
+	}
+}
+
+func (c ArgumentsConfig) StrictnessOrDefault() bwcdisp.JSONCallerStrictness {
+	if c.Strictness == "" {
+		return bwcdisp.JSONCallerStrictCloudProperties
+	}
+
+	return bwcdisp.JSONCallerStrictness(c.Strictness)
+}
+
+func validateLogLevel(level string) error {
+	if level != "" {
+		if _, found := logLevels[level]; !found {
+			return bosherr.New("Must provide Level that is one of DEBUG, INFO, WARN, ERROR or NONE")
+		}
+	}
+
+	return nil
+}
+
+func logLevel(level string) boshlog.LogLevel {
+	if level == "" {
+		return boshlog.LevelDebug
+	}
+
+	return logLevels[level]
+}
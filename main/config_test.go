@@ -1,16 +1,26 @@
 package main_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
 
 	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
 	. "github.com/cppforlife/bosh-warden-cpi/main"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
 
 var validConfig = Config{
@@ -26,6 +36,7 @@ var validWardenConfig = WardenConfig{
 var validActionsOptions = bwcaction.ConcreteFactoryOptions{
 	StemcellsDir: "/tmp/stemcells",
 	DisksDir:     "/tmp/disks",
+	StateDir:     "/tmp/state",
 
 	HostEphemeralBindMountsDir:  "/tmp/host-ephemeral-bind-mounts-dir",
 	HostPersistentBindMountsDir: "/tmp/host-persistent-bind-mounts-dir",
@@ -105,6 +116,46 @@ var _ = Describe("Config", func() {
 			Expect(err.Error()).To(ContainSubstring("Validating Warden configuration"))
 		})
 
+		It("returns error if server section is configured but not valid", func() {
+			config.Server = ServerConfig{ListenNetwork: "unix"}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Server configuration"))
+		})
+
+		It("returns error if logging section is not valid", func() {
+			config.Logging.Format = "fake-format"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Logging configuration"))
+		})
+
+		It("returns error if timeouts section is not valid", func() {
+			config.Timeouts.Default = "fake-timeout"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Timeouts configuration"))
+		})
+
+		It("returns error if response log section is not valid", func() {
+			config.ResponseLog.MaxBytes = -1
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating ResponseLog configuration"))
+		})
+
+		It("returns error if arguments section is not valid", func() {
+			config.Arguments.Strictness = "fake-strictness"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Validating Arguments configuration"))
+		})
+
 		It("returns error if actions section is not valid", func() {
 			config.Actions.DisksDir = ""
 
@@ -147,3 +198,371 @@ var _ = Describe("WardenConfig", func() {
 		})
 	})
 })
+
+var _ = Describe("ServerConfig", func() {
+	var (
+		config ServerConfig
+	)
+
+	Describe("Enabled", func() {
+		It("returns false if nothing is configured", func() {
+			Expect(ServerConfig{}.Enabled()).To(BeFalse())
+		})
+
+		It("returns true if listen address is configured", func() {
+			Expect(ServerConfig{ListenAddress: "/fake-sock"}.Enabled()).To(BeTrue())
+		})
+	})
+
+	Describe("Validate", func() {
+		BeforeEach(func() {
+			config = ServerConfig{
+				ListenNetwork: "unix",
+				ListenAddress: "/fake-sock",
+			}
+		})
+
+		It("does not return error if unix socket is configured", func() {
+			err := config.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if localhost address is configured", func() {
+			for _, address := range []string{"127.0.0.1:8080", "localhost:8080", "[::1]:8080"} {
+				config = ServerConfig{ListenNetwork: "tcp", ListenAddress: address}
+
+				err := config.Validate()
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("returns error if tcp address is not localhost", func() {
+			config = ServerConfig{ListenNetwork: "tcp", ListenAddress: "0.0.0.0:8080"}
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide localhost ListenAddress"))
+		})
+
+		It("returns error if ListenNetwork is not supported", func() {
+			config.ListenNetwork = "udp"
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide ListenNetwork that is either unix or tcp"))
+		})
+
+		It("returns error if ListenAddress is empty", func() {
+			config.ListenAddress = ""
+
+			err := config.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide non-empty ListenAddress"))
+		})
+	})
+})
+
+var _ = Describe("LoggingConfig", func() {
+	Describe("Validate", func() {
+		It("does not return error if nothing is configured", func() {
+			Expect(LoggingConfig{}.Validate()).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if all fields are valid", func() {
+			err := LoggingConfig{
+				Level:        "INFO",
+				Format:       "json",
+				File:         "/fake-file",
+				MaxFileBytes: 100,
+				MaxFiles:     2,
+			}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Level is not known", func() {
+			err := LoggingConfig{Level: "fake-level"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide Level that is one of DEBUG, INFO, WARN, ERROR or NONE"))
+		})
+
+		It("returns error if Format is not known", func() {
+			err := LoggingConfig{Format: "fake-format"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide Format that is either text or json"))
+		})
+
+		It("returns error if MaxFileBytes is negative", func() {
+			err := LoggingConfig{MaxFileBytes: -1}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide non-negative MaxFileBytes"))
+		})
+
+		It("returns error if MaxFiles is negative", func() {
+			err := LoggingConfig{MaxFiles: -1}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide non-negative MaxFiles"))
+		})
+	})
+
+	Describe("LogLevel", func() {
+		It("returns debug level by default", func() {
+			Expect(LoggingConfig{}.LogLevel()).To(Equal(boshlog.LevelDebug))
+		})
+
+		It("returns configured level", func() {
+			Expect(LoggingConfig{Level: "INFO"}.LogLevel()).To(Equal(boshlog.LevelInfo))
+		})
+	})
+
+	Describe("JSONFormat", func() {
+		It("returns false by default", func() {
+			Expect(LoggingConfig{}.JSONFormat()).To(BeFalse())
+		})
+
+		It("returns true if json format is configured", func() {
+			Expect(LoggingConfig{Format: "json"}.JSONFormat()).To(BeTrue())
+		})
+	})
+
+	Describe("MaxFileBytesOrDefault", func() {
+		It("returns 10MB by default", func() {
+			Expect(LoggingConfig{}.MaxFileBytesOrDefault()).To(Equal(int64(10 * 1024 * 1024)))
+		})
+
+		It("returns configured max file bytes", func() {
+			Expect(LoggingConfig{MaxFileBytes: 10}.MaxFileBytesOrDefault()).To(Equal(int64(10)))
+		})
+	})
+
+	Describe("MaxFilesOrDefault", func() {
+		It("returns 5 by default", func() {
+			Expect(LoggingConfig{}.MaxFilesOrDefault()).To(Equal(5))
+		})
+
+		It("returns configured max files", func() {
+			Expect(LoggingConfig{MaxFiles: 2}.MaxFilesOrDefault()).To(Equal(2))
+		})
+	})
+})
+
+var _ = Describe("TimeoutsConfig", func() {
+	Describe("Validate", func() {
+		It("does not return error if nothing is configured", func() {
+			Expect(TimeoutsConfig{}.Validate()).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if all timeouts are valid", func() {
+			err := TimeoutsConfig{
+				Default: "10m",
+				Methods: map[string]string{"create_vm": "90s"},
+			}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Default cannot be parsed", func() {
+			err := TimeoutsConfig{Default: "fake-timeout"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing Default"))
+		})
+
+		It("returns error if method timeout cannot be parsed", func() {
+			err := TimeoutsConfig{Methods: map[string]string{"create_vm": "fake-timeout"}}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing timeout for method 'create_vm'"))
+		})
+
+		It("returns error if timeout is not positive", func() {
+			err := TimeoutsConfig{Methods: map[string]string{"create_vm": "0s"}}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide positive timeout"))
+		})
+	})
+
+	Describe("For", func() {
+		config := TimeoutsConfig{
+			Default: "10m",
+			Methods: map[string]string{"create_vm": "90s"},
+		}
+
+		It("returns method specific timeout", func() {
+			Expect(config.For("create_vm")).To(Equal(90 * time.Second))
+		})
+
+		It("returns default timeout if method does not have its own", func() {
+			Expect(config.For("delete_vm")).To(Equal(10 * time.Minute))
+		})
+
+		It("returns zero if no timeout is configured", func() {
+			Expect(TimeoutsConfig{}.For("create_vm")).To(Equal(time.Duration(0)))
+		})
+	})
+})
+
+var _ = Describe("ResponseLogConfig", func() {
+	Describe("Validate", func() {
+		It("does not return error if nothing is configured", func() {
+			Expect(ResponseLogConfig{}.Validate()).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if level and max bytes are valid", func() {
+			err := ResponseLogConfig{Level: "WARN", MaxBytes: 100}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Level is not known", func() {
+			err := ResponseLogConfig{Level: "fake-level"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide Level that is one of DEBUG, INFO, WARN, ERROR or NONE"))
+		})
+
+		It("returns error if MaxBytes is negative", func() {
+			err := ResponseLogConfig{MaxBytes: -1}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Must provide non-negative MaxBytes"))
+		})
+	})
+
+	Describe("LogLevel", func() {
+		It("returns debug level by default", func() {
+			Expect(ResponseLogConfig{}.LogLevel()).To(Equal(boshlog.LevelDebug))
+		})
+
+		It("returns configured level", func() {
+			Expect(ResponseLogConfig{Level: "ERROR"}.LogLevel()).To(Equal(boshlog.LevelError))
+			Expect(ResponseLogConfig{Level: "NONE"}.LogLevel()).To(Equal(boshlog.LevelNone))
+		})
+	})
+
+	Describe("MaxBytesOrDefault", func() {
+		It("returns 1MB by default", func() {
+			Expect(ResponseLogConfig{}.MaxBytesOrDefault()).To(Equal(1024 * 1024))
+		})
+
+		It("returns configured max bytes", func() {
+			Expect(ResponseLogConfig{MaxBytes: 10}.MaxBytesOrDefault()).To(Equal(10))
+		})
+	})
+})
+
+var _ = Describe("ArgumentsConfig", func() {
+	Describe("Validate", func() {
+		It("returns no error if strictness is not provided", func() {
+			Expect(ArgumentsConfig{}.Validate()).ToNot(HaveOccurred())
+		})
+
+		It("returns no error for known strictness", func() {
+			Expect(ArgumentsConfig{Strictness: "lenient"}.Validate()).ToNot(HaveOccurred())
+			Expect(ArgumentsConfig{Strictness: "cloud_properties"}.Validate()).ToNot(HaveOccurred())
+			Expect(ArgumentsConfig{Strictness: "strict"}.Validate()).ToNot(HaveOccurred())
+		})
+
+		It("returns error for unknown strictness", func() {
+			err := ArgumentsConfig{Strictness: "fake-strictness"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must provide Strictness that is one of lenient, cloud_properties or strict"))
+		})
+	})
+
+	Describe("StrictnessOrDefault", func() {
+		It("rejects unknown fields in cloud properties by default", func() {
+			Expect(ArgumentsConfig{}.StrictnessOrDefault()).To(Equal(bwcdisp.JSONCallerStrictCloudProperties))
+		})
+
+		It("returns configured strictness", func() {
+			Expect(ArgumentsConfig{Strictness: "strict"}.StrictnessOrDefault()).To(Equal(bwcdisp.JSONCallerStrict))
+		})
+
+		// Director passes all stemcell.MF cloud_properties to create_stemcell
+		stemcellMFCloudProps := map[string]interface{}{
+			"name":             "bosh-warden-boshlite-ubuntu-trusty-go_agent",
+			"version":          "3421.11",
+			"infrastructure":   "warden",
+			"hypervisor":       "boshlite",
+			"disk":             3072,
+			"disk_format":      "files",
+			"container_format": "bare",
+			"os_type":          "linux",
+			"os_distro":        "ubuntu",
+			"architecture":     "x86_64",
+			"root_device_name": "/dev/sda1",
+		}
+
+		for _, strictness := range []string{"", "cloud_properties"} {
+			strictness := strictness
+
+			It(fmt.Sprintf("accepts real stemcell.MF cloud properties with '%s' strictness", strictness), func() {
+				importer := &fakestem.FakeImporter{ImportFromPathStemcell: fakestem.NewFakeStemcell("fake-stemcell-id")}
+
+				action := bwcaction.NewCreateStemcell(
+					importer,
+					fakeinv.NewFakeStore(),
+					fakeutil.NewFakeTimeService(time.Now()),
+				)
+
+				caller := bwcdisp.NewJSONCaller(ArgumentsConfig{Strictness: strictness}.StrictnessOrDefault())
+
+				// Round trip through JSON so that values have the same types as in a request
+				var args []interface{}
+				argsBytes, err := json.Marshal([]interface{}{"/fake-image-path", stemcellMFCloudProps})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(argsBytes, &args)).ToNot(HaveOccurred())
+
+				cid, err := caller.Call(context.Background(), action, args)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cid).To(Equal(bwcaction.StemcellCID("fake-stemcell-id")))
+
+				Expect(importer.ImportFromPathOptions.Name).To(Equal("bosh-warden-boshlite-ubuntu-trusty-go_agent"))
+				Expect(importer.ImportFromPathOptions.OS).To(Equal("ubuntu"))
+			})
+		}
+
+		Context("when creating VM with default strictness", func() {
+			var (
+				caller bwcdisp.Caller
+				action bwcaction.CreateVM
+			)
+
+			BeforeEach(func() {
+				stemcellFinder := &fakestem.FakeFinder{
+					FindStemcell: fakestem.NewFakeStemcell("fake-stemcell-id"),
+					FindFound:    true,
+				}
+
+				vmCreator := &fakevm.FakeCreator{CreateVM: fakevm.NewFakeVM("fake-vm-id")}
+
+				action = bwcaction.NewCreateVM(
+					stemcellFinder,
+					vmCreator,
+					fakeutil.NewFakeLockManager(),
+					fakeinv.NewFakeStore(),
+					fakeutil.NewFakeTimeService(time.Now()),
+					1,
+				)
+
+				caller = bwcdisp.NewJSONCaller(ArgumentsConfig{}.StrictnessOrDefault())
+			})
+
+			callWithVMCloudProps := func(vmCloudProps map[string]interface{}) (interface{}, error) {
+				// Round trip through JSON so that values have the same types as in a request
+				var args []interface{}
+				argsBytes, err := json.Marshal([]interface{}{"fake-agent-id", "fake-stemcell-id", vmCloudProps, map[string]interface{}{}, []string{}, map[string]interface{}{}})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(argsBytes, &args)).ToNot(HaveOccurred())
+
+				return caller.Call(context.Background(), action, args)
+			}
+
+			It("accepts declared VM cloud properties", func() {
+				cid, err := callWithVMCloudProps(map[string]interface{}{"cpu": 2, "ram": 4096, "disk": 10240})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cid).To(Equal(bwcaction.VMCID("fake-vm-id")))
+			})
+
+			It("rejects unknown VM cloud properties", func() {
+				_, err := callWithVMCloudProps(map[string]interface{}{"memroy_mb": 4096})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("memroy_mb"))
+			})
+		})
+	})
+})
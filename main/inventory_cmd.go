@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+)
+
+// InventoryCmd implements `inventory` subcommands used by operators
+// to see VMs, disks and stemcells recorded by the CPI on this host
+type InventoryCmd struct {
+	inventory bwcinv.Store
+	out       io.Writer
+}
+
+func NewInventoryCmd(inventory bwcinv.Store, out io.Writer) InventoryCmd {
+	return InventoryCmd{inventory: inventory, out: out}
+}
+
+func (c InventoryCmd) Run(args []string) error {
+	if len(args) == 1 {
+		switch args[0] {
+		case "vms":
+			records, err := c.inventory.FindAllVMs()
+			if err != nil {
+				return bosherr.WrapError(err, "Listing VM records")
+			}
+
+			for _, record := range records {
+				err := c.printRecord(record.CID, record)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+
+		case "disks":
+			records, err := c.inventory.FindAllDisks()
+			if err != nil {
+				return bosherr.WrapError(err, "Listing disk records")
+			}
+
+			for _, record := range records {
+				err := c.printRecord(record.CID, record)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+
+		case "stemcells":
+			records, err := c.inventory.FindAllStemcells()
+			if err != nil {
+				return bosherr.WrapError(err, "Listing stemcell records")
+			}
+
+			for _, record := range records {
+				err := c.printRecord(record.CID, record)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}
+	}
+
+	return bosherr.New("Expected 'inventory vms', 'inventory disks' or 'inventory stemcells'")
+}
+
+// printRecord prints one JSON object per line so that output can be consumed by scripts
+func (c InventoryCmd) printRecord(cid string, record interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return bosherr.WrapError(err, "Marshalling record '%s'", cid)
+	}
+
+	_, err = fmt.Fprintln(c.out, string(recordBytes))
+	if err != nil {
+		return bosherr.WrapError(err, "Writing to OUT")
+	}
+
+	return nil
+}
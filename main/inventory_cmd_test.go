@@ -0,0 +1,100 @@
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	. "github.com/cppforlife/bosh-warden-cpi/main"
+)
+
+var _ = Describe("InventoryCmd", func() {
+	var (
+		inventory *fakeinv.FakeStore
+		out       *bytes.Buffer
+		cmd       InventoryCmd
+
+		createdAt = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
+	)
+
+	BeforeEach(func() {
+		inventory = fakeinv.NewFakeStore()
+		out = bytes.NewBufferString("")
+		cmd = NewInventoryCmd(inventory, out)
+	})
+
+	Describe("Run", func() {
+		It("prints VM records one JSON object per line", func() {
+			inventory.VMs["fake-vm-id2"] = bwcinv.VMRecord{CID: "fake-vm-id2", CreatedAt: createdAt}
+			inventory.VMs["fake-vm-id1"] = bwcinv.VMRecord{
+				CID:         "fake-vm-id1",
+				AgentID:     "fake-agent-id",
+				StemcellCID: "fake-stemcell-id",
+				Networks:    map[string]bwcinv.NetworkRecord{"fake-net": {Type: "manual", IP: "10.0.0.2"}},
+				DiskCIDs:    []string{"fake-disk-id"},
+				CreatedAt:   createdAt,
+			}
+
+			err := cmd.Run([]string{"vms"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(out.String()).To(Equal(
+				`{"cid":"fake-vm-id1","agent_id":"fake-agent-id","stemcell_cid":"fake-stemcell-id",` +
+					`"networks":{"fake-net":{"type":"manual","ip":"10.0.0.2"}},"disk_cids":["fake-disk-id"],` +
+					`"created_at":"2014-01-02T03:04:05Z"}` + "\n" +
+					`{"cid":"fake-vm-id2","agent_id":"","stemcell_cid":"","networks":null,"disk_cids":null,` +
+					`"created_at":"2014-01-02T03:04:05Z"}` + "\n",
+			))
+		})
+
+		It("prints disk records one JSON object per line", func() {
+			inventory.Disks["fake-disk-id"] = bwcinv.DiskRecord{
+				CID:       "fake-disk-id",
+				SizeMB:    100,
+				VMCID:     "fake-vm-id",
+				CreatedAt: createdAt,
+			}
+
+			err := cmd.Run([]string{"disks"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(out.String()).To(Equal(
+				`{"cid":"fake-disk-id","size_mb":100,"vm_cid":"fake-vm-id","created_at":"2014-01-02T03:04:05Z"}` + "\n",
+			))
+		})
+
+		It("prints stemcell records one JSON object per line", func() {
+			inventory.Stemcells["fake-stemcell-id"] = bwcinv.StemcellRecord{
+				CID:       "fake-stemcell-id",
+				CreatedAt: createdAt,
+			}
+
+			err := cmd.Run([]string{"stemcells"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(out.String()).To(Equal(
+				`{"cid":"fake-stemcell-id",` +
+					`"created_at":"2014-01-02T03:04:05Z"}` + "\n",
+			))
+		})
+
+		It("returns error if listing records fails", func() {
+			inventory.FindAllErr = errors.New("fake-find-all-err")
+
+			err := cmd.Run([]string{"disks"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-find-all-err"))
+		})
+
+		It("returns error for unknown subcommand", func() {
+			err := cmd.Run([]string{"unknown"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Expected 'inventory vms', 'inventory disks' or 'inventory stemcells'"))
+		})
+	})
+})
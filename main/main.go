@@ -2,19 +2,25 @@ package main
 
 import (
 	"flag"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	wrdnclient "github.com/cloudfoundry-incubator/garden/client"
 	wrdnconn "github.com/cloudfoundry-incubator/garden/client/connection"
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
-	boshcmd "github.com/cloudfoundry/bosh-agent/platform/commands"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
 	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
 
 	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
 	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
 	bwctrans "github.com/cppforlife/bosh-warden-cpi/api/transport"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
 	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 const mainLogTag = "main"
@@ -24,7 +30,7 @@ var (
 )
 
 func main() {
-	logger, fs, cmdRunner, uuidGen := basicDeps()
+	logger, fs, uuidGen := basicDeps()
 
 	defer logger.HandlePanic("Main")
 
@@ -36,9 +42,36 @@ func main() {
 		os.Exit(1)
 	}
 
-	dispatcher := buildDispatcher(config, logger, fs, cmdRunner, uuidGen)
+	logger, logOut := buildLogger(config.Logging)
 
-	cli := bwctrans.NewCLI(os.Stdin, os.Stdout, dispatcher, logger)
+	fs = boshsys.NewOsFileSystem(logger)
+
+	if args := flag.Args(); len(args) > 0 {
+		err = runCommand(args, config, logger, logOut, fs, uuidGen)
+		if err != nil {
+			logger.Error(mainLogTag, "Running command %s", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	var cli interface {
+		ServeOnce() error
+	}
+
+	if config.Server.Enabled() {
+		cli = bwctrans.NewForwarder(
+			os.Stdin,
+			os.Stdout,
+			config.Server.ListenNetwork,
+			config.Server.ListenAddress,
+			logger,
+		)
+	} else {
+		dispatcher := buildDispatcher(config, logger, logOut, uuidGen)
+		cli = bwctrans.NewCLI(os.Stdin, os.Stdout, dispatcher, logger)
+	}
 
 	err = cli.ServeOnce()
 	if err != nil {
@@ -47,48 +80,221 @@ func main() {
 	}
 }
 
-func basicDeps() (boshlog.Logger, boshsys.FileSystem, boshsys.CmdRunner, boshuuid.Generator) {
-	logger := boshlog.NewWriterLogger(boshlog.LevelDebug, os.Stderr, os.Stderr)
+// buildLogger returns logger configured by the Logging section
+// and a destination that per-request loggers should write entries to
+func buildLogger(config LoggingConfig) (boshlog.Logger, io.Writer) {
+	var logOut io.Writer = os.Stderr
 
-	fs := boshsys.NewOsFileSystem(logger)
+	if config.File != "" {
+		// Filesystem must not log since its entries would be written while writing to the file
+		fs := boshsys.NewOsFileSystem(boshlog.NewLogger(boshlog.LevelNone))
+		logOut = bwcutil.NewLogFileWriter(config.File, config.MaxFileBytesOrDefault(), config.MaxFilesOrDefault(), fs)
+	}
 
-	cmdRunner := boshsys.NewExecCmdRunner(logger)
+	var entryOut io.Writer = bwcutil.NewRedactingWriter(logOut)
+
+	if config.JSONFormat() {
+		entryOut = bwcutil.NewRedactingWriter(bwcutil.NewJSONLogWriter(logOut, "", "", bwcutil.RealTimeService{}))
+	}
+
+	return boshlog.NewWriterLogger(config.LogLevel(), entryOut, entryOut), logOut
+}
+
+func basicDeps() (boshlog.Logger, boshsys.FileSystem, boshuuid.Generator) {
+	logOut := bwcutil.NewRedactingWriter(os.Stderr)
+	logger := boshlog.NewWriterLogger(boshlog.LevelDebug, logOut, logOut)
+
+	fs := boshsys.NewOsFileSystem(logger)
 
 	uuidGen := boshuuid.NewGenerator()
 
-	return logger, fs, cmdRunner, uuidGen
+	return logger, fs, uuidGen
 }
 
-func buildDispatcher(
+// runCommand runs operator subcommands, e.g. `cpi -configPath config.json stemcells pending`
+func runCommand(
+	args []string,
 	config Config,
 	logger boshlog.Logger,
+	logOut io.Writer,
 	fs boshsys.FileSystem,
-	cmdRunner boshsys.CmdRunner,
 	uuidGen boshuuid.Generator,
-) bwcdisp.Dispatcher {
-	wardenConn := wrdnconn.New(
-		config.Warden.ConnectNetwork,
-		config.Warden.ConnectAddress,
-	)
+) error {
+	switch args[0] {
+	case "serve":
+		if !config.Server.Enabled() {
+			return bosherr.New("Expected Server section to be configured")
+		}
 
-	wardenClient := wrdnclient.New(wardenConn)
+		dispatcher := buildDispatcher(config, logger, logOut, uuidGen)
 
-	compressor := boshcmd.NewTarballCompressor(cmdRunner, fs)
+		server := bwctrans.NewServer(
+			config.Server.ListenNetwork,
+			config.Server.ListenAddress,
+			dispatcher,
+			fs,
+			logger,
+		)
 
+		go shutDownOnSignal(server, logger)
+
+		return server.ListenAndServe()
+
+	case "replay":
+		dispatcher := buildDispatcher(config, logger, logOut, uuidGen)
+
+		return NewReplayCmd(dispatcher, fs, os.Stdin, os.Stdout, logger).Run(args[1:])
+
+	case "stemcells":
+		stemcellUsageChecker := bwcvm.NewWardenStemcellUsageChecker(buildWardenClient(config, logger), logger)
+
+		stemcellDeleter := bwcstem.NewFSDeferredDeleter(
+			config.Actions.StemcellsDir,
+			stemcellUsageChecker,
+			buildLockManager(config.Actions, fs, logger),
+			fs,
+			logger,
+		)
+
+		stemcellFinder := bwcstem.NewFSFinder(config.Actions.StemcellsDir, fs, logger)
+
+		return NewStemcellsCmd(stemcellFinder, stemcellDeleter, os.Stdout).Run(args[1:])
+
+	case "reconcile":
+		return buildReconcileCmd(config, logger, fs, uuidGen).Run(args[1:])
+
+	case "inventory":
+		inventory := bwcinv.NewFSStore(config.Actions.StateDirOrDefault(), fs, uuidGen, logger)
+
+		return NewInventoryCmd(inventory, os.Stdout).Run(args[1:])
+
+	default:
+		return bosherr.New("Unknown command '%s'", args[0])
+	}
+}
+
+func buildReconcileCmd(
+	config Config,
+	logger boshlog.Logger,
+	fs boshsys.FileSystem,
+	uuidGen boshuuid.Generator,
+) ReconcileCmd {
+	options := config.Actions
+	wardenClient := buildWardenClient(config, logger)
+	cmdRunner := boshsys.NewExecCmdRunner(logger)
 	sleeper := bwcutil.RealSleeper{}
+	mountTable := bwcvm.NewProcMountTable(fs, logger)
+	mounter := bwcvm.NewMounter(options.Mounter, fs, cmdRunner, logger)
+
+	hostBindMounts := bwcvm.NewFSHostBindMounts(
+		options.HostEphemeralBindMountsDir,
+		options.HostPersistentBindMountsDir,
+		sleeper,
+		fs,
+		mounter,
+		mountTable,
+		bwcvm.NewProcMountUsers(fs, logger),
+		options.UnmountRetry.Policy(),
+		logger,
+	)
+
+	guestBindMounts := bwcvm.NewFSGuestBindMounts(
+		options.GuestEphemeralBindMountPath,
+		options.GuestPersistentBindMountsDir,
+		logger,
+	)
+
+	inventory := bwcinv.NewFSStore(options.StateDirOrDefault(), fs, uuidGen, logger)
 
-	actionFactory := bwcaction.NewConcreteFactory(
+	vmFinder := bwcvm.NewWardenFinder(
 		wardenClient,
+		bwcvm.NewWardenAgentEnvServiceFactory(options.AgentEnvService, options.Registry, logger),
+		hostBindMounts,
+		guestBindMounts,
+		options.FindUntaggedContainers,
+		logger,
+	)
+
+	lockManager := buildLockManager(options, fs, logger)
+
+	stemcellDeleter := bwcstem.NewFSDeferredDeleter(
+		options.StemcellsDir,
+		bwcvm.NewWardenStemcellUsageChecker(wardenClient, logger),
+		lockManager,
 		fs,
-		cmdRunner,
-		uuidGen,
-		compressor,
-		sleeper,
-		config.Actions,
 		logger,
 	)
 
-	caller := bwcdisp.NewJSONCaller()
+	return NewReconcileCmd(
+		wardenClient,
+		vmFinder,
+		hostBindMounts,
+		bwcstem.NewFSFinder(options.StemcellsDir, fs, logger),
+		stemcellDeleter,
+		inventory,
+		lockManager,
+		options,
+		fs,
+		mounter,
+		mountTable,
+		os.Stdout,
+		logger,
+	)
+}
+
+// buildLockManager returns lock manager for operator subcommands which wait for locks until timeout
+func buildLockManager(options bwcaction.ConcreteFactoryOptions, fs boshsys.FileSystem, logger boshlog.Logger) bwcutil.LockManager {
+	return bwcutil.NewFileLockManager(
+		options.LocksDirOrDefault(),
+		options.LockTimeoutOrDefault(),
+		bwcutil.RealSleeper{},
+		bwcutil.RealTimeService{},
+		fs,
+		logger,
+	)
+}
+
+func shutDownOnSignal(server bwctrans.Server, logger boshlog.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+
+	logger.Info(mainLogTag, "Received signal '%s'", sig)
+
+	// Let in-flight requests finish since interrupting them could leave VMs half created
+	err := server.Shutdown()
+	if err != nil {
+		logger.Error(mainLogTag, "Shutting down server %s", err)
+	}
+}
+
+// buildWardenClient logs with process logger since containers created
+// after request was cancelled are destroyed once request is already finished
+func buildWardenClient(config Config, logger boshlog.Logger) bwcvm.WardenClient {
+	wardenConn := wrdnconn.New(
+		config.Warden.ConnectNetwork,
+		config.Warden.ConnectAddress,
+	)
+
+	return bwcvm.NewCancellableWardenClient(wrdnclient.New(wardenConn), logger)
+}
+
+func buildDispatcher(
+	config Config,
+	logger boshlog.Logger,
+	logOut io.Writer,
+	uuidGen boshuuid.Generator,
+) bwcdisp.Dispatcher {
+	scopeBuilder := NewRequestScopeBuilder(
+		config,
+		buildWardenClient(config, logger),
+		uuidGen,
+		config.Logging.LogLevel(),
+		logOut,
+	)
+
+	caller := bwcdisp.NewJSONCaller(config.Arguments.StrictnessOrDefault())
 
-	return bwcdisp.NewJSON(actionFactory, caller, logger)
+	return bwcdisp.NewJSON(scopeBuilder, caller, logger)
 }
@@ -0,0 +1,795 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+
+	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+const reconcileCmdLogTag = "ReconcileCmd"
+
+// ReconcileCmd implements `reconcile` subcommand which compares Garden containers,
+// host mounts, loop devices, bind mount directories, disks, stemcells and inventory records
+// and prints one JSON object per found problem.
+//
+// With `-fix` problems that can be fixed safely are fixed in order:
+// mounts are unmounted before directories containing them are removed.
+// Bind mount directories of VMs that are being created do not have containers yet
+// hence reconcile should not run with `-fix` while Director is creating VMs.
+// Disks that are not recorded in the inventory are only reported and never deleted.
+type ReconcileCmd struct {
+	wardenClient    bwcvm.WardenClient
+	vmFinder        bwcvm.Finder
+	hostBindMounts  bwcvm.HostBindMounts
+	stemcellFinder  bwcstem.Finder
+	stemcellDeleter bwcstem.DeferredDeleter
+	inventory       bwcinv.Store
+	lockManager     bwcutil.LockManager
+	options         bwcaction.ConcreteFactoryOptions
+
+	fs         boshsys.FileSystem
+	mounter    bwcvm.Mounter
+	mountTable bwcvm.MountTable
+	out        io.Writer
+	logger     boshlog.Logger
+}
+
+type reconcileProblem struct {
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Path    string `json:"path,omitempty"`
+	Problem string `json:"problem"`
+
+	// Empty if problem is not fixed automatically
+	Fix string `json:"fix,omitempty"`
+
+	Fixed    bool   `json:"fixed"`
+	FixError string `json:"fix_error,omitempty"`
+
+	fixFunc func() error
+}
+
+// reconcileState is a snapshot of all objects on the host taken before any fixes
+type reconcileState struct {
+	containers   map[string]bool
+	containerIDs []string
+
+	// Keyed by VM ID
+	ephemeralDirs  map[string]string
+	persistentDirs map[string]string
+
+	// Mount points sorted so that nested mounts come after their parents
+	mounts []string
+
+	// Mounted devices, e.g. /dev/loop0
+	mountSources map[string]bool
+
+	loopDevices []bwcvm.LoopDevice
+
+	// Keyed by disk ID
+	disks map[string]string
+
+	stemcells        map[string]bool
+	stemcellIDs      []string
+	pendingStemcells []string
+
+	vmRecords       []bwcinv.VMRecord
+	diskRecords     []bwcinv.DiskRecord
+	stemcellRecords []bwcinv.StemcellRecord
+}
+
+func NewReconcileCmd(
+	wardenClient bwcvm.WardenClient,
+	vmFinder bwcvm.Finder,
+	hostBindMounts bwcvm.HostBindMounts,
+	stemcellFinder bwcstem.Finder,
+	stemcellDeleter bwcstem.DeferredDeleter,
+	inventory bwcinv.Store,
+	lockManager bwcutil.LockManager,
+	options bwcaction.ConcreteFactoryOptions,
+	fs boshsys.FileSystem,
+	mounter bwcvm.Mounter,
+	mountTable bwcvm.MountTable,
+	out io.Writer,
+	logger boshlog.Logger,
+) ReconcileCmd {
+	return ReconcileCmd{
+		wardenClient:    wardenClient,
+		vmFinder:        vmFinder,
+		hostBindMounts:  hostBindMounts,
+		stemcellFinder:  stemcellFinder,
+		stemcellDeleter: stemcellDeleter,
+		inventory:       inventory,
+		lockManager:     lockManager,
+		options:         options,
+
+		fs:         fs,
+		mounter:    mounter,
+		mountTable: mountTable,
+		out:        out,
+		logger:     logger,
+	}
+}
+
+func (c ReconcileCmd) Run(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	fixOpt := flags.Bool("fix", false, "Fix found problems")
+
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() > 0 {
+		return bosherr.New("Expected 'reconcile [-fix]'")
+	}
+
+	// Reconciliation runs until it is done since there is no request to cancel
+	ctx := context.Background()
+
+	state, err := c.buildState(ctx)
+	if err != nil {
+		return err
+	}
+
+	var problems []*reconcileProblem
+
+	problems = append(problems, c.mountProblems(ctx, state)...)
+	problems = append(problems, c.loopDeviceProblems(ctx, state)...)
+	problems = append(problems, c.containerProblems(ctx, state)...)
+	problems = append(problems, c.bindDirProblems(ctx, state)...)
+	problems = append(problems, c.diskProblems(state)...)
+	problems = append(problems, c.recordProblems(ctx, state)...)
+	problems = append(problems, c.stemcellProblems(ctx, state)...)
+
+	var failedFixes int
+
+	for _, problem := range problems {
+		if *fixOpt && problem.fixFunc != nil {
+			c.logger.Info(reconcileCmdLogTag, "Fixing %s '%s': %s", problem.Kind, problem.ID, problem.Fix)
+
+			err := problem.fixFunc()
+			if err != nil {
+				problem.FixError = err.Error()
+				failedFixes++
+			} else {
+				problem.Fixed = true
+			}
+		}
+
+		err := c.printProblem(problem)
+		if err != nil {
+			return err
+		}
+	}
+
+	if failedFixes > 0 {
+		return bosherr.New("Failed to fix %d problem(s)", failedFixes)
+	}
+
+	return nil
+}
+
+func (c ReconcileCmd) buildState(ctx context.Context) (reconcileState, error) {
+	state := reconcileState{
+		containers: map[string]bool{},
+		stemcells:  map[string]bool{},
+	}
+
+	containers, err := c.wardenClient.Containers(ctx, nil)
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing containers")
+	}
+
+	for _, container := range containers {
+		state.containers[container.Handle()] = true
+		state.containerIDs = append(state.containerIDs, container.Handle())
+	}
+
+	sort.Strings(state.containerIDs)
+
+	state.ephemeralDirs, err = c.listDir(c.options.HostEphemeralBindMountsDir)
+	if err != nil {
+		return state, err
+	}
+
+	state.persistentDirs, err = c.listDir(c.options.HostPersistentBindMountsDir)
+	if err != nil {
+		return state, err
+	}
+
+	state.disks, err = c.listDir(c.options.DisksDir)
+	if err != nil {
+		return state, err
+	}
+
+	state.mounts, state.mountSources, err = c.listMounts()
+	if err != nil {
+		return state, err
+	}
+
+	state.loopDevices, err = c.mounter.LoopDevices()
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing loop devices")
+	}
+
+	stemcells, err := c.stemcellFinder.FindAll()
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing stemcells")
+	}
+
+	for _, stemcell := range stemcells {
+		state.stemcells[stemcell.ID()] = true
+	}
+
+	state.pendingStemcells, err = c.stemcellDeleter.Pending()
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing stemcells pending deletion")
+	}
+
+	// Stemcells pending deletion still exist on the host
+	for _, id := range state.pendingStemcells {
+		state.stemcells[id] = true
+	}
+
+	for id := range state.stemcells {
+		state.stemcellIDs = append(state.stemcellIDs, id)
+	}
+
+	sort.Strings(state.stemcellIDs)
+
+	state.vmRecords, err = c.inventory.FindAllVMs()
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing VM records")
+	}
+
+	state.diskRecords, err = c.inventory.FindAllDisks()
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing disk records")
+	}
+
+	state.stemcellRecords, err = c.inventory.FindAllStemcells()
+	if err != nil {
+		return state, bosherr.WrapError(err, "Listing stemcell records")
+	}
+
+	return state, nil
+}
+
+// mountProblems finds mounts within bind mount directories of missing containers
+// and mounts of deleted disks. Problems are ordered so that nested mounts are unmounted first.
+func (c ReconcileCmd) mountProblems(ctx context.Context, state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	for i := len(state.mounts) - 1; i >= 0; i-- {
+		mountPath := state.mounts[i]
+
+		if parts, ok := c.relPathParts(c.options.HostEphemeralBindMountsDir, mountPath); ok {
+			if !state.containers[parts[0]] {
+				problems = append(problems, c.unmountProblem(ctx, parts[0], mountPath, "Mount does not belong to any container"))
+			}
+
+			continue
+		}
+
+		if parts, ok := c.relPathParts(c.options.HostPersistentBindMountsDir, mountPath); ok {
+			if !state.containers[parts[0]] {
+				problems = append(problems, c.unmountProblem(ctx, parts[0], mountPath, "Mount does not belong to any container"))
+			} else if len(parts) == 2 && state.disks[parts[1]] == "" {
+				problems = append(problems, c.unmountProblem(ctx, parts[0], mountPath, "Mounted disk does not exist"))
+			}
+		}
+	}
+
+	return problems
+}
+
+func (c ReconcileCmd) unmountProblem(ctx context.Context, vmID, mountPath, description string) *reconcileProblem {
+	return &reconcileProblem{
+		Kind:    "mount",
+		ID:      vmID,
+		Path:    mountPath,
+		Problem: description,
+		Fix:     "Unmount",
+		fixFunc: func() error {
+			return c.withVMLock(ctx, vmID, func() error {
+				parts, ok := c.relPathParts(c.options.HostPersistentBindMountsDir, mountPath)
+				if ok && len(parts) == 2 {
+					// Retries unmounting while disk is still busy
+					return c.hostBindMounts.UnmountPersistent(ctx, parts[0], parts[1])
+				}
+
+				err := c.mounter.Unmount(mountPath)
+				if err != nil && !bwcvm.IsNotMounted(err) {
+					return bosherr.WrapError(err, "Unmounting '%s'", mountPath)
+				}
+
+				return nil
+			})
+		},
+	}
+}
+
+// loopDeviceProblems finds loop devices attached to disks that are not mounted anywhere,
+// e.g. left behind when mount failed after attaching loop device or by `umount -l`
+func (c ReconcileCmd) loopDeviceProblems(ctx context.Context, state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	for _, device := range state.loopDevices {
+		diskID, ok := c.loopDeviceDiskID(device)
+		if !ok || state.mountSources[device.Path] {
+			continue
+		}
+
+		device := device
+
+		problems = append(problems, &reconcileProblem{
+			Kind:    "loop_device",
+			ID:      diskID,
+			Path:    device.Path,
+			Problem: "Loop device of disk is not mounted",
+			Fix:     "Detach loop device",
+			fixFunc: func() error {
+				return c.withDiskLock(ctx, diskID, func() error { return c.detachLoopDevice(device) })
+			},
+		})
+	}
+
+	return problems
+}
+
+// detachLoopDevice detaches loop device only if it is still attached to the same disk and still not mounted
+func (c ReconcileCmd) detachLoopDevice(device bwcvm.LoopDevice) error {
+	_, mountSources, err := c.listMounts()
+	if err != nil {
+		return err
+	}
+
+	if mountSources[device.Path] {
+		return bosherr.New("Expected loop device '%s' to not be mounted", device.Path)
+	}
+
+	devices, err := c.mounter.LoopDevices()
+	if err != nil {
+		return bosherr.WrapError(err, "Listing loop devices")
+	}
+
+	for _, d := range devices {
+		if d == device {
+			return c.mounter.DetachLoop(device.Path)
+		}
+	}
+
+	return nil
+}
+
+// loopDeviceDiskID returns disk ID if loop device is backed by a disk;
+// kernel appends ' (deleted)' to backing files that were deleted while attached
+func (c ReconcileCmd) loopDeviceDiskID(device bwcvm.LoopDevice) (string, bool) {
+	parts, ok := c.relPathParts(c.options.DisksDir, strings.TrimSuffix(device.BackingFile, " (deleted)"))
+	if !ok || len(parts) != 1 {
+		return "", false
+	}
+
+	return parts[0], true
+}
+
+// containerProblems finds containers without bind mount directories.
+// Only containers recorded in the inventory are deleted since Garden might have other containers.
+func (c ReconcileCmd) containerProblems(ctx context.Context, state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	recorded := map[string]bool{}
+
+	for _, record := range state.vmRecords {
+		recorded[record.CID] = true
+	}
+
+	for _, id := range state.containerIDs {
+		_, hasEphemeral := state.ephemeralDirs[id]
+		_, hasPersistent := state.persistentDirs[id]
+
+		problem := &reconcileProblem{Kind: "container", ID: id}
+
+		switch {
+		case hasEphemeral && hasPersistent:
+			continue
+
+		case hasEphemeral:
+			problem.Problem = "Container does not have persistent bind mount directory"
+
+		case hasPersistent:
+			problem.Problem = "Container does not have ephemeral bind mount directory"
+
+		default:
+			problem.Problem = "Container does not have bind mount directories"
+
+			if recorded[id] {
+				problem.Fix = "Delete VM"
+				problem.fixFunc = func() error { return c.deleteVM(ctx, id) }
+			}
+		}
+
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
+
+func (c ReconcileCmd) deleteVM(ctx context.Context, id string) error {
+	return c.withVMLock(ctx, id, func() error {
+		vm, _, err := c.vmFinder.Find(ctx, id)
+		if err != nil {
+			return bosherr.WrapError(err, "Finding VM '%s'", id)
+		}
+
+		err = vm.Delete(ctx)
+		if err != nil {
+			return bosherr.WrapError(err, "Deleting VM '%s'", id)
+		}
+
+		return nil
+	})
+}
+
+// bindDirProblems finds bind mount directories without containers
+func (c ReconcileCmd) bindDirProblems(ctx context.Context, state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	for _, id := range c.sortedKeys(state.ephemeralDirs) {
+		if state.containers[id] {
+			continue
+		}
+
+		id, path := id, state.ephemeralDirs[id]
+
+		problems = append(problems, &reconcileProblem{
+			Kind:    "ephemeral_bind_dir",
+			ID:      id,
+			Path:    path,
+			Problem: "Directory does not belong to any container",
+			Fix:     "Delete directory",
+			fixFunc: func() error {
+				return c.withMissingContainer(ctx, id, func() error {
+					// Removing directory with mounts would remove files on mounted filesystems
+					mounts, err := c.mountTable.Mounts()
+					if err != nil {
+						return bosherr.WrapError(err, "Listing mounts")
+					}
+
+					if mount, found := mounts.Find(path); found {
+						return bosherr.New("Expected directory '%s' to not have mounts but found '%s'", path, mount.MountPoint)
+					}
+
+					for _, mount := range mounts.Under(path) {
+						return bosherr.New("Expected directory '%s' to not have mounts but found '%s'", path, mount.MountPoint)
+					}
+
+					return c.hostBindMounts.DeleteEphemeral(id)
+				})
+			},
+		})
+	}
+
+	for _, id := range c.sortedKeys(state.persistentDirs) {
+		if state.containers[id] {
+			continue
+		}
+
+		id := id
+
+		problems = append(problems, &reconcileProblem{
+			Kind:    "persistent_bind_dir",
+			ID:      id,
+			Path:    state.persistentDirs[id],
+			Problem: "Directory does not belong to any container",
+			Fix:     "Unmount and delete directory",
+			fixFunc: func() error {
+				return c.withMissingContainer(ctx, id, func() error {
+					// Unmounts mounted disks and the bind mount itself before removing directory
+					return c.hostBindMounts.DeletePersistent(ctx, id)
+				})
+			},
+		})
+	}
+
+	return problems
+}
+
+// diskProblems finds disks that are neither recorded in the inventory nor mounted
+func (c ReconcileCmd) diskProblems(state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	recorded := map[string]bool{}
+
+	for _, record := range state.diskRecords {
+		recorded[record.CID] = true
+	}
+
+	mounted := map[string]bool{}
+
+	for _, mountPath := range state.mounts {
+		parts, ok := c.relPathParts(c.options.HostPersistentBindMountsDir, mountPath)
+		if ok && len(parts) == 2 {
+			mounted[parts[1]] = true
+		}
+	}
+
+	for _, id := range c.sortedKeys(state.disks) {
+		if recorded[id] || mounted[id] {
+			continue
+		}
+
+		// Not fixed automatically since disk may be created by create_disk that has not recorded it yet
+		// or hold data of a disk created before the inventory was introduced
+		problems = append(problems, &reconcileProblem{
+			Kind:    "disk",
+			ID:      id,
+			Path:    state.disks[id],
+			Problem: "Disk is not recorded in inventory and is not mounted",
+		})
+	}
+
+	return problems
+}
+
+// recordProblems finds inventory records of objects that no longer exist
+func (c ReconcileCmd) recordProblems(ctx context.Context, state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	for _, record := range state.vmRecords {
+		if state.containers[record.CID] {
+			continue
+		}
+
+		id := record.CID
+
+		problems = append(problems, &reconcileProblem{
+			Kind:    "vm_record",
+			ID:      id,
+			Problem: "Recorded VM does not have container",
+			Fix:     "Delete record",
+			fixFunc: func() error {
+				return c.withMissingContainer(ctx, id, func() error { return c.inventory.DeleteVM(id) })
+			},
+		})
+	}
+
+	for _, record := range state.diskRecords {
+		id := record.CID
+
+		if _, found := state.disks[id]; !found {
+			problems = append(problems, &reconcileProblem{
+				Kind:    "disk_record",
+				ID:      id,
+				Problem: "Recorded disk does not exist",
+				Fix:     "Delete record",
+				fixFunc: func() error {
+					return c.withDiskLock(ctx, id, func() error { return c.inventory.DeleteDisk(id) })
+				},
+			})
+
+			continue
+		}
+
+		if record.VMCID != "" && !state.containers[record.VMCID] {
+			vmID := record.VMCID
+
+			problems = append(problems, &reconcileProblem{
+				Kind:    "disk_record",
+				ID:      id,
+				Problem: fmt.Sprintf("Disk is recorded as attached to VM '%s' that does not have container", vmID),
+				Fix:     "Record disk as detached",
+				fixFunc: func() error {
+					return c.withDiskLock(ctx, id, func() error {
+						diskRecord, found, err := c.inventory.FindDisk(id)
+						if err != nil {
+							return err
+						}
+
+						// Disk might have been attached to another VM since
+						if !found || diskRecord.VMCID != vmID {
+							return nil
+						}
+
+						diskRecord.VMCID = ""
+
+						return c.inventory.SaveDisk(diskRecord)
+					})
+				},
+			})
+		}
+	}
+
+	for _, record := range state.stemcellRecords {
+		if state.stemcells[record.CID] {
+			continue
+		}
+
+		id := record.CID
+
+		problems = append(problems, &reconcileProblem{
+			Kind:    "stemcell_record",
+			ID:      id,
+			Problem: "Recorded stemcell does not exist",
+			Fix:     "Delete record",
+			fixFunc: func() error { return c.inventory.DeleteStemcell(id) },
+		})
+	}
+
+	return problems
+}
+
+// stemcellProblems finds stemcells that are unknown to the inventory or still pending deletion
+func (c ReconcileCmd) stemcellProblems(ctx context.Context, state reconcileState) []*reconcileProblem {
+	var problems []*reconcileProblem
+
+	recorded := map[string]bool{}
+
+	for _, record := range state.stemcellRecords {
+		recorded[record.CID] = true
+	}
+
+	pending := map[string]bool{}
+
+	for _, id := range state.pendingStemcells {
+		pending[id] = true
+	}
+
+	for _, id := range state.stemcellIDs {
+		if pending[id] {
+			problems = append(problems, &reconcileProblem{
+				Kind:    "stemcell",
+				ID:      id,
+				Problem: "Stemcell is pending deletion",
+				Fix:     "Delete stemcells pending deletion that are no longer used",
+
+				// Stemcells still used by VMs are kept
+				fixFunc: func() error { return c.stemcellDeleter.CollectPending(ctx) },
+			})
+		} else if !recorded[id] {
+			// Stemcells are owned by Director so they are never deleted here
+			problems = append(problems, &reconcileProblem{
+				Kind:    "stemcell",
+				ID:      id,
+				Problem: "Stemcell is not recorded in inventory",
+			})
+		}
+	}
+
+	return problems
+}
+
+// withMissingContainer runs fn while holding VM lock only if VM still does not have container
+func (c ReconcileCmd) withMissingContainer(ctx context.Context, id string, fn func() error) error {
+	return c.withVMLock(ctx, id, func() error {
+		_, found, err := c.vmFinder.Find(ctx, id)
+		if err != nil {
+			return bosherr.WrapError(err, "Finding VM '%s'", id)
+		}
+
+		if found {
+			return bosherr.New("Expected VM '%s' to not have container", id)
+		}
+
+		return fn()
+	})
+}
+
+func (c ReconcileCmd) withVMLock(ctx context.Context, id string, fn func() error) error {
+	lock, err := c.lockManager.Lock(ctx, bwcutil.VMLockKey(id))
+	if err != nil {
+		return bosherr.WrapError(err, "Locking VM '%s'", id)
+	}
+
+	defer lock.Unlock()
+
+	return fn()
+}
+
+func (c ReconcileCmd) withDiskLock(ctx context.Context, id string, fn func() error) error {
+	lock, err := c.lockManager.Lock(ctx, bwcutil.DiskLockKey(id))
+	if err != nil {
+		return bosherr.WrapError(err, "Locking disk '%s'", id)
+	}
+
+	defer lock.Unlock()
+
+	return fn()
+}
+
+// listDir returns paths of directory entries keyed by their names
+func (c ReconcileCmd) listDir(dirPath string) (map[string]string, error) {
+	paths, err := c.fs.Glob(filepath.Join(dirPath, "*"))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing '%s'", dirPath)
+	}
+
+	entries := map[string]string{}
+
+	for _, path := range paths {
+		entries[filepath.Base(path)] = path
+	}
+
+	return entries, nil
+}
+
+// listMounts returns sorted unique mount points and mounted sources;
+// mount points stacked on top of each other are listed once
+func (c ReconcileCmd) listMounts() ([]string, map[string]bool, error) {
+	mounts, err := c.mountTable.Mounts()
+	if err != nil {
+		return nil, nil, bosherr.WrapError(err, "Listing mounts")
+	}
+
+	seen := map[string]bool{}
+	sources := map[string]bool{}
+
+	var mountPoints []string
+
+	for _, mount := range mounts {
+		sources[mount.Source] = true
+
+		if !seen[mount.MountPoint] {
+			seen[mount.MountPoint] = true
+			mountPoints = append(mountPoints, mount.MountPoint)
+		}
+	}
+
+	sort.Strings(mountPoints)
+
+	return mountPoints, sources, nil
+}
+
+// relPathParts returns path components of path relative to dirPath,
+// e.g. VM ID and disk ID for disk mounted in persistent bind mounts directory
+func (c ReconcileCmd) relPathParts(dirPath, path string) ([]string, bool) {
+	prefix := filepath.Clean(dirPath) + "/"
+
+	if !strings.HasPrefix(path, prefix) || path == prefix {
+		return nil, false
+	}
+
+	return strings.Split(strings.TrimPrefix(path, prefix), "/"), true
+}
+
+func (c ReconcileCmd) sortedKeys(m map[string]string) []string {
+	var keys []string
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// printProblem prints one JSON object per line so that output can be consumed by scripts
+func (c ReconcileCmd) printProblem(problem *reconcileProblem) error {
+	problemBytes, err := json.Marshal(problem)
+	if err != nil {
+		return bosherr.WrapError(err, "Marshalling problem with %s '%s'", problem.Kind, problem.ID)
+	}
+
+	_, err = fmt.Fprintln(c.out, string(problemBytes))
+	if err != nil {
+		return bosherr.WrapError(err, "Writing to OUT")
+	}
+
+	return nil
+}
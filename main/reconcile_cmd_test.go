@@ -0,0 +1,330 @@
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcinv "github.com/cppforlife/bosh-warden-cpi/inventory"
+	fakeinv "github.com/cppforlife/bosh-warden-cpi/inventory/fakes"
+	. "github.com/cppforlife/bosh-warden-cpi/main"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
+)
+
+var _ = Describe("ReconcileCmd", func() {
+	var (
+		wardenClient    *fakewrdnclient.FakeClient
+		vmFinder        *fakevm.FakeFinder
+		hostBindMounts  *fakevm.FakeHostBindMounts
+		stemcellFinder  *fakestem.FakeFinder
+		stemcellDeleter *fakestem.FakeDeferredDeleter
+		inventory       *fakeinv.FakeStore
+		lockManager     *fakeutil.FakeLockManager
+		fs              *fakesys.FakeFileSystem
+		cmdRunner       *fakesys.FakeCmdRunner
+		mountTable      *fakevm.FakeMountTable
+		out             *bytes.Buffer
+		cmd             ReconcileCmd
+
+		options = bwcaction.ConcreteFactoryOptions{
+			DisksDir: "/disks",
+
+			HostEphemeralBindMountsDir:  "/ephemeral",
+			HostPersistentBindMountsDir: "/persistent",
+		}
+	)
+
+	BeforeEach(func() {
+		wardenClient = fakewrdnclient.New()
+		vmFinder = &fakevm.FakeFinder{}
+		hostBindMounts = &fakevm.FakeHostBindMounts{}
+		stemcellFinder = &fakestem.FakeFinder{}
+		stemcellDeleter = &fakestem.FakeDeferredDeleter{}
+		inventory = fakeinv.NewFakeStore()
+		lockManager = fakeutil.NewFakeLockManager()
+		fs = fakesys.NewFakeFileSystem()
+		cmdRunner = fakesys.NewFakeCmdRunner()
+		mountTable = fakevm.NewFakeMountTable()
+		out = bytes.NewBufferString("")
+
+		cmd = NewReconcileCmd(
+			bwcvm.NewCancellableWardenClient(wardenClient, boshlog.NewLogger(boshlog.LevelNone)),
+			vmFinder,
+			hostBindMounts,
+			stemcellFinder,
+			stemcellDeleter,
+			inventory,
+			lockManager,
+			options,
+			fs,
+			bwcvm.NewCmdMounter(cmdRunner, boshlog.NewLogger(boshlog.LevelNone)),
+			mountTable,
+			out,
+			boshlog.NewLogger(boshlog.LevelNone),
+		)
+	})
+
+	setMounts := func(mountPoints ...string) {
+		var mounts []bwcvm.Mount
+
+		for _, mountPoint := range mountPoints {
+			mounts = append(mounts, bwcvm.Mount{MountPoint: mountPoint})
+		}
+
+		mountTable.SetMounts(mounts...)
+	}
+
+	outLines := func() []string {
+		return strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	}
+
+	Describe("Run", func() {
+		Context("when host has leftovers from failed runs", func() {
+			BeforeEach(func() {
+				wardenClient.Connection.ListReturns([]string{"vm-ok", "vm-no-dirs"}, nil)
+
+				fs.SetGlob("/ephemeral/*", []string{"/ephemeral/vm-ok", "/ephemeral/vm-orphan"})
+				fs.SetGlob("/persistent/*", []string{"/persistent/vm-ok", "/persistent/vm-orphan"})
+				fs.SetGlob("/disks/*", []string{"/disks/disk-1", "/disks/disk-ok", "/disks/disk-recorded", "/disks/disk-unref"})
+
+				setMounts(
+					"/",
+					"/persistent/vm-orphan",
+					"/persistent/vm-orphan/disk-1",
+					"/persistent/vm-ok/disk-gone",
+					"/persistent/vm-ok/disk-ok",
+					"/persistent/vm-ok/disk-ok", // stacked mounts are reported once
+				)
+
+				inventory.VMs["vm-no-dirs"] = bwcinv.VMRecord{CID: "vm-no-dirs"}
+				inventory.VMs["vm-gone"] = bwcinv.VMRecord{CID: "vm-gone"}
+				inventory.Disks["disk-recorded"] = bwcinv.DiskRecord{CID: "disk-recorded", VMCID: "vm-gone"}
+				inventory.Disks["disk-missing"] = bwcinv.DiskRecord{CID: "disk-missing"}
+				inventory.Stemcells["stemcell-ok"] = bwcinv.StemcellRecord{CID: "stemcell-ok"}
+				inventory.Stemcells["stemcell-gone"] = bwcinv.StemcellRecord{CID: "stemcell-gone"}
+
+				stemcellFinder.FindAllStemcells = []bwcstem.Stemcell{
+					fakestem.NewFakeStemcell("stemcell-ok"),
+					fakestem.NewFakeStemcell("stemcell-unrecorded"),
+				}
+
+				stemcellDeleter.PendingIDs = []string{"stemcell-pending"}
+			})
+
+			It("prints one JSON object per found problem without fixing anything", func() {
+				err := cmd.Run([]string{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(outLines()).To(Equal([]string{
+					`{"kind":"mount","id":"vm-orphan","path":"/persistent/vm-orphan/disk-1","problem":"Mount does not belong to any container","fix":"Unmount","fixed":false}`,
+					`{"kind":"mount","id":"vm-orphan","path":"/persistent/vm-orphan","problem":"Mount does not belong to any container","fix":"Unmount","fixed":false}`,
+					`{"kind":"mount","id":"vm-ok","path":"/persistent/vm-ok/disk-gone","problem":"Mounted disk does not exist","fix":"Unmount","fixed":false}`,
+					`{"kind":"container","id":"vm-no-dirs","problem":"Container does not have bind mount directories","fix":"Delete VM","fixed":false}`,
+					`{"kind":"ephemeral_bind_dir","id":"vm-orphan","path":"/ephemeral/vm-orphan","problem":"Directory does not belong to any container","fix":"Delete directory","fixed":false}`,
+					`{"kind":"persistent_bind_dir","id":"vm-orphan","path":"/persistent/vm-orphan","problem":"Directory does not belong to any container","fix":"Unmount and delete directory","fixed":false}`,
+					`{"kind":"disk","id":"disk-unref","path":"/disks/disk-unref","problem":"Disk is not recorded in inventory and is not mounted","fixed":false}`,
+					`{"kind":"vm_record","id":"vm-gone","problem":"Recorded VM does not have container","fix":"Delete record","fixed":false}`,
+					`{"kind":"disk_record","id":"disk-missing","problem":"Recorded disk does not exist","fix":"Delete record","fixed":false}`,
+					`{"kind":"disk_record","id":"disk-recorded","problem":"Disk is recorded as attached to VM 'vm-gone' that does not have container","fix":"Record disk as detached","fixed":false}`,
+					`{"kind":"stemcell_record","id":"stemcell-gone","problem":"Recorded stemcell does not exist","fix":"Delete record","fixed":false}`,
+					`{"kind":"stemcell","id":"stemcell-pending","problem":"Stemcell is pending deletion","fix":"Delete stemcells pending deletion that are no longer used","fixed":false}`,
+					`{"kind":"stemcell","id":"stemcell-unrecorded","problem":"Stemcell is not recorded in inventory","fixed":false}`,
+				}))
+
+				// Only lists loop devices
+				Expect(cmdRunner.RunCommands).To(Equal([][]string{
+					[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"},
+				}))
+				Expect(hostBindMounts.DeleteEphemeralCalled).To(BeFalse())
+				Expect(hostBindMounts.DeletePersistentCalled).To(BeFalse())
+				Expect(stemcellDeleter.CollectPendingCalled).To(BeFalse())
+				Expect(inventory.VMs).To(HaveLen(2))
+			})
+
+			It("fixes problems unmounting before deleting directories when fix flag is given", func() {
+				vm := fakevm.NewFakeVM("vm-no-dirs")
+				vmFinder.FindVM = vm
+
+				err := cmd.Run([]string{"-fix"})
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, line := range outLines() {
+					if strings.Contains(line, `"fix":`) {
+						Expect(line).To(ContainSubstring(`"fixed":true`))
+					}
+				}
+
+				Expect(cmdRunner.RunCommands).To(ContainElement([]string{"umount", "/persistent/vm-orphan"}))
+				Expect(hostBindMounts.UnmountPersistentID).To(Equal("vm-ok"))
+				Expect(hostBindMounts.UnmountPersistentDiskID).To(Equal("disk-gone"))
+
+				Expect(vm.DeleteCalled).To(BeTrue())
+				Expect(hostBindMounts.DeleteEphemeralID).To(Equal("vm-orphan"))
+				Expect(hostBindMounts.DeletePersistentID).To(Equal("vm-orphan"))
+				// Unrecorded disks are only reported
+				Expect(outLines()).To(ContainElement(
+					`{"kind":"disk","id":"disk-unref","path":"/disks/disk-unref","problem":"Disk is not recorded in inventory and is not mounted","fixed":false}`,
+				))
+
+				Expect(inventory.VMs).To(HaveKey("vm-no-dirs"))
+				Expect(inventory.VMs).ToNot(HaveKey("vm-gone"))
+				Expect(inventory.Disks).To(Equal(map[string]bwcinv.DiskRecord{
+					"disk-recorded": {CID: "disk-recorded"},
+				}))
+				Expect(inventory.Stemcells).ToNot(HaveKey("stemcell-gone"))
+
+				Expect(stemcellDeleter.CollectPendingCalled).To(BeTrue())
+
+				Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+			})
+		})
+
+		It("does not delete bind mount directories if container appears before fixing", func() {
+			fs.SetGlob("/persistent/*", []string{"/persistent/vm-id"})
+			setMounts()
+
+			vmFinder.FindFound = true
+
+			err := cmd.Run([]string{"-fix"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Failed to fix 1 problem(s)"))
+
+			Expect(hostBindMounts.DeletePersistentCalled).To(BeFalse())
+
+			Expect(out.String()).To(ContainSubstring(`"fixed":false,"fix_error":"Expected VM 'vm-id' to not have container"`))
+		})
+
+		It("does not delete ephemeral bind mount directory that still has mounts", func() {
+			fs.SetGlob("/ephemeral/*", []string{"/ephemeral/vm-id"})
+
+			// Mount stays even after unmounting
+			setMounts("/ephemeral/vm-id/data")
+
+			err := cmd.Run([]string{"-fix"})
+			Expect(err).To(HaveOccurred())
+
+			Expect(cmdRunner.RunCommands).To(ContainElement([]string{"umount", "/ephemeral/vm-id/data"}))
+			Expect(hostBindMounts.DeleteEphemeralCalled).To(BeFalse())
+
+			Expect(out.String()).To(ContainSubstring("Expected directory '/ephemeral/vm-id' to not have mounts"))
+		})
+
+		Context("when disks have loop devices", func() {
+			BeforeEach(func() {
+				fs.SetGlob("/disks/*", []string{"/disks/disk-leaked", "/disks/disk-mounted"})
+
+				inventory.Disks["disk-leaked"] = bwcinv.DiskRecord{CID: "disk-leaked"}
+				inventory.Disks["disk-mounted"] = bwcinv.DiskRecord{CID: "disk-mounted"}
+
+				mountTable.SetMounts(bwcvm.Mount{MountPoint: "/other", Source: "/dev/loop1"})
+
+				cmdRunner.AddCmdResult(
+					"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+					fakesys.FakeCmdResult{
+						Stdout: "/dev/loop0 /disks/disk-leaked\n/dev/loop1 /disks/disk-mounted\n/dev/loop2 /other/file\n/dev/loop3 /disks/disk-gone\\x20(deleted)\n",
+						Sticky: true,
+					},
+				)
+			})
+
+			It("reports loop devices of disks that are not mounted", func() {
+				err := cmd.Run([]string{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(outLines()).To(Equal([]string{
+					`{"kind":"loop_device","id":"disk-leaked","path":"/dev/loop0","problem":"Loop device of disk is not mounted","fix":"Detach loop device","fixed":false}`,
+					`{"kind":"loop_device","id":"disk-gone","path":"/dev/loop3","problem":"Loop device of disk is not mounted","fix":"Detach loop device","fixed":false}`,
+				}))
+			})
+
+			It("detaches loop devices of disks that are not mounted", func() {
+				err := cmd.Run([]string{"-fix"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands).To(ContainElement([]string{"losetup", "--detach", "/dev/loop0"}))
+				Expect(cmdRunner.RunCommands).To(ContainElement([]string{"losetup", "--detach", "/dev/loop3"}))
+				Expect(cmdRunner.RunCommands).ToNot(ContainElement([]string{"losetup", "--detach", "/dev/loop1"}))
+				Expect(cmdRunner.RunCommands).ToNot(ContainElement([]string{"losetup", "--detach", "/dev/loop2"}))
+
+				Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+			})
+
+			It("does not detach loop device that was mounted before fixing", func() {
+				mountTable.MountsResults = []bwcvm.Mounts{
+					{{MountPoint: "/other", Source: "/dev/loop1"}},
+					{{MountPoint: "/persistent/vm-id/disk-leaked", Source: "/dev/loop0"}},
+				}
+
+				err := cmd.Run([]string{"-fix"})
+				Expect(err).To(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands).ToNot(ContainElement([]string{"losetup", "--detach", "/dev/loop0"}))
+
+				Expect(out.String()).To(ContainSubstring("Expected loop device '/dev/loop0' to not be mounted"))
+			})
+		})
+
+		It("does not delete containers that are not recorded in the inventory", func() {
+			wardenClient.Connection.ListReturns([]string{"other-container"}, nil)
+			setMounts()
+
+			err := cmd.Run([]string{"-fix"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(out.String()).To(Equal(
+				`{"kind":"container","id":"other-container","problem":"Container does not have bind mount directories","fixed":false}` + "\n",
+			))
+		})
+
+		It("reports fix error and continues fixing other problems", func() {
+			setMounts()
+
+			inventory.VMs["vm-gone"] = bwcinv.VMRecord{CID: "vm-gone"}
+			inventory.DeleteVMErr = errors.New("fake-delete-err")
+
+			inventory.Stemcells["stemcell-gone"] = bwcinv.StemcellRecord{CID: "stemcell-gone"}
+
+			err := cmd.Run([]string{"-fix"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Failed to fix 1 problem(s)"))
+
+			Expect(outLines()).To(Equal([]string{
+				`{"kind":"vm_record","id":"vm-gone","problem":"Recorded VM does not have container","fix":"Delete record","fixed":false,"fix_error":"fake-delete-err"}`,
+				`{"kind":"stemcell_record","id":"stemcell-gone","problem":"Recorded stemcell does not exist","fix":"Delete record","fixed":true}`,
+			}))
+		})
+
+		It("returns error if listing containers fails", func() {
+			wardenClient.Connection.ListReturns(nil, errors.New("fake-list-err"))
+
+			err := cmd.Run([]string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-list-err"))
+		})
+
+		It("returns error if listing mounts fails", func() {
+			mountTable.MountsErr = errors.New("fake-mount-err")
+
+			err := cmd.Run([]string{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-mount-err"))
+		})
+
+		It("returns error if arguments are not expected", func() {
+			err := cmd.Run([]string{"extra"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Expected 'reconcile [-fix]'"))
+		})
+	})
+})
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+
+	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
+)
+
+const replayCmdLogTag = "ReplayCmd"
+
+// Methods whose string result is a CID of a newly created object
+var replayCIDMethods = map[string]bool{
+	"create_stemcell": true,
+	"create_vm":       true,
+	"create_disk":     true,
+}
+
+// ReplayCmd implements `replay` subcommand which runs newline-delimited CPI requests
+// (e.g. copied from Director's debug log) in order and prints one response per line.
+//
+// Lines without method key are treated as recorded responses to the preceding request;
+// they are not dispatched but let `-substitute-cids` map recorded CIDs to newly created ones.
+type ReplayCmd struct {
+	dispatcher bwcdisp.Dispatcher
+	fs         boshsys.FileSystem
+	in         io.Reader
+	out        io.Writer
+	logger     boshlog.Logger
+}
+
+type replayLine struct {
+	Method *string         `json:"method"`
+	Result json.RawMessage `json:"result"`
+}
+
+type replayState struct {
+	substituteCIDs bool
+
+	// Maps CIDs from recorded responses to CIDs returned during replay
+	cids map[string]string
+
+	lastMethod   string
+	lastRespLine replayLine
+}
+
+func NewReplayCmd(
+	dispatcher bwcdisp.Dispatcher,
+	fs boshsys.FileSystem,
+	in io.Reader,
+	out io.Writer,
+	logger boshlog.Logger,
+) ReplayCmd {
+	return ReplayCmd{
+		dispatcher: dispatcher,
+		fs:         fs,
+		in:         in,
+		out:        out,
+		logger:     logger,
+	}
+}
+
+func (c ReplayCmd) Run(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+
+	substituteCIDsOpt := flags.Bool("substitute-cids", false, "Substitute recorded CIDs with ones returned during replay")
+
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() > 1 {
+		return bosherr.New("Expected 'replay [-substitute-cids] [path|-]'")
+	}
+
+	in := c.in
+
+	if path := flags.Arg(0); path != "" && path != "-" {
+		contents, err := c.fs.ReadFile(path)
+		if err != nil {
+			return bosherr.WrapError(err, "Reading requests file '%s'", path)
+		}
+
+		in = bytes.NewReader(contents)
+	}
+
+	state := &replayState{
+		substituteCIDs: *substituteCIDsOpt,
+		cids:           map[string]string{},
+	}
+
+	reader := bufio.NewReader(in)
+
+	for lineNum := 1; ; lineNum++ {
+		lineBytes, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return bosherr.WrapError(err, "Reading line %d", lineNum)
+		}
+
+		lineBytes = bytes.TrimSpace(lineBytes)
+
+		if len(lineBytes) > 0 {
+			replayErr := c.replayLine(lineNum, lineBytes, state)
+			if replayErr != nil {
+				return replayErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func (c ReplayCmd) replayLine(lineNum int, lineBytes []byte, state *replayState) error {
+	var line replayLine
+
+	// Invalid requests are still dispatched so that their error responses are printed
+	err := json.Unmarshal(lineBytes, &line)
+	if err == nil && line.Method == nil {
+		c.recordCIDs(lineNum, line, state)
+		return nil
+	}
+
+	if err == nil && state.substituteCIDs {
+		lineBytes, err = c.substituteCIDs(lineBytes, state)
+		if err != nil {
+			return bosherr.WrapError(err, "Substituting CIDs in line %d", lineNum)
+		}
+	}
+
+	c.logger.Debug(replayCmdLogTag, "Dispatching request from line %d", lineNum)
+
+	respBytes := c.dispatcher.Dispatch(lineBytes)
+
+	_, err = fmt.Fprintln(c.out, string(respBytes))
+	if err != nil {
+		return bosherr.WrapError(err, "Writing to OUT")
+	}
+
+	state.lastMethod = ""
+	state.lastRespLine = replayLine{}
+
+	if line.Method != nil {
+		state.lastMethod = *line.Method
+
+		// Response is only used for CID substitution so its errors are irrelevant
+		_ = json.Unmarshal(respBytes, &state.lastRespLine)
+	}
+
+	return nil
+}
+
+func (c ReplayCmd) recordCIDs(lineNum int, recordedLine replayLine, state *replayState) {
+	if !replayCIDMethods[state.lastMethod] {
+		return
+	}
+
+	recordedCID, found := c.resultCID(recordedLine.Result)
+	if !found {
+		return
+	}
+
+	cid, found := c.resultCID(state.lastRespLine.Result)
+	if !found {
+		c.logger.Debug(replayCmdLogTag, "Not substituting CID '%s' recorded on line %d since request failed", recordedCID, lineNum)
+		return
+	}
+
+	c.logger.Debug(replayCmdLogTag, "Substituting CID '%s' with '%s'", recordedCID, cid)
+
+	state.cids[recordedCID] = cid
+}
+
+// resultCID returns CID from a result that is either the CID itself
+// or an array whose first element is the CID (e.g. create_vm in API v2 returns [cid, networks])
+func (c ReplayCmd) resultCID(result json.RawMessage) (string, bool) {
+	var cid string
+
+	if json.Unmarshal(result, &cid) == nil {
+		return cid, cid != ""
+	}
+
+	var results []interface{}
+
+	if json.Unmarshal(result, &results) != nil || len(results) == 0 {
+		return "", false
+	}
+
+	cid, _ = results[0].(string)
+
+	return cid, cid != ""
+}
+
+func (c ReplayCmd) substituteCIDs(lineBytes []byte, state *replayState) ([]byte, error) {
+	if len(state.cids) == 0 {
+		return lineBytes, nil
+	}
+
+	var req map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(lineBytes))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&req)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Unmarshalling request")
+	}
+
+	if args, found := req["arguments"]; found {
+		req["arguments"] = c.substituteCIDsIn(args, state.cids)
+	}
+
+	return json.Marshal(req)
+}
+
+// substituteCIDsIn replaces strings that exactly match recorded CIDs at any depth
+func (c ReplayCmd) substituteCIDsIn(val interface{}, cids map[string]string) interface{} {
+	switch typedVal := val.(type) {
+	case string:
+		if cid, found := cids[typedVal]; found {
+			return cid
+		}
+
+	case []interface{}:
+		for i, item := range typedVal {
+			typedVal[i] = c.substituteCIDsIn(item, cids)
+		}
+
+	case map[string]interface{}:
+		for key, item := range typedVal {
+			typedVal[key] = c.substituteCIDsIn(item, cids)
+		}
+	}
+
+	return val
+}
@@ -0,0 +1,171 @@
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	fakedisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher/fakes"
+	. "github.com/cppforlife/bosh-warden-cpi/main"
+)
+
+var _ = Describe("ReplayCmd", func() {
+	var (
+		dispatcher *fakedisp.FakeDispatcher
+		reqs       []string
+		fs         *fakesys.FakeFileSystem
+		in         *bytes.Buffer
+		out        *bytes.Buffer
+		cmd        ReplayCmd
+	)
+
+	BeforeEach(func() {
+		reqs = nil
+
+		dispatcher = &fakedisp.FakeDispatcher{
+			DispatchStub: func(reqBytes []byte) []byte {
+				reqs = append(reqs, string(reqBytes))
+				return []byte(fmt.Sprintf(`{"result":"new-cid-%d","error":null,"log":""}`, len(reqs)))
+			},
+		}
+
+		fs = fakesys.NewFakeFileSystem()
+		in = bytes.NewBufferString("")
+		out = bytes.NewBufferString("")
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+		cmd = NewReplayCmd(dispatcher, fs, in, out, logger)
+	})
+
+	Describe("Run", func() {
+		It("dispatches requests from stdin in order and prints one response per line", func() {
+			in.WriteString(`{"method":"create_stemcell","arguments":["/image",{}]}` + "\n\n")
+			in.WriteString(`{"method":"create_vm","arguments":["agent-id","stemcell-cid"]}`)
+
+			err := cmd.Run([]string{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(reqs).To(Equal([]string{
+				`{"method":"create_stemcell","arguments":["/image",{}]}`,
+				`{"method":"create_vm","arguments":["agent-id","stemcell-cid"]}`,
+			}))
+
+			Expect(out.String()).To(Equal(
+				`{"result":"new-cid-1","error":null,"log":""}` + "\n" +
+					`{"result":"new-cid-2","error":null,"log":""}` + "\n",
+			))
+		})
+
+		It("reads requests from stdin when path is '-'", func() {
+			in.WriteString(`{"method":"info","arguments":[]}` + "\n")
+
+			err := cmd.Run([]string{"-"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reqs).To(Equal([]string{`{"method":"info","arguments":[]}`}))
+		})
+
+		It("reads requests from a file", func() {
+			fs.WriteFileString("/requests", `{"method":"info","arguments":[]}`+"\n")
+
+			err := cmd.Run([]string{"/requests"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reqs).To(Equal([]string{`{"method":"info","arguments":[]}`}))
+		})
+
+		It("returns error if reading file fails", func() {
+			fs.WriteFileString("/requests", "")
+			fs.ReadFileError = errors.New("fake-read-err")
+
+			err := cmd.Run([]string{"/requests"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-read-err"))
+		})
+
+		It("dispatches invalid requests so that their errors are printed", func() {
+			in.WriteString("invalid-json\n")
+
+			err := cmd.Run([]string{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reqs).To(Equal([]string{"invalid-json"}))
+		})
+
+		It("does not dispatch recorded responses", func() {
+			in.WriteString(`{"method":"create_disk","arguments":[100,{},"vm-cid"]}` + "\n")
+			in.WriteString(`{"result":"recorded-disk-cid","error":null,"log":""}` + "\n")
+
+			err := cmd.Run([]string{})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(reqs).To(HaveLen(1))
+			Expect(out.String()).To(Equal(`{"result":"new-cid-1","error":null,"log":""}` + "\n"))
+		})
+
+		It("returns error for unexpected arguments", func() {
+			err := cmd.Run([]string{"/requests", "/other"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Expected 'replay [-substitute-cids] [path|-]'"))
+		})
+
+		Context("when substituting CIDs", func() {
+			BeforeEach(func() {
+				in.WriteString(`{"method":"create_stemcell","arguments":["/image",{}]}` + "\n")
+				in.WriteString(`{"result":"recorded-stemcell-cid","error":null}` + "\n")
+				in.WriteString(`{"method":"create_vm","arguments":["agent-id","recorded-stemcell-cid",{},{}]}` + "\n")
+				in.WriteString(`{"result":"recorded-vm-cid","error":null}` + "\n")
+				in.WriteString(`{"method":"attach_disk","arguments":["recorded-vm-cid","unknown-disk-cid"]}` + "\n")
+				in.WriteString(`{"method":"set_vm_metadata","arguments":["recorded-vm-cid",{"nested":["recorded-stemcell-cid"]}]}` + "\n")
+			})
+
+			It("replaces CIDs recorded for earlier requests with CIDs returned during replay", func() {
+				err := cmd.Run([]string{"-substitute-cids"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(reqs).To(Equal([]string{
+					`{"method":"create_stemcell","arguments":["/image",{}]}`,
+					`{"arguments":["agent-id","new-cid-1",{},{}],"method":"create_vm"}`,
+					`{"arguments":["new-cid-2","unknown-disk-cid"],"method":"attach_disk"}`,
+					`{"arguments":["new-cid-2",{"nested":["new-cid-1"]}],"method":"set_vm_metadata"}`,
+				}))
+			})
+
+			It("does not replace CIDs when not requested", func() {
+				err := cmd.Run([]string{})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(reqs[1]).To(Equal(`{"method":"create_vm","arguments":["agent-id","recorded-stemcell-cid",{},{}]}`))
+			})
+
+			It("does not replace CIDs of objects that failed to be created during replay", func() {
+				dispatcher.DispatchStub = func(reqBytes []byte) []byte {
+					reqs = append(reqs, string(reqBytes))
+					return []byte(`{"result":null,"error":{"type":"Bosh::Clouds::CloudError","message":"fake-err","ok_to_retry":false},"log":""}`)
+				}
+
+				err := cmd.Run([]string{"-substitute-cids"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(reqs[1]).To(Equal(`{"method":"create_vm","arguments":["agent-id","recorded-stemcell-cid",{},{}]}`))
+			})
+
+			It("replaces CIDs returned as first element of an array result (e.g. by create_vm in API v2)", func() {
+				in.Reset()
+				in.WriteString(`{"method":"create_vm","arguments":["agent-id","stemcell-cid",{},{}]}` + "\n")
+				in.WriteString(`{"result":["recorded-vm-cid",{"default":{}}],"error":null}` + "\n")
+				in.WriteString(`{"method":"attach_disk","arguments":["recorded-vm-cid","disk-cid"]}` + "\n")
+
+				dispatcher.DispatchStub = func(reqBytes []byte) []byte {
+					reqs = append(reqs, string(reqBytes))
+					return []byte(fmt.Sprintf(`{"result":["new-cid-%d",{"default":{}}],"error":null,"log":""}`, len(reqs)))
+				}
+
+				err := cmd.Run([]string{"-substitute-cids"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(reqs[1]).To(Equal(`{"arguments":["new-cid-1","disk-cid"],"method":"attach_disk"}`))
+			})
+		})
+	})
+})
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"io"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
+
+	bwcaction "github.com/cppforlife/bosh-warden-cpi/action"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	bwcdisp "github.com/cppforlife/bosh-warden-cpi/api/dispatcher"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+// RequestScopeBuilder builds all actions' dependencies for each request
+// so that they log with request id; Garden connection is shared between requests.
+type RequestScopeBuilder struct {
+	config       Config
+	wardenClient bwcvm.WardenClient
+	uuidGen      boshuuid.Generator
+
+	logLevel boshlog.LogLevel
+	logOut   io.Writer
+}
+
+func NewRequestScopeBuilder(
+	config Config,
+	wardenClient bwcvm.WardenClient,
+	uuidGen boshuuid.Generator,
+	logLevel boshlog.LogLevel,
+	logOut io.Writer,
+) RequestScopeBuilder {
+	return RequestScopeBuilder{
+		config:       config,
+		wardenClient: wardenClient,
+		uuidGen:      uuidGen,
+
+		logLevel: logLevel,
+		logOut:   logOut,
+	}
+}
+
+func (b RequestScopeBuilder) Build(method string, reqContext bwcapi.RequestContext) bwcdisp.RequestScope {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if timeout := b.config.Timeouts.For(method); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+
+	timeService := bwcutil.RealTimeService{}
+
+	var entryOut io.Writer
+
+	if b.config.Logging.JSONFormat() {
+		entryOut = bwcutil.NewJSONLogWriter(b.logOut, reqContext.RequestID, method, timeService)
+	} else {
+		entryOut = bwcutil.NewRequestIDWriter(b.logOut, reqContext.RequestID)
+	}
+
+	responseLog := bwcutil.NewLogBuffer(b.config.ResponseLog.MaxBytesOrDefault())
+	responseLogLevel := b.config.ResponseLog.LogLevel()
+
+	// Log entries go to both places but each place has its own level;
+	// secrets are masked in all entries including ones logged by vendored packages
+	logOut := bwcutil.NewRedactingWriter(io.MultiWriter(
+		bwcutil.NewLogLevelWriter(entryOut, b.logLevel),
+		bwcutil.NewLogLevelWriter(responseLog, responseLogLevel),
+	))
+
+	logLevel := b.logLevel
+	if responseLogLevel < logLevel {
+		logLevel = responseLogLevel
+	}
+
+	logger := boshlog.NewWriterLogger(logLevel, logOut, logOut)
+
+	fs := boshsys.NewOsFileSystem(logger)
+
+	cmdRunner := boshsys.NewExecCmdRunner(logger)
+
+	stemcellExtractor := bwcstem.NewTarExtractor(fs, logger)
+
+	sleeper := bwcutil.NewCancellableSleeper(ctx)
+
+	actionFactory := bwcaction.NewConcreteFactory(
+		b.wardenClient,
+		fs,
+		cmdRunner,
+		b.uuidGen,
+		stemcellExtractor,
+		sleeper,
+		timeService,
+		reqContext,
+		b.config.Actions,
+		logger,
+	)
+
+	return bwcdisp.RequestScope{
+		ActionFactory: actionFactory,
+		Logger:        logger,
+		Context:       ctx,
+		Cancel:        cancel,
+		Log:           responseLog,
+	}
+}
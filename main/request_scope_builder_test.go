@@ -0,0 +1,194 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakeuuid "github.com/cloudfoundry/bosh-agent/uuid/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
+	. "github.com/cppforlife/bosh-warden-cpi/main"
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("RequestScopeBuilder", func() {
+	var (
+		wardenClient bwcvm.WardenClient
+		logOut       *bytes.Buffer
+		builder      RequestScopeBuilder
+	)
+
+	BeforeEach(func() {
+		wardenClient = bwcvm.NewCancellableWardenClient(fakewrdnclient.New(), boshlog.NewLogger(boshlog.LevelNone))
+		logOut = bytes.NewBufferString("")
+
+		builder = NewRequestScopeBuilder(
+			validConfig,
+			wardenClient,
+			&fakeuuid.FakeGenerator{},
+			boshlog.LevelDebug,
+			logOut,
+		)
+	})
+
+	Describe("Build", func() {
+		It("returns logger that tags every line with request id", func() {
+			scope := builder.Build("fake-method", bwcapi.RequestContext{RequestID: "fake-request-id"})
+
+			scope.Logger.Debug("fake-tag", "fake-msg1")
+			scope.Logger.Error("fake-tag", "fake-msg2")
+
+			lines := bytes.Split(bytes.TrimSpace(logOut.Bytes()), []byte("\n"))
+			Expect(lines).To(HaveLen(2))
+
+			for _, line := range lines {
+				Expect(string(line)).To(MatchRegexp(`^\[req:fake-request-id\] \[fake-tag\] `))
+			}
+		})
+
+		It("returns logger that does not tag lines when request id is not provided", func() {
+			scope := builder.Build("fake-method", bwcapi.RequestContext{})
+
+			scope.Logger.Debug("fake-tag", "fake-msg")
+
+			Expect(logOut.String()).To(MatchRegexp(`^\[fake-tag\] `))
+		})
+
+		It("returns logger that logs json lines when json format is configured", func() {
+			config := validConfig
+			config.Logging.Format = "json"
+
+			builder = NewRequestScopeBuilder(config, wardenClient, &fakeuuid.FakeGenerator{}, boshlog.LevelDebug, logOut)
+
+			scope := builder.Build("fake-method", bwcapi.RequestContext{RequestID: "fake-request-id"})
+
+			scope.Logger.Info("fake-tag", "fake-msg")
+
+			var entry map[string]interface{}
+
+			err := json.Unmarshal(logOut.Bytes(), &entry)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(entry["timestamp"]).To(MatchRegexp(`^\d{4}-\d{2}-\d{2}T`))
+			delete(entry, "timestamp")
+
+			Expect(entry).To(Equal(map[string]interface{}{
+				"level":      "INFO",
+				"tag":        "fake-tag",
+				"request_id": "fake-request-id",
+				"action":     "fake-method",
+				"message":    "fake-msg",
+			}))
+		})
+
+		It("returns log that keeps text entries when json format is configured", func() {
+			config := validConfig
+			config.Logging.Format = "json"
+
+			builder = NewRequestScopeBuilder(config, wardenClient, &fakeuuid.FakeGenerator{}, boshlog.LevelDebug, logOut)
+
+			scope := builder.Build("fake-method", bwcapi.RequestContext{})
+
+			scope.Logger.Debug("fake-tag", "fake-msg")
+
+			Expect(scope.Log.String()).To(MatchRegexp(`^\[fake-tag\] .+ DEBUG - fake-msg\n$`))
+		})
+
+		It("returns log that captures entries logged by logger", func() {
+			scope := builder.Build("fake-method", bwcapi.RequestContext{RequestID: "fake-request-id"})
+
+			scope.Logger.Debug("fake-tag", "fake-msg")
+
+			Expect(scope.Log.String()).To(MatchRegexp(`^\[fake-tag\] .+ DEBUG - fake-msg\n$`))
+		})
+
+		It("returns log that only captures entries at configured level", func() {
+			config := validConfig
+			config.ResponseLog.Level = "WARN"
+
+			builder = NewRequestScopeBuilder(config, wardenClient, &fakeuuid.FakeGenerator{}, boshlog.LevelDebug, logOut)
+
+			scope := builder.Build("fake-method", bwcapi.RequestContext{})
+
+			scope.Logger.Debug("fake-tag", "fake-msg1")
+			scope.Logger.Warn("fake-tag", "fake-msg2")
+
+			Expect(scope.Log.String()).ToNot(ContainSubstring("fake-msg1"))
+			Expect(scope.Log.String()).To(ContainSubstring("fake-msg2"))
+			Expect(logOut.String()).To(ContainSubstring("fake-msg1"))
+		})
+
+		It("returns log that captures entries even if they are not logged to log output", func() {
+			builder = NewRequestScopeBuilder(validConfig, wardenClient, &fakeuuid.FakeGenerator{}, boshlog.LevelError, logOut)
+
+			scope := builder.Build("fake-method", bwcapi.RequestContext{})
+
+			scope.Logger.Debug("fake-tag", "fake-msg")
+
+			Expect(scope.Log.String()).To(ContainSubstring("fake-msg"))
+			Expect(logOut.String()).To(BeEmpty())
+		})
+
+		It("returns log that keeps most recent entries within configured size", func() {
+			config := validConfig
+			config.ResponseLog.MaxBytes = 100
+
+			builder = NewRequestScopeBuilder(config, wardenClient, &fakeuuid.FakeGenerator{}, boshlog.LevelDebug, logOut)
+
+			scope := builder.Build("fake-method", bwcapi.RequestContext{})
+
+			for i := 0; i < 10; i++ {
+				scope.Logger.Debug("fake-tag", "fake-msg%d", i)
+			}
+
+			log := scope.Log.String()
+			Expect(log).To(MatchRegexp(`^\[Dropped \d+ bytes of earlier log entries\]\n`))
+			Expect(log).ToNot(ContainSubstring("fake-msg0"))
+			Expect(log).To(ContainSubstring("fake-msg9"))
+		})
+
+		It("returns context without deadline when timeout is not configured", func() {
+			scope := builder.Build("create_vm", bwcapi.RequestContext{})
+			defer scope.Cancel()
+
+			_, hasDeadline := scope.Context.Deadline()
+			Expect(hasDeadline).To(BeFalse())
+		})
+
+		It("returns context with deadline for method when timeout is configured", func() {
+			config := validConfig
+			config.Timeouts = TimeoutsConfig{Methods: map[string]string{"create_vm": "1h"}}
+
+			builder = NewRequestScopeBuilder(config, wardenClient, &fakeuuid.FakeGenerator{}, boshlog.LevelDebug, logOut)
+
+			scope := builder.Build("create_vm", bwcapi.RequestContext{})
+			defer scope.Cancel()
+
+			deadline, hasDeadline := scope.Context.Deadline()
+			Expect(hasDeadline).To(BeTrue())
+			Expect(deadline.After(time.Now().Add(59 * time.Minute))).To(BeTrue())
+			Expect(deadline.Before(time.Now().Add(61 * time.Minute))).To(BeTrue())
+		})
+
+		It("returns cancel that finishes context", func() {
+			scope := builder.Build("create_vm", bwcapi.RequestContext{})
+
+			scope.Cancel()
+
+			Expect(scope.Context.Err()).To(Equal(context.Canceled))
+		})
+
+		It("returns action factory that can create actions", func() {
+			scope := builder.Build("fake-method", bwcapi.RequestContext{RequestID: "fake-request-id"})
+
+			_, err := scope.ActionFactory.Create("create_vm")
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+})
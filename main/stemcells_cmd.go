@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+)
+
+// StemcellsCmd implements `stemcells` subcommands used by operators
+type StemcellsCmd struct {
+	stemcellFinder  bwcstem.Finder
+	stemcellDeleter bwcstem.DeferredDeleter
+	out             io.Writer
+}
+
+type stemcellListEntry struct {
+	ID string `json:"id"`
+
+	bwcstem.Metadata
+}
+
+func NewStemcellsCmd(
+	stemcellFinder bwcstem.Finder,
+	stemcellDeleter bwcstem.DeferredDeleter,
+	out io.Writer,
+) StemcellsCmd {
+	return StemcellsCmd{
+		stemcellFinder:  stemcellFinder,
+		stemcellDeleter: stemcellDeleter,
+		out:             out,
+	}
+}
+
+func (c StemcellsCmd) Run(args []string) error {
+	if len(args) == 1 {
+		switch args[0] {
+		case "list":
+			return c.list()
+		case "pending":
+			return c.pending()
+		}
+	}
+
+	return bosherr.New("Expected 'stemcells list' or 'stemcells pending'")
+}
+
+// list prints one JSON object per stemcell so that output can be consumed by scripts
+func (c StemcellsCmd) list() error {
+	stemcells, err := c.stemcellFinder.FindAll()
+	if err != nil {
+		return bosherr.WrapError(err, "Listing stemcells")
+	}
+
+	for _, stemcell := range stemcells {
+		metadata, err := stemcell.Metadata()
+		if err != nil {
+			return bosherr.WrapError(err, "Reading stemcell '%s' metadata", stemcell.ID())
+		}
+
+		entryBytes, err := json.Marshal(stemcellListEntry{ID: stemcell.ID(), Metadata: metadata})
+		if err != nil {
+			return bosherr.WrapError(err, "Marshalling stemcell '%s'", stemcell.ID())
+		}
+
+		err = c.println(string(entryBytes))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c StemcellsCmd) pending() error {
+	ids, err := c.stemcellDeleter.Pending()
+	if err != nil {
+		return bosherr.WrapError(err, "Listing stemcells pending deletion")
+	}
+
+	for _, id := range ids {
+		err := c.println(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c StemcellsCmd) println(line string) error {
+	_, err := fmt.Fprintln(c.out, line)
+	if err != nil {
+		return bosherr.WrapError(err, "Writing to OUT")
+	}
+
+	return nil
+}
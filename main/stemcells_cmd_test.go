@@ -0,0 +1,101 @@
+package main_test
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/main"
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+)
+
+var _ = Describe("StemcellsCmd", func() {
+	var (
+		stemcellFinder  *fakestem.FakeFinder
+		stemcellDeleter *fakestem.FakeDeferredDeleter
+		out             *bytes.Buffer
+		cmd             StemcellsCmd
+	)
+
+	BeforeEach(func() {
+		stemcellFinder = &fakestem.FakeFinder{}
+		stemcellDeleter = &fakestem.FakeDeferredDeleter{}
+		out = bytes.NewBufferString("")
+		cmd = NewStemcellsCmd(stemcellFinder, stemcellDeleter, out)
+	})
+
+	Describe("Run", func() {
+		Context("when running 'list' subcommand", func() {
+			It("prints stemcell ids with metadata one JSON object per line", func() {
+				stemcell1 := fakestem.NewFakeStemcell("fake-stemcell-id1")
+				stemcell1.MetadataMetadata = bwcstem.Metadata{
+					Name:            "fake-name",
+					ImportedAt:      time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC),
+					LastVMCreatedAt: time.Date(2014, time.January, 3, 3, 4, 5, 0, time.UTC),
+				}
+
+				stemcell2 := fakestem.NewFakeStemcell("fake-stemcell-id2")
+
+				stemcellFinder.FindAllStemcells = []bwcstem.Stemcell{stemcell1, stemcell2}
+
+				err := cmd.Run([]string{"list"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(out.String()).To(Equal(
+					`{"id":"fake-stemcell-id1","name":"fake-name","version":"","os":"","image_sha1":"",` +
+						`"imported_at":"2014-01-02T03:04:05Z","size_in_bytes":0,"last_vm_created_at":"2014-01-03T03:04:05Z"}` + "\n" +
+						`{"id":"fake-stemcell-id2","name":"","version":"","os":"","image_sha1":"",` +
+						`"imported_at":"0001-01-01T00:00:00Z","size_in_bytes":0,"last_vm_created_at":"0001-01-01T00:00:00Z"}` + "\n",
+				))
+			})
+
+			It("returns error if listing stemcells fails", func() {
+				stemcellFinder.FindAllErr = errors.New("fake-find-all-err")
+
+				err := cmd.Run([]string{"list"})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-find-all-err"))
+			})
+
+			It("returns error if reading stemcell metadata fails", func() {
+				stemcell := fakestem.NewFakeStemcell("fake-stemcell-id")
+				stemcell.MetadataErr = errors.New("fake-metadata-err")
+
+				stemcellFinder.FindAllStemcells = []bwcstem.Stemcell{stemcell}
+
+				err := cmd.Run([]string{"list"})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-metadata-err"))
+			})
+		})
+
+		Context("when running 'pending' subcommand", func() {
+			It("prints ids of stemcells pending deletion one per line", func() {
+				stemcellDeleter.PendingIDs = []string{"fake-stemcell-id1", "fake-stemcell-id2"}
+
+				err := cmd.Run([]string{"pending"})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(out.String()).To(Equal("fake-stemcell-id1\nfake-stemcell-id2\n"))
+			})
+
+			It("returns error if listing stemcells pending deletion fails", func() {
+				stemcellDeleter.PendingErr = errors.New("fake-pending-err")
+
+				err := cmd.Run([]string{"pending"})
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-pending-err"))
+			})
+		})
+
+		It("returns error if subcommand is not known", func() {
+			err := cmd.Run([]string{"unknown"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Expected 'stemcells list' or 'stemcells pending'"))
+		})
+	})
+})
@@ -0,0 +1,32 @@
+package fakes
+
+import (
+	"context"
+
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+)
+
+type FakeDeferredDeleter struct {
+	DeleteStemcell bwcstem.Stemcell
+	DeleteErr      error
+
+	CollectPendingCalled bool
+	CollectPendingErr    error
+
+	PendingIDs []string
+	PendingErr error
+}
+
+func (d *FakeDeferredDeleter) Delete(_ context.Context, stemcell bwcstem.Stemcell) error {
+	d.DeleteStemcell = stemcell
+	return d.DeleteErr
+}
+
+func (d *FakeDeferredDeleter) CollectPending(_ context.Context) error {
+	d.CollectPendingCalled = true
+	return d.CollectPendingErr
+}
+
+func (d *FakeDeferredDeleter) Pending() ([]string, error) {
+	return d.PendingIDs, d.PendingErr
+}
@@ -0,0 +1,14 @@
+package fakes
+
+type FakeExtractor struct {
+	ExtractImagePaths []string
+	ExtractDirPaths   []string
+	ExtractSize       int64
+	ExtractErr        error
+}
+
+func (e *FakeExtractor) Extract(imagePath, dirPath string) (int64, error) {
+	e.ExtractImagePaths = append(e.ExtractImagePaths, imagePath)
+	e.ExtractDirPaths = append(e.ExtractDirPaths, dirPath)
+	return e.ExtractSize, e.ExtractErr
+}
@@ -9,9 +9,16 @@ type FakeFinder struct {
 	FindStemcell bwcstem.Stemcell
 	FindFound    bool
 	FindErr      error
+
+	FindAllStemcells []bwcstem.Stemcell
+	FindAllErr       error
 }
 
 func (f *FakeFinder) Find(id string) (bwcstem.Stemcell, bool, error) {
 	f.FindID = id
 	return f.FindStemcell, f.FindFound, f.FindErr
 }
+
+func (f *FakeFinder) FindAll() ([]bwcstem.Stemcell, error) {
+	return f.FindAllStemcells, f.FindAllErr
+}
@@ -6,11 +6,24 @@ import (
 
 type FakeImporter struct {
 	ImportFromPathImagePath string
+	ImportFromPathOptions   bwcstem.ImportOptions
 	ImportFromPathStemcell  bwcstem.Stemcell
 	ImportFromPathErr       error
+
+	ImportFromDirDirPath  string
+	ImportFromDirOptions  bwcstem.ImportOptions
+	ImportFromDirStemcell bwcstem.Stemcell
+	ImportFromDirErr      error
 }
 
-func (c *FakeImporter) ImportFromPath(imagePath string) (bwcstem.Stemcell, error) {
+func (c *FakeImporter) ImportFromPath(imagePath string, options bwcstem.ImportOptions) (bwcstem.Stemcell, error) {
 	c.ImportFromPathImagePath = imagePath
+	c.ImportFromPathOptions = options
 	return c.ImportFromPathStemcell, c.ImportFromPathErr
 }
+
+func (c *FakeImporter) ImportFromDir(dirPath string, options bwcstem.ImportOptions) (bwcstem.Stemcell, error) {
+	c.ImportFromDirDirPath = dirPath
+	c.ImportFromDirOptions = options
+	return c.ImportFromDirStemcell, c.ImportFromDirErr
+}
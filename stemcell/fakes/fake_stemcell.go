@@ -1,9 +1,21 @@
 package fakes
 
+import (
+	"time"
+
+	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+)
+
 type FakeStemcell struct {
 	id      string
 	dirPath string
 
+	MetadataMetadata bwcstem.Metadata
+	MetadataErr      error
+
+	RecordVMCreationCreatedAt time.Time
+	RecordVMCreationErr       error
+
 	DeleteCalled bool
 	DeleteErr    error
 }
@@ -20,6 +32,15 @@ func (s FakeStemcell) ID() string { return s.id }
 
 func (s FakeStemcell) DirPath() string { return s.dirPath }
 
+func (s FakeStemcell) Metadata() (bwcstem.Metadata, error) {
+	return s.MetadataMetadata, s.MetadataErr
+}
+
+func (s *FakeStemcell) RecordVMCreation(createdAt time.Time) error {
+	s.RecordVMCreationCreatedAt = createdAt
+	return s.RecordVMCreationErr
+}
+
 func (s *FakeStemcell) Delete() error {
 	s.DeleteCalled = true
 	return s.DeleteErr
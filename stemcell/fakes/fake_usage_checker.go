@@ -0,0 +1,18 @@
+package fakes
+
+import (
+	"context"
+)
+
+type FakeUsageChecker struct {
+	InUseIDs []string
+	InUseErr error
+
+	// Ids of stemcells that are reported to be in use
+	UsedIDs map[string]bool
+}
+
+func (c *FakeUsageChecker) InUse(_ context.Context, id string) (bool, error) {
+	c.InUseIDs = append(c.InUseIDs, id)
+	return c.UsedIDs[id], c.InUseErr
+}
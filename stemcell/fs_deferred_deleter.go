@@ -0,0 +1,130 @@
+package stemcell
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+const (
+	fsDeferredDeleterLogTag = "FSDeferredDeleter"
+
+	// Marker file is placed next to stemcell directory
+	// so that stemcell's root filesystem stays untouched
+	pendingDeletionMarkerSuffix = ".pending-deletion"
+)
+
+type FSDeferredDeleter struct {
+	dirPath string
+
+	usageChecker UsageChecker
+	lockManager  bwcutil.LockManager
+
+	fs     boshsys.FileSystem
+	logger boshlog.Logger
+}
+
+func NewFSDeferredDeleter(
+	dirPath string,
+	usageChecker UsageChecker,
+	lockManager bwcutil.LockManager,
+	fs boshsys.FileSystem,
+	logger boshlog.Logger,
+) FSDeferredDeleter {
+	return FSDeferredDeleter{
+		dirPath: dirPath,
+
+		usageChecker: usageChecker,
+		lockManager:  lockManager,
+
+		fs:     fs,
+		logger: logger,
+	}
+}
+
+func (d FSDeferredDeleter) Delete(ctx context.Context, stemcell Stemcell) error {
+	id := stemcell.ID()
+	markerPath := pendingDeletionMarkerPath(d.dirPath, id)
+
+	// VM that is being created from the stemcell does not have tagged container yet
+	// and holds shared stemcell lock until it does
+	lock, err := d.lockManager.Lock(ctx, bwcutil.StemcellLockKey(id))
+	if err != nil {
+		return bosherr.WrapError(err, "Locking stemcell '%s'", id)
+	}
+
+	defer lock.Unlock()
+
+	inUse, err := d.usageChecker.InUse(ctx, id)
+	if err != nil {
+		return bosherr.WrapError(err, "Checking if stemcell '%s' is in use", id)
+	}
+
+	if inUse {
+		d.logger.Debug(fsDeferredDeleterLogTag, "Deferring deletion of stemcell '%s' since it is in use", id)
+
+		err = d.fs.WriteFileString(markerPath, "")
+		if err != nil {
+			return bosherr.WrapError(err, "Marking stemcell '%s' for deletion", id)
+		}
+
+		return nil
+	}
+
+	err = stemcell.Delete()
+	if err != nil {
+		return err
+	}
+
+	// Marker is removed last so that deletion is retried if stemcell removal fails
+	err = d.fs.RemoveAll(markerPath)
+	if err != nil {
+		return bosherr.WrapError(err, "Unmarking stemcell '%s' for deletion", id)
+	}
+
+	return nil
+}
+
+func (d FSDeferredDeleter) CollectPending(ctx context.Context) error {
+	ids, err := d.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		stemcell := NewFSStemcell(id, filepath.Join(d.dirPath, id), d.fs, d.logger)
+
+		// One stemcell failing to be deleted should not prevent collection of others
+		err := d.Delete(ctx, stemcell)
+		if err != nil {
+			d.logger.Error(fsDeferredDeleterLogTag, "Failed collecting stemcell '%s': %s", id, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (d FSDeferredDeleter) Pending() ([]string, error) {
+	markerPaths, err := d.fs.Glob(filepath.Join(d.dirPath, "*"+pendingDeletionMarkerSuffix))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing stemcells marked for deletion")
+	}
+
+	ids := []string{}
+
+	for _, markerPath := range markerPaths {
+		ids = append(ids, strings.TrimSuffix(filepath.Base(markerPath), pendingDeletionMarkerSuffix))
+	}
+
+	return ids, nil
+}
+
+func pendingDeletionMarkerPath(dirPath, id string) string {
+	return filepath.Join(dirPath, id+pendingDeletionMarkerSuffix)
+}
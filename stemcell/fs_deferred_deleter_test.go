@@ -0,0 +1,223 @@
+package stemcell_test
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
+)
+
+var _ = Describe("FSDeferredDeleter", func() {
+	var (
+		usageChecker *fakestem.FakeUsageChecker
+		lockManager  *fakeutil.FakeLockManager
+		fs           *fakesys.FakeFileSystem
+		logger       boshlog.Logger
+		deleter      FSDeferredDeleter
+	)
+
+	BeforeEach(func() {
+		usageChecker = &fakestem.FakeUsageChecker{UsedIDs: map[string]bool{}}
+		lockManager = fakeutil.NewFakeLockManager()
+		fs = fakesys.NewFakeFileSystem()
+		logger = boshlog.NewLogger(boshlog.LevelNone)
+		deleter = NewFSDeferredDeleter("/fake-collection-dir", usageChecker, lockManager, fs, logger)
+	})
+
+	Describe("Delete", func() {
+		var (
+			stemcell *fakestem.FakeStemcell
+		)
+
+		BeforeEach(func() {
+			stemcell = fakestem.NewFakeStemcell("fake-stemcell-id")
+		})
+
+		It("checks if stemcell is in use", func() {
+			err := deleter.Delete(context.Background(), stemcell)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(usageChecker.InUseIDs).To(Equal([]string{"fake-stemcell-id"}))
+		})
+
+		It("locks stemcell while checking usage and deleting it so that VMs are not created from it meanwhile", func() {
+			err := deleter.Delete(context.Background(), stemcell)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(lockManager.LockKeys).To(Equal([]string{"stemcell-fake-stemcell-id"}))
+			Expect(lockManager.LockLock.Locked).To(BeTrue())
+			Expect(lockManager.LockLock.Unlocked).To(BeTrue())
+		})
+
+		It("returns error without checking usage if locking fails", func() {
+			lockManager.LockErr = errors.New("fake-lock-err")
+
+			err := deleter.Delete(context.Background(), stemcell)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-lock-err"))
+
+			Expect(usageChecker.InUseIDs).To(BeEmpty())
+			Expect(stemcell.DeleteCalled).To(BeFalse())
+		})
+
+		Context("when stemcell is not in use", func() {
+			It("deletes stemcell", func() {
+				err := deleter.Delete(context.Background(), stemcell)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(stemcell.DeleteCalled).To(BeTrue())
+			})
+
+			It("removes deletion marker if stemcell was previously marked for deletion", func() {
+				err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.pending-deletion", "")
+				Expect(err).ToNot(HaveOccurred())
+
+				err = deleter.Delete(context.Background(), stemcell)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id.pending-deletion")).To(BeFalse())
+			})
+
+			It("returns error and keeps deletion marker if deleting stemcell fails", func() {
+				err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.pending-deletion", "")
+				Expect(err).ToNot(HaveOccurred())
+
+				stemcell.DeleteErr = errors.New("fake-delete-err")
+
+				err = deleter.Delete(context.Background(), stemcell)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-delete-err"))
+
+				Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id.pending-deletion")).To(BeTrue())
+			})
+
+			It("returns error if removing deletion marker fails", func() {
+				fs.RemoveAllError = errors.New("fake-remove-all-err")
+
+				err := deleter.Delete(context.Background(), stemcell)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-remove-all-err"))
+			})
+		})
+
+		Context("when stemcell is in use", func() {
+			BeforeEach(func() {
+				usageChecker.UsedIDs["fake-stemcell-id"] = true
+			})
+
+			It("does not delete stemcell", func() {
+				err := deleter.Delete(context.Background(), stemcell)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(stemcell.DeleteCalled).To(BeFalse())
+			})
+
+			It("marks stemcell for deletion", func() {
+				err := deleter.Delete(context.Background(), stemcell)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id.pending-deletion")).To(BeTrue())
+			})
+
+			It("returns error if marking stemcell for deletion fails", func() {
+				fs.WriteToFileError = errors.New("fake-write-err")
+
+				err := deleter.Delete(context.Background(), stemcell)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+			})
+		})
+
+		It("returns error if checking stemcell usage fails", func() {
+			usageChecker.InUseErr = errors.New("fake-in-use-err")
+
+			err := deleter.Delete(context.Background(), stemcell)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-in-use-err"))
+
+			Expect(stemcell.DeleteCalled).To(BeFalse())
+		})
+	})
+
+	Describe("CollectPending", func() {
+		BeforeEach(func() {
+			for _, id := range []string{"fake-stemcell-id1", "fake-stemcell-id2"} {
+				err := fs.MkdirAll("/fake-collection-dir/"+id, os.ModeDir)
+				Expect(err).ToNot(HaveOccurred())
+
+				err = fs.WriteFileString("/fake-collection-dir/"+id+".pending-deletion", "")
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			fs.SetGlob("/fake-collection-dir/*.pending-deletion", []string{
+				"/fake-collection-dir/fake-stemcell-id1.pending-deletion",
+				"/fake-collection-dir/fake-stemcell-id2.pending-deletion",
+			})
+		})
+
+		It("deletes stemcells that are no longer in use", func() {
+			usageChecker.UsedIDs["fake-stemcell-id2"] = true
+
+			err := deleter.CollectPending(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id1")).To(BeFalse())
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id1.pending-deletion")).To(BeFalse())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id2")).To(BeTrue())
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id2.pending-deletion")).To(BeTrue())
+		})
+
+		It("does not return error if some stemcells cannot be collected", func() {
+			usageChecker.InUseErr = errors.New("fake-in-use-err")
+
+			err := deleter.CollectPending(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(usageChecker.InUseIDs).To(Equal([]string{"fake-stemcell-id1", "fake-stemcell-id2"}))
+		})
+
+		It("returns error if listing stemcells marked for deletion fails", func() {
+			fs.GlobErr = errors.New("fake-glob-err")
+
+			err := deleter.CollectPending(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-glob-err"))
+		})
+	})
+
+	Describe("Pending", func() {
+		It("returns ids of stemcells marked for deletion", func() {
+			fs.SetGlob("/fake-collection-dir/*.pending-deletion", []string{
+				"/fake-collection-dir/fake-stemcell-id1.pending-deletion",
+				"/fake-collection-dir/fake-stemcell-id2.pending-deletion",
+			})
+
+			ids, err := deleter.Pending()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(Equal([]string{"fake-stemcell-id1", "fake-stemcell-id2"}))
+		})
+
+		It("returns empty list if no stemcells are marked for deletion", func() {
+			ids, err := deleter.Pending()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ids).To(BeEmpty())
+		})
+
+		It("returns error if listing stemcells marked for deletion fails", func() {
+			fs.GlobErr = errors.New("fake-glob-err")
+
+			_, err := deleter.Pending()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-glob-err"))
+		})
+	})
+})
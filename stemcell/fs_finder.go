@@ -2,7 +2,9 @@ package stemcell
 
 import (
 	"path/filepath"
+	"strings"
 
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
 )
@@ -21,9 +23,60 @@ func NewFSFinder(dirPath string, fs boshsys.FileSystem, logger boshlog.Logger) F
 func (f FSFinder) Find(id string) (Stemcell, bool, error) {
 	dirPath := filepath.Join(f.dirPath, id)
 
-	if f.fs.FileExists(dirPath) {
+	// Stemcell marked for deletion is already deleted from Director's perspective
+	if f.fs.FileExists(pendingDeletionMarkerPath(f.dirPath, id)) {
+		return nil, false, nil
+	}
+
+	if f.exists(dirPath) {
 		return NewFSStemcell(id, dirPath, f.fs, f.logger), true, nil
 	}
 
 	return nil, false, nil
 }
+
+func (f FSFinder) FindAll() ([]Stemcell, error) {
+	paths, err := f.fs.Glob(filepath.Join(f.dirPath, "*"))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing stemcells in '%s'", f.dirPath)
+	}
+
+	stemcells := []Stemcell{}
+
+	for _, path := range paths {
+		id := filepath.Base(path)
+
+		// Skip files that are kept next to stemcell directories
+		if strings.HasSuffix(id, metadataFileSuffix) || strings.HasSuffix(id, pendingDeletionMarkerSuffix) {
+			continue
+		}
+
+		// Skip metadata temp files left behind by interrupted writes
+		if strings.Contains(id, metadataFileSuffix+".") && strings.HasSuffix(id, ".tmp") {
+			continue
+		}
+
+		stemcell, found, err := f.Find(id)
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Finding stemcell '%s'", id)
+		}
+
+		if found {
+			stemcells = append(stemcells, stemcell)
+		}
+	}
+
+	return stemcells, nil
+}
+
+// exists does not follow symlinks (like Lstat) so that stemcells referencing
+// directories that have disappeared are still found and can be deleted
+func (f FSFinder) exists(path string) bool {
+	if f.fs.FileExists(path) {
+		return true
+	}
+
+	_, err := f.fs.ReadLink(path)
+
+	return err == nil
+}
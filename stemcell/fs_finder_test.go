@@ -1,9 +1,13 @@
 package stemcell_test
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -37,11 +41,101 @@ var _ = Describe("FSFinder", func() {
 			Expect(stemcell).To(Equal(expectedStemcell))
 		})
 
+		It("returns found as false if stemcell is marked for deletion", func() {
+			err := fs.MkdirAll("/fake-collection-dir/fake-stemcell-id", os.ModeDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.pending-deletion", "")
+			Expect(err).ToNot(HaveOccurred())
+
+			stemcell, found, err := finder.Find("fake-stemcell-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+			Expect(stemcell).To(BeNil())
+		})
+
 		It("returns found as false if stemcell directory does not exist", func() {
 			stemcell, found, err := finder.Find("fake-stemcell-id")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(found).To(BeFalse())
 			Expect(stemcell).To(BeNil())
 		})
+
+		It("returns stemcell if referenced stemcell directory no longer exists so that it can be deleted", func() {
+			tmpDir, err := ioutil.TempDir("", "fs-finder-test")
+			Expect(err).ToNot(HaveOccurred())
+
+			defer os.RemoveAll(tmpDir)
+
+			err = os.Symlink(filepath.Join(tmpDir, "missing-rootfs-dir"), filepath.Join(tmpDir, "fake-stemcell-id"))
+			Expect(err).ToNot(HaveOccurred())
+
+			osFS := boshsys.NewOsFileSystem(logger)
+			finder = NewFSFinder(tmpDir, osFS, logger)
+
+			stemcell, found, err := finder.Find("fake-stemcell-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeTrue())
+
+			err = stemcell.Delete()
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = os.Lstat(filepath.Join(tmpDir, "fake-stemcell-id"))
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+	})
+
+	Describe("FindAll", func() {
+		It("returns all stemcells skipping metadata and ones marked for deletion", func() {
+			err := fs.MkdirAll("/fake-collection-dir/fake-stemcell-id1", os.ModeDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = fs.MkdirAll("/fake-collection-dir/fake-stemcell-id2", os.ModeDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			fs.SetGlob("/fake-collection-dir/*", []string{
+				"/fake-collection-dir/fake-stemcell-id1",
+				"/fake-collection-dir/fake-stemcell-id1.metadata.json",
+				"/fake-collection-dir/fake-stemcell-id2",
+				"/fake-collection-dir/fake-stemcell-id2.pending-deletion",
+			})
+
+			err = fs.WriteFileString("/fake-collection-dir/fake-stemcell-id2.pending-deletion", "")
+			Expect(err).ToNot(HaveOccurred())
+
+			stemcells, err := finder.FindAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stemcells).To(Equal([]Stemcell{
+				NewFSStemcell("fake-stemcell-id1", "/fake-collection-dir/fake-stemcell-id1", fs, logger),
+			}))
+		})
+
+		It("skips metadata temp files left behind by interrupted writes", func() {
+			err := fs.MkdirAll("/fake-collection-dir/fake-stemcell-id1", os.ModeDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = fs.WriteFileString("/fake-collection-dir/fake-stemcell-id1.metadata.json.123.1.tmp", "")
+			Expect(err).ToNot(HaveOccurred())
+
+			fs.SetGlob("/fake-collection-dir/*", []string{
+				"/fake-collection-dir/fake-stemcell-id1",
+				"/fake-collection-dir/fake-stemcell-id1.metadata.json.123.1.tmp",
+			})
+
+			stemcells, err := finder.FindAll()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(stemcells).To(Equal([]Stemcell{
+				NewFSStemcell("fake-stemcell-id1", "/fake-collection-dir/fake-stemcell-id1", fs, logger),
+			}))
+		})
+
+		It("returns error if listing stemcells fails", func() {
+			fs.GlobErr = errors.New("fake-glob-err")
+
+			stemcells, err := finder.FindAll()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-glob-err"))
+			Expect(stemcells).To(BeNil())
+		})
 	})
 })
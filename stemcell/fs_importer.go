@@ -1,49 +1,68 @@
 package stemcell
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
-	boshcmd "github.com/cloudfoundry/bosh-agent/platform/commands"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
 	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 const fsImporterLogTag = "FSImporter"
 
 type FSImporter struct {
-	dirPath string
+	dirPath         string
+	allowedDirRoots []string
 
-	fs         boshsys.FileSystem
-	uuidGen    boshuuid.Generator
-	compressor boshcmd.Compressor
+	fs          boshsys.FileSystem
+	uuidGen     boshuuid.Generator
+	extractor   Extractor
+	timeService bwcutil.TimeService
 
 	logger boshlog.Logger
 }
 
 func NewFSImporter(
 	dirPath string,
+	allowedDirRoots []string,
 	fs boshsys.FileSystem,
 	uuidGen boshuuid.Generator,
-	compressor boshcmd.Compressor,
+	extractor Extractor,
+	timeService bwcutil.TimeService,
 	logger boshlog.Logger,
 ) FSImporter {
 	return FSImporter{
-		dirPath: dirPath,
+		dirPath:         dirPath,
+		allowedDirRoots: allowedDirRoots,
 
-		fs:         fs,
-		uuidGen:    uuidGen,
-		compressor: compressor,
+		fs:          fs,
+		uuidGen:     uuidGen,
+		extractor:   extractor,
+		timeService: timeService,
 
 		logger: logger,
 	}
 }
 
-func (i FSImporter) ImportFromPath(imagePath string) (Stemcell, error) {
+func (i FSImporter) ImportFromPath(imagePath string, options ImportOptions) (Stemcell, error) {
 	i.logger.Debug(fsImporterLogTag, "Importing stemcell from path '%s'", imagePath)
 
+	// Verify before unpacking since truncated image might still partially unpack
+	imageSHA1, err := i.checksumImage(imagePath, options)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Verifying stemcell image '%s'", imagePath)
+	}
+
 	id, err := i.uuidGen.Generate()
 	if err != nil {
 		return nil, bosherr.WrapError(err, "Generating stemcell id")
@@ -56,12 +75,174 @@ func (i FSImporter) ImportFromPath(imagePath string) (Stemcell, error) {
 		return nil, bosherr.WrapError(err, "Creating stemcell directory '%s'", stemcellPath)
 	}
 
-	err = i.compressor.DecompressFileToDir(imagePath, stemcellPath, boshcmd.CompressorOptions{SameOwner: true})
+	size, err := i.extractor.Extract(imagePath, stemcellPath)
 	if err != nil {
+		// Do not leave partially unpacked stemcell behind
+		removeErr := i.fs.RemoveAll(stemcellPath)
+		if removeErr != nil {
+			i.logger.Error(fsImporterLogTag, "Failed to remove partially unpacked stemcell '%s': %s", stemcellPath, removeErr)
+		}
+
 		return nil, bosherr.WrapError(err, "Unpacking stemcell '%s' to '%s'", imagePath, stemcellPath)
 	}
 
+	stemcell := NewFSStemcell(id, stemcellPath, i.fs, i.logger)
+
+	metadata := i.buildMetadata(options)
+	metadata.ImageSHA1 = imageSHA1
+	metadata.SizeInBytes = size
+
+	err = stemcell.saveMetadata(metadata)
+	if err != nil {
+		// Stemcell without metadata is not found and would never be deleted
+		removeErr := i.fs.RemoveAll(stemcellPath)
+		if removeErr != nil {
+			i.logger.Error(fsImporterLogTag, "Failed to remove unpacked stemcell '%s': %s", stemcellPath, removeErr)
+		}
+
+		return nil, bosherr.WrapError(err, "Saving stemcell '%s' metadata", id)
+	}
+
 	i.logger.Debug(fsImporterLogTag, "Imported stemcell from path '%s'", imagePath)
 
-	return NewFSStemcell(id, stemcellPath, i.fs, i.logger), nil
+	return stemcell, nil
+}
+
+func (i FSImporter) ImportFromDir(dirPath string, options ImportOptions) (Stemcell, error) {
+	i.logger.Debug(fsImporterLogTag, "Importing stemcell from directory '%s'", dirPath)
+
+	// Symlink would be resolved relative to stemcells directory
+	if !filepath.IsAbs(dirPath) {
+		return nil, bosherr.New("Expected stemcell directory '%s' to be an absolute path", dirPath)
+	}
+
+	// Directory contents are not read hence there is nothing to checksum
+	if len(options.SHA1) > 0 || len(options.SHA256) > 0 {
+		return nil, bosherr.New("Expected no checksums for stemcell directory '%s' since only images are verified", dirPath)
+	}
+
+	// Resolved so that symlinks cannot point stemcell outside of allowed directories
+	resolvedPath, err := filepath.EvalSymlinks(dirPath)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Expected stemcell directory '%s' to exist", dirPath)
+	}
+
+	if !i.isAllowedDir(resolvedPath) {
+		return nil, bosherr.New("Expected stemcell directory '%s' to be inside one of allowed directories %v", dirPath, i.allowedDirRoots)
+	}
+
+	dirInfo, err := os.Stat(resolvedPath)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Checking stemcell directory '%s'", dirPath)
+	}
+
+	if !dirInfo.IsDir() {
+		return nil, bosherr.New("Expected stemcell directory '%s' to be a directory", dirPath)
+	}
+
+	id, err := i.uuidGen.Generate()
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Generating stemcell id")
+	}
+
+	stemcellPath := filepath.Join(i.dirPath, id)
+
+	// Deleting stemcell only removes the symlink and leaves referenced directory intact
+	err = i.fs.Symlink(resolvedPath, stemcellPath)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Linking stemcell directory '%s' to '%s'", dirPath, stemcellPath)
+	}
+
+	stemcell := NewFSStemcell(id, stemcellPath, i.fs, i.logger)
+
+	err = stemcell.saveMetadata(i.buildMetadata(options))
+	if err != nil {
+		// Only the symlink is removed; referenced directory is left intact
+		removeErr := i.fs.RemoveAll(stemcellPath)
+		if removeErr != nil {
+			i.logger.Error(fsImporterLogTag, "Failed to remove stemcell link '%s': %s", stemcellPath, removeErr)
+		}
+
+		return nil, bosherr.WrapError(err, "Saving stemcell '%s' metadata", id)
+	}
+
+	i.logger.Debug(fsImporterLogTag, "Imported stemcell from directory '%s'", dirPath)
+
+	return stemcell, nil
+}
+
+func (i FSImporter) isAllowedDir(path string) bool {
+	for _, root := range i.allowedDirRoots {
+		// Root itself might be referenced through a symlink
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+
+		if strings.HasPrefix(path, resolvedRoot+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (i FSImporter) buildMetadata(options ImportOptions) Metadata {
+	return Metadata{
+		Name:       options.Name,
+		Version:    options.Version,
+		OS:         options.OS,
+		ImportedAt: i.timeService.Now().UTC(),
+	}
+}
+
+// checksumImage verifies provided checksums and returns image's sha1
+// which is always calculated to be recorded in stemcell metadata
+func (i FSImporter) checksumImage(imagePath string, options ImportOptions) (string, error) {
+	expectedSums := map[string]string{}
+
+	hashes := map[string]hash.Hash{
+		"sha1": sha1.New(),
+	}
+
+	if len(options.SHA1) > 0 {
+		expectedSums["sha1"] = options.SHA1
+	}
+
+	if len(options.SHA256) > 0 {
+		expectedSums["sha256"] = options.SHA256
+		hashes["sha256"] = sha256.New()
+	}
+
+	file, err := i.fs.OpenFile(imagePath, os.O_RDONLY, 0)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Opening image")
+	}
+
+	defer file.Close()
+
+	writers := []io.Writer{}
+
+	for _, h := range hashes {
+		writers = append(writers, h)
+	}
+
+	// Calculate all checksums in one pass since images are large
+	_, err = io.Copy(io.MultiWriter(writers...), file)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Reading image")
+	}
+
+	for algo, expectedSum := range expectedSums {
+		actualSum := hex.EncodeToString(hashes[algo].Sum(nil))
+		expectedSum = strings.ToLower(strings.TrimSpace(expectedSum))
+
+		if actualSum != expectedSum {
+			return "", bosherr.New("Expected image to have %s checksum '%s' but was '%s'", algo, expectedSum, actualSum)
+		}
+
+		i.logger.Debug(fsImporterLogTag, "Verified %s checksum '%s' of image '%s'", algo, actualSum, imagePath)
+	}
+
+	return hex.EncodeToString(hashes["sha1"].Sum(nil)), nil
 }
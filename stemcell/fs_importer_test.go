@@ -1,41 +1,63 @@
 package stemcell_test
 
 import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
-	boshcmd "github.com/cloudfoundry/bosh-agent/platform/commands"
-	fakecmd "github.com/cloudfoundry/bosh-agent/platform/commands/fakes"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
 	fakeuuid "github.com/cloudfoundry/bosh-agent/uuid/fakes"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
 	. "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
+	fakeutil "github.com/cppforlife/bosh-warden-cpi/util/fakes"
 )
 
 var _ = Describe("FSImporter", func() {
 	var (
-		fs         *fakesys.FakeFileSystem
-		uuidGen    *fakeuuid.FakeGenerator
-		compressor *fakecmd.FakeCompressor
-		logger     boshlog.Logger
-		importer   FSImporter
+		fs        *fakesys.FakeFileSystem
+		uuidGen   *fakeuuid.FakeGenerator
+		extractor *fakestem.FakeExtractor
+		logger    boshlog.Logger
+		importer  FSImporter
+
+		importedAt = time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
 	)
 
 	BeforeEach(func() {
 		fs = fakesys.NewFakeFileSystem()
 		uuidGen = &fakeuuid.FakeGenerator{}
-		compressor = fakecmd.NewFakeCompressor()
+		extractor = &fakestem.FakeExtractor{}
 		logger = boshlog.NewLogger(boshlog.LevelNone)
-		importer = NewFSImporter("/fake-collection-dir", fs, uuidGen, compressor, logger)
+		timeService := fakeutil.NewFakeTimeService(importedAt)
+		importer = NewFSImporter("/fake-collection-dir", nil, fs, uuidGen, extractor, timeService, logger)
+
+		err := fs.MkdirAll("/fake-collection-dir", os.ModeDir)
+		Expect(err).ToNot(HaveOccurred())
 	})
 
 	Describe("ImportFromPath", func() {
+		BeforeEach(func() {
+			imageFile := fakesys.NewFakeFile(fs)
+			imageFile.Contents = []byte("fake-image-contents")
+			imageFile.ReadErr = io.EOF
+			fs.RegisterOpenFile("/fake-image-path", imageFile)
+		})
+
 		It("returns unique stemcell id", func() {
 			uuidGen.GeneratedUuid = "fake-uuid"
 
-			stemcell, err := importer.ImportFromPath("/fake-image-path")
+			stemcell, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
 			Expect(err).ToNot(HaveOccurred())
 
 			expectedStemcell := NewFSStemcell("fake-uuid", "/fake-collection-dir/fake-uuid", fs, logger)
@@ -45,7 +67,7 @@ var _ = Describe("FSImporter", func() {
 		It("returns error if generating stemcell id fails", func() {
 			uuidGen.GenerateError = errors.New("fake-generate-err")
 
-			stemcell, err := importer.ImportFromPath("/fake-image-path")
+			stemcell, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("fake-generate-err"))
 			Expect(stemcell).To(BeNil())
@@ -54,7 +76,7 @@ var _ = Describe("FSImporter", func() {
 		It("creates directory in collection directory that will contain unpacked stemcell", func() {
 			uuidGen.GeneratedUuid = "fake-uuid"
 
-			_, err := importer.ImportFromPath("/fake-image-path")
+			_, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
 			Expect(err).ToNot(HaveOccurred())
 
 			unpackDirStat := fs.GetFileTestStat("/fake-collection-dir/fake-uuid")
@@ -65,7 +87,7 @@ var _ = Describe("FSImporter", func() {
 		It("returns error if creating directory that will contain unpacked stemcell fails", func() {
 			fs.MkdirAllError = errors.New("fake-mkdir-all-err")
 
-			stemcell, err := importer.ImportFromPath("/fake-image-path")
+			stemcell, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("fake-mkdir-all-err"))
 			Expect(stemcell).To(BeNil())
@@ -74,21 +96,352 @@ var _ = Describe("FSImporter", func() {
 		It("unpacks stemcell into directory that will contain this unpacked stemcell", func() {
 			uuidGen.GeneratedUuid = "fake-uuid"
 
-			_, err := importer.ImportFromPath("/fake-image-path")
+			_, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(extractor.ExtractImagePaths).To(Equal([]string{"/fake-image-path"}))
+			Expect(extractor.ExtractDirPaths).To(Equal([]string{"/fake-collection-dir/fake-uuid"}))
+		})
+
+		It("saves stemcell metadata", func() {
+			uuidGen.GeneratedUuid = "fake-uuid"
+			extractor.ExtractSize = 100
+
+			options := ImportOptions{
+				Name:    "fake-name",
+				Version: "fake-version",
+				OS:      "fake-os",
+			}
+
+			stemcell, err := importer.ImportFromPath("/fake-image-path", options)
+			Expect(err).ToNot(HaveOccurred())
+
+			metadata, err := stemcell.Metadata()
 			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata).To(Equal(Metadata{
+				Name:        "fake-name",
+				Version:     "fake-version",
+				OS:          "fake-os",
+				ImageSHA1:   sha1Of("fake-image-contents"),
+				ImportedAt:  importedAt,
+				SizeInBytes: 100,
+			}))
+		})
+
+		It("returns error if saving stemcell metadata fails", func() {
+			fs.WriteToFileError = errors.New("fake-write-err")
 
-			Expect(compressor.DecompressFileToDirTarballPaths[0]).To(Equal("/fake-image-path"))
-			Expect(compressor.DecompressFileToDirDirs[0]).To(Equal("/fake-collection-dir/fake-uuid"))
-			Expect(compressor.DecompressFileToDirOptions[0]).To(Equal(boshcmd.CompressorOptions{SameOwner: true}))
+			stemcell, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		Context("when checksums are provided", func() {
+			var (
+				options ImportOptions
+			)
+
+			BeforeEach(func() {
+				uuidGen.GeneratedUuid = "fake-uuid"
+
+				options = ImportOptions{
+					SHA1:   sha1Of("fake-image-contents"),
+					SHA256: sha256Of("fake-image-contents"),
+				}
+			})
+
+			It("unpacks stemcell if image matches all checksums", func() {
+				stemcell, err := importer.ImportFromPath("/fake-image-path", options)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(stemcell).ToNot(BeNil())
+
+				Expect(extractor.ExtractImagePaths).To(Equal([]string{"/fake-image-path"}))
+			})
+
+			It("ignores checksum case", func() {
+				options.SHA1 = strings.ToUpper(sha1Of("fake-image-contents"))
+				options.SHA256 = ""
+
+				_, err := importer.ImportFromPath("/fake-image-path", options)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns error without unpacking stemcell if image does not match sha1 checksum", func() {
+				options.SHA1 = "fake-sha1"
+				options.SHA256 = ""
+
+				stemcell, err := importer.ImportFromPath("/fake-image-path", options)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(
+					"Expected image to have sha1 checksum 'fake-sha1' but was '" + sha1Of("fake-image-contents") + "'"))
+				Expect(stemcell).To(BeNil())
+
+				Expect(extractor.ExtractImagePaths).To(BeEmpty())
+				Expect(fs.FileExists("/fake-collection-dir/fake-uuid")).To(BeFalse())
+			})
+
+			It("returns error without unpacking stemcell if image does not match sha256 checksum", func() {
+				options.SHA1 = ""
+				options.SHA256 = "fake-sha256"
+
+				stemcell, err := importer.ImportFromPath("/fake-image-path", options)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(
+					"Expected image to have sha256 checksum 'fake-sha256' but was '" + sha256Of("fake-image-contents") + "'"))
+				Expect(stemcell).To(BeNil())
+
+				Expect(extractor.ExtractImagePaths).To(BeEmpty())
+			})
+
+			It("returns error if opening image fails", func() {
+				fs.OpenFileErr = errors.New("fake-open-file-err")
+
+				_, err := importer.ImportFromPath("/fake-image-path", options)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-open-file-err"))
+
+				Expect(extractor.ExtractImagePaths).To(BeEmpty())
+			})
+
+			It("returns error if reading image fails", func() {
+				imageFile := fakesys.NewFakeFile(fs)
+				imageFile.ReadErr = errors.New("fake-read-err")
+				fs.RegisterOpenFile("/fake-image-path", imageFile)
+
+				_, err := importer.ImportFromPath("/fake-image-path", options)
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-read-err"))
+
+				Expect(extractor.ExtractImagePaths).To(BeEmpty())
+			})
 		})
 
 		It("returns error if unpacking stemcell fails", func() {
-			compressor.DecompressFileToDirErr = errors.New("fake-decompress-error")
+			extractor.ExtractErr = errors.New("fake-extract-err")
 
-			stemcell, err := importer.ImportFromPath("/fake-image-path")
+			stemcell, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("fake-decompress-err"))
+			Expect(err.Error()).To(ContainSubstring("fake-extract-err"))
 			Expect(stemcell).To(BeNil())
 		})
+
+		It("removes partially unpacked stemcell directory if unpacking stemcell fails", func() {
+			uuidGen.GeneratedUuid = "fake-uuid"
+			extractor.ExtractErr = errors.New("fake-extract-err")
+
+			_, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
+			Expect(err).To(HaveOccurred())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-uuid")).To(BeFalse())
+		})
+
+		It("removes unpacked stemcell directory if saving metadata fails", func() {
+			uuidGen.GeneratedUuid = "fake-uuid"
+			fs.WriteToFileError = errors.New("fake-write-err")
+
+			stemcell, err := importer.ImportFromPath("/fake-image-path", ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+			Expect(stemcell).To(BeNil())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-uuid")).To(BeFalse())
+		})
+	})
+
+	Describe("ImportFromDir", func() {
+		var (
+			allowedDir string
+			rootFSDir  string
+		)
+
+		BeforeEach(func() {
+			uuidGen.GeneratedUuid = "fake-uuid"
+
+			tmpDir, err := ioutil.TempDir("", "fs-importer-test")
+			Expect(err).ToNot(HaveOccurred())
+
+			// Compared against resolved stemcell directory
+			allowedDir, err = filepath.EvalSymlinks(tmpDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			rootFSDir = filepath.Join(allowedDir, "rootfs")
+
+			err = os.Mkdir(rootFSDir, 0755)
+			Expect(err).ToNot(HaveOccurred())
+
+			timeService := fakeutil.NewFakeTimeService(importedAt)
+			importer = NewFSImporter("/fake-collection-dir", []string{allowedDir}, fs, uuidGen, extractor, timeService, logger)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(allowedDir)
+		})
+
+		It("returns stemcell that references given directory", func() {
+			stemcell, err := importer.ImportFromDir(rootFSDir, ImportOptions{})
+			Expect(err).ToNot(HaveOccurred())
+
+			expectedStemcell := NewFSStemcell("fake-uuid", "/fake-collection-dir/fake-uuid", fs, logger)
+			Expect(stemcell).To(Equal(expectedStemcell))
+
+			linkStat := fs.GetFileTestStat("/fake-collection-dir/fake-uuid")
+			Expect(linkStat.FileType).To(Equal(fakesys.FakeFileTypeSymlink))
+			Expect(linkStat.SymlinkTarget).To(Equal(rootFSDir))
+		})
+
+		It("references resolved directory if given directory is a symlink", func() {
+			err := os.Symlink(rootFSDir, filepath.Join(allowedDir, "rootfs-link"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = importer.ImportFromDir(filepath.Join(allowedDir, "rootfs-link"), ImportOptions{})
+			Expect(err).ToNot(HaveOccurred())
+
+			linkStat := fs.GetFileTestStat("/fake-collection-dir/fake-uuid")
+			Expect(linkStat.SymlinkTarget).To(Equal(rootFSDir))
+		})
+
+		It("saves stemcell metadata", func() {
+			options := ImportOptions{
+				Name:    "fake-name",
+				Version: "fake-version",
+				OS:      "fake-os",
+			}
+
+			stemcell, err := importer.ImportFromDir(rootFSDir, options)
+			Expect(err).ToNot(HaveOccurred())
+
+			metadata, err := stemcell.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata).To(Equal(Metadata{
+				Name:       "fake-name",
+				Version:    "fake-version",
+				OS:         "fake-os",
+				ImportedAt: importedAt,
+			}))
+		})
+
+		It("does not unpack or copy directory contents", func() {
+			_, err := importer.ImportFromDir(rootFSDir, ImportOptions{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(extractor.ExtractImagePaths).To(BeEmpty())
+		})
+
+		It("returns error if directory path is not absolute", func() {
+			stemcell, err := importer.ImportFromDir("fake-rootfs-dir", ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("to be an absolute path"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if checksums are given since directories are not verified", func() {
+			stemcell, err := importer.ImportFromDir(rootFSDir, ImportOptions{SHA1: "fake-sha1"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Expected no checksums"))
+			Expect(stemcell).To(BeNil())
+
+			stemcell, err = importer.ImportFromDir(rootFSDir, ImportOptions{SHA256: "fake-sha256"})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Expected no checksums"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if directory does not exist", func() {
+			missingDir := filepath.Join(allowedDir, "missing")
+
+			stemcell, err := importer.ImportFromDir(missingDir, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Expected stemcell directory '" + missingDir + "' to exist"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if path is not a directory", func() {
+			filePath := filepath.Join(allowedDir, "file")
+
+			err := ioutil.WriteFile(filePath, []byte{}, 0644)
+			Expect(err).ToNot(HaveOccurred())
+
+			stemcell, err := importer.ImportFromDir(filePath, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("to be a directory"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if directory is not inside allowed directories", func() {
+			timeService := fakeutil.NewFakeTimeService(importedAt)
+			importer = NewFSImporter("/fake-collection-dir", nil, fs, uuidGen, extractor, timeService, logger)
+
+			stemcell, err := importer.ImportFromDir(rootFSDir, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("to be inside one of allowed directories"))
+			Expect(stemcell).To(BeNil())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-uuid")).To(BeFalse())
+		})
+
+		It("returns error if allowed directory itself is given", func() {
+			stemcell, err := importer.ImportFromDir(allowedDir, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("to be inside one of allowed directories"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if directory is a symlink pointing outside of allowed directories", func() {
+			outsideDir, err := ioutil.TempDir("", "fs-importer-test-outside")
+			Expect(err).ToNot(HaveOccurred())
+
+			defer os.RemoveAll(outsideDir)
+
+			err = os.Symlink(outsideDir, filepath.Join(allowedDir, "escape-link"))
+			Expect(err).ToNot(HaveOccurred())
+
+			stemcell, err := importer.ImportFromDir(filepath.Join(allowedDir, "escape-link"), ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("to be inside one of allowed directories"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if generating stemcell id fails", func() {
+			uuidGen.GenerateError = errors.New("fake-generate-err")
+
+			stemcell, err := importer.ImportFromDir(rootFSDir, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-generate-err"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("returns error if linking directory fails", func() {
+			fs.SymlinkError = errors.New("fake-symlink-err")
+
+			stemcell, err := importer.ImportFromDir(rootFSDir, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-symlink-err"))
+			Expect(stemcell).To(BeNil())
+		})
+
+		It("removes symlink but not referenced directory if saving metadata fails", func() {
+			fs.WriteToFileError = errors.New("fake-write-err")
+
+			stemcell, err := importer.ImportFromDir(rootFSDir, ImportOptions{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+			Expect(stemcell).To(BeNil())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-uuid")).To(BeFalse())
+
+			_, err = os.Stat(rootFSDir)
+			Expect(err).ToNot(HaveOccurred())
+		})
 	})
 })
+
+func sha1Of(contents string) string {
+	sum := sha1.Sum([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256Of(contents string) string {
+	sum := sha256.Sum256([]byte(contents))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,6 +1,12 @@
 package stemcell
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	boshsys "github.com/cloudfoundry/bosh-agent/system"
@@ -8,6 +14,13 @@ import (
 
 const fsStemcellLogTag = "FSStemcell"
 
+// Metadata is kept next to (not inside) stemcell directory
+// so that root filesystem given to containers stays untouched
+const metadataFileSuffix = ".metadata.json"
+
+// Distinguishes temporary metadata files written concurrently by the same process
+var metadataTmpCounter uint64
+
 type FSStemcell struct {
 	id      string
 	dirPath string
@@ -24,13 +37,87 @@ func (s FSStemcell) ID() string { return s.id }
 
 func (s FSStemcell) DirPath() string { return s.dirPath }
 
+func (s FSStemcell) Metadata() (Metadata, error) {
+	var metadata Metadata
+
+	metadataPath := s.metadataPath()
+
+	if !s.fs.FileExists(metadataPath) {
+		return metadata, nil
+	}
+
+	metadataBytes, err := s.fs.ReadFile(metadataPath)
+	if err != nil {
+		return metadata, bosherr.WrapError(err, "Reading stemcell metadata '%s'", metadataPath)
+	}
+
+	err = json.Unmarshal(metadataBytes, &metadata)
+	if err != nil {
+		return metadata, bosherr.WrapError(err, "Unmarshalling stemcell metadata '%s'", metadataPath)
+	}
+
+	return metadata, nil
+}
+
+// RecordVMCreation does not lock metadata since concurrent VM creations
+// only race on setting (almost) the same time; last writer wins.
+// Metadata is replaced atomically so readers never see partially written JSON.
+func (s FSStemcell) RecordVMCreation(createdAt time.Time) error {
+	s.logger.Debug(fsStemcellLogTag, "Recording VM creation from stemcell '%s'", s.id)
+
+	metadata, err := s.Metadata()
+	if err != nil {
+		return err
+	}
+
+	metadata.LastVMCreatedAt = createdAt
+
+	return s.saveMetadata(metadata)
+}
+
 func (s FSStemcell) Delete() error {
 	s.logger.Debug(fsStemcellLogTag, "Deleting stemcell '%s'", s.id)
 
+	// When stemcell references external directory only the symlink is removed
 	err := s.fs.RemoveAll(s.dirPath)
 	if err != nil {
 		return bosherr.WrapError(err, "Deleting stemcell directory '%s'", s.dirPath)
 	}
 
+	err = s.fs.RemoveAll(s.metadataPath())
+	if err != nil {
+		return bosherr.WrapError(err, "Deleting stemcell metadata '%s'", s.metadataPath())
+	}
+
+	return nil
+}
+
+func (s FSStemcell) saveMetadata(metadata Metadata) error {
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return bosherr.WrapError(err, "Marshalling stemcell metadata")
+	}
+
+	metadataPath := s.metadataPath()
+
+	// Temporary file is next to metadata so that rename does not cross filesystems
+	tmpPath := fmt.Sprintf("%s.%d.%d.tmp", metadataPath, os.Getpid(), atomic.AddUint64(&metadataTmpCounter, 1))
+
+	err = s.fs.WriteFile(tmpPath, metadataBytes)
+	if err != nil {
+		s.fs.RemoveAll(tmpPath)
+		return bosherr.WrapError(err, "Writing stemcell metadata '%s'", metadataPath)
+	}
+
+	err = s.fs.Rename(tmpPath, metadataPath)
+	if err != nil {
+		s.fs.RemoveAll(tmpPath)
+		return bosherr.WrapError(err, "Renaming stemcell metadata '%s'", metadataPath)
+	}
+
 	return nil
 }
+
+func (s FSStemcell) metadataPath() string {
+	return s.dirPath + metadataFileSuffix
+}
@@ -3,6 +3,7 @@ package stemcell_test
 import (
 	"errors"
 	"os"
+	"time"
 
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
@@ -12,7 +13,7 @@ import (
 	. "github.com/cppforlife/bosh-warden-cpi/stemcell"
 )
 
-var _ = Describe("FSImporter", func() {
+var _ = Describe("FSStemcell", func() {
 	var (
 		fs       *fakesys.FakeFileSystem
 		stemcell FSStemcell
@@ -21,18 +22,136 @@ var _ = Describe("FSImporter", func() {
 	BeforeEach(func() {
 		fs = fakesys.NewFakeFileSystem()
 		logger := boshlog.NewLogger(boshlog.LevelNone)
-		stemcell = NewFSStemcell("fake-stemcell-id", "/fake-stemcell-dir", fs, logger)
+		stemcell = NewFSStemcell("fake-stemcell-id", "/fake-collection-dir/fake-stemcell-id", fs, logger)
+
+		err := fs.MkdirAll("/fake-collection-dir", os.ModeDir)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Describe("Metadata", func() {
+		It("returns metadata saved next to stemcell directory", func() {
+			err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.metadata.json", `{
+				"name": "fake-name",
+				"version": "fake-version",
+				"os": "fake-os",
+				"image_sha1": "fake-image-sha1",
+				"imported_at": "2014-01-02T03:04:05Z",
+				"size_in_bytes": 100
+			}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			metadata, err := stemcell.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata).To(Equal(Metadata{
+				Name:        "fake-name",
+				Version:     "fake-version",
+				OS:          "fake-os",
+				ImageSHA1:   "fake-image-sha1",
+				ImportedAt:  time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC),
+				SizeInBytes: 100,
+			}))
+		})
+
+		It("returns empty metadata if stemcell does not have metadata", func() {
+			metadata, err := stemcell.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata).To(Equal(Metadata{}))
+		})
+
+		It("returns error if metadata cannot be unmarshalled", func() {
+			err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.metadata.json", "fake-invalid-json")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = stemcell.Metadata()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Unmarshalling stemcell metadata"))
+		})
+	})
+
+	Describe("RecordVMCreation", func() {
+		It("updates last VM creation time keeping the rest of metadata", func() {
+			err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.metadata.json", `{"name": "fake-name"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			createdAt := time.Date(2014, time.January, 2, 3, 4, 5, 0, time.UTC)
+
+			err = stemcell.RecordVMCreation(createdAt)
+			Expect(err).ToNot(HaveOccurred())
+
+			metadata, err := stemcell.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata.Name).To(Equal("fake-name"))
+			Expect(metadata.LastVMCreatedAt).To(Equal(createdAt))
+		})
+
+		It("replaces metadata via temporary file", func() {
+			err := stemcell.RecordVMCreation(time.Now())
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.RenameOldPaths).To(HaveLen(1))
+			Expect(fs.RenameOldPaths[0]).To(MatchRegexp(`^/fake-collection-dir/fake-stemcell-id\.metadata\.json\.\d+\.\d+\.tmp$`))
+			Expect(fs.RenameNewPaths).To(Equal([]string{"/fake-collection-dir/fake-stemcell-id.metadata.json"}))
+
+			Expect(fs.FileExists(fs.RenameOldPaths[0])).To(BeFalse())
+		})
+
+		It("returns error if writing metadata fails", func() {
+			fs.WriteToFileError = errors.New("fake-write-err")
+
+			err := stemcell.RecordVMCreation(time.Now())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-write-err"))
+		})
+
+		It("returns error and keeps previous metadata if renaming metadata fails", func() {
+			err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.metadata.json", `{"name": "fake-name"}`)
+			Expect(err).ToNot(HaveOccurred())
+
+			fs.RenameError = errors.New("fake-rename-err")
+
+			err = stemcell.RecordVMCreation(time.Now())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-rename-err"))
+
+			metadata, err := stemcell.Metadata()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(metadata).To(Equal(Metadata{Name: "fake-name"}))
+		})
 	})
 
 	Describe("Delete", func() {
 		It("deletes directory in collection directory that contains unpacked stemcell", func() {
-			err := fs.MkdirAll("/fake-stemcell-dir", os.ModeDir)
+			err := fs.MkdirAll("/fake-collection-dir/fake-stemcell-id", os.ModeDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = stemcell.Delete()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id")).To(BeFalse())
+		})
+
+		It("deletes stemcell metadata", func() {
+			err := fs.WriteFileString("/fake-collection-dir/fake-stemcell-id.metadata.json", "{}")
+			Expect(err).ToNot(HaveOccurred())
+
+			err = stemcell.Delete()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id.metadata.json")).To(BeFalse())
+		})
+
+		It("deletes only the link when stemcell references external directory", func() {
+			err := fs.MkdirAll("/fake-rootfs-dir", os.ModeDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			err = fs.Symlink("/fake-rootfs-dir", "/fake-collection-dir/fake-stemcell-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			err = stemcell.Delete()
 			Expect(err).ToNot(HaveOccurred())
 
-			Expect(fs.FileExists("/fake-stemcell-dir")).To(BeFalse())
+			Expect(fs.FileExists("/fake-collection-dir/fake-stemcell-id")).To(BeFalse())
+			Expect(fs.FileExists("/fake-rootfs-dir")).To(BeTrue())
 		})
 
 		It("returns error if deleting stemcell directory fails", func() {
@@ -1,16 +1,90 @@
 package stemcell
 
+import (
+	"context"
+	"time"
+)
+
 type Importer interface {
-	ImportFromPath(imagePath string) (Stemcell, error)
+	ImportFromPath(imagePath string, options ImportOptions) (Stemcell, error)
+
+	// ImportFromDir registers already unpacked root filesystem as a stemcell.
+	// Directory is referenced (not copied) and is never modified or deleted by the CPI.
+	// It is used as is for root filesystems of new containers hence it must be
+	// treated as read-only and kept in place until stemcell is deleted;
+	// stemcell whose directory disappeared is still found so that it can be deleted.
+	// Directory must be inside one of allowed directories and checksums are not supported.
+	ImportFromDir(dirPath string, options ImportOptions) (Stemcell, error)
+}
+
+type ImportOptions struct {
+	// Expected hex encoded checksums of the image;
+	// empty checksums are not verified
+	SHA1   string
+	SHA256 string
+
+	// Recorded in stemcell metadata as is
+	Name    string
+	Version string
+	OS      string
+}
+
+type Extractor interface {
+	// Extract unpacks possibly compressed tar image into existing directory
+	// and returns total size of extracted files
+	Extract(imagePath, dirPath string) (int64, error)
 }
 
 type Finder interface {
 	Find(id string) (Stemcell, bool, error)
+
+	// FindAll returns all stemcells except ones marked for deletion
+	FindAll() ([]Stemcell, error)
 }
 
 type Stemcell interface {
 	ID() string
 	DirPath() string
 
+	// Metadata returns empty metadata for stemcells imported without it
+	Metadata() (Metadata, error)
+	RecordVMCreation(createdAt time.Time) error
+
 	Delete() error
 }
+
+type Metadata struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	OS      string `json:"os"`
+
+	// Hex encoded sha1 of the image stemcell was imported from;
+	// empty for stemcells imported from a directory
+	ImageSHA1 string `json:"image_sha1"`
+
+	ImportedAt time.Time `json:"imported_at"`
+
+	// Total size of extracted files; zero for stemcells imported from a directory
+	// since referenced directory is not owned by the CPI
+	SizeInBytes int64 `json:"size_in_bytes"`
+
+	// Zero if no VMs were created from the stemcell yet
+	LastVMCreatedAt time.Time `json:"last_vm_created_at"`
+}
+
+type UsageChecker interface {
+	// InUse returns true if at least one VM was created from stemcell with given id
+	InUse(ctx context.Context, id string) (bool, error)
+}
+
+type DeferredDeleter interface {
+	// Delete deletes stemcell right away if no VMs use it;
+	// otherwise, stemcell is marked for deletion and deleted later by CollectPending
+	Delete(context.Context, Stemcell) error
+
+	// CollectPending deletes stemcells marked for deletion that are no longer in use
+	CollectPending(context.Context) error
+
+	// Pending returns ids of stemcells marked for deletion
+	Pending() ([]string, error)
+}
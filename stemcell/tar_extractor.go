@@ -0,0 +1,481 @@
+package stemcell
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+const tarExtractorLogTag = "TarExtractor"
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// Same limit as Linux uses for symlinks in a path (MAXSYMLINKS)
+const maxSymlinkHops = 40
+
+// TarExtractor unpacks gzip, bzip2 or uncompressed tar images
+// preserving ownership, modes, hardlinks, device nodes and xattrs.
+// Entries are written with os calls directly since boshsys.FileSystem
+// logs every call and does not support numeric ownership, hardlinks,
+// dangling symlinks, times, device nodes or xattrs.
+type TarExtractor struct {
+	// How often to log extraction progress
+	progressInterval time.Duration
+
+	fs     boshsys.FileSystem
+	logger boshlog.Logger
+}
+
+func NewTarExtractor(fs boshsys.FileSystem, logger boshlog.Logger) TarExtractor {
+	return TarExtractor{
+		progressInterval: 10 * time.Second,
+
+		fs:     fs,
+		logger: logger,
+	}
+}
+
+func (e TarExtractor) Extract(imagePath, dirPath string) (int64, error) {
+	e.logger.Debug(tarExtractorLogTag, "Extracting image '%s' to '%s'", imagePath, dirPath)
+
+	file, err := e.fs.OpenFile(imagePath, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, bosherr.WrapError(err, "Opening image '%s'", imagePath)
+	}
+
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return 0, bosherr.WrapError(err, "Checking image size '%s'", imagePath)
+	}
+
+	progress := &extractProgress{
+		reader:    file,
+		totalSize: fileInfo.Size(),
+	}
+
+	reader, err := e.decompressedReader(progress)
+	if err != nil {
+		return 0, bosherr.WrapError(err, "Detecting image '%s' format", imagePath)
+	}
+
+	tarReader := tar.NewReader(reader)
+
+	// Directory modes and times are applied after all entries are extracted
+	// since read-only directories would not allow writing and writing would change times
+	dirPaths := []string{}
+	dirHeaders := []*tar.Header{}
+
+	lastLoggedAt := time.Now()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return 0, bosherr.WrapError(err, "Reading tar entry after '%d' entries", progress.entries)
+		}
+
+		path, err := e.entryPath(dirPath, header.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		path, err = e.resolveParents(dirPath, path)
+		if err != nil {
+			return 0, bosherr.WrapError(err, "Extracting tar entry '%s'", header.Name)
+		}
+
+		extracted, err := e.extractEntry(dirPath, path, header, tarReader, progress)
+		if err != nil {
+			return 0, bosherr.WrapError(err, "Extracting tar entry '%s'", header.Name)
+		}
+
+		if extracted && header.Typeflag == tar.TypeDir {
+			dirPaths = append(dirPaths, path)
+			dirHeaders = append(dirHeaders, header)
+		}
+
+		progress.entries++
+
+		if time.Since(lastLoggedAt) >= e.progressInterval {
+			e.logProgress(imagePath, progress)
+			lastLoggedAt = time.Now()
+		}
+	}
+
+	// Apply in reverse so that parent directories are finalized after their children
+	for i := len(dirHeaders) - 1; i >= 0; i-- {
+		replaced, err := e.dirReplaced(dirPath, dirPaths[i])
+		if err != nil {
+			return 0, bosherr.WrapError(err, "Checking directory '%s'", dirHeaders[i].Name)
+		}
+
+		if replaced {
+			e.logger.Debug(tarExtractorLogTag, "Skipping metadata of directory '%s' replaced by a later entry", dirHeaders[i].Name)
+			continue
+		}
+
+		err = e.applyMetadata(dirPaths[i], dirHeaders[i])
+		if err != nil {
+			return 0, bosherr.WrapError(err, "Applying metadata to directory '%s'", dirHeaders[i].Name)
+		}
+	}
+
+	e.logProgress(imagePath, progress)
+
+	e.logger.Debug(tarExtractorLogTag, "Extracted image '%s' to '%s'", imagePath, dirPath)
+
+	return progress.extractedSize, nil
+}
+
+func (e TarExtractor) decompressedReader(reader io.Reader) (io.Reader, error) {
+	bufReader := bufio.NewReader(reader)
+
+	// Error is ignored since image might be shorter than magic bytes
+	magic, _ := bufReader.Peek(len(bzip2Magic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		e.logger.Debug(tarExtractorLogTag, "Detected gzip compressed tar")
+		return gzip.NewReader(bufReader)
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		e.logger.Debug(tarExtractorLogTag, "Detected bzip2 compressed tar")
+		return bzip2.NewReader(bufReader), nil
+
+	default:
+		e.logger.Debug(tarExtractorLogTag, "Assuming uncompressed tar")
+		return bufReader, nil
+	}
+}
+
+// entryPath returns path inside dirPath for an entry
+// and refuses entries that would end up outside of dirPath.
+func (e TarExtractor) entryPath(dirPath, name string) (string, error) {
+	cleanName := filepath.Clean(name)
+
+	if filepath.IsAbs(name) || cleanName == ".." || strings.HasPrefix(cleanName, "../") {
+		return "", bosherr.New("Refusing to extract tar entry '%s' outside of '%s'", name, dirPath)
+	}
+
+	return filepath.Join(dirPath, cleanName), nil
+}
+
+// resolveParents resolves previously extracted symlinks in parent directories of path
+// so that entries are written to the same place where container would see them
+// (e.g. entry 'lib/libc.so' after symlink 'lib' pointing to 'usr/lib').
+// Absolute symlink targets are resolved relative to dirPath like inside the container
+// instead of on the host. Symlinks leading outside of dirPath are refused since
+// writing through them would modify host files (e.g. 'etc' pointing to '../../etc').
+func (e TarExtractor) resolveParents(dirPath, path string) (string, error) {
+	relPath, err := filepath.Rel(dirPath, path)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Determining relative path")
+	}
+
+	components := strings.Split(relPath, string(filepath.Separator))
+	resolvedPath := dirPath
+	hops := 0
+
+	// Last component is the entry itself and is not resolved
+	for len(components) > 1 {
+		currPath := filepath.Join(resolvedPath, components[0])
+		components = components[1:]
+
+		// Paths that do not exist or are not symlinks are used as is
+		target, err := os.Readlink(currPath)
+		if err != nil {
+			resolvedPath = currPath
+			continue
+		}
+
+		hops++
+
+		if hops > maxSymlinkHops {
+			return "", bosherr.New("Refusing to extract through too many symlinks at '%s'", currPath)
+		}
+
+		var targetPath string
+
+		if filepath.IsAbs(target) {
+			targetPath = filepath.Join(dirPath, target)
+		} else {
+			targetPath = filepath.Join(resolvedPath, target)
+		}
+
+		targetRelPath, err := filepath.Rel(dirPath, targetPath)
+		if err != nil || targetRelPath == ".." || strings.HasPrefix(targetRelPath, "../") {
+			return "", bosherr.New("Refusing to extract through symlink '%s' pointing outside of '%s'", currPath, dirPath)
+		}
+
+		// Target itself might go through other symlinks
+		resolvedPath = dirPath
+
+		if targetRelPath != "." {
+			components = append(strings.Split(targetRelPath, string(filepath.Separator)), components...)
+		}
+	}
+
+	return filepath.Join(resolvedPath, components[0]), nil
+}
+
+// extractEntry writes entry at path which has parent symlinks already resolved
+func (e TarExtractor) extractEntry(dirPath, path string, header *tar.Header, reader io.Reader, progress *extractProgress) (bool, error) {
+	var err error
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// Directory replaces existing symlink instead of being created at its target
+		_, err = os.Readlink(path)
+		if err == nil {
+			err = e.removeExisting(path)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		err = os.MkdirAll(path, os.FileMode(0700))
+		if err != nil {
+			// Existing file is replaced by directory
+			err = e.removeExisting(path)
+			if err != nil {
+				return false, err
+			}
+
+			err = os.MkdirAll(path, os.FileMode(0700))
+			if err != nil {
+				return false, bosherr.WrapError(err, "Creating directory")
+			}
+		}
+
+		// Metadata is applied once all entries are extracted
+		return true, nil
+
+	case tar.TypeReg, tar.TypeRegA:
+		err = e.makeParentDir(path)
+		if err != nil {
+			return false, err
+		}
+
+		err = e.removeExisting(path)
+		if err != nil {
+			return false, err
+		}
+
+		// Exclusive create does not follow symlink left at path
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(0600))
+		if err != nil {
+			return false, bosherr.WrapError(err, "Creating file")
+		}
+
+		written, err := io.Copy(file, reader)
+		progress.extractedSize += written
+
+		if err != nil {
+			file.Close()
+			return false, bosherr.WrapError(err, "Writing file")
+		}
+
+		err = file.Close()
+		if err != nil {
+			return false, bosherr.WrapError(err, "Closing file")
+		}
+
+	case tar.TypeSymlink:
+		err = e.makeParentDir(path)
+		if err != nil {
+			return false, err
+		}
+
+		err = e.removeExisting(path)
+		if err != nil {
+			return false, err
+		}
+
+		// Symlink targets are checked only when later entries are written through them
+		err = os.Symlink(header.Linkname, path)
+		if err != nil {
+			return false, bosherr.WrapError(err, "Creating symlink")
+		}
+
+	case tar.TypeLink:
+		targetPath, err := e.entryPath(dirPath, header.Linkname)
+		if err != nil {
+			return false, err
+		}
+
+		targetPath, err = e.resolveParents(dirPath, targetPath)
+		if err != nil {
+			return false, err
+		}
+
+		err = e.makeParentDir(path)
+		if err != nil {
+			return false, err
+		}
+
+		err = e.removeExisting(path)
+		if err != nil {
+			return false, err
+		}
+
+		err = os.Link(targetPath, path)
+		if err != nil {
+			return false, bosherr.WrapError(err, "Creating hardlink to '%s'", header.Linkname)
+		}
+
+		// Hardlink shares metadata with its target
+		return true, nil
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		err = e.makeParentDir(path)
+		if err != nil {
+			return false, err
+		}
+
+		err = e.removeExisting(path)
+		if err != nil {
+			return false, err
+		}
+
+		err = makeDeviceNode(path, header)
+		if err != nil {
+			return false, bosherr.WrapError(err, "Creating device node")
+		}
+
+	case tar.TypeXGlobalHeader:
+		return false, nil
+
+	default:
+		e.logger.Warn(tarExtractorLogTag, "Skipping tar entry '%s' with unsupported type '%c'", header.Name, header.Typeflag)
+		return false, nil
+	}
+
+	err = e.applyMetadata(path, header)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (e TarExtractor) makeParentDir(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+	if err != nil {
+		return bosherr.WrapError(err, "Creating parent directory")
+	}
+
+	return nil
+}
+
+func (e TarExtractor) removeExisting(path string) error {
+	// Later entries overwrite earlier ones just like tar does;
+	// symlink itself is removed (not its target)
+	err := os.RemoveAll(path)
+	if err != nil {
+		return bosherr.WrapError(err, "Removing existing file")
+	}
+
+	return nil
+}
+
+// dirReplaced checks whether directory extracted at path was replaced by a later entry
+// (e.g. symlink pointing outside of dirPath) either at path or at one of its parents
+// so that its metadata is not applied to whatever path leads to now.
+func (e TarExtractor) dirReplaced(dirPath, path string) (bool, error) {
+	// Path was already resolved when directory was extracted
+	resolvedPath, err := e.resolveParents(dirPath, path)
+	if err != nil || resolvedPath != path {
+		return true, nil
+	}
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return !info.IsDir(), nil
+}
+
+// applyMetadata never follows symlink at path
+func (e TarExtractor) applyMetadata(path string, header *tar.Header) error {
+	// Chown must happen before chmod since it clears setuid/setgid bits
+	err := os.Lchown(path, header.Uid, header.Gid)
+	if err != nil {
+		return bosherr.WrapError(err, "Changing owner to '%d:%d'", header.Uid, header.Gid)
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		return nil
+	}
+
+	err = lchmod(path, header)
+	if err != nil {
+		return bosherr.WrapError(err, "Changing mode")
+	}
+
+	err = lsetXattrs(path, header.Xattrs)
+	if err != nil {
+		return bosherr.WrapError(err, "Setting xattrs")
+	}
+
+	err = lchtimes(path, header.ModTime)
+	if err != nil {
+		return bosherr.WrapError(err, "Changing times")
+	}
+
+	return nil
+}
+
+func (e TarExtractor) logProgress(imagePath string, progress *extractProgress) {
+	var percent int64
+
+	if progress.totalSize > 0 {
+		percent = progress.readSize * 100 / progress.totalSize
+	}
+
+	e.logger.Debug(
+		tarExtractorLogTag,
+		"Extracted '%d' entries (%d bytes) from image '%s' (%d%% of %d bytes read)",
+		progress.entries, progress.extractedSize, imagePath, percent, progress.totalSize,
+	)
+}
+
+// extractProgress tracks how much of the (possibly compressed) image was read
+type extractProgress struct {
+	reader io.Reader
+
+	totalSize int64
+	readSize  int64
+
+	entries       int
+	extractedSize int64
+}
+
+func (p *extractProgress) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.readSize += int64(n)
+	return n, err
+}
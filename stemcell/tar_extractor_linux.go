@@ -0,0 +1,123 @@
+package stemcell
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Not exported by syscall package
+const (
+	atFDCWD           = -0x64
+	atSymlinkNoFollow = 0x100
+)
+
+func makeDeviceNode(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+
+	switch header.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+
+	return syscall.Mknod(path, mode, makeDev(header.Devmajor, header.Devminor))
+}
+
+// makeDev encodes device numbers the same way glibc's makedev does
+func makeDev(major, minor int64) int {
+	return int(((minor & 0xfff00) << 12) | ((major & 0xfff) << 8) | (minor & 0xff))
+}
+
+// lchmod changes mode of path itself and refuses symlinks
+func lchmod(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+
+	err := syscall.Fchmodat(atFDCWD, path, mode, atSymlinkNoFollow)
+	if err != syscall.EOPNOTSUPP {
+		return err
+	}
+
+	// Kernels without fchmodat2 (before 6.6) cannot chmod without following symlinks
+	// hence path is checked right before; nothing else writes to directory being extracted
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return syscall.ELOOP
+	}
+
+	return syscall.Chmod(path, mode)
+}
+
+// lchtimes changes times of path itself even if it is a symlink
+func lchtimes(path string, modTime time.Time) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	times := [2]syscall.Timespec{
+		syscall.NsecToTimespec(modTime.UnixNano()),
+		syscall.NsecToTimespec(modTime.UnixNano()),
+	}
+
+	dirFD := atFDCWD
+
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_UTIMENSAT,
+		uintptr(dirFD),
+		uintptr(unsafe.Pointer(pathPtr)),
+		uintptr(unsafe.Pointer(&times[0])),
+		atSymlinkNoFollow,
+		0, 0,
+	)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// lsetXattrs sets xattrs on path itself even if it is a symlink
+func lsetXattrs(path string, xattrs map[string]string) error {
+	pathPtr, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range xattrs {
+		namePtr, err := syscall.BytePtrFromString(name)
+		if err != nil {
+			return err
+		}
+
+		var valuePtr unsafe.Pointer
+
+		if len(value) > 0 {
+			valueBytes := []byte(value)
+			valuePtr = unsafe.Pointer(&valueBytes[0])
+		}
+
+		_, _, errno := syscall.Syscall6(
+			syscall.SYS_LSETXATTR,
+			uintptr(unsafe.Pointer(pathPtr)),
+			uintptr(unsafe.Pointer(namePtr)),
+			uintptr(valuePtr),
+			uintptr(len(value)),
+			0, 0,
+		)
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	return nil
+}
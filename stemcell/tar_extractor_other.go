@@ -0,0 +1,54 @@
+//go:build !linux
+// +build !linux
+
+package stemcell
+
+import (
+	"archive/tar"
+	"os"
+	"syscall"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+)
+
+func makeDeviceNode(path string, header *tar.Header) error {
+	return bosherr.New("Creating device nodes is only supported on Linux")
+}
+
+// lchmod changes mode of path itself and refuses symlinks;
+// path is checked right before since nothing else writes to directory being extracted
+func lchmod(path string, header *tar.Header) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return syscall.ELOOP
+	}
+
+	return syscall.Chmod(path, uint32(header.Mode&07777))
+}
+
+// lchtimes refuses symlinks since changing their own times is only supported on Linux
+func lchtimes(path string, modTime time.Time) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		return syscall.ELOOP
+	}
+
+	return os.Chtimes(path, modTime, modTime)
+}
+
+func lsetXattrs(path string, xattrs map[string]string) error {
+	if len(xattrs) > 0 {
+		return bosherr.New("Setting xattrs is only supported on Linux")
+	}
+
+	return nil
+}
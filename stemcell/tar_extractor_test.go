@@ -0,0 +1,317 @@
+package stemcell_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/stemcell"
+)
+
+var _ = Describe("TarExtractor", func() {
+	var (
+		tmpDir    string
+		imagePath string
+		dirPath   string
+		extractor TarExtractor
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "tar-extractor-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		imagePath = filepath.Join(tmpDir, "image")
+
+		dirPath = filepath.Join(tmpDir, "rootfs")
+
+		err = os.Mkdir(dirPath, os.FileMode(0755))
+		Expect(err).ToNot(HaveOccurred())
+
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+		extractor = NewTarExtractor(boshsys.NewOsFileSystem(logger), logger)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	modTime := time.Date(2014, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+	buildTar := func(entries []tarEntry) []byte {
+		buf := &bytes.Buffer{}
+		tarWriter := tar.NewWriter(buf)
+
+		for _, entry := range entries {
+			entry.header.ModTime = modTime
+			entry.header.Size = int64(len(entry.contents))
+
+			err := tarWriter.WriteHeader(&entry.header)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = tarWriter.Write([]byte(entry.contents))
+			Expect(err).ToNot(HaveOccurred())
+		}
+
+		Expect(tarWriter.Close()).ToNot(HaveOccurred())
+
+		return buf.Bytes()
+	}
+
+	gzipBytes := func(b []byte) []byte {
+		buf := &bytes.Buffer{}
+		gzipWriter := gzip.NewWriter(buf)
+		_, err := gzipWriter.Write(b)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(gzipWriter.Close()).ToNot(HaveOccurred())
+		return buf.Bytes()
+	}
+
+	writeImage := func(b []byte) {
+		err := ioutil.WriteFile(imagePath, b, os.FileMode(0644))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	simpleEntries := []tarEntry{
+		{header: tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{header: tar.Header{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644}, contents: "fake-hostname"},
+	}
+
+	expectSimpleEntriesExtracted := func() {
+		contents, err := ioutil.ReadFile(filepath.Join(dirPath, "etc/hostname"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(contents)).To(Equal("fake-hostname"))
+	}
+
+	It("extracts gzip compressed tar", func() {
+		writeImage(gzipBytes(buildTar(simpleEntries)))
+
+		size, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(size).To(Equal(int64(len("fake-hostname"))))
+
+		expectSimpleEntriesExtracted()
+	})
+
+	It("extracts uncompressed tar", func() {
+		writeImage(buildTar(simpleEntries))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		expectSimpleEntriesExtracted()
+	})
+
+	// bzip2 compressed fixtures are generated since Go cannot write bzip2
+	if bzip2Path, err := exec.LookPath("bzip2"); err == nil {
+		It("extracts bzip2 compressed tar", func() {
+			cmd := exec.Command(bzip2Path, "-c")
+			cmd.Stdin = bytes.NewReader(buildTar(simpleEntries))
+
+			compressed, err := cmd.Output()
+			Expect(err).ToNot(HaveOccurred())
+
+			writeImage(compressed)
+
+			_, err = extractor.Extract(imagePath, dirPath)
+			Expect(err).ToNot(HaveOccurred())
+
+			expectSimpleEntriesExtracted()
+		})
+	}
+
+	It("preserves modes, times and hardlinks", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0700}},
+			{header: tar.Header{Name: "bin/sudo", Typeflag: tar.TypeReg, Mode: 04755}, contents: "fake-sudo"},
+			{header: tar.Header{Name: "bin/sudo-link", Typeflag: tar.TypeLink, Linkname: "bin/sudo"}},
+			{header: tar.Header{Name: "bin/sh", Typeflag: tar.TypeSymlink, Linkname: "/bin/bash"}},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		dirInfo, err := os.Stat(filepath.Join(dirPath, "bin"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dirInfo.Mode().Perm()).To(Equal(os.FileMode(0700)))
+		Expect(dirInfo.ModTime().Equal(modTime)).To(BeTrue())
+
+		fileInfo, err := os.Stat(filepath.Join(dirPath, "bin/sudo"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fileInfo.Mode() & (os.ModePerm | os.ModeSetuid)).To(Equal(os.ModeSetuid | os.FileMode(0755)))
+
+		linkInfo, err := os.Stat(filepath.Join(dirPath, "bin/sudo-link"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.SameFile(fileInfo, linkInfo)).To(BeTrue())
+
+		target, err := os.Readlink(filepath.Join(dirPath, "bin/sh"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("/bin/bash"))
+	})
+
+	It("refuses entries outside of directory", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "../escaped", Typeflag: tar.TypeReg, Mode: 0644}, contents: "fake-contents"},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Refusing to extract tar entry '../escaped'"))
+
+		_, err = os.Stat(filepath.Join(tmpDir, "escaped"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("refuses hardlinks to files outside of directory", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../etc/passwd"}},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Refusing to extract tar entry '../../etc/passwd'"))
+	})
+
+	It("extracts entries through previously extracted symlinks staying inside of directory", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "lib", Typeflag: tar.TypeSymlink, Linkname: "usr/lib"}},
+			{header: tar.Header{Name: "lib/libfake.so", Typeflag: tar.TypeReg, Mode: 0644}, contents: "fake-lib"},
+			{header: tar.Header{Name: "lib/libfake-link.so", Typeflag: tar.TypeLink, Linkname: "lib/libfake.so"}},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		contents, err := ioutil.ReadFile(filepath.Join(dirPath, "usr/lib/libfake.so"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(contents)).To(Equal("fake-lib"))
+
+		_, err = os.Stat(filepath.Join(dirPath, "usr/lib/libfake-link.so"))
+		Expect(err).ToNot(HaveOccurred())
+
+		target, err := os.Readlink(filepath.Join(dirPath, "lib"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("usr/lib"))
+	})
+
+	It("resolves absolute symlinks relative to directory when extracting entries through them", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: tmpDir}},
+			{header: tar.Header{Name: "etc/escaped", Typeflag: tar.TypeReg, Mode: 0644}, contents: "fake-contents"},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = os.Stat(filepath.Join(tmpDir, "escaped"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+
+		contents, err := ioutil.ReadFile(filepath.Join(dirPath, tmpDir, "escaped"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(contents)).To(Equal("fake-contents"))
+	})
+
+	It("refuses entries written through previously extracted symlinks pointing outside of directory", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "usr/etc", Typeflag: tar.TypeSymlink, Linkname: "../.."}},
+			{header: tar.Header{Name: "usr/etc/escaped", Typeflag: tar.TypeReg, Mode: 0644}, contents: "fake-contents"},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Refusing to extract through symlink"))
+
+		_, err = os.Stat(filepath.Join(tmpDir, "escaped"))
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("does not apply directory metadata through symlink that replaced directory", func() {
+		outsideDir := filepath.Join(tmpDir, "outside")
+
+		err := os.Mkdir(outsideDir, os.FileMode(0755))
+		Expect(err).ToNot(HaveOccurred())
+
+		outsideInfo, err := os.Stat(outsideDir)
+		Expect(err).ToNot(HaveOccurred())
+
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0777}},
+			{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		}))
+
+		_, err = extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		target, err := os.Readlink(filepath.Join(dirPath, "a"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal("../outside"))
+
+		info, err := os.Stat(outsideDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+		Expect(info.ModTime()).To(Equal(outsideInfo.ModTime()))
+	})
+
+	It("does not apply directory metadata through parent symlink that replaced parent directory", func() {
+		outsideDir := filepath.Join(tmpDir, "outside")
+
+		err := os.MkdirAll(filepath.Join(outsideDir, "b"), os.FileMode(0755))
+		Expect(err).ToNot(HaveOccurred())
+
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "a/", Typeflag: tar.TypeDir, Mode: 0755}},
+			{header: tar.Header{Name: "a/b/", Typeflag: tar.TypeDir, Mode: 0777}},
+			{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../outside"}},
+		}))
+
+		_, err = extractor.Extract(imagePath, dirPath)
+		Expect(err).ToNot(HaveOccurred())
+
+		info, err := os.Stat(filepath.Join(outsideDir, "b"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0755)))
+	})
+
+	It("refuses entries written through symlink loops", func() {
+		writeImage(buildTar([]tarEntry{
+			{header: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"}},
+			{header: tar.Header{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"}},
+			{header: tar.Header{Name: "a/file", Typeflag: tar.TypeReg, Mode: 0644}, contents: "fake-contents"},
+		}))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Refusing to extract through too many symlinks"))
+	})
+
+	It("returns error if image is not a tar", func() {
+		writeImage(gzipBytes([]byte("fake-not-tar-contents")))
+
+		_, err := extractor.Extract(imagePath, dirPath)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("returns error if image does not exist", func() {
+		_, err := extractor.Extract(filepath.Join(tmpDir, "fake-missing-image"), dirPath)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Opening image"))
+	})
+})
+
+type tarEntry struct {
+	header   tar.Header
+	contents string
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"context"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+)
+
+// RunCancellable runs fn and stops waiting for it once ctx is done.
+// Since fn cannot be interrupted it might keep running in the background
+// but its result is discarded. fn is not started if ctx is already done.
+func RunCancellable(ctx context.Context, description string, fn func() error) error {
+	return RunCancellableWithCleanup(ctx, description, fn, nil)
+}
+
+// RunCancellableWithCleanup is like RunCancellable but calls cleanup
+// if fn succeeds after caller stopped waiting for it so that
+// resources fn created (e.g. containers) are not leaked.
+func RunCancellableWithCleanup(ctx context.Context, description string, fn func() error, cleanup func()) error {
+	err := ctx.Err()
+	if err != nil {
+		return bosherr.WrapError(err, "Not starting %s", description)
+	}
+
+	errCh := make(chan error, 1)
+
+	go func() { errCh <- fn() }()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		if cleanup != nil {
+			go func() {
+				if <-errCh == nil {
+					cleanup()
+				}
+			}()
+		}
+
+		return bosherr.WrapError(ctx.Err(), "Waiting for %s", description)
+	}
+}
+
+// How long cleanup after a failed or cancelled operation may take
+const cleanupTimeout = 1 * time.Minute
+
+// NewCleanupContext returns context for cleaning up after an operation
+// whose context might be done already (e.g. request timed out);
+// it is not derived from operation's context but has its own timeout.
+func NewCleanupContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), cleanupTimeout)
+}
+
+// CancellableSleeper wakes up early once ctx is done
+// so that retry loops can notice cancellation
+type CancellableSleeper struct {
+	ctx context.Context
+}
+
+func NewCancellableSleeper(ctx context.Context) CancellableSleeper {
+	return CancellableSleeper{ctx: ctx}
+}
+
+func (s CancellableSleeper) Sleep(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.ctx.Done():
+	}
+}
@@ -0,0 +1,65 @@
+package fakes
+
+import (
+	"context"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+type FakeLockManager struct {
+	LockKeys []string
+	LockLock *FakeLock
+	LockErr  error
+
+	// Keys of all Lock calls in order
+	AllLockKeys [][]string
+
+	// Called while Lock is held, e.g. to simulate concurrent changes
+	LockCallback func(keys []string)
+
+	LockSharedKeys []string
+	LockSharedLock *FakeLock
+	LockSharedErr  error
+}
+
+func NewFakeLockManager() *FakeLockManager {
+	return &FakeLockManager{LockLock: &FakeLock{}, LockSharedLock: &FakeLock{}}
+}
+
+func (m *FakeLockManager) Lock(_ context.Context, keys ...string) (bwcutil.Lock, error) {
+	m.LockKeys = keys
+	m.AllLockKeys = append(m.AllLockKeys, keys)
+
+	if m.LockErr != nil {
+		return nil, m.LockErr
+	}
+
+	m.LockLock.Locked = true
+
+	if m.LockCallback != nil {
+		m.LockCallback(keys)
+	}
+
+	return m.LockLock, nil
+}
+
+func (m *FakeLockManager) LockShared(_ context.Context, keys ...string) (bwcutil.Lock, error) {
+	m.LockSharedKeys = keys
+
+	if m.LockSharedErr != nil {
+		return nil, m.LockSharedErr
+	}
+
+	m.LockSharedLock.Locked = true
+
+	return m.LockSharedLock, nil
+}
+
+type FakeLock struct {
+	Locked   bool
+	Unlocked bool
+}
+
+func (l *FakeLock) Unlock() {
+	l.Unlocked = true
+}
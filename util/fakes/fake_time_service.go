@@ -0,0 +1,17 @@
+package fakes
+
+import (
+	"time"
+)
+
+type FakeTimeService struct {
+	NowTime time.Time
+}
+
+func NewFakeTimeService(now time.Time) *FakeTimeService {
+	return &FakeTimeService{NowTime: now}
+}
+
+func (s *FakeTimeService) Now() time.Time {
+	return s.NowTime
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Matches entries formatted by boshlog.Logger, e.g. '[tag] 2014/01/01 00:00:00 DEBUG - msg'
+var logEntryRegexp = regexp.MustCompile(`(?s)\A\[([^\]]*)\] \d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} (DEBUG|INFO|WARN|ERROR) - (.*)\z`)
+
+type jsonLogEntry struct {
+	Timestamp string `json:"timestamp"`
+	Level     string `json:"level"`
+	Tag       string `json:"tag"`
+	RequestID string `json:"request_id"`
+	Action    string `json:"action"`
+	Message   string `json:"message"`
+}
+
+// JSONLogWriter converts every log entry into a single JSON line
+// so that log shippers do not have to parse free-form text.
+type JSONLogWriter struct {
+	w           io.Writer
+	requestID   string
+	action      string
+	timeService TimeService
+}
+
+func NewJSONLogWriter(w io.Writer, requestID, action string, timeService TimeService) JSONLogWriter {
+	return JSONLogWriter{
+		w:           w,
+		requestID:   requestID,
+		action:      action,
+		timeService: timeService,
+	}
+}
+
+func (w JSONLogWriter) Write(b []byte) (int, error) {
+	entry := jsonLogEntry{
+		// Logger's own timestamp does not include sub-second precision
+		Timestamp: w.timeService.Now().UTC().Format(time.RFC3339Nano),
+		RequestID: w.requestID,
+		Action:    w.action,
+	}
+
+	if matches := logEntryRegexp.FindSubmatch(b); matches != nil {
+		entry.Tag = string(matches[1])
+		entry.Level = string(matches[2])
+		entry.Message = strings.TrimSuffix(string(matches[3]), "\n")
+	} else {
+		entry.Level = "ERROR"
+		entry.Message = strings.TrimSuffix(string(b), "\n")
+	}
+
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	// Single write keeps entries from concurrent requests from interleaving
+	_, err = w.w.Write(append(entryBytes, '\n'))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,200 @@
+package util
+
+import (
+	"context"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+const fileLockManagerLogTag = "FileLockManager"
+
+// How often lock acquisition is retried while another process holds it
+const fileLockManagerPollInterval = 500 * time.Millisecond
+
+type LockManager interface {
+	// Lock waits until all keys are locked or ctx is done. Keys are locked in sorted order
+	// so that callers locking overlapping sets of keys do not deadlock.
+	Lock(ctx context.Context, keys ...string) (Lock, error)
+
+	// LockShared is like Lock but other shared locks of the same keys can be held at the same time,
+	// e.g. VMs can be created from the same stemcell concurrently while it cannot be deleted.
+	LockShared(ctx context.Context, keys ...string) (Lock, error)
+}
+
+type Lock interface {
+	Unlock()
+}
+
+func VMLockKey(vmCID string) string     { return "vm-" + vmCID }
+func DiskLockKey(diskCID string) string { return "disk-" + diskCID }
+
+func StemcellLockKey(stemcellCID string) string { return "stemcell-" + stemcellCID }
+
+// FileLockManager uses flock(2) on files in a shared directory so that
+// CPI processes running concurrently on the same host exclude each other.
+// Locks are released by the kernel if a process dies while holding them.
+// Locks directory must be owned by the process user since anyone who can open
+// lock files could hold locks and block CPI operations.
+type FileLockManager struct {
+	dir     string
+	timeout time.Duration
+
+	sleeper     Sleeper
+	timeService TimeService
+
+	fs     boshsys.FileSystem
+	logger boshlog.Logger
+}
+
+type fileLock struct {
+	files  []*os.File
+	logger boshlog.Logger
+}
+
+func NewFileLockManager(
+	dir string,
+	timeout time.Duration,
+	sleeper Sleeper,
+	timeService TimeService,
+	fs boshsys.FileSystem,
+	logger boshlog.Logger,
+) FileLockManager {
+	return FileLockManager{
+		dir:     dir,
+		timeout: timeout,
+
+		sleeper:     sleeper,
+		timeService: timeService,
+
+		fs:     fs,
+		logger: logger,
+	}
+}
+
+func (m FileLockManager) Lock(ctx context.Context, keys ...string) (Lock, error) {
+	return m.lock(ctx, keys, syscall.LOCK_EX)
+}
+
+func (m FileLockManager) LockShared(ctx context.Context, keys ...string) (Lock, error) {
+	return m.lock(ctx, keys, syscall.LOCK_SH)
+}
+
+func (m FileLockManager) lock(ctx context.Context, keys []string, how int) (Lock, error) {
+	err := m.fs.MkdirAll(m.dir, os.FileMode(0700))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Creating locks directory")
+	}
+
+	err = m.checkDirOwner()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := m.timeService.Now().Add(m.timeout)
+
+	lock := fileLock{logger: m.logger}
+
+	for _, key := range m.sortedKeys(keys) {
+		file, err := m.lockFile(ctx, key, how, deadline)
+		if err != nil {
+			lock.Unlock()
+			return nil, err
+		}
+
+		lock.files = append(lock.files, file)
+	}
+
+	return lock, nil
+}
+
+func (m FileLockManager) checkDirOwner() error {
+	// Symlink could point to a directory owned by someone else
+	dirInfo, err := os.Lstat(m.dir)
+	if err != nil {
+		return bosherr.WrapError(err, "Checking locks directory")
+	}
+
+	if !dirInfo.IsDir() {
+		return bosherr.New("Expected locks directory '%s' to be a directory", m.dir)
+	}
+
+	stat, ok := dirInfo.Sys().(*syscall.Stat_t)
+	if !ok || int(stat.Uid) != os.Getuid() {
+		return bosherr.New("Expected locks directory '%s' to be owned by user '%d'", m.dir, os.Getuid())
+	}
+
+	return nil
+}
+
+func (m FileLockManager) lockFile(ctx context.Context, key string, how int, deadline time.Time) (*os.File, error) {
+	// Lock files are never removed since removing them would race with processes waiting on them
+	path := filepath.Join(m.dir, url.PathEscape(key)+".lock")
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Opening lock file '%s'", path)
+	}
+
+	for {
+		err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			m.logger.Debug(fileLockManagerLogTag, "Acquired lock '%s'", key)
+			return file, nil
+		}
+
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return nil, bosherr.WrapError(err, "Locking '%s'", key)
+		}
+
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			file.Close()
+			return nil, bosherr.WrapError(ctxErr, "Waiting for lock '%s'", key)
+		}
+
+		if m.timeService.Now().After(deadline) {
+			file.Close()
+			return nil, bosherr.New("Timed out after %s waiting for lock '%s'", m.timeout, key)
+		}
+
+		m.logger.Debug(fileLockManagerLogTag, "Waiting for lock '%s' held by another process", key)
+
+		m.sleeper.Sleep(fileLockManagerPollInterval)
+	}
+}
+
+func (m FileLockManager) sortedKeys(keys []string) []string {
+	uniqKeys := map[string]struct{}{}
+
+	for _, key := range keys {
+		uniqKeys[key] = struct{}{}
+	}
+
+	sortedKeys := []string{}
+
+	for key := range uniqKeys {
+		sortedKeys = append(sortedKeys, key)
+	}
+
+	sort.Strings(sortedKeys)
+
+	return sortedKeys
+}
+
+// Unlock releases locks in reverse order; closing file releases its flock
+func (l fileLock) Unlock() {
+	for i := len(l.files) - 1; i >= 0; i-- {
+		err := l.files[i].Close()
+		if err != nil {
+			l.logger.Error(fileLockManagerLogTag, "Releasing lock file '%s': %s", l.files[i].Name(), err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package util_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+// funcSleeper allows tests to act while lock manager is waiting
+type funcSleeper func(time.Duration)
+
+func (s funcSleeper) Sleep(d time.Duration) { s(d) }
+
+var _ = Describe("FileLockManager", func() {
+	var (
+		tmpDir   string
+		locksDir string
+		logOut   *bytes.Buffer
+		logger   boshlog.Logger
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "lock-manager-test")
+		Expect(err).ToNot(HaveOccurred())
+
+		locksDir = filepath.Join(tmpDir, "locks")
+
+		logOut = &bytes.Buffer{}
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logOut, logOut)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	// Each manager opens its own lock files hence managers contend like separate processes
+	newManager := func(timeout time.Duration, sleeper Sleeper) FileLockManager {
+		return NewFileLockManager(
+			locksDir,
+			timeout,
+			sleeper,
+			RealTimeService{},
+			boshsys.NewOsFileSystem(logger),
+			logger,
+		)
+	}
+
+	It("creates lock files for keys in locks directory", func() {
+		lock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "vm-fake/cid", "disk-fake-cid")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer lock.Unlock()
+
+		_, err = os.Stat(filepath.Join(locksDir, "vm-fake%2Fcid.lock"))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = os.Stat(filepath.Join(locksDir, "disk-fake-cid.lock"))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("locks keys in sorted order only once", func() {
+		lock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "b", "a", "b")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer lock.Unlock()
+
+		Expect(strings.Count(logOut.String(), "Acquired lock 'b'")).To(Equal(1))
+
+		aIdx := strings.Index(logOut.String(), "Acquired lock 'a'")
+		bIdx := strings.Index(logOut.String(), "Acquired lock 'b'")
+		Expect(aIdx).To(BeNumerically(">=", 0))
+		Expect(aIdx).To(BeNumerically("<", bIdx))
+	})
+
+	It("times out if key stays locked by another holder and releases already locked keys", func() {
+		heldLock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "b")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer heldLock.Unlock()
+
+		sleeper := NewRecordingNoopSleeper()
+
+		_, err = newManager(10*time.Millisecond, sleeper).Lock(context.Background(), "a", "b")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("Timed out after 10ms waiting for lock 'b'"))
+
+		Expect(sleeper.SleptTimes()).ToNot(BeEmpty())
+		Expect(sleeper.SleptTimes()[0]).To(Equal(500 * time.Millisecond))
+
+		// Key 'a' must not stay locked after failure
+		lock, err := newManager(10*time.Millisecond, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+		lock.Unlock()
+	})
+
+	It("waits until key is unlocked by another holder", func() {
+		heldLock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		sleeps := 0
+
+		sleeper := funcSleeper(func(time.Duration) {
+			sleeps++
+			heldLock.Unlock()
+		})
+
+		lock, err := newManager(time.Minute, sleeper).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer lock.Unlock()
+
+		Expect(sleeps).To(Equal(1))
+	})
+
+	It("allows locking key again once unlocked", func() {
+		lock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		lock.Unlock()
+
+		sleeper := NewRecordingNoopSleeper()
+
+		lock, err = newManager(time.Minute, sleeper).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		lock.Unlock()
+
+		Expect(sleeper.SleptTimes()).To(BeEmpty())
+	})
+
+	It("allows shared locks of the same key to be held at the same time", func() {
+		heldLock, err := newManager(time.Minute, NewRecordingNoopSleeper()).LockShared(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer heldLock.Unlock()
+
+		sleeper := NewRecordingNoopSleeper()
+
+		lock, err := newManager(time.Minute, sleeper).LockShared(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		lock.Unlock()
+
+		Expect(sleeper.SleptTimes()).To(BeEmpty())
+	})
+
+	It("does not allow exclusive lock while shared lock of the same key is held", func() {
+		heldLock, err := newManager(time.Minute, NewRecordingNoopSleeper()).LockShared(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer heldLock.Unlock()
+
+		_, err = newManager(10*time.Millisecond, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("Timed out after 10ms waiting for lock 'a'"))
+	})
+
+	It("does not allow shared lock while exclusive lock of the same key is held", func() {
+		heldLock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer heldLock.Unlock()
+
+		_, err = newManager(10*time.Millisecond, NewRecordingNoopSleeper()).LockShared(context.Background(), "a")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("Timed out after 10ms waiting for lock 'a'"))
+	})
+
+	It("stops waiting once context is cancelled", func() {
+		heldLock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer heldLock.Unlock()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		sleeper := funcSleeper(func(time.Duration) { cancel() })
+
+		_, err = newManager(time.Minute, sleeper).Lock(ctx, "a")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(Equal("Waiting for lock 'a': context canceled"))
+	})
+
+	It("creates locks directory accessible only to its owner", func() {
+		lock, err := newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).ToNot(HaveOccurred())
+
+		defer lock.Unlock()
+
+		dirInfo, err := os.Stat(locksDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dirInfo.Mode().Perm()).To(Equal(os.FileMode(0700)))
+	})
+
+	It("refuses locks directory that is a symlink", func() {
+		err := os.Mkdir(filepath.Join(tmpDir, "other-locks"), os.FileMode(0700))
+		Expect(err).ToNot(HaveOccurred())
+
+		err = os.Symlink(filepath.Join(tmpDir, "other-locks"), locksDir)
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("to be a directory"))
+	})
+
+	// Only root can give directory to another user
+	if os.Getuid() == 0 {
+		It("refuses locks directory owned by another user", func() {
+			err := os.Mkdir(locksDir, os.FileMode(0700))
+			Expect(err).ToNot(HaveOccurred())
+
+			err = os.Chown(locksDir, 65534, 65534)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("to be owned by user '0'"))
+		})
+	}
+
+	It("returns error if locks directory cannot be created", func() {
+		err := ioutil.WriteFile(locksDir, []byte{}, os.FileMode(0600))
+		Expect(err).ToNot(HaveOccurred())
+
+		_, err = newManager(time.Minute, NewRecordingNoopSleeper()).Lock(context.Background(), "a")
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("Creating locks directory"))
+	})
+})
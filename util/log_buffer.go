@@ -0,0 +1,84 @@
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// LogBuffer keeps most recent log entries up to a size limit.
+// Older entries are dropped since the end of the log usually explains failures.
+type LogBuffer struct {
+	maxBytes int
+
+	entries      [][]byte
+	size         int
+	droppedBytes int
+
+	lock sync.Mutex
+}
+
+func NewLogBuffer(maxBytes int) *LogBuffer {
+	return &LogBuffer{maxBytes: maxBytes}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	entry := b.truncate(p)
+
+	b.entries = append(b.entries, entry)
+	b.size += len(entry)
+
+	for b.size > b.maxBytes && len(b.entries) > 0 {
+		b.size -= len(b.entries[0])
+		b.droppedBytes += len(b.entries[0])
+		b.entries = b.entries[1:]
+	}
+
+	return len(p), nil
+}
+
+func (b *LogBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var buf bytes.Buffer
+
+	if b.droppedBytes > 0 {
+		fmt.Fprintf(&buf, "[Dropped %d bytes of earlier log entries]\n", b.droppedBytes)
+	}
+
+	for _, entry := range b.entries {
+		buf.Write(entry)
+	}
+
+	return buf.String()
+}
+
+// truncate keeps beginning of an entry that would not fit by itself
+// since it includes entry's header and usually the most relevant part of the message
+func (b *LogBuffer) truncate(p []byte) []byte {
+	if len(p) <= b.maxBytes {
+		return append([]byte{}, p...)
+	}
+
+	// Suffix length is estimated with the longest possible count of truncated bytes
+	suffixLen := len(fmt.Sprintf("...[Truncated %d bytes]\n", len(p)))
+
+	keptLen := b.maxBytes - suffixLen
+	if keptLen < 0 {
+		keptLen = 0
+	}
+
+	suffix := fmt.Sprintf("...[Truncated %d bytes]\n", len(p)-keptLen)
+
+	entry := append(append([]byte{}, p[:keptLen]...), suffix...)
+
+	if len(entry) > b.maxBytes {
+		entry = entry[:b.maxBytes]
+	}
+
+	return entry
+}
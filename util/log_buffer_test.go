@@ -0,0 +1,72 @@
+package util_test
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+var _ = Describe("LogBuffer", func() {
+	It("keeps written entries", func() {
+		buffer := NewLogBuffer(100)
+
+		buffer.Write([]byte("fake-entry1\n"))
+		buffer.Write([]byte("fake-entry2\n"))
+
+		Expect(buffer.String()).To(Equal("fake-entry1\nfake-entry2\n"))
+	})
+
+	It("drops oldest entries once size limit is exceeded", func() {
+		buffer := NewLogBuffer(24)
+
+		buffer.Write([]byte("fake-entry1\n"))
+		buffer.Write([]byte("fake-entry2\n"))
+		buffer.Write([]byte("fake-entry3\n"))
+
+		Expect(buffer.String()).To(Equal(
+			"[Dropped 12 bytes of earlier log entries]\nfake-entry2\nfake-entry3\n"))
+	})
+
+	It("reports all bytes as written even if entries are dropped", func() {
+		buffer := NewLogBuffer(5)
+
+		n, err := buffer.Write([]byte("fake-entry\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(11))
+	})
+
+	It("does not keep reference to written bytes", func() {
+		buffer := NewLogBuffer(100)
+
+		entry := []byte("fake-entry\n")
+		buffer.Write(entry)
+		copy(entry, "other")
+
+		Expect(buffer.String()).To(Equal("fake-entry\n"))
+	})
+
+	It("truncates entry that is larger than size limit keeping its beginning", func() {
+		buffer := NewLogBuffer(50)
+
+		buffer.Write([]byte("fake-entry1\n"))
+		buffer.Write([]byte("fake-large-entry " + strings.Repeat("x", 100) + "\n"))
+
+		out := buffer.String()
+		Expect(out).To(ContainSubstring("[Dropped 12 bytes of earlier log entries]\n"))
+		Expect(out).To(ContainSubstring("fake-large-entry xxx"))
+		Expect(out).To(MatchRegexp(`\.\.\.\[Truncated \d+ bytes\]\n\z`))
+
+		Expect(len(out) - len("[Dropped 12 bytes of earlier log entries]\n")).To(BeNumerically("<=", 50))
+	})
+
+	It("truncates entry even if size limit is smaller than truncation note", func() {
+		buffer := NewLogBuffer(5)
+
+		buffer.Write([]byte("fake-entry\n"))
+
+		Expect(buffer.String()).To(Equal("...[T"))
+	})
+})
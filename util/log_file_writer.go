@@ -0,0 +1,208 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+// LogFileWriter appends log entries to a file and rotates it once it reaches max size;
+// rotated files are named <path>.1 (most recent) through <path>.<maxFiles>
+// hence maxFiles must be positive. Size is tracked per process so files may
+// slightly exceed max size when multiple CPI processes write to the same file.
+// Rotation itself is coordinated between processes via flock on <path>.lock.
+// Given FileSystem must not log to the writer since logging happens while writing.
+type LogFileWriter struct {
+	path     string
+	maxBytes int64
+	maxFiles int
+
+	fs boshsys.FileSystem
+
+	file boshsys.ReadWriteCloseStater
+	size int64
+
+	lock sync.Mutex
+}
+
+func NewLogFileWriter(path string, maxBytes int64, maxFiles int, fs boshsys.FileSystem) *LogFileWriter {
+	return &LogFileWriter{
+		path:     path,
+		maxBytes: maxBytes,
+		maxFiles: maxFiles,
+
+		fs: fs,
+	}
+}
+
+func (w *LogFileWriter) Write(b []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		err := w.open()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if w.exceedsMaxBytes(int64(len(b))) {
+		err := w.rotateIfNeeded(int64(len(b)))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(b)
+	w.size += int64(n)
+
+	return n, err
+}
+
+func (w *LogFileWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+
+	return err
+}
+
+func (w *LogFileWriter) open() error {
+	file, err := w.fs.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return bosherr.WrapError(err, "Opening log file '%s'", w.path)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return bosherr.WrapError(err, "Stating log file '%s'", w.path)
+	}
+
+	w.file = file
+	w.size = info.Size()
+
+	return nil
+}
+
+func (w *LogFileWriter) exceedsMaxBytes(incoming int64) bool {
+	return w.size > 0 && w.size+incoming > w.maxBytes
+}
+
+// rotateIfNeeded re-checks file under lock since another process
+// might have already rotated it; otherwise each process that saw
+// the old size would rotate again and push out archived logs.
+func (w *LogFileWriter) rotateIfNeeded(incoming int64) error {
+	lockPath := w.path + ".lock"
+
+	lockFile, err := w.fs.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return bosherr.WrapError(err, "Opening log file lock '%s'", lockPath)
+	}
+
+	// Closing lock file releases the lock
+	defer lockFile.Close()
+
+	fdFile, ok := lockFile.(interface {
+		Fd() uintptr
+	})
+	if !ok {
+		return bosherr.New("Expected log file lock '%s' to be an OS file", lockPath)
+	}
+
+	err = syscall.Flock(int(fdFile.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return bosherr.WrapError(err, "Locking log file lock '%s'", lockPath)
+	}
+
+	err = w.reopenIfRotated()
+	if err != nil {
+		return err
+	}
+
+	if !w.exceedsMaxBytes(incoming) {
+		return nil
+	}
+
+	return w.rotate()
+}
+
+// reopenIfRotated switches to the current file at path and refreshes its size
+func (w *LogFileWriter) reopenIfRotated() error {
+	currInfo, err := w.file.Stat()
+	if err != nil {
+		return bosherr.WrapError(err, "Stating log file '%s'", w.path)
+	}
+
+	pathInfo, err := w.statPath()
+	if err == nil && os.SameFile(currInfo, pathInfo) {
+		// Includes entries written by other processes
+		w.size = pathInfo.Size()
+		return nil
+	}
+
+	if err != nil && !os.IsNotExist(err) {
+		return bosherr.WrapError(err, "Stating log file '%s'", w.path)
+	}
+
+	w.file.Close()
+	w.file = nil
+
+	return w.open()
+}
+
+func (w *LogFileWriter) statPath() (os.FileInfo, error) {
+	file, err := w.fs.OpenFile(w.path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return file.Stat()
+}
+
+func (w *LogFileWriter) rotate() error {
+	err := w.file.Close()
+	w.file = nil
+
+	if err != nil {
+		return bosherr.WrapError(err, "Closing log file '%s'", w.path)
+	}
+
+	// Oldest file is overwritten by the next oldest one
+	for i := w.maxFiles - 1; i > 0; i-- {
+		// FileSystem.Rename removes destination even if source does not exist
+		if !w.fs.FileExists(w.rotatedPath(i)) {
+			continue
+		}
+
+		err = w.fs.Rename(w.rotatedPath(i), w.rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return bosherr.WrapError(err, "Rotating log file '%s'", w.rotatedPath(i))
+		}
+	}
+
+	err = w.fs.Rename(w.path, w.rotatedPath(1))
+
+	// Another process might have already rotated the file
+	if err != nil && !os.IsNotExist(err) {
+		return bosherr.WrapError(err, "Rotating log file '%s'", w.path)
+	}
+
+	return w.open()
+}
+
+func (w *LogFileWriter) rotatedPath(i int) string {
+	return fmt.Sprintf("%s.%d", w.path, i)
+}
@@ -0,0 +1,142 @@
+package util_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+var _ = Describe("LogFileWriter", func() {
+	var (
+		tmpDir string
+		path   string
+		fs     boshsys.FileSystem
+	)
+
+	BeforeEach(func() {
+		var err error
+
+		tmpDir, err = ioutil.TempDir("", "bosh-warden-cpi-log-file-writer")
+		Expect(err).ToNot(HaveOccurred())
+
+		path = filepath.Join(tmpDir, "cpi.log")
+
+		fs = boshsys.NewOsFileSystem(boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	readFile := func(path string) string {
+		bytes, err := ioutil.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		return string(bytes)
+	}
+
+	Describe("Write", func() {
+		It("appends entries to existing file", func() {
+			err := ioutil.WriteFile(path, []byte("existing\n"), 0640)
+			Expect(err).ToNot(HaveOccurred())
+
+			writer := NewLogFileWriter(path, 100, 2, fs)
+			defer writer.Close()
+
+			n, err := writer.Write([]byte("entry1\n"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(Equal(7))
+
+			_, err = writer.Write([]byte("entry2\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile(path)).To(Equal("existing\nentry1\nentry2\n"))
+		})
+
+		It("rotates file when it would exceed max size", func() {
+			writer := NewLogFileWriter(path, 10, 2, fs)
+			defer writer.Close()
+
+			for _, entry := range []string{"entry1\n", "entry2\n", "entry3\n"} {
+				_, err := writer.Write([]byte(entry))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(readFile(path)).To(Equal("entry3\n"))
+			Expect(readFile(path + ".1")).To(Equal("entry2\n"))
+			Expect(readFile(path + ".2")).To(Equal("entry1\n"))
+		})
+
+		It("keeps only configured number of rotated files", func() {
+			writer := NewLogFileWriter(path, 10, 2, fs)
+			defer writer.Close()
+
+			for _, entry := range []string{"entry1\n", "entry2\n", "entry3\n", "entry4\n"} {
+				_, err := writer.Write([]byte(entry))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Expect(readFile(path)).To(Equal("entry4\n"))
+			Expect(readFile(path + ".1")).To(Equal("entry3\n"))
+			Expect(readFile(path + ".2")).To(Equal("entry2\n"))
+
+			_, err := os.Stat(path + ".3")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("does not rotate again file that was already rotated by another writer", func() {
+			writer1 := NewLogFileWriter(path, 10, 2, fs)
+			defer writer1.Close()
+
+			writer2 := NewLogFileWriter(path, 10, 2, fs)
+			defer writer2.Close()
+
+			_, err := writer1.Write([]byte("entry1\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = writer2.Write([]byte("xx\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			// Rotates file that includes entries from both writers
+			_, err = writer1.Write([]byte("entry2\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			// Second writer still thinks that file is full
+			_, err = writer2.Write([]byte("yy\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile(path)).To(Equal("entry2\nyy\n"))
+			Expect(readFile(path + ".1")).To(Equal("entry1\nxx\n"))
+
+			_, err = os.Stat(path + ".2")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("writes entry larger than max size without rotating empty file", func() {
+			writer := NewLogFileWriter(path, 5, 2, fs)
+			defer writer.Close()
+
+			_, err := writer.Write([]byte("long-entry\n"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(readFile(path)).To(Equal("long-entry\n"))
+
+			_, err = os.Stat(path + ".1")
+			Expect(os.IsNotExist(err)).To(BeTrue())
+		})
+
+		It("returns error if file cannot be opened", func() {
+			writer := NewLogFileWriter(filepath.Join(tmpDir, "missing-dir", "cpi.log"), 10, 2, fs)
+
+			_, err := writer.Write([]byte("entry\n"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Opening log file"))
+		})
+	})
+})
@@ -0,0 +1,51 @@
+package util
+
+import (
+	"io"
+	"regexp"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+)
+
+// Matches header of entries formatted by boshlog.Logger, e.g. '[tag] 2014/01/01 00:00:00 DEBUG - '
+var logEntryHeaderRegexp = regexp.MustCompile(`\A\[[^\]]*\] \d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} (DEBUG|INFO|WARN|ERROR) - `)
+
+var logEntryLevels = map[string]boshlog.LogLevel{
+	"DEBUG": boshlog.LevelDebug,
+	"INFO":  boshlog.LevelInfo,
+	"WARN":  boshlog.LevelWarn,
+	"ERROR": boshlog.LevelError,
+}
+
+// LogLevelWriter only passes through log entries at or above a level.
+// It allows single logger to write to multiple destinations at different levels.
+// boshlog.Logger does not expose entry level before formatting
+// hence it is taken from the entry header.
+type LogLevelWriter struct {
+	w     io.Writer
+	level boshlog.LogLevel
+}
+
+func NewLogLevelWriter(w io.Writer, level boshlog.LogLevel) LogLevelWriter {
+	return LogLevelWriter{w: w, level: level}
+}
+
+func (w LogLevelWriter) Write(b []byte) (int, error) {
+	if LogEntryLevel(b) < w.level {
+		return len(b), nil
+	}
+
+	return w.w.Write(b)
+}
+
+// LogEntryLevel determines level of a log entry formatted by boshlog.Logger
+// from its header so that message contents never affect it.
+// Unrecognized entries are errors so that they are never filtered out.
+func LogEntryLevel(b []byte) boshlog.LogLevel {
+	matches := logEntryHeaderRegexp.FindSubmatch(b)
+	if matches == nil {
+		return boshlog.LevelError
+	}
+
+	return logEntryLevels[string(matches[1])]
+}
@@ -0,0 +1,75 @@
+package util_test
+
+import (
+	"bytes"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+var _ = Describe("LogLevelWriter", func() {
+	var (
+		buf    *bytes.Buffer
+		writer LogLevelWriter
+	)
+
+	BeforeEach(func() {
+		buf = &bytes.Buffer{}
+		writer = NewLogLevelWriter(buf, boshlog.LevelInfo)
+	})
+
+	It("passes through entries at or above level", func() {
+		logger := boshlog.NewWriterLogger(boshlog.LevelDebug, writer, writer)
+
+		logger.Info("fake-tag", "fake-info-msg")
+		logger.Error("fake-tag", "fake-error-msg")
+
+		Expect(buf.String()).To(ContainSubstring("INFO - fake-info-msg"))
+		Expect(buf.String()).To(ContainSubstring("ERROR - fake-error-msg"))
+	})
+
+	It("drops entries below level reporting them as written", func() {
+		entry := []byte("[fake-tag] 2014/01/01 00:00:00 DEBUG - fake-msg\n")
+
+		n, err := writer.Write(entry)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(entry)))
+
+		Expect(buf.String()).To(BeEmpty())
+	})
+
+	It("drops multi-line debug entries that mention other levels in their details", func() {
+		logger := boshlog.NewWriterLogger(boshlog.LevelDebug, writer, writer)
+
+		logger.DebugWithDetails("fake-tag", "fake-msg", "fake-details ERROR - fake-error")
+
+		Expect(buf.String()).To(BeEmpty())
+	})
+
+	It("passes through entries that are not formatted by logger", func() {
+		_, err := writer.Write([]byte("fake-unformatted DEBUG - fake-msg\n"))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(buf.String()).To(Equal("fake-unformatted DEBUG - fake-msg\n"))
+	})
+})
+
+var _ = Describe("LogEntryLevel", func() {
+	It("returns level from entry header", func() {
+		Expect(LogEntryLevel([]byte("[fake-tag] 2014/01/01 00:00:00 DEBUG - fake-msg"))).To(Equal(boshlog.LevelDebug))
+		Expect(LogEntryLevel([]byte("[fake-tag] 2014/01/01 00:00:00 INFO - fake-msg"))).To(Equal(boshlog.LevelInfo))
+		Expect(LogEntryLevel([]byte("[fake-tag] 2014/01/01 00:00:00 WARN - fake-msg"))).To(Equal(boshlog.LevelWarn))
+		Expect(LogEntryLevel([]byte("[fake-tag] 2014/01/01 00:00:00 ERROR - fake-msg"))).To(Equal(boshlog.LevelError))
+	})
+
+	It("ignores levels mentioned in message", func() {
+		Expect(LogEntryLevel([]byte("[fake-tag] 2014/01/01 00:00:00 INFO - fake DEBUG - msg"))).To(Equal(boshlog.LevelInfo))
+	})
+
+	It("returns error level for unrecognized entries", func() {
+		Expect(LogEntryLevel([]byte("fake-entry DEBUG - fake-msg"))).To(Equal(boshlog.LevelError))
+	})
+})
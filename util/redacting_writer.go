@@ -0,0 +1,26 @@
+package util
+
+import (
+	"io"
+)
+
+// RedactingWriter masks secrets in log entries before passing them on
+// so that entries logged by vendored packages (e.g. written file contents
+// or command output) do not leak secrets either.
+type RedactingWriter struct {
+	w io.Writer
+}
+
+func NewRedactingWriter(w io.Writer) RedactingWriter {
+	return RedactingWriter{w: w}
+}
+
+func (w RedactingWriter) Write(b []byte) (int, error) {
+	// Single write keeps entries from concurrent requests from interleaving
+	_, err := w.w.Write([]byte(RedactText(string(b))))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
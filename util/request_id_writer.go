@@ -0,0 +1,36 @@
+package util
+
+import (
+	"io"
+)
+
+// RequestIDWriter prefixes every log entry with a request id.
+// Logger writes each entry (including multi-line details) with a single Write.
+type RequestIDWriter struct {
+	w      io.Writer
+	prefix []byte
+}
+
+func NewRequestIDWriter(w io.Writer, requestID string) RequestIDWriter {
+	var prefix []byte
+
+	if len(requestID) > 0 {
+		prefix = []byte("[req:" + requestID + "] ")
+	}
+
+	return RequestIDWriter{w: w, prefix: prefix}
+}
+
+func (w RequestIDWriter) Write(b []byte) (int, error) {
+	if len(w.prefix) == 0 {
+		return w.w.Write(b)
+	}
+
+	// Single write keeps entries from concurrent requests from interleaving
+	_, err := w.w.Write(append(append([]byte{}, w.prefix...), b...))
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
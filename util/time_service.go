@@ -0,0 +1,15 @@
+package util
+
+import (
+	"time"
+)
+
+type TimeService interface {
+	Now() time.Time
+}
+
+type RealTimeService struct{}
+
+func (s RealTimeService) Now() time.Time {
+	return time.Now()
+}
@@ -1,7 +1,15 @@
 package vm
 
+import (
+	"context"
+)
+
 type AgentEnvService interface {
 	// Fetch will return an error if Update was not called beforehand
-	Fetch() (AgentEnv, error)
-	Update(AgentEnv) error
+	Fetch(context.Context) (AgentEnv, error)
+	Update(context.Context, AgentEnv) error
+
+	// Delete removes agent env that is stored outside of the container;
+	// deleting agent env that does not exist is not an error
+	Delete(context.Context) error
 }
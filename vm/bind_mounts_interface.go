@@ -1,5 +1,9 @@
 package vm
 
+import (
+	"context"
+)
+
 type GuestBindMounts interface {
 	MakeEphemeral() string
 	MakePersistent() string
@@ -11,8 +15,8 @@ type HostBindMounts interface {
 	DeleteEphemeral(id string) error
 
 	MakePersistent(id string) (string, error)
-	DeletePersistent(id string) error
+	DeletePersistent(ctx context.Context, id string) error
 
 	MountPersistent(id, diskID, diskPath string) error
-	UnmountPersistent(id, diskID string) error
+	UnmountPersistent(ctx context.Context, id, diskID string) error
 }
@@ -0,0 +1,174 @@
+package vm
+
+import (
+	"context"
+	"io"
+
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+const cancellableWardenClientLogTag = "CancellableWardenClient"
+
+// CancellableWardenClient stops waiting for Garden calls once ctx is done
+// so that a hung Garden server does not block request indefinitely.
+// Results of calls that finish after ctx is done are cleaned up
+// (e.g. containers are destroyed) since nobody is going to use them.
+type CancellableWardenClient struct {
+	client wrdn.Client
+	logger boshlog.Logger
+}
+
+func NewCancellableWardenClient(client wrdn.Client, logger boshlog.Logger) CancellableWardenClient {
+	return CancellableWardenClient{client: client, logger: logger}
+}
+
+func (c CancellableWardenClient) Create(ctx context.Context, spec wrdn.ContainerSpec) (WardenContainer, error) {
+	var container wrdn.Container
+
+	create := func() (err error) {
+		container, err = c.client.Create(spec)
+		return
+	}
+
+	// Container created after request is cancelled would not be tracked by anyone
+	destroy := func() {
+		c.logger.Warn(cancellableWardenClientLogTag,
+			"Destroying container '%s' created after request was cancelled", container.Handle())
+
+		err := c.client.Destroy(container.Handle())
+		if err != nil {
+			c.logger.Error(cancellableWardenClientLogTag,
+				"Failed destroying container '%s': %s", container.Handle(), err.Error())
+		}
+	}
+
+	err := bwcutil.RunCancellableWithCleanup(ctx, "Garden 'Create' call", create, destroy)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.wrapContainer(container), nil
+}
+
+func (c CancellableWardenClient) Destroy(ctx context.Context, handle string) error {
+	return c.run(ctx, "Destroy", func() error { return c.client.Destroy(handle) })
+}
+
+func (c CancellableWardenClient) Containers(ctx context.Context, properties wrdn.Properties) ([]WardenContainer, error) {
+	var containers []wrdn.Container
+
+	err := c.run(ctx, "Containers", func() (err error) {
+		containers, err = c.client.Containers(properties)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedContainers := []WardenContainer{}
+
+	for _, container := range containers {
+		wrappedContainers = append(wrappedContainers, c.wrapContainer(container))
+	}
+
+	return wrappedContainers, nil
+}
+
+func (c CancellableWardenClient) wrapContainer(container wrdn.Container) WardenContainer {
+	return cancellableContainer{container: container, logger: c.logger}
+}
+
+func (c CancellableWardenClient) run(ctx context.Context, call string, fn func() error) error {
+	return bwcutil.RunCancellable(ctx, "Garden '"+call+"' call", fn)
+}
+
+type cancellableContainer struct {
+	container wrdn.Container
+	logger    boshlog.Logger
+}
+
+func (c cancellableContainer) Handle() string { return c.container.Handle() }
+
+func (c cancellableContainer) Info(ctx context.Context) (wrdn.ContainerInfo, error) {
+	var info wrdn.ContainerInfo
+
+	err := c.run(ctx, "Info", func() (err error) {
+		info, err = c.container.Info()
+		return
+	})
+
+	if err != nil {
+		return wrdn.ContainerInfo{}, err
+	}
+
+	return info, nil
+}
+
+func (c cancellableContainer) StreamIn(ctx context.Context, dstPath string, tarStream io.Reader) error {
+	return c.run(ctx, "StreamIn", func() error { return c.container.StreamIn(dstPath, tarStream) })
+}
+
+func (c cancellableContainer) StreamOut(ctx context.Context, srcPath string) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+
+	streamOut := func() (err error) {
+		reader, err = c.container.StreamOut(srcPath)
+		return
+	}
+
+	// Otherwise connection to Garden would stay open
+	closeReader := func() {
+		err := reader.Close()
+		if err != nil {
+			c.logger.Error(cancellableWardenClientLogTag,
+				"Failed closing stream out of '%s' after request was cancelled: %s", srcPath, err.Error())
+		}
+	}
+
+	err := bwcutil.RunCancellableWithCleanup(ctx, "Garden 'StreamOut' call", streamOut, closeReader)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func (c cancellableContainer) Run(ctx context.Context, spec wrdn.ProcessSpec, processIO wrdn.ProcessIO) (WardenProcess, error) {
+	var process wrdn.Process
+
+	err := c.run(ctx, "Run", func() (err error) {
+		process, err = c.container.Run(spec, processIO)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cancellableProcess{process: process}, nil
+}
+
+func (c cancellableContainer) run(ctx context.Context, call string, fn func() error) error {
+	return bwcutil.RunCancellable(ctx, "Garden '"+call+"' call", fn)
+}
+
+type cancellableProcess struct {
+	process wrdn.Process
+}
+
+func (p cancellableProcess) Wait(ctx context.Context) (int, error) {
+	var exitStatus int
+
+	err := bwcutil.RunCancellable(ctx, "Garden process to exit", func() (err error) {
+		exitStatus, err = p.process.Wait()
+		return
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return exitStatus, nil
+}
@@ -0,0 +1,280 @@
+package vm_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
+	fakewrdn "github.com/cloudfoundry-incubator/garden/warden/fakes"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("CancellableWardenClient", func() {
+	var (
+		wardenClient *fakewrdnclient.FakeClient
+		ctx          context.Context
+		cancel       context.CancelFunc
+		release      chan struct{}
+		client       CancellableWardenClient
+	)
+
+	BeforeEach(func() {
+		wardenClient = fakewrdnclient.New()
+		ctx, cancel = context.WithCancel(context.Background())
+		release = make(chan struct{})
+		client = NewCancellableWardenClient(wardenClient, boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	AfterEach(func() {
+		// Let Garden calls that are still blocked finish
+		close(release)
+		cancel()
+	})
+
+	Describe("Create", func() {
+		It("returns created container when call finishes", func() {
+			wardenClient.Connection.CreateReturns("fake-handle", nil)
+
+			container, err := client.Create(ctx, wrdn.ContainerSpec{Handle: "fake-handle"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(container.Handle()).To(Equal("fake-handle"))
+
+			Expect(wardenClient.Connection.CreateArgsForCall(0)).To(Equal(wrdn.ContainerSpec{Handle: "fake-handle"}))
+		})
+
+		It("returns error if call fails", func() {
+			wardenClient.Connection.CreateReturns("", errors.New("fake-create-err"))
+
+			_, err := client.Create(ctx, wrdn.ContainerSpec{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("fake-create-err"))
+		})
+
+		It("stops waiting for call once context is done", func() {
+			cancelAndBlock := newCancelAndBlock(cancel, release)
+			wardenClient.Connection.CreateStub = func(wrdn.ContainerSpec) (string, error) {
+				cancelAndBlock()
+				return "", errors.New("fake-create-err")
+			}
+
+			_, err := client.Create(ctx, wrdn.ContainerSpec{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Waiting for Garden 'Create' call: context canceled"))
+		})
+
+		It("destroys container that is created after context is done", func() {
+			created := make(chan struct{})
+			wardenClient.Connection.CreateStub = func(wrdn.ContainerSpec) (string, error) {
+				cancel()
+				<-created
+				return "fake-handle", nil
+			}
+
+			_, err := client.Create(ctx, wrdn.ContainerSpec{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Waiting for Garden 'Create' call: context canceled"))
+
+			Expect(wardenClient.Connection.DestroyCallCount()).To(Equal(0))
+
+			close(created)
+
+			Eventually(wardenClient.Connection.DestroyCallCount).Should(Equal(1))
+			Expect(wardenClient.Connection.DestroyArgsForCall(0)).To(Equal("fake-handle"))
+		})
+
+		It("does not destroy container if create fails after context is done", func() {
+			created := make(chan struct{})
+			wardenClient.Connection.CreateStub = func(wrdn.ContainerSpec) (string, error) {
+				defer close(created)
+				cancel()
+				return "", errors.New("fake-create-err")
+			}
+
+			_, err := client.Create(ctx, wrdn.ContainerSpec{})
+			Expect(err).To(HaveOccurred())
+
+			<-created
+			Consistently(wardenClient.Connection.DestroyCallCount).Should(Equal(0))
+		})
+
+		It("does not start call if context is already done", func() {
+			cancel()
+
+			_, err := client.Create(ctx, wrdn.ContainerSpec{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Not starting Garden 'Create' call: context canceled"))
+
+			Expect(wardenClient.Connection.CreateCallCount()).To(Equal(0))
+		})
+	})
+
+	Describe("Containers", func() {
+		It("returns containers whose calls stop once context is done", func() {
+			wardenClient.Connection.ListReturns([]string{"fake-handle1", "fake-handle2"}, nil)
+
+			containers, err := client.Containers(ctx, wrdn.Properties{"fake-key": "fake-value"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(containers).To(HaveLen(2))
+			Expect(containers[0].Handle()).To(Equal("fake-handle1"))
+			Expect(containers[1].Handle()).To(Equal("fake-handle2"))
+
+			Expect(wardenClient.Connection.ListArgsForCall(0)).To(Equal(wrdn.Properties{"fake-key": "fake-value"}))
+
+			cancelAndBlock := newCancelAndBlock(cancel, release)
+			wardenClient.Connection.InfoStub = func(string) (wrdn.ContainerInfo, error) {
+				cancelAndBlock()
+				return wrdn.ContainerInfo{}, nil
+			}
+
+			_, err = containers[0].Info(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Waiting for Garden 'Info' call: context canceled"))
+		})
+
+		It("uses context passed to each call", func() {
+			wardenClient.Connection.ListReturns([]string{"fake-handle"}, nil)
+
+			containers, err := client.Containers(ctx, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			cancel()
+
+			_, err = containers[0].Info(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Not starting Garden 'Info' call: context canceled"))
+
+			_, err = containers[0].Info(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if call fails", func() {
+			wardenClient.Connection.ListReturns(nil, errors.New("fake-list-err"))
+
+			_, err := client.Containers(ctx, nil)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("fake-list-err"))
+		})
+	})
+
+	Describe("Destroy", func() {
+		It("stops waiting for call once context is done", func() {
+			cancelAndBlock := newCancelAndBlock(cancel, release)
+			wardenClient.Connection.DestroyStub = func(string) error {
+				cancelAndBlock()
+				return nil
+			}
+
+			err := client.Destroy(ctx, "fake-handle")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Waiting for Garden 'Destroy' call: context canceled"))
+		})
+	})
+
+	Describe("container StreamOut", func() {
+		var (
+			container WardenContainer
+		)
+
+		BeforeEach(func() {
+			wardenClient.Connection.ListReturns([]string{"fake-handle"}, nil)
+
+			containers, err := client.Containers(ctx, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			container = containers[0]
+		})
+
+		It("returns stream when call finishes", func() {
+			wardenClient.Connection.StreamOutReturns(ioutil.NopCloser(bytes.NewBufferString("fake-contents")), nil)
+
+			reader, err := container.StreamOut(ctx, "/fake-path")
+			Expect(err).ToNot(HaveOccurred())
+
+			contents, err := ioutil.ReadAll(reader)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(contents)).To(Equal("fake-contents"))
+		})
+
+		It("closes stream that is opened after context is done", func() {
+			reader := &closeRecordingReader{}
+
+			opened := make(chan struct{})
+			wardenClient.Connection.StreamOutStub = func(string, string) (io.ReadCloser, error) {
+				cancel()
+				<-opened
+				return reader, nil
+			}
+
+			_, err := container.StreamOut(ctx, "/fake-path")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Waiting for Garden 'StreamOut' call: context canceled"))
+
+			close(opened)
+
+			Eventually(reader.Closed).Should(BeTrue())
+		})
+	})
+
+	Describe("container Run", func() {
+		It("returns process that stops waiting for it to exit once context is done", func() {
+			wardenClient.Connection.ListReturns([]string{"fake-handle"}, nil)
+
+			process := &fakewrdn.FakeProcess{}
+			cancelAndBlock := newCancelAndBlock(cancel, release)
+			process.WaitStub = func() (int, error) {
+				cancelAndBlock()
+				return 0, nil
+			}
+
+			wardenClient.Connection.RunReturns(process, nil)
+
+			containers, err := client.Containers(ctx, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			runProcess, err := containers[0].Run(ctx, wrdn.ProcessSpec{Path: "fake-path"}, wrdn.ProcessIO{})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = runProcess.Wait(ctx)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Waiting for Garden process to exit: context canceled"))
+		})
+	})
+})
+
+// newCancelAndBlock simulates Garden call that hangs until test is finished;
+// it does not refer to variables that are reassigned by the next test
+func newCancelAndBlock(cancel context.CancelFunc, release chan struct{}) func() {
+	return func() {
+		cancel()
+		<-release
+	}
+}
+
+type closeRecordingReader struct {
+	closed bool
+	lock   sync.Mutex
+}
+
+func (r *closeRecordingReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (r *closeRecordingReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *closeRecordingReader) Closed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+	"strings"
+	"syscall"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+// CmdMounter shells out to mount, umount and losetup;
+// errnos are inferred from command output
+type CmdMounter struct {
+	cmdRunner boshsys.CmdRunner
+	logger    boshlog.Logger
+}
+
+func NewCmdMounter(cmdRunner boshsys.CmdRunner, logger boshlog.Logger) CmdMounter {
+	return CmdMounter{cmdRunner: cmdRunner, logger: logger}
+}
+
+func (m CmdMounter) BindMount(srcPath, dstPath string) error {
+	return m.run("mount", dstPath, "mount", "--bind", srcPath, dstPath)
+}
+
+func (m CmdMounter) MakeUnbindable(path string) error {
+	return m.run("mount", path, "mount", "--make-unbindable", path)
+}
+
+func (m CmdMounter) MakeShared(path string) error {
+	return m.run("mount", path, "mount", "--make-shared", path)
+}
+
+// MountLoop relies on mount to set up loop device with autoclear
+func (m CmdMounter) MountLoop(filePath, mountPoint string) error {
+	return m.run("mount", mountPoint, "mount", filePath, mountPoint, "-o", "loop")
+}
+
+func (m CmdMounter) Unmount(mountPoint string) error {
+	return m.run("umount", mountPoint, "umount", mountPoint)
+}
+
+func (m CmdMounter) LazyUnmount(mountPoint string) error {
+	return m.run("umount", mountPoint, "umount", "-l", mountPoint)
+}
+
+// LoopDevices parses `losetup --list --raw` output, e.g. `/dev/loop0 /var/vcap/store/disks/disk-1`
+func (m CmdMounter) LoopDevices() ([]LoopDevice, error) {
+	stdout, _, _, err := m.cmdRunner.RunCommand("losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE")
+	if err != nil {
+		return nil, MountError{Op: "losetup", Path: "", Err: err}
+	}
+
+	var devices []LoopDevice
+
+	for _, line := range strings.Split(stdout, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		devices = append(devices, LoopDevice{
+			Path:        parts[0],
+			BackingFile: m.unescape(parts[1]),
+		})
+	}
+
+	return devices, nil
+}
+
+func (m CmdMounter) DetachLoop(devicePath string) error {
+	return m.run("losetup", devicePath, "losetup", "--detach", devicePath)
+}
+
+func (m CmdMounter) run(op, path, cmdName string, args ...string) error {
+	_, stderr, _, err := m.cmdRunner.RunCommand(cmdName, args...)
+	if err != nil {
+		return MountError{Op: op, Path: path, Err: err, Errno: m.errno(stderr + err.Error())}
+	}
+
+	return nil
+}
+
+// errno infers errno from messages printed by util-linux commands
+func (m CmdMounter) errno(output string) syscall.Errno {
+	switch {
+	case strings.Contains(output, "not mounted"):
+		return syscall.EINVAL
+	case strings.Contains(output, "busy"):
+		return syscall.EBUSY
+	case strings.Contains(output, "No such file or directory"):
+		return syscall.ENOENT
+	default:
+		return 0
+	}
+}
+
+// unescape decodes \x20 style escapes used by losetup raw output
+func (m CmdMounter) unescape(s string) string {
+	return strings.Replace(s, `\x20`, " ", -1)
+}
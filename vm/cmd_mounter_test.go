@@ -0,0 +1,123 @@
+package vm_test
+
+import (
+	"errors"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("CmdMounter", func() {
+	var (
+		cmdRunner *fakesys.FakeCmdRunner
+		mounter   CmdMounter
+	)
+
+	BeforeEach(func() {
+		cmdRunner = fakesys.NewFakeCmdRunner()
+		mounter = NewCmdMounter(cmdRunner, boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	Describe("MountLoop", func() {
+		It("mounts file via loop device", func() {
+			err := mounter.MountLoop("/fake-disk", "/fake-mount-point")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cmdRunner.RunCommands).To(Equal([][]string{
+				[]string{"mount", "/fake-disk", "/fake-mount-point", "-o", "loop"},
+			}))
+		})
+
+		It("returns error if mounting fails", func() {
+			cmdRunner.AddCmdResult(
+				"mount /fake-disk /fake-mount-point -o loop",
+				fakesys.FakeCmdResult{Error: errors.New("fake-run-err")},
+			)
+
+			err := mounter.MountLoop("/fake-disk", "/fake-mount-point")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+		})
+	})
+
+	Describe("Unmount", func() {
+		It("returns not mounted error if path is not mounted", func() {
+			cmdRunner.AddCmdResult(
+				"umount /fake-mount-point",
+				fakesys.FakeCmdResult{Error: errors.New("umount: /fake-mount-point: not mounted")},
+			)
+
+			err := mounter.Unmount("/fake-mount-point")
+			Expect(err).To(HaveOccurred())
+			Expect(IsNotMounted(err)).To(BeTrue())
+			Expect(IsBusy(err)).To(BeFalse())
+		})
+
+		It("returns busy error if target is busy", func() {
+			cmdRunner.AddCmdResult(
+				"umount /fake-mount-point",
+				fakesys.FakeCmdResult{Error: errors.New("umount: /fake-mount-point: target is busy.")},
+			)
+
+			err := mounter.Unmount("/fake-mount-point")
+			Expect(err).To(HaveOccurred())
+			Expect(IsBusy(err)).To(BeTrue())
+			Expect(IsNotMounted(err)).To(BeFalse())
+		})
+
+		It("returns other errors as is", func() {
+			cmdRunner.AddCmdResult(
+				"umount /fake-mount-point",
+				fakesys.FakeCmdResult{Error: errors.New("fake-run-err")},
+			)
+
+			err := mounter.Unmount("/fake-mount-point")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+			Expect(IsNotMounted(err)).To(BeFalse())
+			Expect(IsBusy(err)).To(BeFalse())
+		})
+	})
+
+	Describe("LoopDevices", func() {
+		It("returns loop devices with their backing files", func() {
+			cmdRunner.AddCmdResult(
+				"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+				fakesys.FakeCmdResult{Stdout: "/dev/loop0 /fake-disks/disk-1\n/dev/loop1 /fake-disks/disk\\x202\n"},
+			)
+
+			devices, err := mounter.LoopDevices()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices).To(Equal([]LoopDevice{
+				{Path: "/dev/loop0", BackingFile: "/fake-disks/disk-1"},
+				{Path: "/dev/loop1", BackingFile: "/fake-disks/disk 2"},
+			}))
+		})
+
+		It("returns error if listing fails", func() {
+			cmdRunner.AddCmdResult(
+				"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+				fakesys.FakeCmdResult{Error: errors.New("fake-run-err")},
+			)
+
+			_, err := mounter.LoopDevices()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+		})
+	})
+
+	Describe("DetachLoop", func() {
+		It("detaches loop device", func() {
+			err := mounter.DetachLoop("/dev/loop0")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cmdRunner.RunCommands).To(Equal([][]string{
+				[]string{"losetup", "--detach", "/dev/loop0"},
+			}))
+		})
+	})
+})
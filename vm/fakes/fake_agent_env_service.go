@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
@@ -11,14 +13,22 @@ type FakeAgentEnvService struct {
 
 	UpdateAgentEnv bwcvm.AgentEnv
 	UpdateErr      error
+
+	DeleteCalled bool
+	DeleteErr    error
 }
 
-func (s *FakeAgentEnvService) Fetch() (bwcvm.AgentEnv, error) {
+func (s *FakeAgentEnvService) Fetch(_ context.Context) (bwcvm.AgentEnv, error) {
 	s.FetchCalled = true
 	return s.FetchAgentEnv, s.FetchErr
 }
 
-func (s *FakeAgentEnvService) Update(agentEnv bwcvm.AgentEnv) error {
+func (s *FakeAgentEnvService) Update(_ context.Context, agentEnv bwcvm.AgentEnv) error {
 	s.UpdateAgentEnv = agentEnv
 	return s.UpdateErr
 }
+
+func (s *FakeAgentEnvService) Delete(_ context.Context) error {
+	s.DeleteCalled = true
+	return s.DeleteErr
+}
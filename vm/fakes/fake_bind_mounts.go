@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	"path/filepath"
 )
 
@@ -64,7 +66,7 @@ func (hbm *FakeHostBindMounts) MakePersistent(id string) (string, error) {
 	return hbm.MakePersistentPath, hbm.MakePersistentErr
 }
 
-func (hbm *FakeHostBindMounts) DeletePersistent(id string) error {
+func (hbm *FakeHostBindMounts) DeletePersistent(_ context.Context, id string) error {
 	hbm.DeletePersistentCalled = true
 	hbm.DeletePersistentID = id
 	return hbm.DeletePersistentErr
@@ -77,7 +79,7 @@ func (hbm *FakeHostBindMounts) MountPersistent(id, diskID, diskPath string) erro
 	return hbm.MountPersistentErr
 }
 
-func (hbm *FakeHostBindMounts) UnmountPersistent(id, diskID string) error {
+func (hbm *FakeHostBindMounts) UnmountPersistent(_ context.Context, id, diskID string) error {
 	hbm.UnmountPersistentID = id
 	hbm.UnmountPersistentDiskID = diskID
 	return hbm.UnmountPersistentErr
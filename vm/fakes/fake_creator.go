@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
@@ -11,13 +13,14 @@ type FakeCreator struct {
 	CreateNetworks    bwcvm.Networks
 	CreateEnvironment bwcvm.Environment
 	CreateVM          bwcvm.VM
+	CreateVMNetworks  bwcvm.Networks
 	CreateErr         error
 }
 
-func (c *FakeCreator) Create(agentID string, stemcell bwcstem.Stemcell, networks bwcvm.Networks, env bwcvm.Environment) (bwcvm.VM, error) {
+func (c *FakeCreator) Create(_ context.Context, agentID string, stemcell bwcstem.Stemcell, networks bwcvm.Networks, env bwcvm.Environment) (bwcvm.VM, bwcvm.Networks, error) {
 	c.CreateAgentID = agentID
 	c.CreateStemcell = stemcell
 	c.CreateNetworks = networks
 	c.CreateEnvironment = env
-	return c.CreateVM, c.CreateErr
+	return c.CreateVM, c.CreateVMNetworks, c.CreateErr
 }
@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
@@ -11,7 +13,7 @@ type FakeFinder struct {
 	FindErr   error
 }
 
-func (f *FakeFinder) Find(id string) (bwcvm.VM, bool, error) {
+func (f *FakeFinder) Find(_ context.Context, id string) (bwcvm.VM, bool, error) {
 	f.FindID = id
 	return f.FindVM, f.FindFound, f.FindErr
 }
@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
@@ -14,7 +16,7 @@ func NewFakeMetadataService() *FakeMetadataService {
 	return &FakeMetadataService{}
 }
 
-func (ms *FakeMetadataService) Save(wardenFileService bwcvm.WardenFileService, instanceID string) error {
+func (ms *FakeMetadataService) Save(_ context.Context, wardenFileService bwcvm.WardenFileService, instanceID string) error {
 	ms.Saved = true
 	ms.SaveInstanceID = instanceID
 
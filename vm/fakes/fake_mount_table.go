@@ -0,0 +1,47 @@
+package fakes
+
+import (
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+type FakeMountTable struct {
+	// Consecutive calls return consecutive results; last result is repeated
+	MountsResults []bwcvm.Mounts
+	MountsErr     error
+
+	MountsCallCount int
+}
+
+func NewFakeMountTable() *FakeMountTable {
+	return &FakeMountTable{}
+}
+
+// SetMounts makes all calls to Mounts return given mounts
+func (t *FakeMountTable) SetMounts(mounts ...bwcvm.Mount) {
+	t.MountsResults = []bwcvm.Mounts{mounts}
+}
+
+// AddMountsResult appends result returned by the next call to Mounts
+func (t *FakeMountTable) AddMountsResult(mounts ...bwcvm.Mount) {
+	t.MountsResults = append(t.MountsResults, mounts)
+}
+
+func (t *FakeMountTable) Mounts() (bwcvm.Mounts, error) {
+	t.MountsCallCount++
+
+	if t.MountsErr != nil {
+		return nil, t.MountsErr
+	}
+
+	if len(t.MountsResults) == 0 {
+		return nil, nil
+	}
+
+	idx := t.MountsCallCount - 1
+
+	if idx >= len(t.MountsResults) {
+		idx = len(t.MountsResults) - 1
+	}
+
+	return t.MountsResults[idx], nil
+}
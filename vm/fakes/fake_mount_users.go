@@ -0,0 +1,22 @@
+package fakes
+
+import (
+	bwcvm "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+type FakeMountUsers struct {
+	FindMount  bwcvm.Mount
+	FindUsers  []bwcvm.MountUser
+	FindErr    error
+	FindCalled bool
+}
+
+func NewFakeMountUsers() *FakeMountUsers {
+	return &FakeMountUsers{}
+}
+
+func (u *FakeMountUsers) Find(mount bwcvm.Mount) ([]bwcvm.MountUser, error) {
+	u.FindCalled = true
+	u.FindMount = mount
+	return u.FindUsers, u.FindErr
+}
@@ -1,6 +1,8 @@
 package fakes
 
 import (
+	"context"
+
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
 )
 
@@ -10,8 +12,9 @@ type FakeVM struct {
 	DeleteCalled bool
 	DeleteErr    error
 
-	AttachDiskDisk bwcdisk.Disk
-	AttachDiskErr  error
+	AttachDiskDisk     bwcdisk.Disk
+	AttachDiskDiskHint string
+	AttachDiskErr      error
 
 	DetachDiskDisk bwcdisk.Disk
 	DetachDiskErr  error
@@ -23,17 +26,17 @@ func NewFakeVM(id string) *FakeVM {
 
 func (vm FakeVM) ID() string { return vm.id }
 
-func (vm *FakeVM) Delete() error {
+func (vm *FakeVM) Delete(_ context.Context) error {
 	vm.DeleteCalled = true
 	return vm.DeleteErr
 }
 
-func (vm *FakeVM) AttachDisk(disk bwcdisk.Disk) error {
+func (vm *FakeVM) AttachDisk(_ context.Context, disk bwcdisk.Disk) (string, error) {
 	vm.AttachDiskDisk = disk
-	return vm.AttachDiskErr
+	return vm.AttachDiskDiskHint, vm.AttachDiskErr
 }
 
-func (vm *FakeVM) DetachDisk(disk bwcdisk.Disk) error {
+func (vm *FakeVM) DetachDisk(_ context.Context, disk bwcdisk.Disk) error {
 	vm.DetachDiskDisk = disk
 	return vm.DetachDiskErr
 }
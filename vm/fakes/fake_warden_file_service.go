@@ -1,5 +1,9 @@
 package fakes
 
+import (
+	"context"
+)
+
 type FakeWardenFileService struct {
 	UploadInputs []UploadInput
 	UploadErr    error
@@ -20,7 +24,7 @@ func NewFakeWardenFileService() *FakeWardenFileService {
 	}
 }
 
-func (s *FakeWardenFileService) Upload(destinationPath string, contents []byte) error {
+func (s *FakeWardenFileService) Upload(_ context.Context, destinationPath string, contents []byte) error {
 	s.UploadInputs = append(s.UploadInputs, UploadInput{
 		DestinationPath: destinationPath,
 		Contents:        contents,
@@ -29,7 +33,7 @@ func (s *FakeWardenFileService) Upload(destinationPath string, contents []byte)
 	return s.UploadErr
 }
 
-func (s *FakeWardenFileService) Download(sourcePath string) ([]byte, error) {
+func (s *FakeWardenFileService) Download(_ context.Context, sourcePath string) ([]byte, error) {
 	s.DownloadSourcePath = sourcePath
 
 	return s.DownloadContents, s.DownloadErr
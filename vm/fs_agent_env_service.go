@@ -1,10 +1,13 @@
 package vm
 
 import (
+	"context"
 	"encoding/json"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 type fsAgentEnvService struct {
@@ -26,10 +29,10 @@ func NewFSAgentEnvService(
 	}
 }
 
-func (s fsAgentEnvService) Fetch() (AgentEnv, error) {
+func (s fsAgentEnvService) Fetch(ctx context.Context) (AgentEnv, error) {
 	var agentEnv AgentEnv
 
-	contents, err := s.wardenFileService.Download(s.settingsPath)
+	contents, err := s.wardenFileService.Download(ctx, s.settingsPath)
 	if err != nil {
 		return AgentEnv{}, bosherr.WrapError(err, "Downloading agent env from container")
 	}
@@ -39,18 +42,23 @@ func (s fsAgentEnvService) Fetch() (AgentEnv, error) {
 		return AgentEnv{}, bosherr.WrapError(err, "Unmarshalling agent env")
 	}
 
-	s.logger.Debug(s.logTag, "Fetched agent env: %#v", agentEnv)
+	s.logger.Debug(s.logTag, "Fetched agent env: %s", bwcutil.Redact(agentEnv))
 
 	return agentEnv, nil
 }
 
-func (s fsAgentEnvService) Update(agentEnv AgentEnv) error {
-	s.logger.Debug(s.logTag, "Updating agent env: %#v", agentEnv)
+func (s fsAgentEnvService) Update(ctx context.Context, agentEnv AgentEnv) error {
+	s.logger.Debug(s.logTag, "Updating agent env: %s", bwcutil.Redact(agentEnv))
 
 	jsonBytes, err := json.Marshal(agentEnv)
 	if err != nil {
 		return bosherr.WrapError(err, "Marshalling agent env")
 	}
 
-	return s.wardenFileService.Upload(s.settingsPath, jsonBytes)
+	return s.wardenFileService.Upload(ctx, s.settingsPath, jsonBytes)
+}
+
+func (s fsAgentEnvService) Delete(_ context.Context) error {
+	// Agent env is stored in the container hence it is removed together with the container
+	return nil
 }
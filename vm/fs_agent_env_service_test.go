@@ -1,6 +1,8 @@
 package vm_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 
@@ -16,12 +18,14 @@ import (
 var _ = Describe("WardenAgentEnvService", func() {
 	var (
 		fakeWardenFileService *fakebwcvm.FakeWardenFileService
+		logOut                *bytes.Buffer
 		agentEnvService       AgentEnvService
 	)
 
 	BeforeEach(func() {
 		fakeWardenFileService = fakebwcvm.NewFakeWardenFileService()
-		logger := boshlog.NewLogger(boshlog.LevelNone)
+		logOut = bytes.NewBufferString("")
+		logger := boshlog.NewWriterLogger(boshlog.LevelDebug, logOut, logOut)
 		agentEnvService = NewFSAgentEnvService(fakeWardenFileService, logger)
 	})
 
@@ -35,20 +39,32 @@ var _ = Describe("WardenAgentEnvService", func() {
 
 			fakeWardenFileService.DownloadContents = downloadAgentEnvBytes
 
-			agentEnv, err := agentEnvService.Fetch()
+			agentEnv, err := agentEnvService.Fetch(context.Background())
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(agentEnv).To(Equal(expectedAgentEnv))
 			Expect(fakeWardenFileService.DownloadSourcePath).To(Equal("/var/vcap/bosh/warden-cpi-agent-env.json"))
 		})
 
+		It("logs fetched agent env without secrets", func() {
+			downloadAgentEnvBytes, err := json.Marshal(NewAgentEnvWithSecrets())
+			Expect(err).ToNot(HaveOccurred())
+
+			fakeWardenFileService.DownloadContents = downloadAgentEnvBytes
+
+			_, err = agentEnvService.Fetch(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+
+			ExpectAgentEnvSecretsRedacted(logOut.String())
+		})
+
 		Context("when container fails to stream out because agent env cannot be deserialized", func() {
 			BeforeEach(func() {
 				fakeWardenFileService.DownloadContents = []byte("invalid-json")
 			})
 
 			It("returns error", func() {
-				agentEnv, err := agentEnvService.Fetch()
+				agentEnv, err := agentEnvService.Fetch(context.Background())
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("Unmarshalling agent env"))
 				Expect(agentEnv).To(Equal(AgentEnv{}))
@@ -61,7 +77,7 @@ var _ = Describe("WardenAgentEnvService", func() {
 			})
 
 			It("returns error", func() {
-				agentEnv, err := agentEnvService.Fetch()
+				agentEnv, err := agentEnvService.Fetch(context.Background())
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-download-error"))
 				Expect(agentEnv).To(Equal(AgentEnv{}))
@@ -85,18 +101,25 @@ var _ = Describe("WardenAgentEnvService", func() {
 		})
 
 		It("uploads file contents to the warden container", func() {
-			err := agentEnvService.Update(newAgentEnv)
+			err := agentEnvService.Update(context.Background(), newAgentEnv)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(fakeWardenFileService.UploadInputs[0].Contents).To(Equal(expectedAgentEnvBytes))
 		})
 
+		It("logs agent env without secrets", func() {
+			err := agentEnvService.Update(context.Background(), NewAgentEnvWithSecrets())
+			Expect(err).ToNot(HaveOccurred())
+
+			ExpectAgentEnvSecretsRedacted(logOut.String())
+		})
+
 		Context("when container fails to stream in because agent env cannot be serialized", func() {
 			BeforeEach(func() {
 				newAgentEnv.Env = EnvSpec{"fake-net-name": NonJSONMarshable{}} // cheating!
 			})
 
 			It("returns error", func() {
-				err := agentEnvService.Update(newAgentEnv)
+				err := agentEnvService.Update(context.Background(), newAgentEnv)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-marshal-err"))
 			})
@@ -108,7 +131,7 @@ var _ = Describe("WardenAgentEnvService", func() {
 			})
 
 			It("returns error", func() {
-				err := agentEnvService.Update(newAgentEnv)
+				err := agentEnvService.Update(context.Background(), newAgentEnv)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-upload-error"))
 			})
@@ -1,10 +1,11 @@
 package vm
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
@@ -13,6 +14,8 @@ import (
 	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
+const fsHostBindMountsLogTag = "FSHostBindMounts"
+
 // FSHostBindMounts represents bind mounts from the perspective of the host
 type FSHostBindMounts struct {
 	// Directory with sub-directories at which ephemeral disks are mounted
@@ -21,10 +24,14 @@ type FSHostBindMounts struct {
 	// Directory with sub-directories at which ephemeral disks are mounted
 	persistentBindMountsDir string
 
-	sleeper   bwcutil.Sleeper
-	fs        boshsys.FileSystem
-	cmdRunner boshsys.CmdRunner
-	logger    boshlog.Logger
+	sleeper    bwcutil.Sleeper
+	fs         boshsys.FileSystem
+	mounter    Mounter
+	mountTable MountTable
+	mountUsers MountUsers
+	logger     boshlog.Logger
+
+	unmountRetry UnmountRetryPolicy
 }
 
 func NewFSHostBindMounts(
@@ -32,17 +39,24 @@ func NewFSHostBindMounts(
 	persistentBindMountsDir string,
 	sleeper bwcutil.Sleeper,
 	fs boshsys.FileSystem,
-	cmdRunner boshsys.CmdRunner,
+	mounter Mounter,
+	mountTable MountTable,
+	mountUsers MountUsers,
+	unmountRetry UnmountRetryPolicy,
 	logger boshlog.Logger,
 ) FSHostBindMounts {
 	return FSHostBindMounts{
 		ephemeralBindMountsDir:  ephemeralBindMountsDir,
 		persistentBindMountsDir: persistentBindMountsDir,
 
-		sleeper:   sleeper,
-		fs:        fs,
-		cmdRunner: cmdRunner,
-		logger:    logger,
+		sleeper:    sleeper,
+		fs:         fs,
+		mounter:    mounter,
+		mountTable: mountTable,
+		mountUsers: mountUsers,
+		logger:     logger,
+
+		unmountRetry: unmountRetry,
 	}
 }
 
@@ -76,46 +90,82 @@ func (hbm FSHostBindMounts) MakePersistent(id string) (string, error) {
 		return "", bosherr.WrapError(err, "Making persistent bind mounts")
 	}
 
-	mountArgss := [][]string{
-		[]string{"--bind", path, path},
-
-		// An unbindable mount is a private mount which cannot be cloned through a bind operation.
-		[]string{"--make-unbindable", path},
-
-		// A shared mount provides ability to create mirrors of that mount such that mounts and
-		// umounts within any of the mirrors propagate to the other mirror.
-		[]string{"--make-shared", path},
+	mounts, err := hbm.mountTable.Mounts()
+	if err != nil {
+		return "", bosherr.WrapError(err, "Checking persistent bind mounts")
 	}
 
-	for _, mountArgs := range mountArgss {
-		_, _, _, err = hbm.cmdRunner.RunCommand("mount", mountArgs...)
+	// Bind mounting again (e.g. when retrying) would stack another mount on top
+	if _, found := mounts.Find(path); !found {
+		err = hbm.mounter.BindMount(path, path)
 		if err != nil {
 			return "", err
 		}
 	}
 
+	// An unbindable mount is a private mount which cannot be cloned through a bind operation.
+	err = hbm.mounter.MakeUnbindable(path)
+	if err != nil {
+		return "", err
+	}
+
+	// A shared mount provides ability to create mirrors of that mount such that mounts and
+	// umounts within any of the mirrors propagate to the other mirror.
+	err = hbm.mounter.MakeShared(path)
+	if err != nil {
+		return "", err
+	}
+
+	err = hbm.verifySharedMount(path)
+	if err != nil {
+		return "", err
+	}
+
 	return path, nil
 }
 
-func (hbm FSHostBindMounts) DeletePersistent(id string) error {
+// verifySharedMount makes sure that disks mounted later propagate into the container
+func (hbm FSHostBindMounts) verifySharedMount(path string) error {
+	mounts, err := hbm.mountTable.Mounts()
+	if err != nil {
+		return bosherr.WrapError(err, "Checking persistent bind mounts")
+	}
+
+	mount, found := mounts.Find(path)
+	if !found {
+		return bosherr.New("Expected persistent bind mounts '%s' to be mounted", path)
+	}
+
+	if !mount.IsShared() {
+		return bosherr.New("Expected persistent bind mounts '%s' to be a shared mount but found '%s'",
+			path, strings.Join(mount.Propagation, " "))
+	}
+
+	return nil
+}
+
+func (hbm FSHostBindMounts) DeletePersistent(ctx context.Context, id string) error {
 	path := filepath.Join(hbm.persistentBindMountsDir, id)
 
 	if hbm.fs.FileExists(path) {
-		mountedDiskPaths, err := hbm.fs.Glob(filepath.Join(path, "*"))
+		mounts, err := hbm.mountTable.Mounts()
 		if err != nil {
 			return bosherr.WrapError(err, "Getting mounted disk paths in '%s'", path)
 		}
 
-		for _, mountedDiskPath := range mountedDiskPaths {
-			err := hbm.unmountPath(mountedDiskPath)
+		// Later mounts may be mounted on top of earlier ones so they are unmounted first
+		mountedDisks := mounts.Under(path)
+
+		for i := len(mountedDisks) - 1; i >= 0; i-- {
+			err := hbm.unmountPath(ctx, mountedDisks[i].MountPoint)
 			if err != nil {
-				return bosherr.WrapError(err, "Unmounting persistent disk '%s'", mountedDiskPath)
+				return bosherr.WrapError(err, "Unmounting persistent disk '%s'", mountedDisks[i].MountPoint)
 			}
 		}
 
-		_, _, _, err = hbm.cmdRunner.RunCommand("umount", path)
-		if err != nil && !strings.Contains(err.Error(), "not mounted") {
-			return err
+		err = hbm.unmountPath(ctx, path)
+		if err != nil {
+			return bosherr.WrapError(err, "Unmounting persistent bind mounts '%s'", path)
 		}
 
 		err = hbm.fs.RemoveAll(path)
@@ -135,7 +185,31 @@ func (hbm FSHostBindMounts) MountPersistent(id, diskID, diskPath string) error {
 		return bosherr.WrapError(err, "Making disk specific persistent bind mount")
 	}
 
-	_, _, _, err = hbm.cmdRunner.RunCommand("mount", diskPath, path, "-o", "loop")
+	mounts, err := hbm.mountTable.Mounts()
+	if err != nil {
+		return bosherr.WrapError(err, "Checking disk specific persistent bind mount")
+	}
+
+	// Mounting again would attach another loop device to the same disk
+	if _, found := mounts.Find(path); found {
+		hbm.logger.Debug(fsHostBindMountsLogTag, "Disk specific persistent bind mount '%s' is already mounted", path)
+		return nil
+	}
+
+	// Lazily unmounted disk stays attached to a loop device until processes stop using it;
+	// mounting it again would use two file systems on the same disk
+	loopDevice, found, err := hbm.findLoopDevice(func(d LoopDevice) bool {
+		return filepath.Clean(d.BackingFile) == filepath.Clean(diskPath)
+	})
+	if err != nil {
+		return bosherr.WrapError(err, "Checking loop devices of disk '%s'", diskPath)
+	}
+
+	if found {
+		return bosherr.New("Expected disk '%s' to not be in use but it is attached to loop device '%s'", diskPath, loopDevice.Path)
+	}
+
+	err = hbm.mounter.MountLoop(diskPath, path)
 	if err != nil {
 		return bosherr.WrapError(err, "Mounting disk specific persistent bind mount")
 	}
@@ -143,35 +217,136 @@ func (hbm FSHostBindMounts) MountPersistent(id, diskID, diskPath string) error {
 	return nil
 }
 
-func (hbm FSHostBindMounts) UnmountPersistent(id, diskID string) error {
+func (hbm FSHostBindMounts) UnmountPersistent(ctx context.Context, id, diskID string) error {
 	path := filepath.Join(hbm.persistentBindMountsDir, id, diskID)
-	return hbm.unmountPath(path)
+	return hbm.unmountPath(ctx, path)
 }
 
-func (hbm FSHostBindMounts) unmountPath(path string) error {
+// unmountPath retries unmounting according to retry policy since disks stay busy
+// while processes in the container are shutting down; it stops retrying once ctx is done
+func (hbm FSHostBindMounts) unmountPath(ctx context.Context, path string) error {
+	var lastMount Mount
 	var lastErr error
 
-	for i := 0; i < 60; i++ {
-		// Check for all mounts on the host
-		stdout, _, _, err := hbm.cmdRunner.RunCommand("mount")
+	backoff := hbm.unmountRetry.Backoff
+
+	for i := 0; i < hbm.unmountRetry.Attempts; i++ {
+		if i > 0 {
+			hbm.sleeper.Sleep(backoff)
+			backoff = hbm.unmountRetry.NextBackoff(backoff)
+		}
+
+		err := ctx.Err()
+		if err != nil {
+			return bosherr.WrapError(err, "Unmounting disk specific persistent bind mount '%s'", path)
+		}
+
+		mounts, err := hbm.mountTable.Mounts()
 		if err != nil {
 			return bosherr.WrapError(err, "Checking persistent bind mount")
 		}
 
-		// If output does not contain path it means that either
-		// it was never mounted or it was successfully unmounted
-		if !strings.Contains(stdout, path) {
+		// Either it was never mounted or it was successfully unmounted
+		mount, found := mounts.Find(path)
+		if !found {
 			return nil
 		}
 
 		// Try unmounting again; otherwise, try doing it later
-		_, _, _, lastErr = hbm.cmdRunner.RunCommand("umount", path)
+		lastMount, lastErr = mount, hbm.mounter.Unmount(path)
 		if lastErr == nil {
 			return nil
 		}
 
-		hbm.sleeper.Sleep(3 * time.Second)
+		// Someone else unmounted it since mount table was read
+		if IsNotMounted(lastErr) {
+			return nil
+		}
+	}
+
+	diagnostics := hbm.mountUsersDiagnostics(lastMount)
+
+	if hbm.unmountRetry.Lazy {
+		err := hbm.mounter.LazyUnmount(path)
+		if err != nil && !IsNotMounted(err) {
+			return bosherr.WrapError(err, "Lazily unmounting disk specific persistent bind mount '%s' (%s)", path, diagnostics)
+		}
+
+		hbm.logger.Warn(fsHostBindMountsLogTag, "Lazily unmounted '%s' which is still busy: %s", path, diagnostics)
+
+		// Disk is only unmounted once its loop device is released
+		err = hbm.waitForLoopDeviceRelease(ctx, lastMount.Source)
+		if err != nil {
+			return bosherr.WrapError(err, "Waiting for lazily unmounted disk specific persistent bind mount '%s' to be released (%s)", path, diagnostics)
+		}
+
+		return nil
+	}
+
+	return bosherr.WrapError(lastErr, "Unmounting disk specific persistent bind mount after %d attempts (%s)",
+		hbm.unmountRetry.Attempts, diagnostics)
+}
+
+// waitForLoopDeviceRelease retries according to retry policy since loop device
+// is only released once processes stop using lazily unmounted file system
+func (hbm FSHostBindMounts) waitForLoopDeviceRelease(ctx context.Context, devicePath string) error {
+	backoff := hbm.unmountRetry.Backoff
+
+	for i := 0; i < hbm.unmountRetry.Attempts; i++ {
+		if i > 0 {
+			hbm.sleeper.Sleep(backoff)
+			backoff = hbm.unmountRetry.NextBackoff(backoff)
+		}
+
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		_, found, err := hbm.findLoopDevice(func(d LoopDevice) bool { return d.Path == devicePath })
+		if err != nil {
+			return bosherr.WrapError(err, "Checking loop device '%s'", devicePath)
+		}
+
+		if !found {
+			return nil
+		}
+	}
+
+	return bosherr.New("Loop device '%s' is still in use after %d attempts", devicePath, hbm.unmountRetry.Attempts)
+}
+
+func (hbm FSHostBindMounts) findLoopDevice(matches func(LoopDevice) bool) (LoopDevice, bool, error) {
+	devices, err := hbm.mounter.LoopDevices()
+	if err != nil {
+		return LoopDevice{}, false, err
+	}
+
+	for _, device := range devices {
+		if matches(device) {
+			return device, true, nil
+		}
+	}
+
+	return LoopDevice{}, false, nil
+}
+
+// mountUsersDiagnostics describes processes keeping mount busy so that operators know what to stop
+func (hbm FSHostBindMounts) mountUsersDiagnostics(mount Mount) string {
+	users, err := hbm.mountUsers.Find(mount)
+	if err != nil {
+		return fmt.Sprintf("finding processes using mount failed: %s", err.Error())
+	}
+
+	if len(users) == 0 {
+		return "no processes found using mount"
+	}
+
+	var descs []string
+
+	for _, user := range users {
+		descs = append(descs, user.String())
 	}
 
-	return bosherr.WrapError(lastErr, "Unmounting disk specific persistent bind mount")
+	return "used by " + strings.Join(descs, "; ")
 }
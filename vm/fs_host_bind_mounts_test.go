@@ -1,6 +1,7 @@
 package vm_test
 
 import (
+	"context"
 	"errors"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 
 	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	. "github.com/cppforlife/bosh-warden-cpi/vm"
+	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 )
 
 var _ = Describe("FSHostBindMounts", func() {
@@ -18,6 +20,8 @@ var _ = Describe("FSHostBindMounts", func() {
 		sleeper        *bwcutil.RecordingNoopSleeper
 		fs             *fakesys.FakeFileSystem
 		cmdRunner      *fakesys.FakeCmdRunner
+		mountTable     *fakevm.FakeMountTable
+		mountUsers     *fakevm.FakeMountUsers
 		hostBindMounts FSHostBindMounts
 	)
 
@@ -25,6 +29,8 @@ var _ = Describe("FSHostBindMounts", func() {
 		sleeper = bwcutil.NewRecordingNoopSleeper()
 		fs = fakesys.NewFakeFileSystem()
 		cmdRunner = fakesys.NewFakeCmdRunner()
+		mountTable = fakevm.NewFakeMountTable()
+		mountUsers = fakevm.NewFakeMountUsers()
 		logger := boshlog.NewLogger(boshlog.LevelNone)
 
 		hostBindMounts = NewFSHostBindMounts(
@@ -32,11 +38,22 @@ var _ = Describe("FSHostBindMounts", func() {
 			"/fake-persistent-dir",
 			sleeper,
 			fs,
-			cmdRunner,
+			NewCmdMounter(cmdRunner, logger),
+			mountTable,
+			mountUsers,
+			UnmountRetryOptions{}.Policy(),
 			logger,
 		)
 	})
 
+	mountAt := func(path string) Mount {
+		return Mount{MountPoint: path, Propagation: []string{"master:1"}}
+	}
+
+	sharedMountAt := func(path string) Mount {
+		return Mount{MountPoint: path, Propagation: []string{"shared:1"}}
+	}
+
 	Describe("MakeEphemeral", func() {
 		It("creates directory for requested id", func() {
 			path, err := hostBindMounts.MakeEphemeral("fake-id")
@@ -79,6 +96,12 @@ var _ = Describe("FSHostBindMounts", func() {
 	})
 
 	Describe("MakePersistent", func() {
+		BeforeEach(func() {
+			// Not mounted before bind mounting; shared afterwards
+			mountTable.AddMountsResult()
+			mountTable.AddMountsResult(sharedMountAt("/fake-persistent-dir/fake-id"))
+		})
+
 		It("creates directory for requested id", func() {
 			path, err := hostBindMounts.MakePersistent("fake-id")
 			Expect(err).ToNot(HaveOccurred())
@@ -111,6 +134,56 @@ var _ = Describe("FSHostBindMounts", func() {
 				}))
 			})
 
+			It("does not bind mount again if directory is already a mount point", func() {
+				mountTable.SetMounts(sharedMountAt("/fake-persistent-dir/fake-id"))
+
+				_, err := hostBindMounts.MakePersistent("fake-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands).To(Equal([][]string{
+					[]string{"mount", "--make-unbindable", "/fake-persistent-dir/fake-id"},
+					[]string{"mount", "--make-shared", "/fake-persistent-dir/fake-id"},
+				}))
+			})
+
+			It("does not treat mount at a path with the same prefix as a mount point", func() {
+				mountTable.MountsResults[0] = Mounts{mountAt("/fake-persistent-dir/fake-id-2")}
+
+				_, err := hostBindMounts.MakePersistent("fake-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands[0]).To(Equal([]string{
+					"mount", "--bind", "/fake-persistent-dir/fake-id", "/fake-persistent-dir/fake-id"}))
+			})
+
+			It("returns error if checking mounts fails", func() {
+				mountTable.MountsErr = errors.New("fake-mounts-err")
+
+				_, err := hostBindMounts.MakePersistent("fake-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-mounts-err"))
+
+				Expect(cmdRunner.RunCommands).To(BeEmpty())
+			})
+
+			It("returns error if directory is not mounted after bind mounting", func() {
+				mountTable.SetMounts()
+
+				_, err := hostBindMounts.MakePersistent("fake-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(
+					"Expected persistent bind mounts '/fake-persistent-dir/fake-id' to be mounted"))
+			})
+
+			It("returns error if bind mount does not have shared propagation", func() {
+				mountTable.MountsResults[1] = Mounts{mountAt("/fake-persistent-dir/fake-id")}
+
+				_, err := hostBindMounts.MakePersistent("fake-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(Equal(
+					"Expected persistent bind mounts '/fake-persistent-dir/fake-id' to be a shared mount but found 'master:1'"))
+			})
+
 			Context("when making bind point shareable fails", func() {
 				It("returns error if --bind fails", func() {
 					cmdRunner.AddCmdResult(
@@ -174,56 +247,53 @@ var _ = Describe("FSHostBindMounts", func() {
 			)
 
 			BeforeEach(func() {
-				var err error
+				path = "/fake-persistent-dir/fake-id"
 
-				path, err = hostBindMounts.MakePersistent("fake-id")
+				err := fs.MkdirAll(path, 0755)
 				Expect(err).ToNot(HaveOccurred())
 
-				fs.SetGlob("/fake-persistent-dir/fake-id/*", []string{
-					"/fake-persistent-dir/fake-id/fake-disk-id-1",
-					"/fake-persistent-dir/fake-id/fake-disk-id-2",
-				})
-
-				cmdRunner.AddCmdResult(
-					"mount",
-					fakesys.FakeCmdResult{Stdout: "/fake-persistent-dir/fake-id/fake-disk-id-1\n/fake-persistent-dir/fake-id/fake-disk-id-2"},
-				)
-				cmdRunner.AddCmdResult(
-					"mount",
-					fakesys.FakeCmdResult{Stdout: "/fake-persistent-dir/fake-id/fake-disk-id-2"},
-				)
-
-				cmdRunner.RunCommands = [][]string{} // Reset cmd runner comamnds
+				allMounts := Mounts{
+					mountAt("/"),
+					sharedMountAt("/fake-persistent-dir/fake-id"),
+					mountAt("/fake-persistent-dir/fake-id/fake-disk-id-1"),
+					mountAt("/fake-persistent-dir/fake-id/fake-disk-id-2"),
+					mountAt("/fake-persistent-dir/fake-id-2/fake-disk-id-3"),
+				}
+
+				mountTable.MountsResults = []Mounts{
+					allMounts,     // listing mounts in directory
+					allMounts,     // before unmounting disk 2
+					allMounts[:3], // before unmounting disk 1
+					allMounts[:2], // before unmounting directory
+				}
 			})
 
 			It("unmounts all mount points in that directory and then directory itself", func() {
-				err := hostBindMounts.DeletePersistent("fake-id")
+				err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(cmdRunner.RunCommands).To(Equal([][]string{
-					[]string{"mount"},
-					[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id-1"},
-					[]string{"mount"},
 					[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id-2"},
+					[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id-1"},
 					[]string{"umount", "/fake-persistent-dir/fake-id"},
 				}))
 			})
 
 			Context("when getting mounted disk paths fails", func() {
 				BeforeEach(func() {
-					fs.GlobErr = errors.New("fake-glob-error")
+					mountTable.MountsErr = errors.New("fake-mounts-err")
 				})
 
 				It("returns an error", func() {
-					err := hostBindMounts.DeletePersistent("fake-id")
+					err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 					Expect(err).To(HaveOccurred())
-					Expect(err.Error()).To(ContainSubstring("fake-glob-error"))
+					Expect(err.Error()).To(ContainSubstring("fake-mounts-err"))
 				})
 			})
 
 			Context("when unmounting directory succeeds", func() {
 				It("deletes directory for requested id", func() {
-					err := hostBindMounts.DeletePersistent("fake-id")
+					err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 					Expect(err).ToNot(HaveOccurred())
 
 					Expect(fs.FileExists(path)).To(BeFalse())
@@ -232,44 +302,45 @@ var _ = Describe("FSHostBindMounts", func() {
 				It("returns error if deleting directory fails", func() {
 					fs.RemoveAllError = errors.New("fake-remove-all-err")
 
-					err := hostBindMounts.DeletePersistent("fake-id")
+					err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-remove-all-err"))
 				})
 			})
 
-			Context("when unmounting fails because it is not mounted", func() {
+			Context("when directory is not mounted", func() {
 				BeforeEach(func() {
-					cmdRunner.AddCmdResult(
-						"umount /fake-persistent-dir/fake-id",
-						fakesys.FakeCmdResult{Error: errors.New("not mounted")},
-					)
+					mountTable.SetMounts(mountAt("/"))
 				})
 
-				It("deletes directory for requested id", func() {
-					err := hostBindMounts.DeletePersistent("fake-id")
+				It("deletes directory without unmounting it", func() {
+					err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 					Expect(err).ToNot(HaveOccurred())
 
+					Expect(cmdRunner.RunCommands).To(BeEmpty())
 					Expect(fs.FileExists(path)).To(BeFalse())
 				})
 			})
 
 			Context("when unmounting directory fails", func() {
 				BeforeEach(func() {
+					// Directory stays mounted
+					mountTable.AddMountsResult(sharedMountAt("/fake-persistent-dir/fake-id"))
+
 					cmdRunner.AddCmdResult(
 						"umount /fake-persistent-dir/fake-id",
-						fakesys.FakeCmdResult{Error: errors.New("fake-run-err")},
+						fakesys.FakeCmdResult{Error: errors.New("fake-run-err"), Sticky: true},
 					)
 				})
 
 				It("returns error", func() {
-					err := hostBindMounts.DeletePersistent("fake-id")
+					err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-run-err"))
 				})
 
 				It("does not delete directory because unmounting failed", func() {
-					err := hostBindMounts.DeletePersistent("fake-id")
+					err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 					Expect(err).To(HaveOccurred())
 
 					Expect(fs.FileExists(path)).To(BeTrue())
@@ -279,12 +350,12 @@ var _ = Describe("FSHostBindMounts", func() {
 
 		Context("when directory for requested id does not exist", func() {
 			It("does not return error", func() {
-				err := hostBindMounts.DeletePersistent("fake-id")
+				err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 				Expect(err).ToNot(HaveOccurred())
 			})
 
 			It("does not unmount directory", func() {
-				err := hostBindMounts.DeletePersistent("fake-id")
+				err := hostBindMounts.DeletePersistent(context.Background(), "fake-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(cmdRunner.RunCommands).To(BeEmpty())
@@ -307,10 +378,55 @@ var _ = Describe("FSHostBindMounts", func() {
 				err := hostBindMounts.MountPersistent("fake-id", "fake-disk-id", "/fake-disk-path")
 				Expect(err).ToNot(HaveOccurred())
 
-				Expect(cmdRunner.RunCommands).To(HaveLen(1))
-				Expect(cmdRunner.RunCommands[0]).To(Equal(
+				Expect(cmdRunner.RunCommands).To(Equal([][]string{
+					[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"},
 					[]string{"mount", "/fake-disk-path", "/fake-persistent-dir/fake-id/fake-disk-id", "-o", "loop"},
-				))
+				}))
+			})
+
+			It("returns error without mounting if disk is still attached to a loop device (e.g. after lazy unmount)", func() {
+				cmdRunner.AddCmdResult(
+					"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+					fakesys.FakeCmdResult{Stdout: "/dev/loop0 /fake-other-disk-path\n/dev/loop1 /fake-disk-path\n"},
+				)
+
+				err := hostBindMounts.MountPersistent("fake-id", "fake-disk-id", "/fake-disk-path")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("attached to loop device '/dev/loop1'"))
+
+				Expect(cmdRunner.RunCommands).To(Equal([][]string{[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"}}))
+			})
+
+			It("returns error without mounting if listing loop devices fails", func() {
+				cmdRunner.AddCmdResult(
+					"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+					fakesys.FakeCmdResult{Error: errors.New("fake-losetup-err")},
+				)
+
+				err := hostBindMounts.MountPersistent("fake-id", "fake-disk-id", "/fake-disk-path")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-losetup-err"))
+
+				Expect(cmdRunner.RunCommands).To(Equal([][]string{[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"}}))
+			})
+
+			It("does not mount disk path again if it is already mounted", func() {
+				mountTable.SetMounts(mountAt("/fake-persistent-dir/fake-id/fake-disk-id"))
+
+				err := hostBindMounts.MountPersistent("fake-id", "fake-disk-id", "/fake-disk-path")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands).To(BeEmpty())
+			})
+
+			It("returns error if checking mounts fails", func() {
+				mountTable.MountsErr = errors.New("fake-mounts-err")
+
+				err := hostBindMounts.MountPersistent("fake-id", "fake-disk-id", "/fake-disk-path")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-mounts-err"))
+
+				Expect(cmdRunner.RunCommands).To(BeEmpty())
 			})
 
 			Context("when mounting fails", func() {
@@ -347,54 +463,51 @@ var _ = Describe("FSHostBindMounts", func() {
 	})
 
 	Describe("UnmountPersistent", func() {
+		diskMount := mountAt("/fake-persistent-dir/fake-id/fake-disk-id")
+
 		It("unmounts disk path if disk path is mounted", func() {
-			cmdRunner.AddCmdResult("mount", fakesys.FakeCmdResult{
-				Stdout: `/dev/sda1 on / type ext4 (rw)
-/fake-persistent-dir/fake-id/fake-disk-id on /fake-disk-path type none (rw,bind)`,
-			})
+			mountTable.SetMounts(mountAt("/"), diskMount)
 
-			err := hostBindMounts.UnmountPersistent("fake-id", "fake-disk-id")
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
 			Expect(err).ToNot(HaveOccurred())
 
-			Expect(cmdRunner.RunCommands).To(HaveLen(2))
 			Expect(cmdRunner.RunCommands).To(Equal([][]string{
-				[]string{"mount"},
 				[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id"},
 			}))
 		})
 
 		It("does not try to unmount disk path if it is not mounted", func() {
-			cmdRunner.AddCmdResult("mount", fakesys.FakeCmdResult{
-				Stdout: "/dev/sda1 on / type ext4 (rw)",
-			})
+			mountTable.SetMounts(mountAt("/"))
 
-			err := hostBindMounts.UnmountPersistent("fake-id", "fake-disk-id")
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
 			Expect(err).ToNot(HaveOccurred())
 
-			Expect(cmdRunner.RunCommands).To(HaveLen(1))
-			Expect(cmdRunner.RunCommands[0]).To(Equal([]string{"mount"}))
+			Expect(cmdRunner.RunCommands).To(BeEmpty())
+		})
+
+		It("does not treat mount of another disk with the same prefix as disk path being mounted", func() {
+			mountTable.SetMounts(mountAt("/fake-persistent-dir/fake-id/fake-disk-id-10"))
+
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cmdRunner.RunCommands).To(BeEmpty())
 		})
 
 		It("returns error if checking mount information fails", func() {
-			cmdRunner.AddCmdResult("mount", fakesys.FakeCmdResult{
-				Error: errors.New("fake-run-err"),
-			})
+			mountTable.MountsErr = errors.New("fake-mounts-err")
 
-			err := hostBindMounts.UnmountPersistent("fake-id", "fake-disk-id")
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
 			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+			Expect(err.Error()).To(ContainSubstring("fake-mounts-err"))
 
-			// Does not try to unmount or run mount command again
-			Expect(cmdRunner.RunCommands).To(HaveLen(1))
-			Expect(cmdRunner.RunCommands[0]).To(Equal([]string{"mount"}))
+			// Does not try to unmount or check mounts again
+			Expect(cmdRunner.RunCommands).To(BeEmpty())
+			Expect(mountTable.MountsCallCount).To(Equal(1))
 		})
 
 		It("tries to unmount disk path up to 60 times", func() {
-			for i := 0; i < 60; i++ {
-				cmdRunner.AddCmdResult("mount", fakesys.FakeCmdResult{
-					Stdout: "/fake-persistent-dir/fake-id/fake-disk-id",
-				})
-			}
+			mountTable.SetMounts(diskMount)
 
 			for i := 0; i < 59; i++ {
 				cmdRunner.AddCmdResult(
@@ -409,17 +522,15 @@ var _ = Describe("FSHostBindMounts", func() {
 				fakesys.FakeCmdResult{},
 			)
 
-			err := hostBindMounts.UnmountPersistent("fake-id", "fake-disk-id")
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			// Mount check and unmount operations performed
-			Expect(cmdRunner.RunCommands).To(HaveLen(120))
+			Expect(mountTable.MountsCallCount).To(Equal(60))
+			Expect(cmdRunner.RunCommands).To(HaveLen(60))
 
-			for i := 0; i < 120; i += 2 {
-				Expect(cmdRunner.RunCommands[i]).To(Equal([]string{"mount"}))
-				Expect(cmdRunner.RunCommands[i+1]).To(Equal(
-					[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id"},
-				))
+			for _, cmd := range cmdRunner.RunCommands {
+				Expect(cmd).To(Equal([]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id"}))
 			}
 
 			// Times slept in between unmount operations
@@ -430,30 +541,242 @@ var _ = Describe("FSHostBindMounts", func() {
 			}
 		})
 
+		It("stops retrying to unmount disk path once it is no longer mounted", func() {
+			mountTable.MountsResults = []Mounts{{diskMount}, {}}
+
+			cmdRunner.AddCmdResult(
+				"umount /fake-persistent-dir/fake-id/fake-disk-id",
+				fakesys.FakeCmdResult{Error: errors.New("fake-run-err")},
+			)
+
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cmdRunner.RunCommands).To(HaveLen(1))
+			Expect(sleeper.SleptTimes()).To(HaveLen(1))
+		})
+
+		It("does not retry to unmount disk path if it was unmounted after checking mounts", func() {
+			mountTable.SetMounts(diskMount)
+
+			cmdRunner.AddCmdResult(
+				"umount /fake-persistent-dir/fake-id/fake-disk-id",
+				fakesys.FakeCmdResult{Error: errors.New("umount: /fake-persistent-dir/fake-id/fake-disk-id: not mounted")},
+			)
+
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(cmdRunner.RunCommands).To(HaveLen(1))
+			Expect(sleeper.SleptTimes()).To(BeEmpty())
+		})
+
+		It("stops retrying to unmount disk path once context is cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+
+			hostBindMounts = NewFSHostBindMounts(
+				"/fake-ephemeral-dir",
+				"/fake-persistent-dir",
+				cancellingSleeper{cancel: cancel},
+				fs,
+				NewCmdMounter(cmdRunner, boshlog.NewLogger(boshlog.LevelNone)),
+				mountTable,
+				mountUsers,
+				UnmountRetryOptions{}.Policy(),
+				boshlog.NewLogger(boshlog.LevelNone),
+			)
+
+			mountTable.SetMounts(diskMount)
+
+			cmdRunner.AddCmdResult(
+				"umount /fake-persistent-dir/fake-id/fake-disk-id",
+				fakesys.FakeCmdResult{Error: errors.New("fake-run-err"), Sticky: true},
+			)
+
+			err := hostBindMounts.UnmountPersistent(ctx, "fake-id", "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(
+				"Unmounting disk specific persistent bind mount '/fake-persistent-dir/fake-id/fake-disk-id': context canceled"))
+
+			Expect(cmdRunner.RunCommands).To(Equal([][]string{
+				[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id"},
+			}))
+		})
+
 		It("returns error if unmounting disk path fails at 60th time", func() {
-			for i := 0; i < 60; i++ {
-				cmdRunner.AddCmdResult("mount", fakesys.FakeCmdResult{
-					Stdout: "/fake-persistent-dir/fake-id/fake-disk-id",
-				})
+			mountTable.SetMounts(diskMount)
+
+			cmdRunner.AddCmdResult(
+				"umount /fake-persistent-dir/fake-id/fake-disk-id",
+				fakesys.FakeCmdResult{Error: errors.New("fake-run-err"), Sticky: true},
+			)
+
+			err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+
+			Expect(mountTable.MountsCallCount).To(Equal(60))
+			Expect(cmdRunner.RunCommands).To(HaveLen(60))
+		})
+
+		Context("when unmounting keeps failing", func() {
+			BeforeEach(func() {
+				mountTable.SetMounts(diskMount)
 
 				cmdRunner.AddCmdResult(
 					"umount /fake-persistent-dir/fake-id/fake-disk-id",
-					fakesys.FakeCmdResult{Error: errors.New("fake-run-err")},
+					fakesys.FakeCmdResult{Error: errors.New("fake-run-err"), Sticky: true},
+				)
+			})
+
+			newHostBindMounts := func(opts UnmountRetryOptions) FSHostBindMounts {
+				logger := boshlog.NewLogger(boshlog.LevelNone)
+
+				return NewFSHostBindMounts(
+					"/fake-ephemeral-dir",
+					"/fake-persistent-dir",
+					sleeper,
+					fs,
+					NewCmdMounter(cmdRunner, logger),
+					mountTable,
+					mountUsers,
+					opts.Policy(),
+					logger,
 				)
 			}
 
-			err := hostBindMounts.UnmountPersistent("fake-id", "fake-disk-id")
-			Expect(err).To(HaveOccurred())
-			Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+			It("retries according to configured attempts and backoff", func() {
+				hostBindMounts = newHostBindMounts(UnmountRetryOptions{
+					Attempts:      5,
+					Backoff:       "1s",
+					BackoffFactor: 2,
+					MaxBackoff:    "5s",
+				})
+
+				err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("after 5 attempts"))
+
+				Expect(cmdRunner.RunCommands).To(HaveLen(5))
+				Expect(sleeper.SleptTimes()).To(Equal([]time.Duration{
+					1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}))
+			})
+
+			It("includes processes using the mount in the error", func() {
+				hostBindMounts = newHostBindMounts(UnmountRetryOptions{Attempts: 1})
 
-			Expect(cmdRunner.RunCommands).To(HaveLen(120))
+				mountUsers.FindUsers = []MountUser{
+					{PID: 123, NSPID: 123, Command: "fake-host-cmd", Paths: []string{"/fake-persistent-dir/fake-id/fake-disk-id/file"}},
+					{PID: 456, NSPID: 7, Command: "fake-container-cmd", Paths: []string{"/warden-cpi-dev/fake-disk-id/a", "/warden-cpi-dev/fake-disk-id/b"}},
+				}
 
-			for i := 0; i < 120; i += 2 {
-				Expect(cmdRunner.RunCommands[i]).To(Equal([]string{"mount"}))
-				Expect(cmdRunner.RunCommands[i+1]).To(Equal(
+				err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring(
+					"used by pid 123 'fake-host-cmd' using /fake-persistent-dir/fake-id/fake-disk-id/file; " +
+						"pid 456 (container pid 7) 'fake-container-cmd' using /warden-cpi-dev/fake-disk-id/a, /warden-cpi-dev/fake-disk-id/b"))
+				Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+
+				Expect(mountUsers.FindMount).To(Equal(diskMount))
+			})
+
+			It("includes error finding processes using the mount in the error", func() {
+				hostBindMounts = newHostBindMounts(UnmountRetryOptions{Attempts: 1})
+
+				mountUsers.FindErr = errors.New("fake-find-err")
+
+				err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("finding processes using mount failed: fake-find-err"))
+				Expect(err.Error()).To(ContainSubstring("fake-run-err"))
+			})
+
+			It("lazily unmounts disk path once all attempts fail if configured", func() {
+				hostBindMounts = newHostBindMounts(UnmountRetryOptions{Attempts: 2, Lazy: true})
+
+				err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands).To(Equal([][]string{
 					[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id"},
-				))
-			}
+					[]string{"umount", "/fake-persistent-dir/fake-id/fake-disk-id"},
+					[]string{"umount", "-l", "/fake-persistent-dir/fake-id/fake-disk-id"},
+					[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"},
+				}))
+			})
+
+			Context("when disk is mounted from a loop device", func() {
+				BeforeEach(func() {
+					loopDiskMount := diskMount
+					loopDiskMount.Source = "/dev/loop1"
+					mountTable.SetMounts(loopDiskMount)
+				})
+
+				It("waits for loop device to be released after lazily unmounting", func() {
+					hostBindMounts = newHostBindMounts(UnmountRetryOptions{Attempts: 3, Backoff: "1s", Lazy: true})
+
+					cmdRunner.AddCmdResult(
+						"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+						fakesys.FakeCmdResult{Stdout: "/dev/loop1 /fake-disk-path\n"},
+					)
+					cmdRunner.AddCmdResult(
+						"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+						fakesys.FakeCmdResult{Stdout: "/dev/loop0 /fake-other-disk-path\n"},
+					)
+
+					err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(sleeper.SleptTimes()).To(ContainElement(1 * time.Second))
+					Expect(cmdRunner.RunCommands[3:]).To(Equal([][]string{
+						[]string{"umount", "-l", "/fake-persistent-dir/fake-id/fake-disk-id"},
+						[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"},
+						[]string{"losetup", "--list", "--raw", "--noheadings", "--output", "NAME,BACK-FILE"},
+					}))
+				})
+
+				It("returns error if loop device is not released so that disk is not mounted again", func() {
+					hostBindMounts = newHostBindMounts(UnmountRetryOptions{Attempts: 2, Lazy: true})
+
+					cmdRunner.AddCmdResult(
+						"losetup --list --raw --noheadings --output NAME,BACK-FILE",
+						fakesys.FakeCmdResult{Stdout: "/dev/loop1 /fake-disk-path\n", Sticky: true},
+					)
+
+					err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("Loop device '/dev/loop1' is still in use after 2 attempts"))
+				})
+			})
+
+			It("returns error if lazily unmounting fails", func() {
+				hostBindMounts = newHostBindMounts(UnmountRetryOptions{Attempts: 1, Lazy: true})
+
+				cmdRunner.AddCmdResult(
+					"umount -l /fake-persistent-dir/fake-id/fake-disk-id",
+					fakesys.FakeCmdResult{Error: errors.New("fake-lazy-err")},
+				)
+
+				err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Lazily unmounting"))
+				Expect(err.Error()).To(ContainSubstring("fake-lazy-err"))
+			})
+
+			It("does not lazily unmount disk path if not configured", func() {
+				err := hostBindMounts.UnmountPersistent(context.Background(), "fake-id", "fake-disk-id")
+				Expect(err).To(HaveOccurred())
+
+				Expect(cmdRunner.RunCommands).ToNot(ContainElement(
+					[]string{"umount", "-l", "/fake-persistent-dir/fake-id/fake-disk-id"}))
+			})
 		})
 	})
 })
+
+// cancellingSleeper cancels context instead of sleeping, as if request timed out while sleeping
+type cancellingSleeper struct {
+	cancel context.CancelFunc
+}
+
+func (s cancellingSleeper) Sleep(time.Duration) { s.cancel() }
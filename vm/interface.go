@@ -1,26 +1,30 @@
 package vm
 
 import (
+	"context"
+
 	bwcdisk "github.com/cppforlife/bosh-warden-cpi/disk"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
 )
 
 type Creator interface {
-	// Create takes an agent id and creates a VM with provided configuration
-	Create(string, bwcstem.Stemcell, Networks, Environment) (VM, error)
+	// Create takes an agent id and creates a VM with provided configuration.
+	// Returned networks include IPs resolved for dynamic networks.
+	Create(context.Context, string, bwcstem.Stemcell, Networks, Environment) (VM, Networks, error)
 }
 
 type Finder interface {
-	Find(string) (VM, bool, error)
+	Find(context.Context, string) (VM, bool, error)
 }
 
 type VM interface {
 	ID() string
 
-	Delete() error
+	Delete(context.Context) error
 
-	AttachDisk(bwcdisk.Disk) error
-	DetachDisk(bwcdisk.Disk) error
+	// AttachDisk returns disk hint, i.e. where disk can be found inside the VM
+	AttachDisk(context.Context, bwcdisk.Disk) (string, error)
+	DetachDisk(context.Context, bwcdisk.Disk) error
 }
 
 type Environment map[string]interface{}
@@ -1,6 +1,7 @@
 package vm
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 
@@ -18,7 +19,7 @@ type metadataService struct {
 }
 
 type MetadataService interface {
-	Save(WardenFileService, string) error
+	Save(context.Context, WardenFileService, string) error
 }
 
 func NewMetadataService(
@@ -48,7 +49,7 @@ type MetadataContentsType struct {
 	InstanceID string `json:"instance-id"`
 }
 
-func (ms *metadataService) Save(wardenFileService WardenFileService, instanceID string) error {
+func (ms *metadataService) Save(ctx context.Context, wardenFileService WardenFileService, instanceID string) error {
 	var endpoint string
 
 	if ms.agentEnvService == "registry" {
@@ -74,9 +75,9 @@ func (ms *metadataService) Save(wardenFileService WardenFileService, instanceID
 		return bosherr.WrapError(err, "Marshalling user data")
 	}
 
-	ms.logger.Debug(ms.logTag, "Saving user data %#v to %s", userDataContents, ms.userDataFilePath)
+	ms.logger.Debug(ms.logTag, "Saving user data %s to %s", string(jsonBytes), ms.userDataFilePath)
 
-	err = wardenFileService.Upload(ms.userDataFilePath, jsonBytes)
+	err = wardenFileService.Upload(ctx, ms.userDataFilePath, jsonBytes)
 	if err != nil {
 		return bosherr.WrapError(err, "Saving user data")
 	}
@@ -92,7 +93,7 @@ func (ms *metadataService) Save(wardenFileService WardenFileService, instanceID
 
 	ms.logger.Debug(ms.logTag, "Saving metadata %#v to %s", metadataContents, ms.metadataFilePath)
 
-	err = wardenFileService.Upload(ms.metadataFilePath, jsonBytes)
+	err = wardenFileService.Upload(ctx, ms.metadataFilePath, jsonBytes)
 	if err != nil {
 		return bosherr.WrapError(err, "Saving metadata")
 	}
@@ -1,6 +1,8 @@
 package vm_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 
@@ -10,6 +12,7 @@ import (
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	fakebwcvm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	. "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
@@ -18,6 +21,7 @@ var _ = Describe("MetadataService", func() {
 		metadataService       MetadataService
 		fakeWardenFileService *fakebwcvm.FakeWardenFileService
 		registryOptions       RegistryOptions
+		logOut                *bytes.Buffer
 		logger                boshlog.Logger
 	)
 
@@ -30,12 +34,15 @@ var _ = Describe("MetadataService", func() {
 				Username: "fake-registry-username",
 				Password: "fake-registry-password",
 			}
-			logger = boshlog.NewLogger(boshlog.LevelNone)
+			logOut = bytes.NewBufferString("")
+			// Secrets are masked by the writer like in production
+			redactingLogOut := bwcutil.NewRedactingWriter(logOut)
+			logger = boshlog.NewWriterLogger(boshlog.LevelDebug, redactingLogOut, redactingLogOut)
 		})
 
 		It("saves instance id to metadata", func() {
 			metadataService = NewMetadataService("registry", registryOptions, logger)
-			err := metadataService.Save(fakeWardenFileService, "fake-instance-id")
+			err := metadataService.Save(context.Background(), fakeWardenFileService, "fake-instance-id")
 			Expect(err).ToNot(HaveOccurred())
 
 			metadataContents := MetadataContentsType{
@@ -57,7 +64,7 @@ var _ = Describe("MetadataService", func() {
 			})
 
 			It("saves registry endpoint as URL to registry", func() {
-				err := metadataService.Save(fakeWardenFileService, "fake-instance-id")
+				err := metadataService.Save(context.Background(), fakeWardenFileService, "fake-instance-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				userDataContents := UserDataContentsType{
@@ -75,6 +82,15 @@ var _ = Describe("MetadataService", func() {
 					Contents:        expectedContents,
 				}))
 			})
+
+			It("logs registry endpoint without credentials", func() {
+				err := metadataService.Save(context.Background(), fakeWardenFileService, "fake-instance-id")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logOut.String()).To(ContainSubstring("http://<redacted>:<redacted>@fake-registry-host:1234"))
+				Expect(logOut.String()).ToNot(ContainSubstring("fake-registry-username"))
+				Expect(logOut.String()).ToNot(ContainSubstring("fake-registry-password"))
+			})
 		})
 
 		Context("when agent env service is file", func() {
@@ -83,7 +99,7 @@ var _ = Describe("MetadataService", func() {
 			})
 
 			It("saves registry endpoint as file path", func() {
-				err := metadataService.Save(fakeWardenFileService, "fake-instance-id")
+				err := metadataService.Save(context.Background(), fakeWardenFileService, "fake-instance-id")
 				Expect(err).ToNot(HaveOccurred())
 
 				userDataContents := UserDataContentsType{
@@ -107,7 +123,7 @@ var _ = Describe("MetadataService", func() {
 			})
 
 			It("returns an error", func() {
-				err := metadataService.Save(fakeWardenFileService, "fake-instance-id")
+				err := metadataService.Save(context.Background(), fakeWardenFileService, "fake-instance-id")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-upload-error"))
 			})
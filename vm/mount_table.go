@@ -0,0 +1,205 @@
+package vm
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+const procMountTableLogTag = "ProcMountTable"
+
+// Mount table of the CPI process; see proc(5) for the format
+const procMountInfoPath = "/proc/self/mountinfo"
+
+type MountTable interface {
+	// Mounts returns mounts in the order they appear in the mount table,
+	// i.e. a mount always comes after the mount it is mounted on
+	Mounts() (Mounts, error)
+}
+
+type Mount struct {
+	ID       int
+	ParentID int
+
+	// major:minor of device backing mounted filesystem, e.g. 7:0
+	Device string
+
+	// Path within mounted filesystem that is mounted, e.g. source directory of a bind mount
+	Root       string
+	MountPoint string
+
+	Options []string
+
+	// Optional fields, e.g. shared:1 or master:2
+	Propagation []string
+
+	FSType string
+	Source string
+}
+
+// IsShared returns true if mounts and unmounts under the mount point
+// propagate to its peers (e.g. bind mounts inside containers)
+func (m Mount) IsShared() bool {
+	for _, field := range m.Propagation {
+		if strings.HasPrefix(field, "shared:") {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Mounts []Mount
+
+// Find returns topmost mount at exactly given path
+func (ms Mounts) Find(path string) (Mount, bool) {
+	path = filepath.Clean(path)
+
+	for i := len(ms) - 1; i >= 0; i-- {
+		if ms[i].MountPoint == path {
+			return ms[i], true
+		}
+	}
+
+	return Mount{}, false
+}
+
+// Under returns mounts with mount points inside given directory,
+// not including mounts at directory itself
+func (ms Mounts) Under(dirPath string) Mounts {
+	prefix := filepath.Clean(dirPath) + "/"
+
+	var mounts Mounts
+
+	for _, m := range ms {
+		if strings.HasPrefix(m.MountPoint, prefix) {
+			mounts = append(mounts, m)
+		}
+	}
+
+	return mounts
+}
+
+// ProcMountTable reads mount table from /proc instead of parsing `mount` output
+// since /proc escapes paths and keeps mount point separate from other fields
+type ProcMountTable struct {
+	fs     boshsys.FileSystem
+	logger boshlog.Logger
+}
+
+func NewProcMountTable(fs boshsys.FileSystem, logger boshlog.Logger) ProcMountTable {
+	return ProcMountTable{fs: fs, logger: logger}
+}
+
+func (t ProcMountTable) Mounts() (Mounts, error) {
+	return t.mountsAt(procMountInfoPath)
+}
+
+// mountsAt reads mount table of any process, e.g. /proc/123/mountinfo
+// lists mounts in the mount namespace of a container process
+func (t ProcMountTable) mountsAt(path string) (Mounts, error) {
+	contents, err := t.fs.ReadFileString(path)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Reading mount table '%s'", path)
+	}
+
+	var mounts Mounts
+
+	for i, line := range strings.Split(contents, "\n") {
+		if len(line) == 0 {
+			continue
+		}
+
+		mount, err := t.parseLine(line)
+		if err != nil {
+			return nil, bosherr.WrapError(err, "Parsing mount table line %d", i+1)
+		}
+
+		mounts = append(mounts, mount)
+	}
+
+	t.logger.Debug(procMountTableLogTag, "Read %d mounts", len(mounts))
+
+	return mounts, nil
+}
+
+// parseLine parses a line such as:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// where optional fields (e.g. master:1) are terminated by a single hyphen
+func (t ProcMountTable) parseLine(line string) (Mount, error) {
+	fields := strings.Split(line, " ")
+
+	sepIdx := -1
+
+	for i := 6; i < len(fields); i++ {
+		if fields[i] == "-" {
+			sepIdx = i
+			break
+		}
+	}
+
+	if sepIdx < 0 || len(fields) < sepIdx+3 {
+		return Mount{}, bosherr.New("Expected mount info fields but found '%s'", line)
+	}
+
+	id, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return Mount{}, bosherr.WrapError(err, "Parsing mount ID")
+	}
+
+	parentID, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return Mount{}, bosherr.WrapError(err, "Parsing parent mount ID")
+	}
+
+	mount := Mount{
+		ID:       id,
+		ParentID: parentID,
+
+		Device: fields[2],
+
+		Root:       t.unescape(fields[3]),
+		MountPoint: t.unescape(fields[4]),
+
+		Options: strings.Split(fields[5], ","),
+
+		FSType: t.unescape(fields[sepIdx+1]),
+		Source: t.unescape(fields[sepIdx+2]),
+	}
+
+	if sepIdx > 6 {
+		mount.Propagation = fields[6:sepIdx]
+	}
+
+	return mount, nil
+}
+
+// unescape decodes octal escapes that kernel uses for
+// space, tab, newline and backslash in paths, e.g. \040
+func (t ProcMountTable) unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+
+	unescaped := make([]byte, 0, len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			unescaped = append(unescaped, (s[i+1]-'0')<<6|(s[i+2]-'0')<<3|(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+
+		unescaped = append(unescaped, s[i])
+	}
+
+	return string(unescaped)
+}
+
+func isOctal(c byte) bool { return c >= '0' && c <= '7' }
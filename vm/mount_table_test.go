@@ -0,0 +1,146 @@
+package vm_test
+
+import (
+	"errors"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("ProcMountTable", func() {
+	var (
+		fs         *fakesys.FakeFileSystem
+		mountTable ProcMountTable
+	)
+
+	BeforeEach(func() {
+		fs = fakesys.NewFakeFileSystem()
+		mountTable = NewProcMountTable(fs, boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	Describe("Mounts", func() {
+		It("parses mounts from /proc/self/mountinfo", func() {
+			fs.WriteFileString("/proc/self/mountinfo", ""+
+				"22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro\n"+
+				"36 22 8:1 /var/vcap/store/persistent/vm-1 /var/vcap/store/persistent/vm-1 rw,relatime shared:20 master:1 - ext4 /dev/sda1 rw\n"+
+				"40 36 7:0 / /var/vcap/store/persistent/vm-1/disk-1 rw,relatime - ext4 /dev/loop0 rw\n",
+			)
+
+			mounts, err := mountTable.Mounts()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mounts).To(Equal(Mounts{
+				{
+					ID:          22,
+					ParentID:    1,
+					Device:      "8:1",
+					Root:        "/",
+					MountPoint:  "/",
+					Options:     []string{"rw", "relatime"},
+					Propagation: []string{"shared:1"},
+					FSType:      "ext4",
+					Source:      "/dev/sda1",
+				},
+				{
+					ID:          36,
+					ParentID:    22,
+					Device:      "8:1",
+					Root:        "/var/vcap/store/persistent/vm-1",
+					MountPoint:  "/var/vcap/store/persistent/vm-1",
+					Options:     []string{"rw", "relatime"},
+					Propagation: []string{"shared:20", "master:1"},
+					FSType:      "ext4",
+					Source:      "/dev/sda1",
+				},
+				{
+					ID:         40,
+					ParentID:   36,
+					Device:     "7:0",
+					Root:       "/",
+					MountPoint: "/var/vcap/store/persistent/vm-1/disk-1",
+					Options:    []string{"rw", "relatime"},
+					FSType:     "ext4",
+					Source:     "/dev/loop0",
+				},
+			}))
+		})
+
+		It("unescapes spaces, tabs, newlines and backslashes in paths", func() {
+			fs.WriteFileString("/proc/self/mountinfo",
+				`40 36 7:0 / /mnt/with\040space\011tab\012newline\134backslash rw - ext4 /dev/loop0 rw`+"\n")
+
+			mounts, err := mountTable.Mounts()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mounts[0].MountPoint).To(Equal("/mnt/with space\ttab\nnewline\\backslash"))
+		})
+
+		It("returns error if reading mount table fails", func() {
+			fs.WriteFileString("/proc/self/mountinfo", "")
+			fs.ReadFileError = errors.New("fake-read-err")
+
+			_, err := mountTable.Mounts()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-read-err"))
+		})
+
+		It("returns error if line does not have optional fields separator", func() {
+			fs.WriteFileString("/proc/self/mountinfo", "22 1 8:1 / / rw,relatime shared:1 ext4 /dev/sda1 rw\n")
+
+			_, err := mountTable.Mounts()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing mount table line 1"))
+		})
+
+		It("returns error if mount ID is not a number", func() {
+			fs.WriteFileString("/proc/self/mountinfo", "x 1 8:1 / / rw - ext4 /dev/sda1 rw\n")
+
+			_, err := mountTable.Mounts()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing mount ID"))
+		})
+	})
+})
+
+var _ = Describe("Mounts", func() {
+	mounts := Mounts{
+		{MountPoint: "/"},
+		{MountPoint: "/persistent/vm-1", Propagation: []string{"shared:1"}},
+		{MountPoint: "/persistent/vm-1/disk-1"},
+		{MountPoint: "/persistent/vm-1/disk-10"},
+		{MountPoint: "/persistent/vm-10/disk-2"},
+		{MountPoint: "/persistent/vm-1", Propagation: []string{"shared:2"}},
+	}
+
+	Describe("Find", func() {
+		It("finds topmost mount at exactly given path", func() {
+			mount, found := mounts.Find("/persistent/vm-1/")
+			Expect(found).To(BeTrue())
+			Expect(mount.Propagation).To(Equal([]string{"shared:2"}))
+		})
+
+		It("does not find mounts at paths that only share a prefix", func() {
+			_, found := mounts.Find("/persistent/vm-1/disk")
+			Expect(found).To(BeFalse())
+		})
+	})
+
+	Describe("Under", func() {
+		It("returns mounts inside directory excluding directory itself", func() {
+			Expect(mounts.Under("/persistent/vm-1")).To(Equal(Mounts{
+				{MountPoint: "/persistent/vm-1/disk-1"},
+				{MountPoint: "/persistent/vm-1/disk-10"},
+			}))
+		})
+	})
+
+	Describe("IsShared", func() {
+		It("returns true only if mount has shared peer group", func() {
+			Expect(Mount{Propagation: []string{"master:1", "shared:3"}}.IsShared()).To(BeTrue())
+			Expect(Mount{Propagation: []string{"master:1"}}.IsShared()).To(BeFalse())
+			Expect(Mount{}.IsShared()).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,216 @@
+package vm
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+const procMountUsersLogTag = "ProcMountUsers"
+
+// MountUsers finds processes that keep mount busy
+type MountUsers interface {
+	Find(mount Mount) ([]MountUser, error)
+}
+
+type MountUser struct {
+	PID int
+
+	// PID in the innermost PID namespace, e.g. inside container;
+	// same as PID for host processes
+	NSPID int
+
+	Command string
+
+	// Open files, working directory or root directory on the mount
+	Paths []string
+}
+
+func (u MountUser) String() string {
+	str := fmt.Sprintf("pid %d", u.PID)
+
+	if u.NSPID != u.PID {
+		str += fmt.Sprintf(" (container pid %d)", u.NSPID)
+	}
+
+	return fmt.Sprintf("%s '%s' using %s", str, u.Command, strings.Join(u.Paths, ", "))
+}
+
+// ProcMountUsers looks through /proc for processes with open files, working
+// or root directories on the mount. Host processes are matched by paths.
+// Container processes see paths in their own mount namespace hence their open files
+// are matched by device and root of the mount that files were opened on.
+type ProcMountUsers struct {
+	fs         boshsys.FileSystem
+	mountTable ProcMountTable
+	logger     boshlog.Logger
+}
+
+func NewProcMountUsers(fs boshsys.FileSystem, logger boshlog.Logger) ProcMountUsers {
+	return ProcMountUsers{
+		fs:         fs,
+		mountTable: NewProcMountTable(fs, logger),
+		logger:     logger,
+	}
+}
+
+func (u ProcMountUsers) Find(mount Mount) ([]MountUser, error) {
+	pidDirs, err := u.fs.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing processes")
+	}
+
+	var users []MountUser
+
+	for _, pidDir := range pidDirs {
+		pid, err := strconv.Atoi(filepath.Base(pidDir))
+		if err != nil {
+			continue
+		}
+
+		// Process might have exited since listing
+		paths, err := u.processPaths(pidDir, mount)
+		if err != nil {
+			u.logger.Debug(procMountUsersLogTag, "Skipping process %d: %s", pid, err.Error())
+			continue
+		}
+
+		if len(paths) == 0 {
+			continue
+		}
+
+		users = append(users, MountUser{
+			PID:     pid,
+			NSPID:   u.nsPID(pidDir, pid),
+			Command: u.command(pidDir),
+			Paths:   paths,
+		})
+	}
+
+	sort.Sort(mountUsersByPID(users))
+
+	return users, nil
+}
+
+func (u ProcMountUsers) processPaths(pidDir string, mount Mount) ([]string, error) {
+	var paths []string
+
+	for _, name := range []string{"cwd", "root"} {
+		target, err := u.fs.ReadLink(filepath.Join(pidDir, name))
+		if err == nil && u.isUnder(target, mount.MountPoint) {
+			paths = append(paths, target)
+		}
+	}
+
+	fdPaths, err := u.fs.Glob(filepath.Join(pidDir, "fd", "*"))
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing open files")
+	}
+
+	// Lazily read since most processes do not have files open on the mount
+	var processMounts Mounts
+
+	for _, fdPath := range fdPaths {
+		target, err := u.fs.ReadLink(fdPath)
+		if err != nil {
+			continue
+		}
+
+		if u.isUnder(target, mount.MountPoint) {
+			paths = append(paths, target)
+			continue
+		}
+
+		// Sockets, pipes and such are not files on mounts
+		if !strings.HasPrefix(target, "/") {
+			continue
+		}
+
+		mntID, found := u.fdMountID(pidDir, filepath.Base(fdPath))
+		if !found {
+			continue
+		}
+
+		if processMounts == nil {
+			processMounts, err = u.mountTable.mountsAt(filepath.Join(pidDir, "mountinfo"))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, m := range processMounts {
+			if m.ID == mntID && m.Device == mount.Device && m.Root == mount.Root {
+				paths = append(paths, target)
+				break
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// fdMountID returns ID of the mount that file was opened on, e.g. from `mnt_id:	40`
+func (u ProcMountUsers) fdMountID(pidDir, fd string) (int, bool) {
+	fdInfo, err := u.fs.ReadFileString(filepath.Join(pidDir, "fdinfo", fd))
+	if err != nil {
+		return 0, false
+	}
+
+	for _, line := range strings.Split(fdInfo, "\n") {
+		if strings.HasPrefix(line, "mnt_id:") {
+			id, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "mnt_id:")))
+			return id, err == nil
+		}
+	}
+
+	return 0, false
+}
+
+// nsPID returns last PID from `NSpid:	1234	5` status line
+func (u ProcMountUsers) nsPID(pidDir string, pid int) int {
+	status, err := u.fs.ReadFileString(filepath.Join(pidDir, "status"))
+	if err != nil {
+		return pid
+	}
+
+	for _, line := range strings.Split(status, "\n") {
+		if strings.HasPrefix(line, "NSpid:") {
+			fields := strings.Fields(strings.TrimPrefix(line, "NSpid:"))
+
+			if len(fields) > 0 {
+				nsPID, err := strconv.Atoi(fields[len(fields)-1])
+				if err == nil {
+					return nsPID
+				}
+			}
+		}
+	}
+
+	return pid
+}
+
+func (u ProcMountUsers) command(pidDir string) string {
+	comm, err := u.fs.ReadFileString(filepath.Join(pidDir, "comm"))
+	if err != nil {
+		return "?"
+	}
+
+	return strings.TrimSpace(comm)
+}
+
+func (u ProcMountUsers) isUnder(path, dirPath string) bool {
+	dirPath = filepath.Clean(dirPath)
+	return path == dirPath || strings.HasPrefix(path, dirPath+"/")
+}
+
+type mountUsersByPID []MountUser
+
+func (s mountUsersByPID) Len() int           { return len(s) }
+func (s mountUsersByPID) Less(i, j int) bool { return s[i].PID < s[j].PID }
+func (s mountUsersByPID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
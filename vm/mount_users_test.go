@@ -0,0 +1,105 @@
+package vm_test
+
+import (
+	"errors"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("ProcMountUsers", func() {
+	var (
+		fs         *fakesys.FakeFileSystem
+		mountUsers ProcMountUsers
+
+		diskMount = Mount{
+			ID:         40,
+			Device:     "7:0",
+			Root:       "/",
+			MountPoint: "/persistent/vm-1/disk-1",
+		}
+	)
+
+	BeforeEach(func() {
+		fs = fakesys.NewFakeFileSystem()
+		mountUsers = NewProcMountUsers(fs, boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	Describe("Find", func() {
+		BeforeEach(func() {
+			fs.SetGlob("/proc/[0-9]*", []string{"/proc/10", "/proc/20", "/proc/30"})
+
+			// Host process with open file and working directory on the mount
+			fs.WriteFileString("/proc/10/comm", "fake-host-cmd\n")
+			fs.WriteFileString("/proc/10/status", "Name:\tfake-host-cmd\nNSpid:\t10\n")
+			fs.Symlink("/persistent/vm-1/disk-1/dir", "/proc/10/cwd")
+			fs.Symlink("/", "/proc/10/root")
+			fs.SetGlob("/proc/10/fd/*", []string{"/proc/10/fd/0", "/proc/10/fd/3"})
+			fs.Symlink("/dev/null", "/proc/10/fd/0")
+			fs.Symlink("/persistent/vm-1/disk-1/file", "/proc/10/fd/3")
+			fs.WriteFileString("/proc/10/mountinfo", "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n")
+			fs.WriteFileString("/proc/10/fdinfo/0", "pos:\t0\nflags:\t02\nmnt_id:\t1\n")
+
+			// Container process sees disk at guest path
+			fs.WriteFileString("/proc/20/comm", "fake-container-cmd\n")
+			fs.WriteFileString("/proc/20/status", "Name:\tfake-container-cmd\nNSpid:\t20\t5\n")
+			fs.SetGlob("/proc/20/fd/*", []string{"/proc/20/fd/4", "/proc/20/fd/5", "/proc/20/fd/6"})
+			fs.Symlink("/warden-cpi-dev/disk-1/data", "/proc/20/fd/4")
+			fs.Symlink("/var/vcap/data/other", "/proc/20/fd/5")
+			fs.Symlink("socket:[123]", "/proc/20/fd/6")
+			fs.WriteFileString("/proc/20/fdinfo/4", "pos:\t0\nmnt_id:\t90\n")
+			fs.WriteFileString("/proc/20/fdinfo/5", "pos:\t0\nmnt_id:\t80\n")
+			fs.WriteFileString("/proc/20/mountinfo", ""+
+				"80 70 8:1 /ephemeral/vm-1 /var/vcap/data rw - ext4 /dev/sda1 rw\n"+
+				"90 70 7:0 / /warden-cpi-dev/disk-1 rw - ext4 /dev/loop0 rw\n",
+			)
+
+			// Unrelated process
+			fs.WriteFileString("/proc/30/comm", "fake-other-cmd\n")
+			fs.SetGlob("/proc/30/fd/*", []string{"/proc/30/fd/1"})
+			fs.Symlink("/var/log/other", "/proc/30/fd/1")
+			fs.WriteFileString("/proc/30/fdinfo/1", "mnt_id:\t1\n")
+			fs.WriteFileString("/proc/30/mountinfo", "1 0 8:1 / / rw - ext4 /dev/sda1 rw\n")
+		})
+
+		It("returns host and container processes using the mount", func() {
+			users, err := mountUsers.Find(diskMount)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(users).To(Equal([]MountUser{
+				{
+					PID:     10,
+					NSPID:   10,
+					Command: "fake-host-cmd",
+					Paths:   []string{"/persistent/vm-1/disk-1/dir", "/persistent/vm-1/disk-1/file"},
+				},
+				{
+					PID:     20,
+					NSPID:   5,
+					Command: "fake-container-cmd",
+					Paths:   []string{"/warden-cpi-dev/disk-1/data"},
+				},
+			}))
+		})
+
+		It("skips processes whose mount table cannot be read", func() {
+			fs.RemoveAll("/proc/20/mountinfo")
+
+			users, err := mountUsers.Find(diskMount)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(users).To(HaveLen(1))
+			Expect(users[0].PID).To(Equal(10))
+		})
+
+		It("returns error if listing processes fails", func() {
+			fs.GlobErr = errors.New("fake-glob-err")
+
+			_, err := mountUsers.Find(diskMount)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-glob-err"))
+		})
+	})
+})
@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"fmt"
+	"syscall"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+// Mounter names that can be configured; native mounter is used by default
+const (
+	NativeMounterName = "native"
+	CmdMounterName    = "command"
+)
+
+// Mounter mounts and unmounts file systems on the host
+type Mounter interface {
+	BindMount(srcPath, dstPath string) error
+	MakeUnbindable(path string) error
+	MakeShared(path string) error
+
+	// MountLoop attaches file to a loop device and mounts it;
+	// loop device is freed once file system is unmounted
+	MountLoop(filePath, mountPoint string) error
+
+	Unmount(mountPoint string) error
+
+	// LazyUnmount detaches file system right away
+	// and cleans it up once it is no longer busy
+	LazyUnmount(mountPoint string) error
+
+	// LoopDevices returns attached loop devices so that leaked ones can be found
+	LoopDevices() ([]LoopDevice, error)
+	DetachLoop(devicePath string) error
+}
+
+type LoopDevice struct {
+	Path        string // e.g. /dev/loop0
+	BackingFile string
+}
+
+// NewMounter returns configured mounter; command-based mounter is a fallback
+// for hosts where native mounting is not possible (e.g. no /dev/loop-control)
+func NewMounter(name string, fs boshsys.FileSystem, cmdRunner boshsys.CmdRunner, logger boshlog.Logger) Mounter {
+	if name == CmdMounterName {
+		return NewCmdMounter(cmdRunner, logger)
+	}
+
+	return NewNativeMounter(fs, logger)
+}
+
+// MountError keeps errno so that callers do not need to parse error messages
+type MountError struct {
+	Op   string
+	Path string
+	Err  error
+
+	// Zero if underlying error is not known to correspond to an errno
+	Errno syscall.Errno
+}
+
+func (e MountError) Error() string {
+	return fmt.Sprintf("Running %s on '%s': %s", e.Op, e.Path, e.Err.Error())
+}
+
+func (e MountError) Unwrap() error { return e.Err }
+
+// IsNotMounted returns true if unmounting failed because path is not a mount point
+func IsNotMounted(err error) bool {
+	mountErr, ok := err.(MountError)
+	return ok && mountErr.Errno == syscall.EINVAL
+}
+
+// IsBusy returns true if unmounting failed because file system is still in use
+func IsBusy(err error) bool {
+	mountErr, ok := err.(MountError)
+	return ok && mountErr.Errno == syscall.EBUSY
+}
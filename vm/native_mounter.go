@@ -0,0 +1,114 @@
+package vm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	boshsys "github.com/cloudfoundry/bosh-agent/system"
+)
+
+const nativeMounterLogTag = "NativeMounter"
+
+// Disks are formatted as ext4 when they are created
+const nativeMounterLoopFSType = "ext4"
+
+// Loop devices expose their backing files in sysfs
+const nativeMounterLoopSysfsGlob = "/sys/block/loop*/loop/backing_file"
+
+// NativeMounter uses mount(2), umount(2) and loop device ioctls directly;
+// returned MountErrors carry errnos reported by the kernel
+type NativeMounter struct {
+	fs     boshsys.FileSystem
+	logger boshlog.Logger
+}
+
+func NewNativeMounter(fs boshsys.FileSystem, logger boshlog.Logger) NativeMounter {
+	return NativeMounter{fs: fs, logger: logger}
+}
+
+func (m NativeMounter) BindMount(srcPath, dstPath string) error {
+	return m.mountErr("mount", dstPath, mountBind(srcPath, dstPath))
+}
+
+func (m NativeMounter) MakeUnbindable(path string) error {
+	return m.mountErr("mount", path, mountMakeUnbindable(path))
+}
+
+func (m NativeMounter) MakeShared(path string) error {
+	return m.mountErr("mount", path, mountMakeShared(path))
+}
+
+func (m NativeMounter) MountLoop(filePath, mountPoint string) error {
+	devicePath, err := mountLoop(filePath, mountPoint, nativeMounterLoopFSType)
+	if err != nil {
+		return m.mountErr("mount", mountPoint, err)
+	}
+
+	m.logger.Debug(nativeMounterLogTag, "Mounted '%s' at '%s' via '%s'", filePath, mountPoint, devicePath)
+
+	return nil
+}
+
+func (m NativeMounter) Unmount(mountPoint string) error {
+	return m.mountErr("umount", mountPoint, unmount(mountPoint))
+}
+
+func (m NativeMounter) LazyUnmount(mountPoint string) error {
+	return m.mountErr("umount", mountPoint, unmountLazy(mountPoint))
+}
+
+func (m NativeMounter) LoopDevices() ([]LoopDevice, error) {
+	paths, err := m.fs.Glob(nativeMounterLoopSysfsGlob)
+	if err != nil {
+		return nil, bosherr.WrapError(err, "Listing loop devices")
+	}
+
+	var devices []LoopDevice
+
+	for _, path := range paths {
+		// Loop device might have been detached since listing
+		backingFile, err := m.fs.ReadFileString(path)
+		if err != nil {
+			continue
+		}
+
+		// e.g. /sys/block/loop0/loop/backing_file
+		name := filepath.Base(filepath.Dir(filepath.Dir(path)))
+
+		devices = append(devices, LoopDevice{
+			Path:        filepath.Join("/dev", name),
+			BackingFile: strings.TrimSuffix(backingFile, "\n"),
+		})
+	}
+
+	return devices, nil
+}
+
+func (m NativeMounter) DetachLoop(devicePath string) error {
+	return m.mountErr("losetup", devicePath, detachLoop(devicePath))
+}
+
+func (m NativeMounter) mountErr(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return MountError{Op: op, Path: path, Err: err, Errno: m.errno(err)}
+}
+
+func (m NativeMounter) errno(err error) syscall.Errno {
+	switch typedErr := err.(type) {
+	case syscall.Errno:
+		return typedErr
+	case *os.PathError:
+		return m.errno(typedErr.Err)
+	case *os.SyscallError:
+		return m.errno(typedErr.Err)
+	default:
+		return 0
+	}
+}
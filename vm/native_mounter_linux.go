@@ -0,0 +1,156 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// See linux/loop.h
+const (
+	loopCtlGetFree  = 0x4C82
+	loopSetFD       = 0x4C00
+	loopClrFD       = 0x4C01
+	loopSetStatus64 = 0x4C04
+
+	loopFlagsAutoclear = 4
+
+	loopControlPath = "/dev/loop-control"
+
+	// Another process may grab a free loop device before it is attached
+	loopAttachAttempts = 10
+)
+
+// loopInfo64 mirrors struct loop_info64
+type loopInfo64 struct {
+	Device         uint64
+	Inode          uint64
+	RDevice        uint64
+	Offset         uint64
+	SizeLimit      uint64
+	Number         uint32
+	EncryptType    uint32
+	EncryptKeySize uint32
+	Flags          uint32
+	FileName       [64]byte
+	CryptName      [64]byte
+	EncryptKey     [32]byte
+	Init           [2]uint64
+}
+
+func mountBind(srcPath, dstPath string) error {
+	return syscall.Mount(srcPath, dstPath, "", syscall.MS_BIND, "")
+}
+
+func mountMakeUnbindable(path string) error {
+	return syscall.Mount("", path, "", syscall.MS_UNBINDABLE, "")
+}
+
+func mountMakeShared(path string) error {
+	return syscall.Mount("", path, "", syscall.MS_SHARED, "")
+}
+
+func unmount(path string) error {
+	return syscall.Unmount(path, 0)
+}
+
+func unmountLazy(path string) error {
+	return syscall.Unmount(path, syscall.MNT_DETACH)
+}
+
+// mountLoop attaches file to a free loop device with autoclear set
+// so that kernel detaches it once file system is unmounted
+func mountLoop(filePath, mountPoint, fsType string) (string, error) {
+	file, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+
+	defer file.Close()
+
+	device, err := attachLoop(file)
+	if err != nil {
+		return "", err
+	}
+
+	// Closing device does not detach it since autoclear only applies after mount
+	defer device.Close()
+
+	err = syscall.Mount(device.Name(), mountPoint, fsType, 0, "")
+	if err != nil {
+		_ = ioctl(device.Fd(), loopClrFD, 0)
+		return "", err
+	}
+
+	return device.Name(), nil
+}
+
+func attachLoop(file *os.File) (*os.File, error) {
+	control, err := os.OpenFile(loopControlPath, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer control.Close()
+
+	var lastErr error
+
+	for i := 0; i < loopAttachAttempts; i++ {
+		num, _, errno := syscall.Syscall(syscall.SYS_IOCTL, control.Fd(), loopCtlGetFree, 0)
+		if errno != 0 {
+			return nil, &os.SyscallError{Syscall: "ioctl LOOP_CTL_GET_FREE", Err: errno}
+		}
+
+		device, err := os.OpenFile(fmt.Sprintf("/dev/loop%d", num), os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		err = ioctl(device.Fd(), loopSetFD, file.Fd())
+		if err != nil {
+			device.Close()
+
+			if err.(*os.SyscallError).Err == syscall.EBUSY {
+				lastErr = err
+				continue
+			}
+
+			return nil, err
+		}
+
+		info := loopInfo64{Flags: loopFlagsAutoclear}
+		copy(info.FileName[:len(info.FileName)-1], file.Name())
+
+		err = ioctl(device.Fd(), loopSetStatus64, uintptr(unsafe.Pointer(&info)))
+		if err != nil {
+			_ = ioctl(device.Fd(), loopClrFD, 0)
+			device.Close()
+			return nil, err
+		}
+
+		return device, nil
+	}
+
+	return nil, lastErr
+}
+
+func detachLoop(devicePath string) error {
+	device, err := os.OpenFile(devicePath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer device.Close()
+
+	return ioctl(device.Fd(), loopClrFD, 0)
+}
+
+func ioctl(fd, req, arg uintptr) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	if errno != 0 {
+		return &os.SyscallError{Syscall: fmt.Sprintf("ioctl 0x%X", req), Err: errno}
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package vm
+
+import (
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+)
+
+func mountBind(srcPath, dstPath string) error { return nativeMounterUnsupported() }
+
+func mountMakeUnbindable(path string) error { return nativeMounterUnsupported() }
+
+func mountMakeShared(path string) error { return nativeMounterUnsupported() }
+
+func unmount(path string) error { return nativeMounterUnsupported() }
+
+func unmountLazy(path string) error { return nativeMounterUnsupported() }
+
+func mountLoop(filePath, mountPoint, fsType string) (string, error) {
+	return "", nativeMounterUnsupported()
+}
+
+func detachLoop(devicePath string) error { return nativeMounterUnsupported() }
+
+func nativeMounterUnsupported() error {
+	return bosherr.New("Native mounting is only supported on Linux")
+}
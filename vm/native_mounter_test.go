@@ -0,0 +1,66 @@
+package vm_test
+
+import (
+	"errors"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	fakesys "github.com/cloudfoundry/bosh-agent/system/fakes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("NativeMounter", func() {
+	var (
+		fs      *fakesys.FakeFileSystem
+		mounter NativeMounter
+	)
+
+	BeforeEach(func() {
+		fs = fakesys.NewFakeFileSystem()
+		mounter = NewNativeMounter(fs, boshlog.NewLogger(boshlog.LevelNone))
+	})
+
+	Describe("LoopDevices", func() {
+		It("returns loop devices with their backing files from sysfs", func() {
+			fs.SetGlob("/sys/block/loop*/loop/backing_file", []string{
+				"/sys/block/loop0/loop/backing_file",
+				"/sys/block/loop1/loop/backing_file",
+			})
+
+			fs.WriteFileString("/sys/block/loop0/loop/backing_file", "/fake-disks/disk-1\n")
+			fs.WriteFileString("/sys/block/loop1/loop/backing_file", "/fake-disks/disk-2\n")
+
+			devices, err := mounter.LoopDevices()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices).To(Equal([]LoopDevice{
+				{Path: "/dev/loop0", BackingFile: "/fake-disks/disk-1"},
+				{Path: "/dev/loop1", BackingFile: "/fake-disks/disk-2"},
+			}))
+		})
+
+		It("skips loop devices that were detached while listing", func() {
+			fs.SetGlob("/sys/block/loop*/loop/backing_file", []string{
+				"/sys/block/loop0/loop/backing_file",
+				"/sys/block/loop1/loop/backing_file",
+			})
+
+			fs.WriteFileString("/sys/block/loop1/loop/backing_file", "/fake-disks/disk-2\n")
+
+			devices, err := mounter.LoopDevices()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(devices).To(Equal([]LoopDevice{
+				{Path: "/dev/loop1", BackingFile: "/fake-disks/disk-2"},
+			}))
+		})
+
+		It("returns error if listing loop devices fails", func() {
+			fs.GlobErr = errors.New("fake-glob-err")
+
+			_, err := mounter.LoopDevices()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-glob-err"))
+		})
+	})
+})
@@ -2,6 +2,7 @@ package vm
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,12 +10,18 @@ import (
 
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 type registryAgentEnvService struct {
 	endpoint string
-	logger   boshlog.Logger
-	logTag   string
+
+	// Endpoint includes registry credentials so only redacted one is logged
+	redactedEndpoint string
+
+	logger boshlog.Logger
+	logTag string
 }
 
 func NewRegistryAgentEnvService(
@@ -32,16 +39,24 @@ func NewRegistryAgentEnvService(
 	)
 	return registryAgentEnvService{
 		endpoint: endpoint,
-		logger:   logger,
-		logTag:   "registryAgentEnvService",
+
+		redactedEndpoint: bwcutil.RedactURL(endpoint),
+
+		logger: logger,
+		logTag: "registryAgentEnvService",
 	}
 }
 
-func (s registryAgentEnvService) Fetch() (AgentEnv, error) {
-	s.logger.Debug(s.logTag, "Fetching agent env from registry endpoint %s", s.endpoint)
+func (s registryAgentEnvService) Fetch(ctx context.Context) (AgentEnv, error) {
+	s.logger.Debug(s.logTag, "Fetching agent env from registry endpoint %s", s.redactedEndpoint)
+
+	request, err := http.NewRequest("GET", s.endpoint, nil)
+	if err != nil {
+		return AgentEnv{}, bosherr.WrapError(err, "Creating GET request to registry at %s", s.redactedEndpoint)
+	}
 
 	httpClient := http.Client{}
-	httpResponse, err := httpClient.Get(s.endpoint)
+	httpResponse, err := httpClient.Do(request.WithContext(ctx))
 	if err != nil {
 		return AgentEnv{}, bosherr.WrapError(err, "Fetching agent env from registry")
 	}
@@ -55,7 +70,7 @@ func (s registryAgentEnvService) Fetch() (AgentEnv, error) {
 
 	httpBody, err := ioutil.ReadAll(httpResponse.Body)
 	if err != nil {
-		return AgentEnv{}, bosherr.WrapError(err, "Reading response from registry endpoint %s", s.endpoint)
+		return AgentEnv{}, bosherr.WrapError(err, "Reading response from registry endpoint %s", s.redactedEndpoint)
 	}
 
 	var agentEnv AgentEnv
@@ -64,29 +79,29 @@ func (s registryAgentEnvService) Fetch() (AgentEnv, error) {
 		return AgentEnv{}, bosherr.WrapError(err, "Unmarshalling agent env from registry")
 	}
 
-	s.logger.Debug(s.logTag, "Received agent env from registry endpoint %s, contents: %s", s.endpoint, httpBody)
+	s.logger.Debug(s.logTag, "Received agent env from registry endpoint %s, contents: %s", s.redactedEndpoint, string(httpBody))
 
 	return agentEnv, nil
 }
 
-func (s registryAgentEnvService) Update(agentEnv AgentEnv) error {
+func (s registryAgentEnvService) Update(ctx context.Context, agentEnv AgentEnv) error {
 	settingsJSON, err := json.Marshal(agentEnv)
 	if err != nil {
 		return bosherr.WrapError(err, "Marshalling agent env")
 	}
 
-	s.logger.Debug(s.logTag, "Updating registry endpoint %s with agent env: %s", s.endpoint, settingsJSON)
+	s.logger.Debug(s.logTag, "Updating registry endpoint %s with agent env: %s", s.redactedEndpoint, string(settingsJSON))
 
 	putPayload := bytes.NewReader(settingsJSON)
 	request, err := http.NewRequest("PUT", s.endpoint, putPayload)
 	if err != nil {
-		return bosherr.WrapError(err, "Creating PUT request to update registry at %s with settings %s", s.endpoint, settingsJSON)
+		return bosherr.WrapError(err, "Creating PUT request to update registry at %s with settings %s", s.redactedEndpoint, bwcutil.RedactJSON(settingsJSON))
 	}
 
 	httpClient := http.Client{}
-	httpResponse, err := httpClient.Do(request)
+	httpResponse, err := httpClient.Do(request.WithContext(ctx))
 	if err != nil {
-		return bosherr.WrapError(err, "Updating registry endpoint %s with settings: %s", s.endpoint, settingsJSON)
+		return bosherr.WrapError(err, "Updating registry endpoint %s with settings: %s", s.redactedEndpoint, bwcutil.RedactJSON(settingsJSON))
 	}
 
 	defer httpResponse.Body.Close()
@@ -101,3 +116,30 @@ func (s registryAgentEnvService) Update(agentEnv AgentEnv) error {
 
 	return nil
 }
+
+func (s registryAgentEnvService) Delete(ctx context.Context) error {
+	s.logger.Debug(s.logTag, "Deleting agent env from registry endpoint %s", s.redactedEndpoint)
+
+	request, err := http.NewRequest("DELETE", s.endpoint, nil)
+	if err != nil {
+		return bosherr.WrapError(err, "Creating DELETE request to registry at %s", s.redactedEndpoint)
+	}
+
+	httpClient := http.Client{}
+	httpResponse, err := httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return bosherr.WrapError(err, "Deleting agent env from registry endpoint %s", s.redactedEndpoint)
+	}
+
+	defer httpResponse.Body.Close()
+
+	switch httpResponse.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	default:
+		return bosherr.New(
+			"Received non-2xx status code when contacting registry: %d",
+			httpResponse.StatusCode,
+		)
+	}
+}
@@ -1,6 +1,8 @@
 package vm_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -13,11 +15,13 @@ import (
 
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 	. "github.com/cppforlife/bosh-warden-cpi/vm"
 )
 
 var _ = Describe("RegistryAgentEnvService", func() {
 	var (
+		logOut               *bytes.Buffer
 		logger               boshlog.Logger
 		agentEnvService      AgentEnvService
 		registryServer       *registryServer
@@ -38,7 +42,10 @@ var _ = Describe("RegistryAgentEnvService", func() {
 		<-readyCh
 
 		instanceID := "fake-instance-id"
-		logger = boshlog.NewLogger(boshlog.LevelNone)
+		logOut = bytes.NewBufferString("")
+		// Secrets are masked by the writer like in production
+		redactingLogOut := bwcutil.NewRedactingWriter(logOut)
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, redactingLogOut, redactingLogOut)
 		agentEnvService = NewRegistryAgentEnvService(registryOptions, instanceID, logger)
 
 		expectedAgentEnv = AgentEnv{AgentID: "fake-agent-id"}
@@ -58,15 +65,29 @@ var _ = Describe("RegistryAgentEnvService", func() {
 			})
 
 			It("fetches settings from the registry", func() {
-				agentEnv, err := agentEnvService.Fetch()
+				agentEnv, err := agentEnvService.Fetch(context.Background())
 				Expect(err).ToNot(HaveOccurred())
 				Expect(agentEnv).To(Equal(expectedAgentEnv))
 			})
+
+			It("logs registry endpoint and fetched settings without secrets", func() {
+				settingsJSON, err := json.Marshal(NewAgentEnvWithSecrets())
+				Expect(err).ToNot(HaveOccurred())
+
+				registryServer.InstanceSettings = settingsJSON
+
+				_, err = agentEnvService.Fetch(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logOut.String()).To(ContainSubstring("http://<redacted>:<redacted>@127.0.0.1:6307/instances/fake-instance-id/settings"))
+				Expect(logOut.String()).ToNot(ContainSubstring("fake-password"))
+				ExpectAgentEnvSecretsRedacted(logOut.String())
+			})
 		})
 
 		Context("when settings for instance do not exist", func() {
 			It("returns an error", func() {
-				agentEnv, err := agentEnvService.Fetch()
+				agentEnv, err := agentEnvService.Fetch(context.Background())
 				Expect(err).To(HaveOccurred())
 				Expect(agentEnv).To(Equal(AgentEnv{}))
 			})
@@ -76,17 +97,52 @@ var _ = Describe("RegistryAgentEnvService", func() {
 	Describe("Update", func() {
 		It("updates settings in the registry", func() {
 			Expect(registryServer.InstanceSettings).To(Equal([]byte{}))
-			err := agentEnvService.Update(expectedAgentEnv)
+			err := agentEnvService.Update(context.Background(), expectedAgentEnv)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(registryServer.InstanceSettings).To(Equal(expectedAgentEnvJSON))
 		})
+
+		It("logs registry endpoint and settings without secrets", func() {
+			agentEnvService.Update(context.Background(), NewAgentEnvWithSecrets())
+
+			Expect(logOut.String()).To(ContainSubstring("http://<redacted>:<redacted>@127.0.0.1:6307/instances/fake-instance-id/settings"))
+			Expect(logOut.String()).ToNot(ContainSubstring("fake-password"))
+			ExpectAgentEnvSecretsRedacted(logOut.String())
+		})
+	})
+
+	Describe("Delete", func() {
+		It("deletes settings from the registry", func() {
+			registryServer.InstanceSettings = expectedAgentEnvJSON
+
+			err := agentEnvService.Delete(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(registryServer.InstanceSettings).To(BeNil())
+		})
+
+		It("does not return error if settings do not exist", func() {
+			registryServer.InstanceSettings = nil
+
+			err := agentEnvService.Delete(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if registry responds with unexpected status code", func() {
+			registryServer.DeleteStatusCode = http.StatusInternalServerError
+
+			err := agentEnvService.Delete(context.Background())
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("500"))
+		})
 	})
 })
 
 type registryServer struct {
 	InstanceSettings []byte
+	DeleteStatusCode int
 	options          RegistryOptions
 	listener         net.Listener
+	httpServer       *http.Server
 }
 
 func NewRegistryServer(options RegistryOptions) *registryServer {
@@ -103,26 +159,27 @@ func (s *registryServer) Start(readyCh chan struct{}) error {
 		return err
 	}
 
-	readyCh <- struct{}{}
-
-	httpServer := http.Server{}
 	mux := http.NewServeMux()
-	httpServer.Handler = mux
 	mux.HandleFunc("/instances/fake-instance-id/settings", s.instanceHandler)
 
-	return httpServer.Serve(s.listener)
+	s.httpServer = &http.Server{Handler: mux}
+
+	readyCh <- struct{}{}
+
+	return s.httpServer.Serve(s.listener)
 }
 
 func (s *registryServer) Stop() error {
-	// if client keeps connection alive, server will still be running
 	s.InstanceSettings = nil
 
-	err := s.listener.Close()
-	if err != nil {
-		return err
-	}
+	// Close kept alive connections so that next test does not talk to this server
+	err := s.httpServer.Close()
 
-	return nil
+	// Client side of those connections is pooled by default transport
+	// and would otherwise be reused against next test's server
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+	return err
 }
 
 func (s *registryServer) instanceHandler(w http.ResponseWriter, req *http.Request) {
@@ -147,6 +204,22 @@ func (s *registryServer) instanceHandler(w http.ResponseWriter, req *http.Reques
 		w.WriteHeader(http.StatusOK)
 		return
 	}
+
+	if req.Method == "DELETE" {
+		if s.DeleteStatusCode != 0 {
+			w.WriteHeader(s.DeleteStatusCode)
+			return
+		}
+
+		if s.InstanceSettings != nil {
+			s.InstanceSettings = nil
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		http.NotFound(w, req)
+		return
+	}
 }
 
 func (s *registryServer) isAuthorized(req *http.Request) bool {
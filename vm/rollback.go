@@ -0,0 +1,79 @@
+package vm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
+)
+
+const rollbackLogTag = "rollback"
+
+// rollback records undo actions for completed steps of a multi-step
+// operation so that they can be undone in reverse order on failure
+type rollback struct {
+	steps  []rollbackStep
+	logger boshlog.Logger
+}
+
+type rollbackStep struct {
+	desc string
+	undo func(context.Context) error
+}
+
+func newRollback(logger boshlog.Logger) *rollback {
+	return &rollback{logger: logger}
+}
+
+// Add records an undo action; it should be added before the step it undoes
+// is attempted if the step may leave partial state behind on failure
+func (r *rollback) Add(desc string, undo func(context.Context) error) {
+	r.steps = append(r.steps, rollbackStep{desc: desc, undo: undo})
+}
+
+// Run undoes recorded steps in reverse order and returns original error
+// annotated with any errors encountered while undoing.
+// Steps are undone with a context detached from the request's
+// so that cancelled request still cleans up after itself.
+func (r *rollback) Run(err error) error {
+	var undoErrs []string
+
+	ctx, cancel := bwcutil.NewCleanupContext()
+	defer cancel()
+
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+
+		r.logger.Debug(rollbackLogTag, "Rolling back: %s", step.desc)
+
+		undoErr := step.undo(ctx)
+		if undoErr != nil {
+			r.logger.Error(rollbackLogTag, "Failed rolling back '%s': %s", step.desc, undoErr.Error())
+			undoErrs = append(undoErrs, fmt.Sprintf("%s: %s", step.desc, undoErr.Error()))
+		}
+	}
+
+	r.steps = nil
+
+	if len(undoErrs) == 0 {
+		return err
+	}
+
+	return rollbackError{err: err, undoErrs: undoErrs}
+}
+
+// rollbackError keeps original error reachable via Unwrap
+// so that callers can still find typed errors (e.g. CloudError)
+type rollbackError struct {
+	err      error
+	undoErrs []string
+}
+
+func (e rollbackError) Error() string {
+	return fmt.Sprintf("%s (rollback errors: %s)", e.err.Error(), strings.Join(e.undoErrs, "; "))
+}
+
+func (e rollbackError) Unwrap() error { return e.err }
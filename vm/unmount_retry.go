@@ -0,0 +1,111 @@
+package vm
+
+import (
+	"time"
+
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+)
+
+// UnmountRetryOptions configures how unmounting of busy file systems is retried;
+// by default unmounting is tried 60 times every 3 seconds
+type UnmountRetryOptions struct {
+	// Optional; defaults to 60
+	Attempts int
+
+	// Optional; delay between first attempts, e.g. 3s; defaults to 3s
+	Backoff string
+
+	// Optional; delay is multiplied by factor after each attempt; defaults to 1
+	BackoffFactor float64
+
+	// Optional; upper bound of delay between attempts, e.g. 30s
+	MaxBackoff string
+
+	// Optional; lazily unmount (umount -l) once all attempts fail. File system
+	// is detached right away and cleaned up once processes stop using it.
+	// Unmounting still fails if loop device is not released within the same attempts.
+	Lazy bool
+}
+
+type UnmountRetryPolicy struct {
+	Attempts      int
+	Backoff       time.Duration
+	BackoffFactor float64
+	MaxBackoff    time.Duration // zero if not bound
+	Lazy          bool
+}
+
+const (
+	defaultUnmountAttempts = 60
+	defaultUnmountBackoff  = 3 * time.Second
+)
+
+func (o UnmountRetryOptions) Validate() error {
+	if o.Attempts < 0 {
+		return bosherr.New("Must provide non-negative Attempts")
+	}
+
+	if o.BackoffFactor != 0 && o.BackoffFactor < 1 {
+		return bosherr.New("Must provide BackoffFactor of at least 1")
+	}
+
+	for name, value := range map[string]string{"Backoff": o.Backoff, "MaxBackoff": o.MaxBackoff} {
+		if value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return bosherr.WrapError(err, "Parsing %s", name)
+		}
+
+		if d <= 0 {
+			return bosherr.New("Must provide positive %s", name)
+		}
+	}
+
+	return nil
+}
+
+// Policy returns policy with defaults filled in; options must be valid
+func (o UnmountRetryOptions) Policy() UnmountRetryPolicy {
+	policy := UnmountRetryPolicy{
+		Attempts:      o.Attempts,
+		Backoff:       defaultUnmountBackoff,
+		BackoffFactor: o.BackoffFactor,
+		Lazy:          o.Lazy,
+	}
+
+	if policy.Attempts == 0 {
+		policy.Attempts = defaultUnmountAttempts
+	}
+
+	if policy.BackoffFactor == 0 {
+		policy.BackoffFactor = 1
+	}
+
+	if o.Backoff != "" {
+		policy.Backoff, _ = time.ParseDuration(o.Backoff)
+	}
+
+	if o.MaxBackoff != "" {
+		policy.MaxBackoff, _ = time.ParseDuration(o.MaxBackoff)
+
+		if policy.Backoff > policy.MaxBackoff {
+			policy.Backoff = policy.MaxBackoff
+		}
+	}
+
+	return policy
+}
+
+// NextBackoff returns delay to wait after given delay
+func (p UnmountRetryPolicy) NextBackoff(d time.Duration) time.Duration {
+	next := time.Duration(float64(d) * p.BackoffFactor)
+
+	if p.MaxBackoff > 0 && next > p.MaxBackoff {
+		return p.MaxBackoff
+	}
+
+	return next
+}
@@ -0,0 +1,89 @@
+package vm_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("UnmountRetryOptions", func() {
+	Describe("Validate", func() {
+		It("does not return error if all fields are empty", func() {
+			err := UnmountRetryOptions{}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("does not return error if all fields are valid", func() {
+			err := UnmountRetryOptions{Attempts: 5, Backoff: "1s", BackoffFactor: 2, MaxBackoff: "10s", Lazy: true}.Validate()
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns error if Attempts is negative", func() {
+			err := UnmountRetryOptions{Attempts: -1}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must provide non-negative Attempts"))
+		})
+
+		It("returns error if BackoffFactor is less than 1", func() {
+			err := UnmountRetryOptions{BackoffFactor: 0.5}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must provide BackoffFactor of at least 1"))
+		})
+
+		It("returns error if Backoff cannot be parsed", func() {
+			err := UnmountRetryOptions{Backoff: "fake-backoff"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("Parsing Backoff"))
+		})
+
+		It("returns error if MaxBackoff is not positive", func() {
+			err := UnmountRetryOptions{MaxBackoff: "0s"}.Validate()
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(Equal("Must provide positive MaxBackoff"))
+		})
+	})
+
+	Describe("Policy", func() {
+		It("returns 60 attempts every 3 seconds by default", func() {
+			Expect(UnmountRetryOptions{}.Policy()).To(Equal(UnmountRetryPolicy{
+				Attempts:      60,
+				Backoff:       3 * time.Second,
+				BackoffFactor: 1,
+			}))
+		})
+
+		It("returns configured policy", func() {
+			policy := UnmountRetryOptions{Attempts: 5, Backoff: "1s", BackoffFactor: 2, MaxBackoff: "10s", Lazy: true}.Policy()
+			Expect(policy).To(Equal(UnmountRetryPolicy{
+				Attempts:      5,
+				Backoff:       1 * time.Second,
+				BackoffFactor: 2,
+				MaxBackoff:    10 * time.Second,
+				Lazy:          true,
+			}))
+		})
+
+		It("limits initial backoff by MaxBackoff", func() {
+			policy := UnmountRetryOptions{MaxBackoff: "1s"}.Policy()
+			Expect(policy.Backoff).To(Equal(1 * time.Second))
+		})
+	})
+})
+
+var _ = Describe("UnmountRetryPolicy", func() {
+	Describe("NextBackoff", func() {
+		It("multiplies backoff by factor up to max backoff", func() {
+			policy := UnmountRetryPolicy{BackoffFactor: 2, MaxBackoff: 5 * time.Second}
+			Expect(policy.NextBackoff(2 * time.Second)).To(Equal(4 * time.Second))
+			Expect(policy.NextBackoff(4 * time.Second)).To(Equal(5 * time.Second))
+		})
+
+		It("does not limit backoff if max backoff is not set", func() {
+			policy := UnmountRetryPolicy{BackoffFactor: 2}
+			Expect(policy.NextBackoff(1 * time.Hour)).To(Equal(2 * time.Hour))
+		})
+	})
+})
@@ -0,0 +1,31 @@
+package vm
+
+import (
+	"context"
+	"io"
+
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
+)
+
+// WardenClient is a subset of Garden client used by the CPI;
+// each call stops waiting for Garden once ctx is done
+type WardenClient interface {
+	Create(context.Context, wrdn.ContainerSpec) (WardenContainer, error)
+	Destroy(context.Context, string) error
+	Containers(context.Context, wrdn.Properties) ([]WardenContainer, error)
+}
+
+type WardenContainer interface {
+	Handle() string
+
+	Info(context.Context) (wrdn.ContainerInfo, error)
+
+	StreamIn(context.Context, string, io.Reader) error
+	StreamOut(context.Context, string) (io.ReadCloser, error)
+
+	Run(context.Context, wrdn.ProcessSpec, wrdn.ProcessIO) (WardenProcess, error)
+}
+
+type WardenProcess interface {
+	Wait(context.Context) (int, error)
+}
@@ -1,38 +1,57 @@
 package vm
 
 import (
+	"context"
+
 	wrdn "github.com/cloudfoundry-incubator/garden/warden"
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	boshuuid "github.com/cloudfoundry/bosh-agent/uuid"
 
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	bwcstem "github.com/cppforlife/bosh-warden-cpi/stemcell"
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 const wardenCreatorLogTag = "WardenCreator"
 
+// Container properties used to correlate containers with Director's requests
+const (
+	directorUUIDPropertyName    = "bosh-warden-cpi.director-uuid"
+	createRequestIDPropertyName = "bosh-warden-cpi.create-request-id"
+)
+
+// Container properties that mark containers as owned by the CPI;
+// VM ID property lets finder look up containers without listing all of them
+const (
+	vmIDPropertyName    = "bosh-warden-cpi.vm-id"
+	agentIDPropertyName = "bosh-warden-cpi.agent-id"
+)
+
 type WardenCreator struct {
 	uuidGen boshuuid.Generator
 
-	wardenClient           wrdn.Client
+	wardenClient           WardenClient
 	metadataService        MetadataService
 	agentEnvServiceFactory AgentEnvServiceFactory
 
 	hostBindMounts  HostBindMounts
 	guestBindMounts GuestBindMounts
 
-	agentOptions AgentOptions
-	logger       boshlog.Logger
+	agentOptions   AgentOptions
+	requestContext bwcapi.RequestContext
+	logger         boshlog.Logger
 }
 
 func NewWardenCreator(
 	uuidGen boshuuid.Generator,
-	wardenClient wrdn.Client,
+	wardenClient WardenClient,
 	metadataService MetadataService,
 	agentEnvServiceFactory AgentEnvServiceFactory,
 	hostBindMounts HostBindMounts,
 	guestBindMounts GuestBindMounts,
 	agentOptions AgentOptions,
+	requestContext bwcapi.RequestContext,
 	logger boshlog.Logger,
 ) WardenCreator {
 	return WardenCreator{
@@ -45,25 +64,30 @@ func NewWardenCreator(
 		hostBindMounts:  hostBindMounts,
 		guestBindMounts: guestBindMounts,
 
-		agentOptions: agentOptions,
-		logger:       logger,
+		agentOptions:   agentOptions,
+		requestContext: requestContext,
+		logger:         logger,
 	}
 }
 
-func (c WardenCreator) Create(agentID string, stemcell bwcstem.Stemcell, networks Networks, env Environment) (VM, error) {
+func (c WardenCreator) Create(ctx context.Context, agentID string, stemcell bwcstem.Stemcell, networks Networks, env Environment) (VM, Networks, error) {
 	id, err := c.uuidGen.Generate()
 	if err != nil {
-		return WardenVM{}, bosherr.WrapError(err, "Generating VM id")
+		return WardenVM{}, nil, bosherr.WrapError(err, "Generating VM id")
 	}
 
 	networkIP, err := c.resolveNetworkIP(networks)
 	if err != nil {
-		return WardenVM{}, err
+		return WardenVM{}, nil, err
 	}
 
-	hostEphemeralBindMountPath, hostPersistentBindMountsDir, err := c.makeHostBindMounts(id)
+	// Each completed step records how to undo it so that failure
+	// at any later step does not leave containers, mounts or settings behind
+	rollback := newRollback(c.logger)
+
+	hostEphemeralBindMountPath, hostPersistentBindMountsDir, err := c.makeHostBindMounts(ctx, id, rollback)
 	if err != nil {
-		return WardenVM{}, err
+		return WardenVM{}, nil, rollback.Run(err)
 	}
 
 	containerSpec := wrdn.ContainerSpec{
@@ -84,37 +108,48 @@ func (c WardenCreator) Create(agentID string, stemcell bwcstem.Stemcell, network
 				Origin:  wrdn.BindMountOriginHost,
 			},
 		},
-		Properties: wrdn.Properties{},
+		Properties: c.containerProperties(id, agentID, stemcell),
 	}
 
-	c.logger.Debug(wardenCreatorLogTag, "Creating container with spec %#v", containerSpec)
+	c.logger.Debug(wardenCreatorLogTag, "Creating container with spec %s", bwcutil.Redact(containerSpec))
 
-	container, err := c.wardenClient.Create(containerSpec)
+	container, err := c.wardenClient.Create(ctx, containerSpec)
 	if err != nil {
-		return WardenVM{}, bosherr.WrapError(err, "Creating container")
+		return WardenVM{}, nil, rollback.Run(bosherr.WrapError(err, "Creating container"))
 	}
 
+	rollback.Add("Destroying container", func(ctx context.Context) error {
+		return c.wardenClient.Destroy(ctx, id)
+	})
+
 	agentEnv := NewAgentEnvForVM(agentID, id, networks, env, c.agentOptions)
 
 	wardenFileService := NewWardenFileService(container, c.logger)
 	agentEnvService := c.agentEnvServiceFactory.New(wardenFileService, id)
 
-	err = agentEnvService.Update(agentEnv)
+	// Registry may have stored settings even if update reported failure
+	rollback.Add("Deleting agent env", func(ctx context.Context) error {
+		return agentEnvService.Delete(ctx)
+	})
+
+	err = agentEnvService.Update(ctx, agentEnv)
 	if err != nil {
-		c.cleanUpContainer(container)
-		return WardenVM{}, bosherr.WrapError(err, "Updating container's agent env")
+		return WardenVM{}, nil, rollback.Run(bosherr.WrapError(err, "Updating container's agent env"))
 	}
 
-	err = c.metadataService.Save(wardenFileService, id)
+	err = c.metadataService.Save(ctx, wardenFileService, id)
 	if err != nil {
-		c.cleanUpContainer(container)
-		return WardenVM{}, bosherr.WrapError(err, "Updating container's metadata")
+		return WardenVM{}, nil, rollback.Run(bosherr.WrapError(err, "Updating container's metadata"))
 	}
 
-	err = c.startAgentInContainer(container)
+	err = c.startAgentInContainer(ctx, container)
 	if err != nil {
-		c.cleanUpContainer(container)
-		return WardenVM{}, err
+		return WardenVM{}, nil, rollback.Run(err)
+	}
+
+	resolvedNetworks, err := c.resolveNetworks(ctx, container, networks)
+	if err != nil {
+		return WardenVM{}, nil, rollback.Run(err)
 	}
 
 	vm := NewWardenVM(
@@ -127,7 +162,26 @@ func (c WardenCreator) Create(agentID string, stemcell bwcstem.Stemcell, network
 		true,
 	)
 
-	return vm, nil
+	return vm, resolvedNetworks, nil
+}
+
+func (c WardenCreator) containerProperties(id, agentID string, stemcell bwcstem.Stemcell) wrdn.Properties {
+	props := wrdn.Properties{
+		vmIDPropertyName:       id,
+		agentIDPropertyName:    agentID,
+		stemcellIDPropertyName: stemcell.ID(),
+	}
+
+	// Older Directors do not send request context
+	if len(c.requestContext.DirectorUUID) > 0 {
+		props[directorUUIDPropertyName] = c.requestContext.DirectorUUID
+	}
+
+	if len(c.requestContext.RequestID) > 0 {
+		props[createRequestIDPropertyName] = c.requestContext.RequestID
+	}
+
+	return props
 }
 
 func (c WardenCreator) resolveNetworkIP(networks Networks) (string, error) {
@@ -149,12 +203,42 @@ func (c WardenCreator) resolveNetworkIP(networks Networks) (string, error) {
 	return network.IP, nil
 }
 
-func (c WardenCreator) makeHostBindMounts(id string) (string, string, error) {
+// resolveNetworks fills in IPs that Garden assigned for dynamic networks
+func (c WardenCreator) resolveNetworks(ctx context.Context, container WardenContainer, networks Networks) (Networks, error) {
+	resolvedNetworks := Networks{}
+
+	for netName, network := range networks {
+		if network.IsDynamic() {
+			info, err := container.Info(ctx)
+			if err != nil {
+				return nil, bosherr.WrapError(err, "Fetching container info")
+			}
+
+			network.IP = info.ContainerIP
+		}
+
+		resolvedNetworks[netName] = network
+	}
+
+	return resolvedNetworks, nil
+}
+
+// makeHostBindMounts records deletion of bind mounts before making them
+// since making them may fail half way (e.g. after bind mounting persistent dir)
+func (c WardenCreator) makeHostBindMounts(ctx context.Context, id string, rollback *rollback) (string, string, error) {
+	rollback.Add("Deleting host ephemeral bind mount path", func(_ context.Context) error {
+		return c.hostBindMounts.DeleteEphemeral(id)
+	})
+
 	ephemeralBindMountPath, err := c.hostBindMounts.MakeEphemeral(id)
 	if err != nil {
 		return "", "", bosherr.WrapError(err, "Making host ephemeral bind mount path")
 	}
 
+	rollback.Add("Deleting host persistent bind mounts dir", func(ctx context.Context) error {
+		return c.hostBindMounts.DeletePersistent(ctx, id)
+	})
+
 	persistentBindMountsDir, err := c.hostBindMounts.MakePersistent(id)
 	if err != nil {
 		return "", "", bosherr.WrapError(err, "Making host persistent bind mounts dir")
@@ -163,25 +247,17 @@ func (c WardenCreator) makeHostBindMounts(id string) (string, string, error) {
 	return ephemeralBindMountPath, persistentBindMountsDir, nil
 }
 
-func (c WardenCreator) startAgentInContainer(container wrdn.Container) error {
+func (c WardenCreator) startAgentInContainer(ctx context.Context, container WardenContainer) error {
 	processSpec := wrdn.ProcessSpec{
 		Path:       "/usr/sbin/runsvdir-start",
 		Privileged: true,
 	}
 
 	// Do not Wait() for the process to finish
-	_, err := container.Run(processSpec, wrdn.ProcessIO{})
+	_, err := container.Run(ctx, processSpec, wrdn.ProcessIO{})
 	if err != nil {
 		return bosherr.WrapError(err, "Running BOSH Agent in container")
 	}
 
 	return nil
 }
-
-func (c WardenCreator) cleanUpContainer(container wrdn.Container) {
-	// false is to kill immediately
-	err := container.Stop(false)
-	if err != nil {
-		c.logger.Error(wardenCreatorLogTag, "Failed destroying container '%s': %s", container.Handle, err.Error())
-	}
-}
@@ -1,6 +1,8 @@
 package vm_test
 
 import (
+	"bytes"
+	"context"
 	"errors"
 
 	. "github.com/onsi/ginkgo"
@@ -10,6 +12,7 @@ import (
 	wrdn "github.com/cloudfoundry-incubator/garden/warden"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	fakeuuid "github.com/cloudfoundry/bosh-agent/uuid/fakes"
+	bwcapi "github.com/cppforlife/bosh-warden-cpi/api"
 	fakestem "github.com/cppforlife/bosh-warden-cpi/stemcell/fakes"
 	fakevm "github.com/cppforlife/bosh-warden-cpi/vm/fakes"
 
@@ -25,6 +28,8 @@ var _ = Describe("WardenCreator", func() {
 		hostBindMounts         *fakevm.FakeHostBindMounts
 		guestBindMounts        *fakevm.FakeGuestBindMounts
 		agentOptions           AgentOptions
+		requestContext         bwcapi.RequestContext
+		logOut                 *bytes.Buffer
 		logger                 boshlog.Logger
 		creator                WardenCreator
 	)
@@ -40,16 +45,19 @@ var _ = Describe("WardenCreator", func() {
 			PersistentBindMountsDir: "/fake-guest-persistent-bind-mounts-dir",
 		}
 		agentOptions = AgentOptions{Mbus: "fake-mbus"}
-		logger = boshlog.NewLogger(boshlog.LevelNone)
+		requestContext = bwcapi.RequestContext{}
+		logOut = bytes.NewBufferString("")
+		logger = boshlog.NewWriterLogger(boshlog.LevelDebug, logOut, logOut)
 
 		creator = NewWardenCreator(
 			uuidGen,
-			wardenClient,
+			NewCancellableWardenClient(wardenClient, logger),
 			fakeMetadataService,
 			agentEnvServiceFactory,
 			hostBindMounts,
 			guestBindMounts,
 			agentOptions,
+			requestContext,
 			logger,
 		)
 	})
@@ -80,7 +88,7 @@ var _ = Describe("WardenCreator", func() {
 
 			expectedVM := NewWardenVM(
 				"fake-vm-id",
-				wardenClient,
+				NewCancellableWardenClient(wardenClient, logger),
 				agentEnvService,
 				hostBindMounts,
 				guestBindMounts,
@@ -88,18 +96,112 @@ var _ = Describe("WardenCreator", func() {
 				true,
 			)
 
-			vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+			vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 			Expect(err).ToNot(HaveOccurred())
 			Expect(vm).To(Equal(expectedVM))
 		})
 
+		It("does not roll back anything when creation succeeds", func() {
+			uuidGen.GeneratedUuid = "fake-vm-id"
+
+			agentEnvService := &fakevm.FakeAgentEnvService{}
+			agentEnvServiceFactory.NewAgentEnvService = agentEnvService
+
+			_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(wardenClient.Connection.DestroyCallCount()).To(Equal(0))
+			Expect(agentEnvService.DeleteCalled).To(BeFalse())
+			Expect(hostBindMounts.DeleteEphemeralCalled).To(BeFalse())
+			Expect(hostBindMounts.DeletePersistentCalled).To(BeFalse())
+		})
+
+		It("logs container spec without agent secrets", func() {
+			uuidGen.GeneratedUuid = "fake-vm-id"
+			agentEnvServiceFactory.NewAgentEnvService = &fakevm.FakeAgentEnvService{}
+
+			agentEnvWithSecrets := NewAgentEnvWithSecrets()
+
+			agentOptions.Mbus = agentEnvWithSecrets.Mbus
+			agentOptions.Blobstore = BlobstoreOptions{
+				Type:    agentEnvWithSecrets.Blobstore.Provider,
+				Options: agentEnvWithSecrets.Blobstore.Options,
+			}
+
+			creator = NewWardenCreator(
+				uuidGen,
+				NewCancellableWardenClient(wardenClient, logger),
+				fakeMetadataService,
+				agentEnvServiceFactory,
+				hostBindMounts,
+				guestBindMounts,
+				agentOptions,
+				requestContext,
+				logger,
+			)
+
+			env = Environment(agentEnvWithSecrets.Env)
+
+			_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(logOut.String()).To(ContainSubstring("Creating container with spec"))
+
+			for _, secret := range agentEnvSecrets {
+				Expect(logOut.String()).ToNot(ContainSubstring(secret))
+			}
+		})
+
+		It("returns provided networks when networks are not dynamic", func() {
+			uuidGen.GeneratedUuid = "fake-vm-id"
+			agentEnvServiceFactory.NewAgentEnvService = &fakevm.FakeAgentEnvService{}
+
+			networks = Networks{"fake-net-name": Network{IP: "fake-ip"}}
+
+			_, resolvedNetworks, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolvedNetworks).To(Equal(networks))
+
+			Expect(wardenClient.Connection.InfoCallCount()).To(Equal(0))
+		})
+
+		It("returns networks with container IP when network is dynamic", func() {
+			uuidGen.GeneratedUuid = "fake-vm-id"
+			agentEnvServiceFactory.NewAgentEnvService = &fakevm.FakeAgentEnvService{}
+
+			wardenClient.Connection.InfoReturns(wrdn.ContainerInfo{ContainerIP: "fake-container-ip"}, nil)
+
+			networks = Networks{"fake-net-name": Network{Type: "dynamic"}}
+
+			_, resolvedNetworks, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resolvedNetworks).To(Equal(Networks{
+				"fake-net-name": Network{Type: "dynamic", IP: "fake-container-ip"},
+			}))
+		})
+
+		It("returns error and destroys container if fetching container info for dynamic network fails", func() {
+			uuidGen.GeneratedUuid = "fake-vm-id"
+			agentEnvServiceFactory.NewAgentEnvService = &fakevm.FakeAgentEnvService{}
+
+			wardenClient.Connection.InfoReturns(wrdn.ContainerInfo{}, errors.New("fake-info-err"))
+
+			networks = Networks{"fake-net-name": Network{Type: "dynamic"}}
+
+			_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-info-err"))
+
+			Expect(wardenClient.Connection.DestroyCallCount()).To(Equal(1))
+		})
+
 		Context("when generating VM id succeeds", func() {
 			BeforeEach(func() {
 				uuidGen.GeneratedUuid = "fake-vm-id"
 			})
 
 			It("returns error if zero networks are provided", func() {
-				vm, err := creator.Create("fake-agent-id", stemcell, Networks{}, env)
+				vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, Networks{}, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(Equal("Expected exactly one network; received zero"))
 				Expect(vm).To(Equal(WardenVM{}))
@@ -108,14 +210,14 @@ var _ = Describe("WardenCreator", func() {
 			It("returns error if more than one network is provided", func() {
 				networks = Networks{"fake-net1": Network{}, "fake-net2": Network{}}
 
-				vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(Equal("Expected exactly one network; received multiple"))
 				Expect(vm).To(Equal(WardenVM{}))
 			})
 
 			It("creates one container with generated VM id", func() {
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				count := wardenClient.Connection.CreateCallCount()
@@ -126,7 +228,7 @@ var _ = Describe("WardenCreator", func() {
 			})
 
 			It("creates container with stemcell as its root fs", func() {
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				containerSpec := wardenClient.Connection.CreateArgsForCall(0)
@@ -137,7 +239,7 @@ var _ = Describe("WardenCreator", func() {
 				hostBindMounts.MakeEphemeralPath = "/fake-host-ephemeral-bind-mount-path"
 				hostBindMounts.MakePersistentPath = "/fake-host-persistent-bind-mounts-dir"
 
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				containerSpec := wardenClient.Connection.CreateArgsForCall(0)
@@ -165,17 +267,26 @@ var _ = Describe("WardenCreator", func() {
 			It("returns error if making host ephemeral bind mount fails", func() {
 				hostBindMounts.MakeEphemeralErr = errors.New("fake-make-ephemeral-err")
 
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-make-ephemeral-err"))
+
+				Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
+				Expect(hostBindMounts.DeletePersistentCalled).To(BeFalse())
+				Expect(wardenClient.Connection.CreateCallCount()).To(Equal(0))
 			})
 
 			It("returns error if making host persistent bind mount fails", func() {
 				hostBindMounts.MakePersistentErr = errors.New("fake-make-persistent-err")
 
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-make-persistent-err"))
+
+				// Persistent dir may have been bind mounted before failure
+				Expect(hostBindMounts.DeletePersistentID).To(Equal("fake-vm-id"))
+				Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
+				Expect(wardenClient.Connection.CreateCallCount()).To(Equal(0))
 			})
 
 			It("creates container with IP address if network is not dynamic", func() {
@@ -184,7 +295,7 @@ var _ = Describe("WardenCreator", func() {
 					IP:   "fake-ip",
 				}
 
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				containerSpec := wardenClient.Connection.CreateArgsForCall(0)
@@ -197,19 +308,54 @@ var _ = Describe("WardenCreator", func() {
 					IP:   "fake-ip", // is not usually set
 				}
 
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				containerSpec := wardenClient.Connection.CreateArgsForCall(0)
 				Expect(containerSpec.Network).To(BeEmpty()) // fake-ip is not used
 			})
 
-			It("creates container without properties", func() {
-				_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+			It("creates container with CPI-owned properties so that container can be found by VM ID", func() {
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).ToNot(HaveOccurred())
 
 				containerSpec := wardenClient.Connection.CreateArgsForCall(0)
-				Expect(containerSpec.Properties).To(Equal(wrdn.Properties{}))
+				Expect(containerSpec.Properties).To(Equal(wrdn.Properties{
+					"bosh-warden-cpi.vm-id":       "fake-vm-id",
+					"bosh-warden-cpi.agent-id":    "fake-agent-id",
+					"bosh-warden-cpi.stemcell-id": "fake-stemcell-id",
+				}))
+			})
+
+			It("creates container with director uuid and request id properties when request context is provided", func() {
+				requestContext = bwcapi.RequestContext{
+					DirectorUUID: "fake-director-uuid",
+					RequestID:    "fake-request-id",
+				}
+
+				creator = NewWardenCreator(
+					uuidGen,
+					NewCancellableWardenClient(wardenClient, logger),
+					fakeMetadataService,
+					agentEnvServiceFactory,
+					hostBindMounts,
+					guestBindMounts,
+					agentOptions,
+					requestContext,
+					logger,
+				)
+
+				_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+				Expect(err).ToNot(HaveOccurred())
+
+				containerSpec := wardenClient.Connection.CreateArgsForCall(0)
+				Expect(containerSpec.Properties).To(Equal(wrdn.Properties{
+					"bosh-warden-cpi.vm-id":             "fake-vm-id",
+					"bosh-warden-cpi.agent-id":          "fake-agent-id",
+					"bosh-warden-cpi.stemcell-id":       "fake-stemcell-id",
+					"bosh-warden-cpi.director-uuid":     "fake-director-uuid",
+					"bosh-warden-cpi.create-request-id": "fake-request-id",
+				}))
 			})
 
 			Context("when creating container succeeds", func() {
@@ -224,7 +370,7 @@ var _ = Describe("WardenCreator", func() {
 				})
 
 				It("updates container's agent env", func() {
-					_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+					_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 					Expect(err).ToNot(HaveOccurred())
 
 					expectedAgentEnv := NewAgentEnvForVM(
@@ -242,7 +388,7 @@ var _ = Describe("WardenCreator", func() {
 
 				It("saves metadata", func() {
 					wardenClient.Connection.CreateReturns("fake-container-handle", nil)
-					_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+					_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 					Expect(err).ToNot(HaveOccurred())
 
 					Expect(fakeMetadataService.Saved).To(BeTrue())
@@ -251,34 +397,53 @@ var _ = Describe("WardenCreator", func() {
 
 				ItDestroysContainer := func(errMsg string) {
 					It("destroys created container", func() {
-						_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+						_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 						Expect(err).To(HaveOccurred())
 
-						count := wardenClient.Connection.StopCallCount()
+						count := wardenClient.Connection.DestroyCallCount()
 						Expect(count).To(Equal(1))
 
-						handle, force := wardenClient.Connection.StopArgsForCall(0)
+						handle := wardenClient.Connection.DestroyArgsForCall(0)
 						Expect(handle).To(Equal("fake-vm-id"))
-						Expect(force).To(BeFalse())
 					})
 
-					Context("when destroying created container fails", func() {
+					It("deletes agent env and host bind mounts", func() {
+						_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+						Expect(err).To(HaveOccurred())
+
+						Expect(agentEnvService.DeleteCalled).To(BeTrue())
+						Expect(hostBindMounts.DeletePersistentID).To(Equal("fake-vm-id"))
+						Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
+					})
+
+					Context("when rolling back fails", func() {
 						BeforeEach(func() {
-							wardenClient.Connection.StopReturns(errors.New("fake-stop-err"))
+							wardenClient.Connection.DestroyReturns(errors.New("fake-destroy-err"))
+							hostBindMounts.DeletePersistentErr = errors.New("fake-delete-persistent-err")
 						})
 
-						It("returns running error and not destroy error", func() {
-							vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+						It("returns original error together with rollback errors", func() {
+							vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 							Expect(err).To(HaveOccurred())
 							Expect(err.Error()).To(ContainSubstring(errMsg))
+							Expect(err.Error()).To(ContainSubstring("Destroying container: fake-destroy-err"))
+							Expect(err.Error()).To(ContainSubstring("fake-delete-persistent-err"))
 							Expect(vm).To(Equal(WardenVM{}))
 						})
+
+						It("continues rolling back remaining steps", func() {
+							_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+							Expect(err).To(HaveOccurred())
+
+							Expect(agentEnvService.DeleteCalled).To(BeTrue())
+							Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
+						})
 					})
 				}
 
 				Context("when container's agent env succeeds", func() {
 					It("starts BOSH Agent in the container", func() {
-						_, err := creator.Create("fake-agent-id", stemcell, networks, env)
+						_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 						Expect(err).ToNot(HaveOccurred())
 
 						count := wardenClient.Connection.RunCallCount()
@@ -301,13 +466,34 @@ var _ = Describe("WardenCreator", func() {
 						})
 
 						It("returns error if starting BOSH Agent fails", func() {
-							vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+							vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 							Expect(err).To(HaveOccurred())
 							Expect(err.Error()).To(ContainSubstring("fake-run-err"))
 							Expect(vm).To(Equal(WardenVM{}))
 						})
 
 						ItDestroysContainer("fake-run-err")
+
+						It("rolls back even if request is cancelled before rolling back", func() {
+							ctx, cancel := context.WithCancel(context.Background())
+							defer cancel()
+
+							wardenClient.Connection.RunStub = func(_ string, _ wrdn.ProcessSpec, _ wrdn.ProcessIO) (wrdn.Process, error) {
+								cancel()
+								return nil, errors.New("fake-run-err")
+							}
+
+							_, _, err := creator.Create(ctx, "fake-agent-id", stemcell, networks, env)
+							Expect(err).To(HaveOccurred())
+							Expect(err.Error()).ToNot(ContainSubstring("rollback errors"))
+
+							Expect(wardenClient.Connection.DestroyCallCount()).To(Equal(1))
+							Expect(wardenClient.Connection.DestroyArgsForCall(0)).To(Equal("fake-vm-id"))
+
+							Expect(agentEnvService.DeleteCalled).To(BeTrue())
+							Expect(hostBindMounts.DeletePersistentID).To(Equal("fake-vm-id"))
+							Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
+						})
 					})
 				})
 
@@ -317,7 +503,7 @@ var _ = Describe("WardenCreator", func() {
 					})
 
 					It("returns error because BOSH Agent will fail to start without agent env", func() {
-						vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+						vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 						Expect(err).To(HaveOccurred())
 						Expect(err.Error()).To(ContainSubstring("fake-update-err"))
 						Expect(vm).To(Equal(WardenVM{}))
@@ -333,11 +519,20 @@ var _ = Describe("WardenCreator", func() {
 				})
 
 				It("returns error if creating container fails", func() {
-					vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+					vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-create-err"))
 					Expect(vm).To(Equal(WardenVM{}))
 				})
+
+				It("deletes host bind mounts but does not destroy container", func() {
+					_, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
+					Expect(err).To(HaveOccurred())
+
+					Expect(hostBindMounts.DeletePersistentID).To(Equal("fake-vm-id"))
+					Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
+					Expect(wardenClient.Connection.DestroyCallCount()).To(Equal(0))
+				})
 			})
 		})
 
@@ -347,7 +542,7 @@ var _ = Describe("WardenCreator", func() {
 			})
 
 			It("returns error if generating VM id fails", func() {
-				vm, err := creator.Create("fake-agent-id", stemcell, networks, env)
+				vm, _, err := creator.Create(context.Background(), "fake-agent-id", stemcell, networks, env)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-generate-err"))
 				Expect(vm).To(Equal(WardenVM{}))
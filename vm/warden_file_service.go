@@ -3,28 +3,34 @@ package vm
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 
 	wrdn "github.com/cloudfoundry-incubator/garden/warden"
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+
+	bwcutil "github.com/cppforlife/bosh-warden-cpi/util"
 )
 
 type WardenFileService interface {
-	Upload(string, []byte) error
-	Download(string) ([]byte, error)
+	Upload(context.Context, string, []byte) error
+	Download(context.Context, string) ([]byte, error)
 }
 
 type wardenFileService struct {
-	container wrdn.Container
+	container WardenContainer
 	logger    boshlog.Logger
 	logTag    string
 }
 
-func NewWardenFileService(container wrdn.Container, logger boshlog.Logger) WardenFileService {
+func NewWardenFileService(container WardenContainer, logger boshlog.Logger) WardenFileService {
 	return &wardenFileService{
 		container: container,
 		logger:    logger,
@@ -32,32 +38,43 @@ func NewWardenFileService(container wrdn.Container, logger boshlog.Logger) Warde
 	}
 }
 
-func (s *wardenFileService) Download(sourcePath string) ([]byte, error) {
+func (s *wardenFileService) Download(ctx context.Context, sourcePath string) ([]byte, error) {
 	sourceFileName := filepath.Base(sourcePath)
-	tmpFilePath := filepath.Join("/tmp", sourceFileName)
+
+	tmpDirPath, err := s.tmpPath("/tmp/warden-cpi-")
+	if err != nil {
+		return []byte{}, err
+	}
+
+	tmpFilePath := filepath.Join(tmpDirPath, sourceFileName)
 
 	s.logger.Debug(s.logTag, "Downloading file at %s", sourcePath)
 
 	// Copy settings file to a temporary directory
 	// so that tar (running as vcap) has permission to readdir.
 	// (/var/vcap/bosh is owned by root.)
+	// Directory is created exclusively so that its contents cannot be pre-created by others.
 	script := fmt.Sprintf(
-		"cp %s %s && chown vcap:vcap %s",
-		sourcePath,
-		tmpFilePath,
-		tmpFilePath,
+		"mkdir -m 0700 %[1]s || exit 1; cp %[2]s %[3]s && chown -R vcap:vcap %[1]s || { rm -rf %[1]s; exit 1; }",
+		shellQuote(tmpDirPath),
+		shellQuote(sourcePath),
+		shellQuote(tmpFilePath),
 	)
 
-	err := s.runPrivilegedScript(script)
+	err = s.runPrivilegedScript(ctx, script)
 	if err != nil {
 		return []byte{}, bosherr.WrapError(err, "Running copy source file script")
 	}
 
-	streamOut, err := s.container.StreamOut(tmpFilePath)
+	defer s.removeTmpDir(tmpDirPath)
+
+	streamOut, err := s.container.StreamOut(ctx, tmpFilePath)
 	if err != nil {
 		return []byte{}, bosherr.WrapError(err, "Streaming out file %s", sourceFileName)
 	}
 
+	defer streamOut.Close()
+
 	tarReader := tar.NewReader(streamOut)
 
 	_, err = tarReader.Next()
@@ -68,40 +85,97 @@ func (s *wardenFileService) Download(sourcePath string) ([]byte, error) {
 	return ioutil.ReadAll(tarReader)
 }
 
-func (s *wardenFileService) Upload(destinationPath string, contents []byte) error {
+func (s *wardenFileService) Upload(ctx context.Context, destinationPath string, contents []byte) error {
 	s.logger.Debug(s.logTag, "Uploading file to %s", destinationPath)
 
 	destinationFileName := filepath.Base(destinationPath)
 
+	tmpDirPath, err := s.tmpPath("/tmp/warden-cpi-")
+	if err != nil {
+		return err
+	}
+
 	// Stream in settings file to a temporary directory
 	// so that tar (running as vcap) has permission to unpack into dir.
+	// Directory is created exclusively so that its contents cannot be pre-created by others.
+	script := fmt.Sprintf(
+		"mkdir -m 0700 %[1]s && chown vcap:vcap %[1]s",
+		shellQuote(tmpDirPath),
+	)
+
+	err = s.runPrivilegedScript(ctx, script)
+	if err != nil {
+		return bosherr.WrapError(err, "Creating temporary directory")
+	}
+
 	tarReader, err := s.tarReader(destinationFileName, contents)
 	if err != nil {
+		s.removeTmpDir(tmpDirPath)
 		return bosherr.WrapError(err, "Creating tar")
 	}
 
-	err = s.container.StreamIn("/tmp/", tarReader)
+	err = s.container.StreamIn(ctx, tmpDirPath+"/", tarReader)
 	if err != nil {
+		s.removeTmpDir(tmpDirPath)
 		return bosherr.WrapError(err, "Streaming in tar")
 	}
 
-	tmpFilePath := filepath.Join("/tmp", destinationFileName)
-	// Move settings file to its final location
-	script := fmt.Sprintf(
-		"mv %s %s",
-		tmpFilePath,
-		destinationPath,
+	tmpFilePath := filepath.Join(tmpDirPath, destinationFileName)
+
+	// Temporary directory might be on a different filesystem than destination
+	// so file is first copied next to destination and then renamed over it
+	stagedFilePath, err := s.tmpPath(filepath.Join(filepath.Dir(destinationPath), "."+destinationFileName+"."))
+	if err != nil {
+		s.removeTmpDir(tmpDirPath)
+		return err
+	}
+
+	// Move settings file to its final location.
+	// Temporary directory is writable by vcap so file in it might have been replaced by a symlink;
+	// symlink is copied as is (-P) and only a regular file is moved over destination.
+	script = fmt.Sprintf(
+		"cp -P -p %[1]s %[2]s && [ -f %[2]s ] && [ ! -L %[2]s ] && mv -f %[2]s %[3]s; status=$?; rm -rf %[4]s; rm -f %[2]s; exit $status",
+		shellQuote(tmpFilePath),
+		shellQuote(stagedFilePath),
+		shellQuote(destinationPath),
+		shellQuote(tmpDirPath),
 	)
 
-	err = s.runPrivilegedScript(script)
+	err = s.runPrivilegedScript(ctx, script)
 	if err != nil {
+		// Script might not have run at all if request was cancelled
+		s.removeTmpDir(tmpDirPath)
 		return bosherr.WrapError(err, "Moving temporary file to destination %s", destinationPath)
 	}
 
 	return nil
 }
 
-func (s *wardenFileService) runPrivilegedScript(script string) error {
+// tmpPath returns unpredictable path with a given prefix
+func (s *wardenFileService) tmpPath(prefix string) (string, error) {
+	randBytes := make([]byte, 16)
+
+	_, err := rand.Read(randBytes)
+	if err != nil {
+		return "", bosherr.WrapError(err, "Generating temporary path")
+	}
+
+	return prefix + hex.EncodeToString(randBytes), nil
+}
+
+// removeTmpDir is not bound to request's context since request
+// might have been cancelled already but temporary files must not be left behind
+func (s *wardenFileService) removeTmpDir(tmpDirPath string) {
+	ctx, cancel := bwcutil.NewCleanupContext()
+	defer cancel()
+
+	err := s.runPrivilegedScript(ctx, fmt.Sprintf("rm -rf %s", shellQuote(tmpDirPath)))
+	if err != nil {
+		s.logger.Error(s.logTag, "Removing temporary directory %s: %s", tmpDirPath, err)
+	}
+}
+
+func (s *wardenFileService) runPrivilegedScript(ctx context.Context, script string) error {
 	processSpec := wrdn.ProcessSpec{
 		Path: "bash",
 		Args: []string{"-c", script},
@@ -109,12 +183,12 @@ func (s *wardenFileService) runPrivilegedScript(script string) error {
 		Privileged: true,
 	}
 
-	process, err := s.container.Run(processSpec, wrdn.ProcessIO{})
+	process, err := s.container.Run(ctx, processSpec, wrdn.ProcessIO{})
 	if err != nil {
 		return bosherr.WrapError(err, "Running script")
 	}
 
-	exitCode, err := process.Wait()
+	exitCode, err := process.Wait(ctx)
 	if err != nil {
 		return bosherr.WrapError(err, "Waiting for script")
 	}
@@ -154,3 +228,8 @@ func (s *wardenFileService) tarReader(fileName string, contents []byte) (io.Read
 
 	return tarBytes, nil
 }
+
+// shellQuote returns single-quoted string safe to be interpolated into a bash script
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'"'"'`, -1) + "'"
+}
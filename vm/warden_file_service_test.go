@@ -3,9 +3,11 @@ package vm_test
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"io/ioutil"
+	"path/filepath"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -34,10 +36,11 @@ var _ = Describe("WardenFileService", func() {
 			RootFSPath: "fake-root-fs-path",
 		}
 
-		container, err := wardenClient.Create(containerSpec)
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+
+		container, err := NewCancellableWardenClient(wardenClient, logger).Create(context.Background(), containerSpec)
 		Expect(err).ToNot(HaveOccurred())
 
-		logger := boshlog.NewLogger(boshlog.LevelNone)
 		wardenFileService = NewWardenFileService(container, logger)
 	})
 
@@ -52,8 +55,41 @@ var _ = Describe("WardenFileService", func() {
 			wardenClient.Connection.RunReturns(runProcess, nil)
 		})
 
-		It("places content into the container at /tmp/destination", func() {
-			err := wardenFileService.Upload("/var/vcap/file.ext", []byte("fake-contents"))
+		runScript := func(i int) string {
+			handle, processSpec, processIO := wardenClient.Connection.RunArgsForCall(i)
+			Expect(handle).To(Equal("fake-vm-id"))
+			Expect(processSpec.Path).To(Equal("bash"))
+			Expect(processSpec.Privileged).To(BeTrue())
+			Expect(processIO).To(Equal(wrdn.ProcessIO{}))
+			Expect(processSpec.Args).To(HaveLen(2))
+			Expect(processSpec.Args[0]).To(Equal("-c"))
+			return processSpec.Args[1]
+		}
+
+		tmpDirPattern := `/tmp/warden-cpi-[0-9a-f]{32}`
+
+		It("exclusively creates unique temporary directory owned by vcap", func() {
+			err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(runScript(0)).To(MatchRegexp(
+				`^mkdir -m 0700 '(` + tmpDirPattern + `)' && chown vcap:vcap '` + tmpDirPattern + `'$`))
+		})
+
+		It("uses different temporary directory for every upload", func() {
+			err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
+			Expect(err).ToNot(HaveOccurred())
+
+			err = wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, dstPath1, _ := wardenClient.Connection.StreamInArgsForCall(0)
+			_, dstPath2, _ := wardenClient.Connection.StreamInArgsForCall(1)
+			Expect(dstPath1).ToNot(Equal(dstPath2))
+		})
+
+		It("places content into the container in temporary directory", func() {
+			err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
 			Expect(err).ToNot(HaveOccurred())
 
 			count := wardenClient.Connection.StreamInCallCount()
@@ -61,54 +97,81 @@ var _ = Describe("WardenFileService", func() {
 
 			handle, dstPath, reader := wardenClient.Connection.StreamInArgsForCall(0)
 			Expect(handle).To(Equal("fake-vm-id"))
-			Expect(dstPath).To(Equal("/tmp/"))
+			Expect(dstPath).To(MatchRegexp(`^` + tmpDirPattern + `/$`))
+			Expect(runScript(0)).To(ContainSubstring(dstPath[:len(dstPath)-1]))
 
 			tarStream := tar.NewReader(reader)
 
 			header, err := tarStream.Next()
 			Expect(err).ToNot(HaveOccurred())
-			Expect(header.Name).To(Equal("file.ext")) // todo more?
-
-			contentBytes := make([]byte, header.Size)
+			Expect(header.Name).To(Equal("file.ext"))
 
-			_, err = tarStream.Read(contentBytes)
+			contentBytes, err := ioutil.ReadAll(tarStream)
 			Expect(err).ToNot(HaveOccurred())
-
 			Expect(contentBytes).To(Equal([]byte("fake-contents")))
 
 			_, err = tarStream.Next()
 			Expect(err).To(HaveOccurred())
 		})
 
+		Context("when creating temporary directory fails", func() {
+			BeforeEach(func() {
+				runProcess.WaitReturns(1, nil)
+			})
+
+			It("returns error without streaming in", func() {
+				err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("Creating temporary directory"))
+
+				Expect(wardenClient.Connection.StreamInCallCount()).To(Equal(0))
+			})
+		})
+
 		Context("when streaming into the container succeeds", func() {
-			It("moves the temporary file into the final location", func() {
-				err := wardenFileService.Upload("/var/vcap/file.ext", []byte("fake-contents"))
+			It("atomically moves the temporary file into the final location and removes temporary directory", func() {
+				err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
 				Expect(err).ToNot(HaveOccurred())
 
 				count := wardenClient.Connection.RunCallCount()
-				Expect(count).To(Equal(1))
+				Expect(count).To(Equal(2))
 
-				expectedProcessSpec := wrdn.ProcessSpec{
-					Path:       "bash",
-					Args:       []string{"-c", "mv /tmp/file.ext /var/vcap/file.ext"},
-					Privileged: true,
-				}
+				_, dstPath, _ := wardenClient.Connection.StreamInArgsForCall(0)
+				tmpDirPath := dstPath[:len(dstPath)-1]
 
-				handle, processSpec, processIO := wardenClient.Connection.RunArgsForCall(0)
-				Expect(handle).To(Equal("fake-vm-id"))
-				Expect(processSpec).To(Equal(expectedProcessSpec))
-				Expect(processIO).To(Equal(wrdn.ProcessIO{}))
+				// Staged next to destination so that mv is a rename within the same filesystem
+				Expect(runScript(1)).To(MatchRegexp(
+					`^cp -P -p '` + tmpDirPath + `/file.ext' '(/var/vcap/\.file\.ext\.[0-9a-f]{32})' && ` +
+						`\[ -f '/var/vcap/\.file\.ext\.[0-9a-f]{32}' \] && \[ ! -L '/var/vcap/\.file\.ext\.[0-9a-f]{32}' \] && ` +
+						`mv -f '/var/vcap/\.file\.ext\.[0-9a-f]{32}' '/var/vcap/file.ext'; status=\$\?; ` +
+						`rm -rf '` + tmpDirPath + `'; rm -f '/var/vcap/\.file\.ext\.[0-9a-f]{32}'; exit \$status$`))
+			})
+
+			It("quotes paths", func() {
+				err := wardenFileService.Upload(context.Background(), "/var/vcap/it's file", []byte("fake-contents"))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(runScript(1)).To(ContainSubstring(`'/var/vcap/it'"'"'s file'`))
 			})
 
 			Context("when moving the temporary file into the final location fails because command exits with non-0 code", func() {
 				BeforeEach(func() {
-					runProcess.WaitReturns(1, nil)
+					runCount := 0
+					wardenClient.Connection.RunStub = func(string, wrdn.ProcessSpec, wrdn.ProcessIO) (wrdn.Process, error) {
+						runCount++
+						process := &fakewrdn.FakeProcess{}
+						if runCount == 2 {
+							process.WaitReturns(1, nil)
+						}
+						return process, nil
+					}
 				})
 
 				It("returns error", func() {
-					err := wardenFileService.Upload("/var/vcap/file.ext", []byte("fake-contents"))
+					err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("Script exited with non-0 exit code"))
+					Expect(err.Error()).To(ContainSubstring("Moving temporary file to destination /var/vcap/file.ext"))
 				})
 			})
 
@@ -118,7 +181,7 @@ var _ = Describe("WardenFileService", func() {
 				})
 
 				It("returns error", func() {
-					err := wardenFileService.Upload("/var/vcap/file.ext", []byte("fake-contents"))
+					err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-wait-err"))
 				})
@@ -130,7 +193,7 @@ var _ = Describe("WardenFileService", func() {
 				})
 
 				It("returns error", func() {
-					err := wardenFileService.Upload("/var/vcap/file.ext", []byte("fake-contents"))
+					err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-run-err"))
 				})
@@ -143,10 +206,37 @@ var _ = Describe("WardenFileService", func() {
 			})
 
 			It("returns error", func() {
-				err := wardenFileService.Upload("/var/vcap/file.ext", []byte("fake-contents"))
+				err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-stream-in-err"))
 			})
+
+			It("removes temporary directory", func() {
+				err := wardenFileService.Upload(context.Background(), "/var/vcap/file.ext", []byte("fake-contents"))
+				Expect(err).To(HaveOccurred())
+
+				Expect(wardenClient.Connection.RunCallCount()).To(Equal(2))
+
+				_, dstPath, _ := wardenClient.Connection.StreamInArgsForCall(0)
+				Expect(runScript(1)).To(Equal("rm -rf '" + dstPath[:len(dstPath)-1] + "'"))
+			})
+
+			It("removes temporary directory even if request was cancelled", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+
+				wardenClient.Connection.StreamInStub = func(string, string, io.Reader) error {
+					cancel()
+					return errors.New("fake-stream-in-err")
+				}
+
+				err := wardenFileService.Upload(ctx, "/var/vcap/file.ext", []byte("fake-contents"))
+				Expect(err).To(HaveOccurred())
+
+				Expect(wardenClient.Connection.RunCallCount()).To(Equal(2))
+
+				_, dstPath, _ := wardenClient.Connection.StreamInArgsForCall(0)
+				Expect(runScript(1)).To(Equal("rm -rf '" + dstPath[:len(dstPath)-1] + "'"))
+			})
 		})
 	})
 
@@ -189,29 +279,31 @@ var _ = Describe("WardenFileService", func() {
 			wardenClient.Connection.StreamOutReturns(makeValidAgentEnvTar(), nil)
 		})
 
-		It("copies agent env into temporary location", func() {
-			_, err := wardenFileService.Download("/fake-download-path/file.ext")
-			Expect(err).ToNot(HaveOccurred())
-
-			count := wardenClient.Connection.RunCallCount()
-			Expect(count).To(Equal(1))
-
-			expectedProcessSpec := wrdn.ProcessSpec{
-				Path:       "bash",
-				Args:       []string{"-c", "cp /fake-download-path/file.ext /tmp/file.ext && chown vcap:vcap /tmp/file.ext"},
-				Privileged: true,
-			}
-
-			handle, processSpec, processIO := wardenClient.Connection.RunArgsForCall(0)
+		runScript := func(i int) string {
+			handle, processSpec, processIO := wardenClient.Connection.RunArgsForCall(i)
 			Expect(handle).To(Equal("fake-vm-id"))
-			Expect(processSpec).To(Equal(expectedProcessSpec))
+			Expect(processSpec.Path).To(Equal("bash"))
+			Expect(processSpec.Privileged).To(BeTrue())
 			Expect(processIO).To(Equal(wrdn.ProcessIO{}))
+			Expect(processSpec.Args).To(HaveLen(2))
+			Expect(processSpec.Args[0]).To(Equal("-c"))
+			return processSpec.Args[1]
+		}
+
+		It("copies agent env into exclusively created unique temporary directory", func() {
+			_, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(runScript(0)).To(MatchRegexp(
+				`^mkdir -m 0700 '(/tmp/warden-cpi-[0-9a-f]{32})' \|\| exit 1; ` +
+					`cp '/fake-download-path/file\.ext' '/tmp/warden-cpi-[0-9a-f]{32}/file\.ext' && ` +
+					`chown -R vcap:vcap '/tmp/warden-cpi-[0-9a-f]{32}' \|\| \{ rm -rf '/tmp/warden-cpi-[0-9a-f]{32}'; exit 1; \}$`))
 		})
 
 		Context("when copying agent env into temporary location succeeds", func() {
 			Context("when container succeeds to stream out agent env", func() {
 				It("returns agent env from temporary location in the container", func() {
-					contents, err := wardenFileService.Download("/fake-download-path/file.ext")
+					contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
 					Expect(err).ToNot(HaveOccurred())
 					Expect(contents).To(Equal([]byte("fake-contents")))
 
@@ -220,7 +312,33 @@ var _ = Describe("WardenFileService", func() {
 
 					handle, srcPath := wardenClient.Connection.StreamOutArgsForCall(0)
 					Expect(handle).To(Equal("fake-vm-id"))
-					Expect(srcPath).To(Equal("/tmp/file.ext"))
+					Expect(srcPath).To(MatchRegexp(`^/tmp/warden-cpi-[0-9a-f]{32}/file\.ext$`))
+					Expect(runScript(0)).To(ContainSubstring("'" + srcPath + "'"))
+				})
+
+				It("removes temporary directory afterwards", func() {
+					_, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(wardenClient.Connection.RunCallCount()).To(Equal(2))
+
+					_, srcPath := wardenClient.Connection.StreamOutArgsForCall(0)
+					Expect(runScript(1)).To(Equal("rm -rf '" + filepath.Dir(srcPath) + "'"))
+				})
+
+				It("returns agent env even if removing temporary directory fails", func() {
+					runCount := 0
+					wardenClient.Connection.RunStub = func(string, wrdn.ProcessSpec, wrdn.ProcessIO) (wrdn.Process, error) {
+						runCount++
+						if runCount == 2 {
+							return nil, errors.New("fake-run-err")
+						}
+						return runProcess, nil
+					}
+
+					contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(contents).To(Equal([]byte("fake-contents")))
 				})
 			})
 
@@ -230,7 +348,7 @@ var _ = Describe("WardenFileService", func() {
 				})
 
 				It("returns error", func() {
-					contents, err := wardenFileService.Download("/fake-download-path/file.ext")
+					contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("Reading tar header for file.ext"))
 					Expect(contents).To(Equal([]byte{}))
@@ -243,11 +361,19 @@ var _ = Describe("WardenFileService", func() {
 				})
 
 				It("returns error", func() {
-					contents, err := wardenFileService.Download("/fake-download-path/file.ext")
+					contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-stream-out-err"))
 					Expect(contents).To(Equal([]byte{}))
 				})
+
+				It("removes temporary directory", func() {
+					_, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
+					Expect(err).To(HaveOccurred())
+
+					Expect(wardenClient.Connection.RunCallCount()).To(Equal(2))
+					Expect(runScript(1)).To(MatchRegexp(`^rm -rf '/tmp/warden-cpi-[0-9a-f]{32}'$`))
+				})
 			})
 		})
 
@@ -257,11 +383,19 @@ var _ = Describe("WardenFileService", func() {
 			})
 
 			It("returns error", func() {
-				contents, err := wardenFileService.Download("/fake-download-path/file.ext")
+				contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("Script exited with non-0 exit code"))
 				Expect(contents).To(Equal([]byte{}))
 			})
+
+			It("does not stream out", func() {
+				_, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
+				Expect(err).To(HaveOccurred())
+
+				Expect(wardenClient.Connection.StreamOutCallCount()).To(Equal(0))
+				Expect(wardenClient.Connection.RunCallCount()).To(Equal(1))
+			})
 		})
 
 		Context("when copying file into temporary location fails", func() {
@@ -270,7 +404,7 @@ var _ = Describe("WardenFileService", func() {
 			})
 
 			It("returns error", func() {
-				contents, err := wardenFileService.Download("/fake-download-path/file.ext")
+				contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-wait-err"))
 				Expect(contents).To(Equal([]byte{}))
@@ -283,7 +417,7 @@ var _ = Describe("WardenFileService", func() {
 			})
 
 			It("returns error", func() {
-				contents, err := wardenFileService.Download("/fake-download-path/file.ext")
+				contents, err := wardenFileService.Download(context.Background(), "/fake-download-path/file.ext")
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-run-err"))
 				Expect(contents).To(Equal([]byte{}))
@@ -1,7 +1,9 @@
 package vm
 
 import (
-	wrdnclient "github.com/cloudfoundry-incubator/garden/client"
+	"context"
+
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 )
@@ -9,20 +11,24 @@ import (
 const wardenFinderLogTag = "WardenFinder"
 
 type WardenFinder struct {
-	wardenClient           wrdnclient.Client
+	wardenClient           WardenClient
 	agentEnvServiceFactory AgentEnvServiceFactory
 
 	hostBindMounts  HostBindMounts
 	guestBindMounts GuestBindMounts
 
+	// Containers created before they were tagged with VM ID only show up in full listing
+	findUntagged bool
+
 	logger boshlog.Logger
 }
 
 func NewWardenFinder(
-	wardenClient wrdnclient.Client,
+	wardenClient WardenClient,
 	agentEnvServiceFactory AgentEnvServiceFactory,
 	hostBindMounts HostBindMounts,
 	guestBindMounts GuestBindMounts,
+	findUntagged bool,
 	logger boshlog.Logger,
 ) WardenFinder {
 	return WardenFinder{
@@ -32,38 +38,37 @@ func NewWardenFinder(
 		hostBindMounts:  hostBindMounts,
 		guestBindMounts: guestBindMounts,
 
+		findUntagged: findUntagged,
+
 		logger: logger,
 	}
 }
 
-func (f WardenFinder) Find(id string) (VM, bool, error) {
+func (f WardenFinder) Find(ctx context.Context, id string) (VM, bool, error) {
 	f.logger.Debug(wardenFinderLogTag, "Finding container with ID '%s'", id)
 
-	// Cannot just use Lookup(id) since we need to differentiate between error and not found
-	containers, err := f.wardenClient.Containers(nil)
+	container, found, err := f.lookUp(ctx, id)
 	if err != nil {
-		return nil, false, bosherr.WrapError(err, "Listing all containers")
+		return nil, false, err
 	}
 
-	for _, container := range containers {
-		if container.Handle() == id {
-			f.logger.Debug(wardenFinderLogTag, "Found container with ID '%s'", id)
-
-			wardenFileService := NewWardenFileService(container, f.logger)
-			agentEnvService := f.agentEnvServiceFactory.New(wardenFileService, id)
-
-			vm := NewWardenVM(
-				id,
-				f.wardenClient,
-				agentEnvService,
-				f.hostBindMounts,
-				f.guestBindMounts,
-				f.logger,
-				true,
-			)
-
-			return vm, true, nil
-		}
+	if found {
+		f.logger.Debug(wardenFinderLogTag, "Found container with ID '%s'", id)
+
+		wardenFileService := NewWardenFileService(container, f.logger)
+		agentEnvService := f.agentEnvServiceFactory.New(wardenFileService, id)
+
+		vm := NewWardenVM(
+			id,
+			f.wardenClient,
+			agentEnvService,
+			f.hostBindMounts,
+			f.guestBindMounts,
+			f.logger,
+			true,
+		)
+
+		return vm, true, nil
 	}
 
 	f.logger.Debug(wardenFinderLogTag, "Did not find container with ID '%s'", id)
@@ -80,3 +85,38 @@ func (f WardenFinder) Find(id string) (VM, bool, error) {
 
 	return vm, false, nil
 }
+
+// lookUp finds container by VM ID property so that Garden does not have to return all containers.
+// Lookup(id) is not used since it lists all containers and does not differentiate
+// between error and not found.
+func (f WardenFinder) lookUp(ctx context.Context, id string) (WardenContainer, bool, error) {
+	containers, err := f.wardenClient.Containers(ctx, wrdn.Properties{vmIDPropertyName: id})
+	if err != nil {
+		return nil, false, bosherr.WrapError(err, "Listing containers with VM ID '%s'", id)
+	}
+
+	for _, container := range containers {
+		if container.Handle() == id {
+			return container, true, nil
+		}
+	}
+
+	if !f.findUntagged {
+		return nil, false, nil
+	}
+
+	f.logger.Debug(wardenFinderLogTag, "Did not find tagged container with ID '%s'; listing all containers", id)
+
+	containers, err = f.wardenClient.Containers(ctx, nil)
+	if err != nil {
+		return nil, false, bosherr.WrapError(err, "Listing all containers")
+	}
+
+	for _, container := range containers {
+		if container.Handle() == id {
+			return container, true, nil
+		}
+	}
+
+	return nil, false, nil
+}
@@ -1,9 +1,11 @@
 package vm_test
 
 import (
+	"context"
 	"errors"
 
 	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -30,24 +32,48 @@ var _ = Describe("WardenFinder", func() {
 		logger = boshlog.NewLogger(boshlog.LevelNone)
 
 		finder = NewWardenFinder(
-			wardenClient,
+			NewCancellableWardenClient(wardenClient, logger),
 			agentEnvServiceFactory,
 			hostBindMounts,
 			guestBindMounts,
+			false,
 			logger,
 		)
 	})
 
 	Describe("Find", func() {
-		It("returns VM and found as true if warden has container with VM ID as its handle", func() {
+		var (
+			taggedHandles []string
+			allHandles    []string
+		)
+
+		BeforeEach(func() {
+			taggedHandles = []string{}
+			allHandles = []string{}
+
+			// Garden only returns containers that have all requested properties
+			wardenClient.Connection.ListStub = func(props wrdn.Properties) ([]string, error) {
+				if props == nil {
+					return allHandles, nil
+				}
+
+				if props["bosh-warden-cpi.vm-id"] == "fake-vm-id" {
+					return taggedHandles, nil
+				}
+
+				return []string{}, nil
+			}
+		})
+
+		It("returns VM and found as true if warden has container tagged with VM ID", func() {
 			agentEnvService := &fakevm.FakeAgentEnvService{}
 			agentEnvServiceFactory.NewAgentEnvService = agentEnvService
 
-			wardenClient.Connection.ListReturns([]string{"non-matching-vm-id", "fake-vm-id"}, nil)
+			taggedHandles = []string{"fake-vm-id"}
 
 			expectedVM := NewWardenVM(
 				"fake-vm-id",
-				wardenClient,
+				NewCancellableWardenClient(wardenClient, logger),
 				agentEnvService,
 				hostBindMounts,
 				guestBindMounts,
@@ -55,23 +81,98 @@ var _ = Describe("WardenFinder", func() {
 				true,
 			)
 
-			vm, found, err := finder.Find("fake-vm-id")
+			vm, found, err := finder.Find(context.Background(), "fake-vm-id")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(found).To(BeTrue())
 			Expect(vm).To(Equal(expectedVM))
 
 			Expect(agentEnvServiceFactory.NewInstanceID).To(Equal("fake-vm-id"))
 
+			// Does not list all containers
 			Expect(wardenClient.Connection.ListCallCount()).To(Equal(1))
-			Expect(wardenClient.Connection.ListArgsForCall(0)).To(BeNil())
+			Expect(wardenClient.Connection.ListArgsForCall(0)).To(Equal(
+				wrdn.Properties{"bosh-warden-cpi.vm-id": "fake-vm-id"},
+			))
+		})
+
+		It("does not list all containers if finding untagged containers is not enabled", func() {
+			allHandles = []string{"fake-vm-id"}
+
+			_, found, err := finder.Find(context.Background(), "fake-vm-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
+
+			Expect(wardenClient.Connection.ListCallCount()).To(Equal(1))
+		})
+
+		Context("when finding untagged containers is enabled", func() {
+			BeforeEach(func() {
+				finder = NewWardenFinder(
+					NewCancellableWardenClient(wardenClient, logger),
+					agentEnvServiceFactory,
+					hostBindMounts,
+					guestBindMounts,
+					true,
+					logger,
+				)
+			})
+
+			It("returns VM and found as true if warden has untagged container with VM ID as its handle", func() {
+				agentEnvService := &fakevm.FakeAgentEnvService{}
+				agentEnvServiceFactory.NewAgentEnvService = agentEnvService
+
+				allHandles = []string{"non-matching-vm-id", "fake-vm-id"}
+
+				vm, found, err := finder.Find(context.Background(), "fake-vm-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(found).To(BeTrue())
+				Expect(vm.ID()).To(Equal("fake-vm-id"))
+
+				Expect(agentEnvServiceFactory.NewInstanceID).To(Equal("fake-vm-id"))
+
+				Expect(wardenClient.Connection.ListCallCount()).To(Equal(2))
+				Expect(wardenClient.Connection.ListArgsForCall(1)).To(BeNil())
+			})
+
+			It("returns found as false if warden does not have untagged container with VM ID as its handle", func() {
+				allHandles = []string{"non-matching-vm-id"}
+
+				_, found, err := finder.Find(context.Background(), "fake-vm-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(found).To(BeFalse())
+			})
+
+			It("returns error if listing all containers fails", func() {
+				wardenClient.Connection.ListStub = func(props wrdn.Properties) ([]string, error) {
+					if props == nil {
+						return nil, errors.New("fake-list-err")
+					}
+
+					return []string{}, nil
+				}
+
+				vm, found, err := finder.Find(context.Background(), "fake-vm-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-list-err"))
+				Expect(found).To(BeFalse())
+				Expect(vm).To(BeNil())
+			})
+		})
+
+		It("ignores tagged containers with handle different from VM ID", func() {
+			taggedHandles = []string{"non-matching-vm-id"}
+
+			_, found, err := finder.Find(context.Background(), "fake-vm-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(found).To(BeFalse())
 		})
 
 		It("returns found as false if warden does not have container with VM ID as its handle", func() {
-			wardenClient.Connection.ListReturns([]string{"non-matching-vm-id"}, nil)
+			allHandles = []string{"non-matching-vm-id"}
 
 			expectedVM := NewWardenVM(
 				"fake-vm-id",
-				wardenClient,
+				NewCancellableWardenClient(wardenClient, logger),
 				nil,
 				hostBindMounts,
 				guestBindMounts,
@@ -79,20 +180,23 @@ var _ = Describe("WardenFinder", func() {
 				false,
 			)
 
-			vm, found, err := finder.Find("fake-vm-id")
+			vm, found, err := finder.Find(context.Background(), "fake-vm-id")
 			Expect(err).ToNot(HaveOccurred())
 			Expect(found).To(BeFalse())
 			Expect(vm).To(Equal(expectedVM))
 		})
 
-		It("returns error if warden container listing fails", func() {
+		It("returns error if listing tagged containers fails", func() {
+			wardenClient.Connection.ListStub = nil
 			wardenClient.Connection.ListReturns(nil, errors.New("fake-list-err"))
 
-			vm, found, err := finder.Find("fake-vm-id")
+			vm, found, err := finder.Find(context.Background(), "fake-vm-id")
 			Expect(err).To(HaveOccurred())
 			Expect(err.Error()).To(ContainSubstring("fake-list-err"))
 			Expect(found).To(BeFalse())
 			Expect(vm).To(BeNil())
+
+			Expect(wardenClient.Connection.ListCallCount()).To(Equal(1))
 		})
 	})
 })
@@ -0,0 +1,73 @@
+package vm
+
+import (
+	"context"
+
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
+	bosherr "github.com/cloudfoundry/bosh-agent/errors"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+)
+
+const wardenStemcellUsageCheckerLogTag = "WardenStemcellUsageChecker"
+
+// Container property used to record which stemcell container's root fs came from
+const stemcellIDPropertyName = "bosh-warden-cpi.stemcell-id"
+
+type WardenStemcellUsageChecker struct {
+	wardenClient WardenClient
+	logger       boshlog.Logger
+}
+
+func NewWardenStemcellUsageChecker(
+	wardenClient WardenClient,
+	logger boshlog.Logger,
+) WardenStemcellUsageChecker {
+	return WardenStemcellUsageChecker{
+		wardenClient: wardenClient,
+		logger:       logger,
+	}
+}
+
+// InUse returns true if any container was created from the stemcell. Containers created
+// before they were tagged with stemcell ID are treated as using every stemcell since
+// Garden does not report root fs path of existing containers.
+func (c WardenStemcellUsageChecker) InUse(ctx context.Context, stemcellID string) (bool, error) {
+	c.logger.Debug(wardenStemcellUsageCheckerLogTag, "Finding containers using stemcell '%s'", stemcellID)
+
+	containers, err := c.wardenClient.Containers(ctx, wrdn.Properties{
+		stemcellIDPropertyName: stemcellID,
+	})
+	if err != nil {
+		return false, bosherr.WrapError(err, "Listing containers using stemcell '%s'", stemcellID)
+	}
+
+	c.logger.Debug(wardenStemcellUsageCheckerLogTag, "Found '%d' containers using stemcell '%s'", len(containers), stemcellID)
+
+	if len(containers) > 0 {
+		return true, nil
+	}
+
+	return c.anyUntagged(ctx)
+}
+
+func (c WardenStemcellUsageChecker) anyUntagged(ctx context.Context) (bool, error) {
+	containers, err := c.wardenClient.Containers(ctx, nil)
+	if err != nil {
+		return false, bosherr.WrapError(err, "Listing containers")
+	}
+
+	for _, container := range containers {
+		info, err := container.Info(ctx)
+		if err != nil {
+			return false, bosherr.WrapError(err, "Fetching info of container '%s'", container.Handle())
+		}
+
+		if _, found := info.Properties[stemcellIDPropertyName]; !found {
+			c.logger.Debug(wardenStemcellUsageCheckerLogTag,
+				"Container '%s' does not record its stemcell; treating stemcell as in use", container.Handle())
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
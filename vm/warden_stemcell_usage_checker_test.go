@@ -0,0 +1,104 @@
+package vm_test
+
+import (
+	"context"
+	"errors"
+
+	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
+	wrdn "github.com/cloudfoundry-incubator/garden/warden"
+	boshlog "github.com/cloudfoundry/bosh-agent/logger"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/cppforlife/bosh-warden-cpi/vm"
+)
+
+var _ = Describe("WardenStemcellUsageChecker", func() {
+	var (
+		wardenClient *fakewrdnclient.FakeClient
+		checker      WardenStemcellUsageChecker
+	)
+
+	BeforeEach(func() {
+		wardenClient = fakewrdnclient.New()
+		logger := boshlog.NewLogger(boshlog.LevelNone)
+		checker = NewWardenStemcellUsageChecker(NewCancellableWardenClient(wardenClient, logger), logger)
+	})
+
+	Describe("InUse", func() {
+		It("lists containers created from given stemcell", func() {
+			_, err := checker.InUse(context.Background(), "fake-stemcell-id")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(wardenClient.Connection.ListArgsForCall(0)).To(Equal(wrdn.Properties{
+				"bosh-warden-cpi.stemcell-id": "fake-stemcell-id",
+			}))
+		})
+
+		It("returns true if at least one container was created from given stemcell", func() {
+			wardenClient.Connection.ListReturns([]string{"fake-vm-id"}, nil)
+
+			inUse, err := checker.InUse(context.Background(), "fake-stemcell-id")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inUse).To(BeTrue())
+
+			Expect(wardenClient.Connection.ListCallCount()).To(Equal(1))
+		})
+
+		Context("when no containers are tagged with given stemcell", func() {
+			BeforeEach(func() {
+				wardenClient.Connection.ListStub = func(props wrdn.Properties) ([]string, error) {
+					if props == nil {
+						return []string{"fake-other-vm-id", "fake-old-vm-id"}, nil
+					}
+					return []string{}, nil
+				}
+			})
+
+			It("returns false if all containers are tagged with other stemcells", func() {
+				wardenClient.Connection.InfoReturns(wrdn.ContainerInfo{
+					Properties: wrdn.Properties{"bosh-warden-cpi.stemcell-id": "fake-other-stemcell-id"},
+				}, nil)
+
+				inUse, err := checker.InUse(context.Background(), "fake-stemcell-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(inUse).To(BeFalse())
+
+				Expect(wardenClient.Connection.ListArgsForCall(1)).To(BeNil())
+				Expect(wardenClient.Connection.InfoCallCount()).To(Equal(2))
+			})
+
+			It("returns true if any container was created before containers were tagged with stemcells", func() {
+				wardenClient.Connection.InfoStub = func(handle string) (wrdn.ContainerInfo, error) {
+					if handle == "fake-old-vm-id" {
+						return wrdn.ContainerInfo{Properties: wrdn.Properties{}}, nil
+					}
+					return wrdn.ContainerInfo{
+						Properties: wrdn.Properties{"bosh-warden-cpi.stemcell-id": "fake-other-stemcell-id"},
+					}, nil
+				}
+
+				inUse, err := checker.InUse(context.Background(), "fake-stemcell-id")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(inUse).To(BeTrue())
+			})
+
+			It("returns error if fetching container info fails", func() {
+				wardenClient.Connection.InfoReturns(wrdn.ContainerInfo{}, errors.New("fake-info-err"))
+
+				_, err := checker.InUse(context.Background(), "fake-stemcell-id")
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("fake-info-err"))
+			})
+		})
+
+		It("returns error if listing containers fails", func() {
+			wardenClient.Connection.ListReturns(nil, errors.New("fake-list-err"))
+
+			inUse, err := checker.InUse(context.Background(), "fake-stemcell-id")
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("fake-list-err"))
+			Expect(inUse).To(BeFalse())
+		})
+	})
+})
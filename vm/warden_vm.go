@@ -1,7 +1,8 @@
 package vm
 
 import (
-	wrdnclient "github.com/cloudfoundry-incubator/garden/client"
+	"context"
+
 	bosherr "github.com/cloudfoundry/bosh-agent/errors"
 	boshlog "github.com/cloudfoundry/bosh-agent/logger"
 
@@ -11,7 +12,7 @@ import (
 type WardenVM struct {
 	id string
 
-	wardenClient    wrdnclient.Client
+	wardenClient    WardenClient
 	agentEnvService AgentEnvService
 
 	hostBindMounts  HostBindMounts
@@ -24,7 +25,7 @@ type WardenVM struct {
 
 func NewWardenVM(
 	id string,
-	wardenClient wrdnclient.Client,
+	wardenClient WardenClient,
 	agentEnvService AgentEnvService,
 	hostBindMounts HostBindMounts,
 	guestBindMounts GuestBindMounts,
@@ -47,9 +48,9 @@ func NewWardenVM(
 
 func (vm WardenVM) ID() string { return vm.id }
 
-func (vm WardenVM) Delete() error {
+func (vm WardenVM) Delete(ctx context.Context) error {
 	if vm.containerExists {
-		err := vm.wardenClient.Destroy(vm.id)
+		err := vm.wardenClient.Destroy(ctx, vm.id)
 		if err != nil {
 			return err
 		}
@@ -60,7 +61,7 @@ func (vm WardenVM) Delete() error {
 		return err
 	}
 
-	err = vm.hostBindMounts.DeletePersistent(vm.id)
+	err = vm.hostBindMounts.DeletePersistent(ctx, vm.id)
 	if err != nil {
 		return err
 	}
@@ -68,53 +69,52 @@ func (vm WardenVM) Delete() error {
 	return nil
 }
 
-func (vm WardenVM) AttachDisk(disk bwcdisk.Disk) error {
-
+func (vm WardenVM) AttachDisk(ctx context.Context, disk bwcdisk.Disk) (string, error) {
 	if !vm.containerExists {
-		return bosherr.New("VM does not exist")
+		return "", bosherr.New("VM does not exist")
 	}
 
-	agentEnv, err := vm.agentEnvService.Fetch()
+	agentEnv, err := vm.agentEnvService.Fetch(ctx)
 	if err != nil {
-		return bosherr.WrapError(err, "Fetching agent env")
+		return "", bosherr.WrapError(err, "Fetching agent env")
 	}
 
 	err = vm.hostBindMounts.MountPersistent(vm.id, disk.ID(), disk.Path())
 	if err != nil {
-		return bosherr.WrapError(err, "Mounting persistent bind mounts dir")
+		return "", bosherr.WrapError(err, "Mounting persistent bind mounts dir")
 	}
 
 	diskHintPath := vm.guestBindMounts.MountPersistent(disk.ID())
 
+	// Disk hint is still recorded for agents that read it from agent env
 	agentEnv = agentEnv.AttachPersistentDisk(disk.ID(), diskHintPath)
 
-	err = vm.agentEnvService.Update(agentEnv)
+	err = vm.agentEnvService.Update(ctx, agentEnv)
 	if err != nil {
-		return bosherr.WrapError(err, "Updating agent env")
+		return "", bosherr.WrapError(err, "Updating agent env")
 	}
 
-	return nil
+	return diskHintPath, nil
 }
 
-func (vm WardenVM) DetachDisk(disk bwcdisk.Disk) error {
-
+func (vm WardenVM) DetachDisk(ctx context.Context, disk bwcdisk.Disk) error {
 	if !vm.containerExists {
 		return bosherr.New("VM does not exist")
 	}
 
-	agentEnv, err := vm.agentEnvService.Fetch()
+	agentEnv, err := vm.agentEnvService.Fetch(ctx)
 	if err != nil {
 		return bosherr.WrapError(err, "Fetching agent env")
 	}
 
-	err = vm.hostBindMounts.UnmountPersistent(vm.id, disk.ID())
+	err = vm.hostBindMounts.UnmountPersistent(ctx, vm.id, disk.ID())
 	if err != nil {
 		return bosherr.WrapError(err, "Unmounting persistent bind mounts dir")
 	}
 
 	agentEnv = agentEnv.DetachPersistentDisk(disk.ID())
 
-	err = vm.agentEnvService.Update(agentEnv)
+	err = vm.agentEnvService.Update(ctx, agentEnv)
 	if err != nil {
 		return bosherr.WrapError(err, "Updating agent env")
 	}
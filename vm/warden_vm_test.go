@@ -1,6 +1,7 @@
 package vm_test
 
 import (
+	"context"
 	"errors"
 
 	fakewrdnclient "github.com/cloudfoundry-incubator/garden/client/fake_warden_client"
@@ -35,7 +36,7 @@ var _ = Describe("WardenVM", func() {
 
 		vm = NewWardenVM(
 			"fake-vm-id",
-			wardenClient,
+			NewCancellableWardenClient(wardenClient, logger),
 			agentEnvService,
 			hostBindMounts,
 			guestBindMounts,
@@ -46,7 +47,7 @@ var _ = Describe("WardenVM", func() {
 
 	Describe("Delete", func() {
 		It("destroys container before deleting bind mounts so that they are not marked as busy by the kernel", func() {
-			err := vm.Delete()
+			err := vm.Delete(context.Background())
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(wardenClient.Connection.DestroyCallCount()).To(Equal(1))
@@ -55,7 +56,7 @@ var _ = Describe("WardenVM", func() {
 
 		Context("when destroying container succeeds", func() {
 			It("deletes ephemeral bind mount dir", func() {
-				err := vm.Delete()
+				err := vm.Delete(context.Background())
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
@@ -63,7 +64,7 @@ var _ = Describe("WardenVM", func() {
 
 			Context("when deleting ephemeral bind mount dir succeeds", func() {
 				It("deletes persistent bind mounts dir for persistent disks and returns no error", func() {
-					err := vm.Delete()
+					err := vm.Delete(context.Background())
 					Expect(err).ToNot(HaveOccurred())
 
 					Expect(hostBindMounts.DeletePersistentID).To(Equal("fake-vm-id"))
@@ -75,7 +76,7 @@ var _ = Describe("WardenVM", func() {
 					})
 
 					It("returns error", func() {
-						err := vm.Delete()
+						err := vm.Delete(context.Background())
 						Expect(err).To(HaveOccurred())
 						Expect(err.Error()).To(ContainSubstring("fake-delete-persistent-err"))
 					})
@@ -88,7 +89,7 @@ var _ = Describe("WardenVM", func() {
 				})
 
 				It("returns error", func() {
-					err := vm.Delete()
+					err := vm.Delete(context.Background())
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-delete-ephemeral-err"))
 				})
@@ -101,20 +102,20 @@ var _ = Describe("WardenVM", func() {
 			})
 
 			It("returns error", func() {
-				err := vm.Delete()
+				err := vm.Delete(context.Background())
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-destroy-err"))
 			})
 
 			It("does not delete ephemeral bind mounts dir", func() {
-				err := vm.Delete()
+				err := vm.Delete(context.Background())
 				Expect(err).To(HaveOccurred())
 
 				Expect(hostBindMounts.DeleteEphemeralCalled).To(BeFalse())
 			})
 
 			It("does not delete persistent bind mounts dir", func() {
-				err := vm.Delete()
+				err := vm.Delete(context.Background())
 				Expect(err).To(HaveOccurred())
 
 				Expect(hostBindMounts.DeletePersistentCalled).To(BeFalse())
@@ -125,7 +126,7 @@ var _ = Describe("WardenVM", func() {
 			BeforeEach(func() {
 				vm = NewWardenVM(
 					"fake-vm-id",
-					wardenClient,
+					NewCancellableWardenClient(wardenClient, logger),
 					nil,
 					hostBindMounts,
 					guestBindMounts,
@@ -135,7 +136,7 @@ var _ = Describe("WardenVM", func() {
 			})
 
 			It("deletes ephemeral and persistent bind mount dirs", func() {
-				err := vm.Delete()
+				err := vm.Delete(context.Background())
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(hostBindMounts.DeleteEphemeralID).To(Equal("fake-vm-id"))
@@ -154,7 +155,7 @@ var _ = Describe("WardenVM", func() {
 		})
 
 		It("tries to fetch agent env", func() {
-			err := vm.AttachDisk(disk)
+			_, err := vm.AttachDisk(context.Background(), disk)
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(agentEnvService.FetchCalled).To(BeTrue())
@@ -171,7 +172,7 @@ var _ = Describe("WardenVM", func() {
 			})
 
 			It("mounts persistent bind mounts dir", func() {
-				err := vm.AttachDisk(disk)
+				_, err := vm.AttachDisk(context.Background(), disk)
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(hostBindMounts.MountPersistentID).To(Equal("fake-vm-id"))
@@ -181,7 +182,7 @@ var _ = Describe("WardenVM", func() {
 
 			Context("when mounting persistent bind mounts dir succeeds", func() {
 				It("updates agent env attaching persistent disk", func() {
-					err := vm.AttachDisk(disk)
+					_, err := vm.AttachDisk(context.Background(), disk)
 					Expect(err).ToNot(HaveOccurred())
 
 					// Expected agent env will have additional persistent disk
@@ -193,9 +194,10 @@ var _ = Describe("WardenVM", func() {
 				})
 
 				Context("when updating agent env succeeds", func() {
-					It("returns without an error", func() {
-						err := vm.AttachDisk(disk)
+					It("returns disk hint without an error", func() {
+						diskHint, err := vm.AttachDisk(context.Background(), disk)
 						Expect(err).ToNot(HaveOccurred())
+						Expect(diskHint).To(Equal("/fake-guest-persistent-bind-mounts-dir/fake-disk-id"))
 					})
 				})
 
@@ -203,7 +205,7 @@ var _ = Describe("WardenVM", func() {
 					It("returns error", func() {
 						agentEnvService.UpdateErr = errors.New("fake-update-err")
 
-						err := vm.AttachDisk(disk)
+						_, err := vm.AttachDisk(context.Background(), disk)
 						Expect(err).To(HaveOccurred())
 						Expect(err.Error()).To(ContainSubstring("fake-update-err"))
 					})
@@ -214,7 +216,7 @@ var _ = Describe("WardenVM", func() {
 				It("returns error", func() {
 					hostBindMounts.MountPersistentErr = errors.New("fake-mount-err")
 
-					err := vm.AttachDisk(disk)
+					_, err := vm.AttachDisk(context.Background(), disk)
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-mount-err"))
 				})
@@ -225,7 +227,7 @@ var _ = Describe("WardenVM", func() {
 			It("returns error", func() {
 				agentEnvService.FetchErr = errors.New("fake-fetch-err")
 
-				err := vm.AttachDisk(disk)
+				_, err := vm.AttachDisk(context.Background(), disk)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-fetch-err"))
 			})
@@ -242,7 +244,7 @@ var _ = Describe("WardenVM", func() {
 		})
 
 		It("tries to fetch agent env", func() {
-			err := vm.DetachDisk(disk)
+			err := vm.DetachDisk(context.Background(), disk)
 			Expect(err).ToNot(HaveOccurred())
 
 			Expect(agentEnvService.FetchCalled).To(BeTrue())
@@ -260,7 +262,7 @@ var _ = Describe("WardenVM", func() {
 			})
 
 			It("unmounts persistent bind mounts dir", func() {
-				err := vm.DetachDisk(disk)
+				err := vm.DetachDisk(context.Background(), disk)
 				Expect(err).ToNot(HaveOccurred())
 
 				Expect(hostBindMounts.UnmountPersistentID).To(Equal("fake-vm-id"))
@@ -269,7 +271,7 @@ var _ = Describe("WardenVM", func() {
 
 			Context("when unmounting persistent bind mounts dir succeeds", func() {
 				It("updates agent env detaching persistent disk", func() {
-					err := vm.DetachDisk(disk)
+					err := vm.DetachDisk(context.Background(), disk)
 					Expect(err).ToNot(HaveOccurred())
 
 					// Expected agent env will not have first persistent disk
@@ -279,7 +281,7 @@ var _ = Describe("WardenVM", func() {
 
 				Context("when updating agent env succeeds", func() {
 					It("returns without an error", func() {
-						err := vm.DetachDisk(disk)
+						err := vm.DetachDisk(context.Background(), disk)
 						Expect(err).ToNot(HaveOccurred())
 					})
 				})
@@ -288,7 +290,7 @@ var _ = Describe("WardenVM", func() {
 					It("returns error", func() {
 						agentEnvService.UpdateErr = errors.New("fake-update-err")
 
-						err := vm.DetachDisk(disk)
+						err := vm.DetachDisk(context.Background(), disk)
 						Expect(err).To(HaveOccurred())
 						Expect(err.Error()).To(ContainSubstring("fake-update-err"))
 					})
@@ -299,7 +301,7 @@ var _ = Describe("WardenVM", func() {
 				It("returns error", func() {
 					hostBindMounts.UnmountPersistentErr = errors.New("fake-unmount-err")
 
-					err := vm.DetachDisk(disk)
+					err := vm.DetachDisk(context.Background(), disk)
 					Expect(err).To(HaveOccurred())
 					Expect(err.Error()).To(ContainSubstring("fake-unmount-err"))
 				})
@@ -310,7 +312,7 @@ var _ = Describe("WardenVM", func() {
 			It("returns error", func() {
 				agentEnvService.FetchErr = errors.New("fake-fetch-err")
 
-				err := vm.DetachDisk(disk)
+				err := vm.DetachDisk(context.Background(), disk)
 				Expect(err).To(HaveOccurred())
 				Expect(err.Error()).To(ContainSubstring("fake-fetch-err"))
 			})